@@ -7,10 +7,14 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/lkmio/avformat/utils"
 	"github.com/lkmio/lkm/flv"
+	"github.com/lkmio/lkm/fmp4"
 	"github.com/lkmio/lkm/hls"
 	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/mpegts"
 	"github.com/lkmio/lkm/rtc"
+	"github.com/lkmio/lkm/rtsp"
 	"github.com/lkmio/lkm/stream"
+	"github.com/lkmio/lkm/transcode/ffmpeg"
 	"io"
 	"net"
 	"net/http"
@@ -23,8 +27,9 @@ import (
 )
 
 type ApiServer struct {
-	upgrader *websocket.Upgrader
-	router   *mux.Router
+	upgrader   *websocket.Upgrader
+	router     *mux.Router
+	rtspServer rtsp.Server // 处理RTSP over HTTP/WebSocket
 }
 
 var apiServer *ApiServer
@@ -78,17 +83,47 @@ func startApiServer(addr string) {
 	  http://host:port/xxx.rtc
 	  http://host:port/xxx.m3u8
 	  http://host:port/xxx_0.ts
+	  http://host:port/xxx_keyid.key
+	  http://host:port/xxx.ts
+	  http://host:port/xxx.mp4
 	  ws://host:port/xxx.flv
+	  ws://host:port/xxx.ts
+	  ws://host:port/xxx.mp4
+	  ws://host:port/xxx.rtsp
 	*/
+	// RTSP over HTTP隧道使用rtsp url的路径, 根据x-sessioncookie等请求头匹配, 需要优先注册
+	if stream.AppConfig.Rtsp.Enable && apiServer.rtspServer != nil {
+		apiServer.router.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return rtsp.IsTunnelRequest(r)
+		}).HandlerFunc(apiServer.rtspServer.ServeHttpTunnel)
+
+		apiServer.router.HandleFunc("/{source}.rtsp", filterSourceID(apiServer.onWSRtsp, ".rtsp"))
+		apiServer.router.HandleFunc("/{source}/{stream}.rtsp", filterSourceID(apiServer.onWSRtsp, ".rtsp"))
+	}
+
 	// {source}.flv和/{source}/{stream}.flv意味着, 推流id(路径)只能嵌套一层
 	apiServer.router.HandleFunc("/{source}.flv", filterSourceID(apiServer.onFlv, ".flv"))
 	apiServer.router.HandleFunc("/{source}/{stream}.flv", filterSourceID(apiServer.onFlv, ".flv"))
+	// HLS切片和http-ts/ws-ts共用.ts路由, 根据是否携带hls会话ID区分
+	if stream.AppConfig.Hls.Enable || stream.AppConfig.Ts.Enable {
+		apiServer.router.HandleFunc("/{source}.ts", filterSourceID(apiServer.onTS, ".ts"))
+		apiServer.router.HandleFunc("/{source}/{stream}.ts", filterSourceID(apiServer.onTS, ".ts"))
+	}
+
+	if stream.AppConfig.Fmp4.Enable {
+		apiServer.router.HandleFunc("/{source}.mp4", filterSourceID(apiServer.onFMP4, ".mp4"))
+		apiServer.router.HandleFunc("/{source}/{stream}.mp4", filterSourceID(apiServer.onFMP4, ".mp4"))
+	}
 
 	if stream.AppConfig.Hls.Enable {
 		apiServer.router.HandleFunc("/{source}.m3u8", filterSourceID(apiServer.onHLS, ".m3u8"))
 		apiServer.router.HandleFunc("/{source}/{stream}.m3u8", filterSourceID(apiServer.onHLS, ".m3u8"))
-		apiServer.router.HandleFunc("/{source}.ts", filterSourceID(apiServer.onTS, ".ts"))
-		apiServer.router.HandleFunc("/{source}/{stream}.ts", filterSourceID(apiServer.onTS, ".ts"))
+		apiServer.router.HandleFunc("/{source}.key", filterSourceID(apiServer.onHlsKey, ".key"))
+		apiServer.router.HandleFunc("/{source}/{stream}.key", filterSourceID(apiServer.onHlsKey, ".key"))
+
+		apiServer.router.HandleFunc("/api/v1/hls/group/create", filterRequestBodyParams(apiServer.OnHlsGroupCreate, &HlsGroupParams{})) // 创建variant组, 多个推流源组合成一个主播放列表
+		apiServer.router.HandleFunc("/api/v1/hls/group/delete", filterRequestBodyParams(apiServer.OnHlsGroupDelete, &HlsGroupParams{})) // 删除variant组
+		apiServer.router.HandleFunc("/api/v1/hls/group/list", apiServer.OnHlsGroupList)                                                 // 查询所有variant组
 	}
 
 	if stream.AppConfig.WebRtc.Enable {
@@ -101,6 +136,12 @@ func startApiServer(addr string) {
 	apiServer.router.HandleFunc("/api/v1/sink/list", filterRequestBodyParams(apiServer.OnSinkList, &IDS{}))       // 查询某个推流源下，所有的拉流端列表
 	apiServer.router.HandleFunc("/api/v1/sink/close", filterRequestBodyParams(apiServer.OnSinkClose, &IDS{}))     // 关闭拉流端
 
+	// 查询各输出协议支持的编码器. 携带source参数时, 返回该推流源在各输出协议下每路track的输出情况
+	apiServer.router.HandleFunc("/api/v1/source/capabilities", filterRequestBodyParams(apiServer.OnSourceCapabilities, &IDS{}))
+
+	// 向拉流端下发元数据, 例如告警. 目前通过webrtc DataChannel下发
+	apiServer.router.HandleFunc("/api/v1/source/metadata", filterRequestBodyParams(apiServer.OnSourceMetadata, &stream.Metadata{}))
+
 	apiServer.router.HandleFunc("/api/v1/streams/statistics", nil) // 统计所有推拉流
 
 	if stream.AppConfig.GB28181.Enable {
@@ -143,18 +184,21 @@ func (api *ApiServer) generateSinkID(remoteAddr string) stream.SinkID {
 	return stream.NetAddr2SinkId(tcpAddr)
 }
 
-func (api *ApiServer) onFlv(sourceId string, w http.ResponseWriter, r *http.Request) {
-	// 区分ws请求
-	ws := true
+// 区分ws请求
+func isWebSocketRequest(r *http.Request) bool {
 	if !("upgrade" == strings.ToLower(r.Header.Get("Connection"))) {
-		ws = false
+		return false
 	} else if !("websocket" == strings.ToLower(r.Header.Get("Upgrade"))) {
-		ws = false
+		return false
 	} else if !("13" == r.Header.Get("Sec-Websocket-Version")) {
-		ws = false
+		return false
 	}
 
-	if ws {
+	return true
+}
+
+func (api *ApiServer) onFlv(sourceId string, w http.ResponseWriter, r *http.Request) {
+	if isWebSocketRequest(r) {
 		apiServer.onWSFlv(sourceId, w, r)
 	} else {
 		apiServer.onHttpFLV(sourceId, w, r)
@@ -173,6 +217,12 @@ func (api *ApiServer) onWSFlv(sourceId string, w http.ResponseWriter, r *http.Re
 	sink.SetUrlValues(r.URL.Query())
 	log.Sugar.Infof("ws-flv 连接 sink:%s", sink.String())
 
+	if err := stream.SetSinkTrackParams(sink, r.URL.Query()); err != nil {
+		log.Sugar.Warnf("ws-flv 播放失败 err: %s sink:%s", err.Error(), sink.String())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	_, state := stream.PreparePlaySink(sink)
 	if utils.HookStateOK != state {
 		log.Sugar.Warnf("ws-flv 播放失败 sink:%s", sink.String())
@@ -202,22 +252,29 @@ func (api *ApiServer) onHttpFLV(sourceId string, w http.ResponseWriter, r *http.
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
 	conn, _, err := hj.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	sink := flv.NewFLVSink(api.generateSinkID(r.RemoteAddr), sourceId, conn)
+	// 推流后再应答200, 等待推流超时应答404
+	httpConn := newHttpStreamConn(conn, w.Header())
+	sink := flv.NewFLVSink(api.generateSinkID(r.RemoteAddr), sourceId, httpConn)
 	sink.SetUrlValues(r.URL.Query())
 	log.Sugar.Infof("http-flv 连接 sink:%s", sink.String())
 
+	if err := stream.SetSinkTrackParams(sink, r.URL.Query()); err != nil {
+		log.Sugar.Warnf("http-flv 播放失败 err: %s sink:%s", err.Error(), sink.String())
+		httpConn.CloseWithStatus(http.StatusBadRequest)
+		return
+	}
+
 	_, state := stream.PreparePlaySink(sink)
 	if utils.HookStateOK != state {
 		log.Sugar.Warnf("http-flv 播放失败 sink:%s", sink.String())
 
-		w.WriteHeader(http.StatusForbidden)
+		httpConn.CloseWithStatus(http.StatusForbidden)
 		return
 	}
 
@@ -232,12 +289,210 @@ func (api *ApiServer) onHttpFLV(sourceId string, w http.ResponseWriter, r *http.
 }
 
 func (api *ApiServer) onTS(source string, w http.ResponseWriter, r *http.Request) {
+	// HLS切片url都携带会话ID, 未携带的是http-ts/ws-ts直播流请求
 	sid := r.URL.Query().Get(hls.SessionIdKey)
-	var sink stream.Sink
-	if sid != "" {
-		sink = stream.SinkManager.Find(stream.SinkID(sid))
+	if sid != "" && stream.AppConfig.Hls.Enable {
+		api.onHlsSegment(source, sid, w, r)
+	} else if !stream.AppConfig.Ts.Enable {
+		w.WriteHeader(http.StatusNotFound)
+	} else if isWebSocketRequest(r) {
+		api.onWSTS(source, w, r)
+	} else {
+		api.onHttpTS(source, w, r)
 	}
-	if sink == nil {
+}
+
+func (api *ApiServer) onWSTS(sourceId string, w http.ResponseWriter, r *http.Request) {
+	conn, err := api.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Sugar.Errorf("websocket头检查失败 err:%s", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sink := mpegts.NewTSSink(api.generateSinkID(r.RemoteAddr), sourceId, mpegts.NewWSConn(conn))
+	sink.SetUrlValues(r.URL.Query())
+	log.Sugar.Infof("ws-ts 连接 sink:%s", sink.String())
+
+	if err := stream.SetSinkTrackParams(sink, r.URL.Query()); err != nil {
+		log.Sugar.Warnf("ws-ts 播放失败 err: %s sink:%s", err.Error(), sink.String())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	_, state := stream.PreparePlaySink(sink)
+	if utils.HookStateOK != state {
+		log.Sugar.Warnf("ws-ts 播放失败 sink:%s", sink.String())
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	netConn := conn.NetConn()
+	bytes := make([]byte, 64)
+	for {
+		if _, err := netConn.Read(bytes); err != nil {
+			log.Sugar.Infof("ws-ts 断开连接 sink:%s", sink.String())
+			sink.Close()
+			break
+		}
+	}
+}
+
+func (api *ApiServer) onHttpTS(sourceId string, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "video/MP2T")
+	w.Header().Set("Connection", "Keep-Alive")
+	// 不使用chunked编码, 直接发送ts流, 以关闭连接结束
+	w.Header().Set("Transfer-Encoding", "identity")
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 推流后再应答200, 等待推流超时应答404
+	httpConn := newHttpStreamConn(conn, w.Header())
+	sink := mpegts.NewTSSink(api.generateSinkID(r.RemoteAddr), sourceId, httpConn)
+	sink.SetUrlValues(r.URL.Query())
+	log.Sugar.Infof("http-ts 连接 sink:%s", sink.String())
+
+	if err := stream.SetSinkTrackParams(sink, r.URL.Query()); err != nil {
+		log.Sugar.Warnf("http-ts 播放失败 err: %s sink:%s", err.Error(), sink.String())
+		httpConn.CloseWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	_, state := stream.PreparePlaySink(sink)
+	if utils.HookStateOK != state {
+		log.Sugar.Warnf("http-ts 播放失败 sink:%s", sink.String())
+
+		httpConn.CloseWithStatus(http.StatusForbidden)
+		return
+	}
+
+	bytes := make([]byte, 64)
+	for {
+		if _, err := conn.Read(bytes); err != nil {
+			log.Sugar.Infof("http-ts 断开连接 sink:%s", sink.String())
+			sink.Close()
+			break
+		}
+	}
+}
+
+func (api *ApiServer) onFMP4(sourceId string, w http.ResponseWriter, r *http.Request) {
+	if isWebSocketRequest(r) {
+		api.onWSFMP4(sourceId, w, r)
+	} else {
+		api.onHttpFMP4(sourceId, w, r)
+	}
+}
+
+func (api *ApiServer) onWSFMP4(sourceId string, w http.ResponseWriter, r *http.Request) {
+	conn, err := api.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Sugar.Errorf("websocket头检查失败 err:%s", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sink := fmp4.NewFMP4Sink(api.generateSinkID(r.RemoteAddr), sourceId, fmp4.NewWSConn(conn))
+	sink.SetUrlValues(r.URL.Query())
+	log.Sugar.Infof("ws-fmp4 连接 sink:%s", sink.String())
+
+	if err := stream.SetSinkTrackParams(sink, r.URL.Query()); err != nil {
+		log.Sugar.Warnf("ws-fmp4 播放失败 err: %s sink:%s", err.Error(), sink.String())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	_, state := stream.PreparePlaySink(sink)
+	if utils.HookStateOK != state {
+		log.Sugar.Warnf("ws-fmp4 播放失败 sink:%s", sink.String())
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	netConn := conn.NetConn()
+	bytes := make([]byte, 64)
+	for {
+		if _, err := netConn.Read(bytes); err != nil {
+			log.Sugar.Infof("ws-fmp4 断开连接 sink:%s", sink.String())
+			sink.Close()
+			break
+		}
+	}
+}
+
+func (api *ApiServer) onHttpFMP4(sourceId string, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Connection", "Keep-Alive")
+	// 不使用chunked编码, 直接发送fmp4流, 以关闭连接结束
+	w.Header().Set("Transfer-Encoding", "identity")
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 推流后再应答200, 等待推流超时应答404
+	httpConn := newHttpStreamConn(conn, w.Header())
+	sink := fmp4.NewFMP4Sink(api.generateSinkID(r.RemoteAddr), sourceId, httpConn)
+	sink.SetUrlValues(r.URL.Query())
+	log.Sugar.Infof("http-fmp4 连接 sink:%s", sink.String())
+
+	if err := stream.SetSinkTrackParams(sink, r.URL.Query()); err != nil {
+		log.Sugar.Warnf("http-fmp4 播放失败 err: %s sink:%s", err.Error(), sink.String())
+		httpConn.CloseWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	_, state := stream.PreparePlaySink(sink)
+	if utils.HookStateOK != state {
+		log.Sugar.Warnf("http-fmp4 播放失败 sink:%s", sink.String())
+
+		httpConn.CloseWithStatus(http.StatusForbidden)
+		return
+	}
+
+	bytes := make([]byte, 64)
+	for {
+		if _, err := conn.Read(bytes); err != nil {
+			log.Sugar.Infof("http-fmp4 断开连接 sink:%s", sink.String())
+			sink.Close()
+			break
+		}
+	}
+}
+
+// RTSP over WebSocket, 拉流的流id以RTSP请求中的url为准
+func (api *ApiServer) onWSRtsp(_ string, w http.ResponseWriter, r *http.Request) {
+	conn, err := api.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Sugar.Errorf("websocket头检查失败 err:%s", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	api.rtspServer.ServeWebSocket(conn)
+}
+
+func (api *ApiServer) onHlsSegment(source string, sid string, w http.ResponseWriter, r *http.Request) {
+	sink, ok := stream.SinkManager.Find(stream.SinkID(sid)).(*hls.M3U8Sink)
+	if !ok {
 		log.Sugar.Errorf("hls session with id '%s' has expired.", sid)
 		w.WriteHeader(http.StatusForbidden)
 		return
@@ -249,18 +504,68 @@ func (api *ApiServer) onTS(source string, w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// 纯音频切片的文件名携带后缀, 只允许访问会话所属推流源的切片
+	prefix := source[:index]
+	if prefix != sink.GetSourceID() && prefix != sink.GetSourceID()+hls.AudioRenditionSuffix {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	seq := source[index+1:]
-	tsPath := stream.AppConfig.Hls.TSPath(sink.GetSourceID(), seq)
+	tsPath := stream.AppConfig.Hls.TSPath(prefix, seq)
 	if _, err := os.Stat(tsPath); err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	sink.(*hls.M3U8Sink).RefreshPlayTime()
+	sink.RefreshPlayTime()
 	w.Header().Set("Content-Type", "video/MP2T")
 	http.ServeFile(w, r, tsPath)
 }
 
+// 应答HLS切片加密密钥, 密钥url格式为: xxx_keyid.key
+// m3u8中的密钥url携带会话ID, 只有已经通过on_play鉴权的M3U8会话才能请求密钥.
+func (api *ApiServer) onHlsKey(source string, w http.ResponseWriter, r *http.Request) {
+	if hls.KeyStore == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	index := strings.LastIndex(source, "_")
+	if index < 1 || index == len(source)-1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	prefix := source[:index]
+	keyId := source[index+1:]
+
+	sid := r.URL.Query().Get(hls.SessionIdKey)
+	sink, ok := stream.SinkManager.Find(stream.SinkID(sid)).(*hls.M3U8Sink)
+	if !ok {
+		log.Sugar.Warnf("hls密钥请求失败, 会话不存在 sid: %s source: %s", sid, source)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if prefix != sink.GetSourceID() && prefix != sink.GetSourceID()+hls.AudioRenditionSuffix {
+		// 只允许请求会话所属推流源的密钥
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	sink.RefreshPlayTime()
+	key, err := hls.KeyStore.FindKey(prefix, keyId)
+	if err != nil {
+		log.Sugar.Warnf("hls密钥请求失败 err: %s", err.Error())
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// 密钥不允许缓存
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(key.Data)
+}
+
 func (api *ApiServer) onHLS(source string, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
 
@@ -268,23 +573,25 @@ func (api *ApiServer) onHLS(source string, w http.ResponseWriter, r *http.Reques
 	// 会话ID的Key为"hls_sid", 为避免冲突, 播放端和hook server不要再使用, 否则会一直拉流失败.
 	sid := r.URL.Query().Get(hls.SessionIdKey)
 	if sid == "" {
-		sid = utils.RandStringBytes(10)
+		// 主播放列表的参数会带到每路variant的地址
+		if err := stream.CheckHlsTrackParams(r.URL.Query()); err != nil {
+			log.Sugar.Warnf("m3u8拉流失败 err: %s source: %s", err.Error(), source)
 
-		query := r.URL.Query()
-		query.Add(hls.SessionIdKey, sid)
-		path := fmt.Sprintf("/%s.m3u8?%s", source, query.Encode())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-		response := "#EXTM3U\r\n" +
-			"#EXT-X-STREAM-INF:BANDWIDTH=1,AVERAGE-BANDWIDTH=1\r\n" +
-			path + "\r\n"
-		w.Write([]byte(response))
+		w.Write([]byte(api.generateMasterPlaylist(source, r)))
 		return
 	}
 
 	sink := stream.SinkManager.Find(sid)
 	// 更新最近的M3U8文件
-	if sink != nil {
-		w.Write([]byte(sink.(*hls.M3U8Sink).GetM3U8String()))
+	if m3u8Sink, ok := sink.(*hls.M3U8Sink); ok {
+		w.Write([]byte(m3u8Sink.GetM3U8String()))
+		return
+	} else if sink != nil {
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
@@ -294,8 +601,17 @@ func (api *ApiServer) onHLS(source string, w http.ResponseWriter, r *http.Reques
 	sink = hls.NewM3U8Sink(sid, source, func(m3u8 []byte) {
 		m3u8Pipe <- m3u8
 	}, sid)
+	notFound := sink.(*hls.M3U8Sink).NotFound()
 
 	sink.SetUrlValues(r.URL.Query())
+	// video=0拉取纯音频rendition, 其余选择track和编码器的参数应答400
+	if err := stream.SetSinkTrackParams(sink, r.URL.Query()); err != nil {
+		log.Sugar.Warnf("m3u8拉流失败 err: %s sink: %s", err.Error(), sink.String())
+
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	if _, state := stream.PreparePlaySink(sink); utils.HookStateOK != state {
 		log.Sugar.Warnf("m3u8拉流失败 sink: %s", sink.String())
 
@@ -317,6 +633,12 @@ func (api *ApiServer) onHLS(source string, w http.ResponseWriter, r *http.Reques
 			w.Write(m3u8)
 		}
 		break
+	case <-notFound:
+		// 等待推流超时
+		log.Sugar.Warnf("hls拉流失败 等待推流超时 sink: %s source: %s", sink.GetID(), sink.GetSourceID())
+		w.WriteHeader(http.StatusNotFound)
+		sink.Close()
+		break
 	case <-context.Done():
 		// 拉流端断开拉流
 		log.Sugar.Infof(stream.CreateSinkDisconnectionMessage(sink))
@@ -325,6 +647,50 @@ func (api *ApiServer) onHLS(source string, w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// 生成主播放列表, 每路variant分配单独的会话ID.
+// 如果source是variant组, 组内每个推流源作为一路variant, 否则只包含source自身.
+func (api *ApiServer) generateMasterPlaylist(source string, r *http.Request) string {
+	sources := hls.VariantGroups.Find(source)
+	if sources == nil {
+		sources = []string{source}
+	}
+
+	createUri := func(sourceId string, audioOnly bool) string {
+		query := r.URL.Query()
+		query.Add(hls.SessionIdKey, utils.RandStringBytes(10))
+		if audioOnly {
+			query.Set("video", "0")
+		}
+
+		return fmt.Sprintf("/%s.m3u8?%s", sourceId, query.Encode())
+	}
+
+	var variants []hls.Variant
+	var renditions []hls.AudioRendition
+	for i, sourceId := range sources {
+		publishSource := stream.SourceManager.Find(sourceId)
+		variant := hls.NewVariant(publishSource, createUri(sourceId, false))
+
+		// 音视频都存在, 追加一路纯音频rendition, 由视频variant通过AUDIO属性引用
+		if stream.AppConfig.Hls.AudioRendition && publishSource != nil && publishSource.IsCompleted() {
+			var existAudio, existVideo bool
+			for _, avStream := range publishSource.OriginStreams() {
+				existAudio = existAudio || utils.AVMediaTypeAudio == avStream.Type()
+				existVideo = existVideo || utils.AVMediaTypeVideo == avStream.Type()
+			}
+
+			if existAudio && existVideo {
+				variant.Audio = fmt.Sprintf("audio%d", i)
+				renditions = append(renditions, hls.AudioRendition{GroupID: variant.Audio, Name: sourceId, Uri: createUri(sourceId, true)})
+			}
+		}
+
+		variants = append(variants, variant)
+	}
+
+	return hls.MasterPlaylist(variants, renditions)
+}
+
 func (api *ApiServer) onRtc(sourceId string, w http.ResponseWriter, r *http.Request) {
 	v := struct {
 		Type string `json:"type"`
@@ -344,15 +710,25 @@ func (api *ApiServer) onRtc(sourceId string, w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	var notFound bool
 	group := sync.WaitGroup{}
 	group.Add(1)
 	sink := rtc.NewSink(api.generateSinkID(r.RemoteAddr), sourceId, v.SDP, func(sdp string) {
+		// 等待推流超时, 流不存在. 在请求协程中应答并关闭sink
+		if sdp == "" {
+			notFound = true
+			group.Done()
+			return
+		}
+
 		response := struct {
-			Type string `json:"type"`
-			SDP  string `json:"sdp"`
+			Type       string          `json:"type"`
+			SDP        string          `json:"sdp"`
+			ICEServers []rtc.ICEServer `json:"ice_servers,omitempty"` // 开启turn时, 下发临时账号
 		}{
-			Type: "answer",
-			SDP:  sdp,
+			Type:       "answer",
+			SDP:        sdp,
+			ICEServers: rtc.ICEServers(),
 		}
 
 		marshal, err := json.Marshal(response)
@@ -369,6 +745,13 @@ func (api *ApiServer) onRtc(sourceId string, w http.ResponseWriter, r *http.Requ
 	sink.SetUrlValues(r.URL.Query())
 	log.Sugar.Infof("rtc 请求 sink:%s sdp:%v", sink.String(), v.SDP)
 
+	if err := stream.SetSinkTrackParams(sink, r.URL.Query()); err != nil {
+		log.Sugar.Warnf("rtc 播放失败 err: %s sink:%s", err.Error(), sink.String())
+
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	_, state := stream.PreparePlaySink(sink)
 	if utils.HookStateOK != state {
 		log.Sugar.Warnf("rtc 播放失败 sink:%s", sink.String())
@@ -378,6 +761,12 @@ func (api *ApiServer) onRtc(sourceId string, w http.ResponseWriter, r *http.Requ
 	}
 
 	group.Wait()
+
+	if notFound {
+		log.Sugar.Warnf("rtc 播放失败 等待推流超时 sink:%s", sink.String())
+		http.Error(w, "stream not found", http.StatusNotFound)
+		sink.Close()
+	}
 }
 
 func (api *ApiServer) OnSourceList(w http.ResponseWriter, r *http.Request) {
@@ -390,6 +779,7 @@ func (api *ApiServer) OnSourceList(w http.ResponseWriter, r *http.Request) {
 		SinkCount int       `json:"sink_count"` // 播放端计数
 		Bitrate   string    `json:"bitrate"`    // 码率统计
 		Tracks    []string  `json:"tracks"`     // 每路流编码器ID
+		Derived   []string  `json:"derived"`    // 转码生成的派生流ID
 	}
 
 	var details []SourceDetails
@@ -407,6 +797,7 @@ func (api *ApiServer) OnSourceList(w http.ResponseWriter, r *http.Request) {
 			SinkCount: source.SinkCount(),
 			Bitrate:   strconv.Itoa(source.GetBitrateStatistics().PreviousSecond()/1024) + "KBS", // 后续开发
 			Tracks:    tracks,
+			Derived:   ffmpeg.LadderManager.DerivedSources(source.GetID()),
 		})
 	}
 
@@ -421,21 +812,28 @@ func (api *ApiServer) OnSinkList(v *IDS, w http.ResponseWriter, r *http.Request)
 	}
 
 	type SinkDetails struct {
-		ID       string    `json:"id"`
-		Protocol string    `json:"protocol"` // 拉流协议
-		Time     time.Time `json:"time"`     // 拉流时间
-		Bitrate  string    `json:"bitrate"`  // 码率统计
-		Tracks   []string  `json:"tracks"`   // 每路流编码器ID
+		ID         string                   `json:"id"`
+		Protocol   string                   `json:"protocol"`             // 拉流协议
+		Time       time.Time                `json:"time"`                 // 拉流时间
+		Bitrate    string                   `json:"bitrate"`              // 码率统计
+		Tracks     []string                 `json:"tracks"`               // 每路流编码器ID
+		Statistics []stream.TrackStatistics `json:"statistics,omitempty"` // 每路流的丢包和抖动统计
 	}
 
 	var details []SinkDetails
 	sinks := source.Sinks()
 	for _, sink := range sinks {
+		var statistics []stream.TrackStatistics
+		if statisticsSink, ok := sink.(stream.StatisticsSink); ok {
+			statistics = statisticsSink.Statistics()
+		}
+
 		details = append(details,
 			SinkDetails{
-				ID:       stream.SinkId2String(sink.GetID()),
-				Protocol: sink.GetProtocol().String(),
-				Time:     sink.CreateTime(),
+				ID:         stream.SinkId2String(sink.GetID()),
+				Protocol:   sink.GetProtocol().String(),
+				Time:       sink.CreateTime(),
+				Statistics: statistics,
 			},
 		)
 	}
@@ -455,6 +853,36 @@ func (api *ApiServer) OnSourceClose(v *IDS, w http.ResponseWriter, r *http.Reque
 	httpResponseOK(w, nil)
 }
 
+func (api *ApiServer) OnSourceCapabilities(v *IDS, w http.ResponseWriter, r *http.Request) {
+	if v.Source == "" {
+		httpResponseOK(w, stream.CodecCapabilities())
+		return
+	}
+
+	source := stream.SourceManager.Find(v.Source)
+	if source == nil {
+		httpResponseError(w, "source not found")
+		return
+	} else if !source.IsCompleted() {
+		httpResponseError(w, "the tracks of the source are not ready")
+		return
+	}
+
+	httpResponseOK(w, stream.CheckCompatibility(source.OriginStreams()))
+}
+
+func (api *ApiServer) OnSourceMetadata(v *stream.Metadata, w http.ResponseWriter, r *http.Request) {
+	if v.Source == "" {
+		httpResponseError(w, "source is required")
+		return
+	} else if v.Time == 0 {
+		v.Time = time.Now().UnixMilli()
+	}
+
+	stream.PublishMetadata(v)
+	httpResponseOK(w, nil)
+}
+
 func (api *ApiServer) OnSinkClose(v *IDS, w http.ResponseWriter, r *http.Request) {
 	log.Sugar.Infof("close sink: %v", v)
 
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/lkmio/lkm/hls"
+	"github.com/lkmio/lkm/log"
+	"net/http"
+)
+
+type HlsGroupParams struct {
+	Group   string   `json:"group"`   // 组ID, 作为主播放列表的拉流地址. 例如: group为live/cam, 拉流地址为http://host:port/live/cam.m3u8
+	Sources []string `json:"sources"` // 组内推流源ID, 每个推流源作为一路variant
+}
+
+func (api *ApiServer) OnHlsGroupCreate(v *HlsGroupParams, w http.ResponseWriter, r *http.Request) {
+	log.Sugar.Infof("创建hls variant组: %v", v)
+
+	if v.Group == "" {
+		httpResponseError(w, "the group id is required")
+		return
+	}
+
+	if err := hls.VariantGroups.Add(v.Group, v.Sources); err != nil {
+		httpResponseError(w, err.Error())
+		return
+	}
+
+	httpResponseOK(w, nil)
+}
+
+func (api *ApiServer) OnHlsGroupDelete(v *HlsGroupParams, w http.ResponseWriter, r *http.Request) {
+	log.Sugar.Infof("删除hls variant组: %v", v)
+
+	hls.VariantGroups.Remove(v.Group)
+	httpResponseOK(w, nil)
+}
+
+func (api *ApiServer) OnHlsGroupList(w http.ResponseWriter, r *http.Request) {
+	httpResponseOK(w, hls.VariantGroups.All())
+}
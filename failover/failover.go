@@ -0,0 +1,146 @@
+package failover
+
+import (
+	"fmt"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/stream"
+	"sync"
+)
+
+var (
+	Manager = &sourceManager{sources: make(map[string]*Source, 8)}
+)
+
+type sourceManager struct {
+	lock       sync.Mutex
+	createLock sync.Mutex         // 串行创建虚拟源, PreparePublishSource期间不持有lock, 不阻塞上游源关闭时的查找
+	sources    map[string]*Source // key为虚拟源id
+}
+
+// 查找源流作为主源或备用源的规则
+func (m *sourceManager) matchRules(sourceId string) []stream.FailoverRuleConfig {
+	var rules []stream.FailoverRuleConfig
+	for _, rule := range stream.AppConfig.Failover.Rules {
+		if rule.Primary == sourceId || rule.Backup == sourceId {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+func (m *sourceManager) find(id string) *Source {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if source, ok := m.sources[id]; ok && !source.IsClosed() {
+		return source
+	}
+
+	return nil
+}
+
+// 查找或创建虚拟源. PreparePublishSource会同步执行on_publish hook, 不能在上游源的事件协程中调用
+func (m *sourceManager) findOrCreate(rule stream.FailoverRuleConfig) *Source {
+	m.createLock.Lock()
+	defer m.createLock.Unlock()
+
+	if source := m.find(rule.Source); source != nil {
+		return source
+	}
+
+	source := NewSource(rule)
+	if _, state := stream.PreparePublishSource(source, false); utils.HookStateOK != state {
+		log.Sugar.Errorf("创建虚拟源失败, id已经被占用 source: %s", rule.Source)
+		return nil
+	}
+
+	m.lock.Lock()
+	m.sources[rule.Source] = source
+	m.lock.Unlock()
+
+	go source.run()
+	return source
+}
+
+func (m *sourceManager) remove(source *Source) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.sources[source.GetID()] == source {
+		delete(m.sources, source.GetID())
+	}
+}
+
+// OnSourceReady 在源流的事件协程中回调, 主源或备用源推流后, 创建虚拟源并转发AVPacket
+func (m *sourceManager) OnSourceReady(sourceId string) {
+	rules := m.matchRules(sourceId)
+	if len(rules) == 0 {
+		return
+	}
+
+	source := stream.SourceManager.Find(sourceId)
+	if source == nil {
+		return
+	}
+
+	// 创建虚拟源会阻塞, 不能占用上游源的事件协程
+	go m.attach(source, rules)
+}
+
+// 创建虚拟源后, 回到上游源的事件协程添加AVPacket监听
+func (m *sourceManager) attach(source stream.Source, rules []stream.FailoverRuleConfig) {
+	for _, rule := range rules {
+		virtual := m.findOrCreate(rule)
+		if virtual == nil {
+			continue
+		}
+
+		listener := &upstream{id: source.GetID(), source: source, virtual: virtual}
+		source.PostEvent(func() {
+			if virtual.IsClosed() {
+				return
+			}
+
+			source.AddPacketListener(listener)
+			streams := source.OriginStreams()
+			virtual.PostEvent(func() {
+				virtual.onUpstreamReady(listener, streams)
+			})
+		})
+	}
+}
+
+// OnSourceClosed 在源流的事件协程中回调, 通知虚拟源切换或关闭
+func (m *sourceManager) OnSourceClosed(sourceId string) {
+	var virtuals []*Source
+	m.lock.Lock()
+	for _, rule := range m.matchRules(sourceId) {
+		if virtual, ok := m.sources[rule.Source]; ok && !virtual.IsClosed() {
+			virtuals = append(virtuals, virtual)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, virtual := range virtuals {
+		v := virtual
+		v.PostEvent(func() {
+			v.onUpstreamClosed(sourceId)
+		})
+	}
+}
+
+// Start 开启主备切换, 监听主备源的创建和关闭
+func Start() error {
+	for _, rule := range stream.AppConfig.Failover.Rules {
+		if rule.Source == "" || rule.Primary == "" || rule.Backup == "" {
+			return fmt.Errorf("invalid failover rule %v", rule)
+		} else if rule.Source == rule.Primary || rule.Source == rule.Backup || rule.Primary == rule.Backup {
+			return fmt.Errorf("failover rule %s: the source, primary and backup must be different", rule.Source)
+		}
+	}
+
+	stream.AddSourceListener(Manager)
+	return nil
+}
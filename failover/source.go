@@ -0,0 +1,328 @@
+package failover
+
+import (
+	"bytes"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/stream"
+	"time"
+)
+
+// 从主备源转发到虚拟源的AVPacket, 时间基统一为1000
+type forwardPacket struct {
+	source    string
+	stream    utils.AVStream
+	data      []byte
+	dts       int64
+	pts       int64
+	key       bool
+	discarded bool // 之前有包因为虚拟源处理不过来被丢弃, 需要等待关键帧
+}
+
+// 上游源(主源或备用源)的AVPacket监听, 在上游源的事件协程中回调
+type upstream struct {
+	id        string
+	source    stream.Source
+	virtual   *Source
+	discarded bool
+}
+
+func (u *upstream) OnPacket(source stream.Source, avStream utils.AVStream, packet utils.AVPacket) {
+	// 虚拟源已经关闭, 移除监听
+	if u.virtual.IsClosed() {
+		source.RemovePacketListener(u)
+		return
+	}
+
+	var data []byte
+	if utils.AVMediaTypeVideo == packet.MediaType() {
+		data = packet.AnnexBPacketData(avStream)
+	} else {
+		data = packet.Data()
+	}
+
+	pkt := forwardPacket{
+		source:    u.id,
+		stream:    avStream,
+		data:      append([]byte(nil), data...),
+		dts:       packet.ConvertDts(1000),
+		pts:       packet.ConvertPts(1000),
+		key:       packet.KeyFrame(),
+		discarded: u.discarded,
+	}
+
+	// 不阻塞上游源, 虚拟源处理不过来直接丢弃
+	select {
+	case u.virtual.packets <- pkt:
+		u.discarded = false
+	default:
+		u.discarded = true
+	}
+}
+
+// Source 跟随主源的虚拟源, 主源超时未收到流时切换到备用源, 主源恢复后切回.
+// 切换发生在新源的关键帧, 时间戳从切换前延续
+type Source struct {
+	stream.PublishSource
+
+	rule      stream.FailoverRuleConfig
+	packets   chan forwardPacket
+	upstreams map[string][]utils.AVStream // 在线的上游源和track
+	listeners map[string]*upstream        // 添加到上游源的AVPacket监听, 虚拟源关闭时移除
+
+	active       string        // 正在输出的上游源
+	pending      string        // 等待关键帧切换的上游源
+	waitKeyFrame bool          // 等待关键帧才开始输出
+	offset       int64         // 当前上游源的时间戳偏移量
+	lastDts      map[int]int64 // 每路track最近输出的dts
+	duration     int64         // 最近两帧视频的dts间隔
+}
+
+func NewSource(rule stream.FailoverRuleConfig) *Source {
+	source := &Source{
+		PublishSource: stream.PublishSource{ID: rule.Source, Type: stream.SourceTypeFailover},
+		rule:          rule,
+		packets:       make(chan forwardPacket, 512),
+		upstreams:     make(map[string][]utils.AVStream, 2),
+		listeners:     make(map[string]*upstream, 2),
+		lastDts:       make(map[int]int64, 4),
+		waitKeyFrame:  true,
+	}
+
+	source.Init(stream.ReceiveBufferTCPBlockCount)
+	return source
+}
+
+// 虚拟源的事件协程, 处理转发的AVPacket和定时检查主备源状态
+func (s *Source) run() {
+	ticker := time.NewTicker(time.Duration(stream.AppConfig.Failover.Timeout/4) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case pkt := <-s.packets:
+			s.onPacket(pkt)
+		case <-ticker.C:
+			s.checkHealth()
+		case event := <-s.MainContextEvents():
+			event()
+		}
+
+		if s.IsClosed() {
+			log.Sugar.Debugf("主协程执行结束 source: %s", s.GetID())
+			Manager.remove(s)
+			s.removeListeners()
+			return
+		}
+	}
+}
+
+// 移除上游源的AVPacket监听, 上游源在自己的事件协程中删除
+func (s *Source) removeListeners() {
+	for _, listener := range s.listeners {
+		l := listener
+		if !l.source.IsClosed() {
+			l.source.PostEvent(func() {
+				l.source.RemovePacketListener(l)
+			})
+		}
+	}
+
+	s.listeners = make(map[string]*upstream, 2)
+}
+
+// 上游源解析完track, 第一个在线的上游源作为输出
+func (s *Source) onUpstreamReady(listener *upstream, streams []utils.AVStream) {
+	id := listener.id
+	s.upstreams[id] = streams
+	s.listeners[id] = listener
+	if s.IsCompleted() {
+		return
+	}
+
+	s.active = id
+	for _, avStream := range streams {
+		s.OnDeMuxStream(copyStream(avStream))
+	}
+
+	s.OnDeMuxStreamDone()
+	log.Sugar.Infof("虚拟源输出 %s source: %s", id, s.GetID())
+}
+
+// 上游源关闭, 正在输出的上游源关闭时立即切换. 主备源都关闭, 关闭虚拟源
+func (s *Source) onUpstreamClosed(id string) {
+	delete(s.upstreams, id)
+	delete(s.listeners, id)
+	if s.pending == id {
+		s.pending = ""
+	}
+
+	if len(s.upstreams) == 0 {
+		log.Sugar.Infof("主备源都已关闭 source: %s", s.GetID())
+		s.DoClose()
+		return
+	}
+
+	if s.active == id {
+		s.checkHealth()
+	}
+}
+
+// 上游源是否正常收流
+func (s *Source) isHealthy(id string) bool {
+	if _, ok := s.upstreams[id]; !ok {
+		return false
+	}
+
+	source := stream.SourceManager.Find(id)
+	return source != nil && time.Since(source.LastPacketTime()) < time.Duration(stream.AppConfig.Failover.Timeout)*time.Millisecond
+}
+
+// 检查主备源状态, 优先输出主源
+func (s *Source) checkHealth() {
+	// 上游源在添加监听前已经关闭, 没有可以输出的上游源
+	if len(s.upstreams) == 0 && time.Since(s.CreateTime()) > time.Duration(stream.AppConfig.Failover.Timeout)*time.Millisecond {
+		log.Sugar.Infof("没有在线的上游源 source: %s", s.GetID())
+		s.DoClose()
+		return
+	} else if !s.IsCompleted() {
+		return
+	}
+
+	target := s.active
+	if s.isHealthy(s.rule.Primary) {
+		target = s.rule.Primary
+	} else if s.isHealthy(s.rule.Backup) {
+		target = s.rule.Backup
+	}
+
+	if target == s.active {
+		s.pending = ""
+	} else if target != s.pending && s.isCompatible(target) {
+		log.Sugar.Infof("准备切换 %s->%s 等待关键帧 source: %s", s.active, target, s.GetID())
+		s.pending = target
+	}
+}
+
+// 上游源的track编码器与虚拟源一致才能切换, 不支持中途更换编码器
+func (s *Source) isCompatible(id string) bool {
+	for _, avStream := range s.upstreams[id] {
+		for _, origin := range s.OriginStreams() {
+			if origin.Index() == avStream.Index() && (origin.Type() != avStream.Type() || origin.CodecId() != avStream.CodecId()) {
+				log.Sugar.Warnf("%s的track: %d编码器%s与虚拟源不一致, 不能切换 source: %s", id, avStream.Index(), avStream.CodecId(), s.GetID())
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// 等待切换的上游源遇到关键帧(纯音频源的第一帧)时切换
+func (s *Source) isSwitchPoint(pkt forwardPacket) bool {
+	if utils.AVMediaTypeVideo == pkt.stream.Type() {
+		return pkt.key
+	}
+
+	for _, avStream := range s.upstreams[pkt.source] {
+		if utils.AVMediaTypeVideo == avStream.Type() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// 切换到新的上游源, 时间戳从切换前延续, 编码参数变化的track重新生成封装头
+func (s *Source) switchTo(pkt forwardPacket) {
+	from := s.active
+
+	var last int64
+	for _, dts := range s.lastDts {
+		if dts > last {
+			last = dts
+		}
+	}
+
+	s.offset = last + s.duration - pkt.dts
+	s.active = pkt.source
+	s.pending = ""
+	s.waitKeyFrame = false
+
+	// 新增的track和编码参数变化的track
+	for _, avStream := range s.upstreams[pkt.source] {
+		var origin utils.AVStream
+		for _, stream_ := range s.OriginStreams() {
+			if stream_.Index() == avStream.Index() {
+				origin = stream_
+				break
+			}
+		}
+
+		if origin == nil || !bytes.Equal(origin.Extra(), avStream.Extra()) {
+			s.OnDeMuxStream(copyStream(avStream))
+		}
+	}
+
+	log.Sugar.Infof("切换 %s->%s source: %s", from, s.active, s.GetID())
+	go stream.HookFailoverEvent(s, from, s.active)
+}
+
+func (s *Source) onPacket(pkt forwardPacket) {
+	if !s.IsCompleted() {
+		return
+	} else if pkt.source == s.pending && s.isSwitchPoint(pkt) {
+		s.switchTo(pkt)
+	}
+
+	if pkt.source != s.active {
+		return
+	} else if pkt.discarded {
+		s.waitKeyFrame = true
+	}
+
+	// 丢包后等待关键帧
+	if s.waitKeyFrame && !s.isSwitchPoint(pkt) {
+		return
+	}
+
+	s.waitKeyFrame = false
+
+	// 上游源中途添加的track, 虚拟源没有该track
+	avStream := pkt.stream
+	if s.NotTrackAdded(avStream.Index()) {
+		return
+	}
+
+	// 丢弃切换后与切换前重叠的包, 保持每路track的时间戳单调递增
+	dts := pkt.dts + s.offset
+	pts := pkt.pts + s.offset
+	if last, ok := s.lastDts[avStream.Index()]; ok {
+		if dts < last {
+			return
+		} else if utils.AVMediaTypeVideo == avStream.Type() && dts > last {
+			s.duration = dts - last
+		}
+	}
+
+	s.lastDts[avStream.Index()] = dts
+
+	// AVPacket的data从虚拟源的内存池中分配, 由GOP缓存释放
+	buffer := s.FindOrCreatePacketBuffer(avStream.Index(), avStream.Type())
+	buffer.Mark()
+	buffer.Write(pkt.data)
+	data := buffer.Fetch()
+
+	var packet utils.AVPacket
+	if utils.AVMediaTypeVideo == avStream.Type() {
+		packet = utils.NewVideoPacket(data, dts, pts, pkt.key, utils.PacketTypeAnnexB, avStream.CodecId(), avStream.Index(), 1000)
+	} else {
+		packet = utils.NewAudioPacket(data, dts, pts, avStream.CodecId(), avStream.Index(), 1000)
+	}
+
+	s.OnDeMuxPacket(packet)
+}
+
+func copyStream(avStream utils.AVStream) utils.AVStream {
+	return utils.NewAVStream(avStream.Type(), avStream.Index(), avStream.CodecId(), avStream.Extra(), avStream.CodecParameters())
+}
@@ -0,0 +1,78 @@
+package failover
+
+import (
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/stream"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.InitLogger(false, zapcore.ErrorLevel, "", 0, 0, 0, false)
+	os.Exit(m.Run())
+}
+
+// 切换到备用源, 时间戳从切换前延续, 新增和编码参数变化的track更新到虚拟源
+func TestSwitchTo(t *testing.T) {
+	video := func(extra string) utils.AVStream {
+		return utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, []byte(extra), nil)
+	}
+	audio := func(extra string) utils.AVStream {
+		return utils.NewAVStream(utils.AVMediaTypeAudio, 1, utils.AVCodecIdAAC, []byte(extra), nil)
+	}
+
+	tests := []struct {
+		name     string
+		lastDts  map[int]int64
+		duration int64
+		dts      int64
+		origin   []utils.AVStream
+		backup   []utils.AVStream
+		offset   int64
+		extra    map[int]string // 切换后虚拟源每路track的编码参数
+	}{
+		{"continue", map[int]int64{0: 1000, 1: 980}, 40, 5000, []utils.AVStream{video("sps")}, []utils.AVStream{video("sps")}, 1000 + 40 - 5000, map[int]string{0: "sps"}},
+		{"backward", map[int]int64{0: 9000}, 40, 100, []utils.AVStream{video("sps")}, []utils.AVStream{video("sps")}, 9000 + 40 - 100, map[int]string{0: "sps"}},
+		{"no output", map[int]int64{}, 0, 200, []utils.AVStream{video("sps")}, []utils.AVStream{video("sps")}, -200, map[int]string{0: "sps"}},
+		{"extra changed", map[int]int64{0: 1000}, 40, 1000, []utils.AVStream{video("sps")}, []utils.AVStream{video("new")}, 40, map[int]string{0: "new"}},
+		{"track added", map[int]int64{0: 1000}, 40, 1000, []utils.AVStream{video("sps")}, []utils.AVStream{video("sps"), audio("aac")}, 40, map[int]string{0: "sps", 1: "aac"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := NewSource(stream.FailoverRuleConfig{Source: "live/virtual", Primary: "live/primary", Backup: "live/backup"})
+			for _, avStream := range test.origin {
+				source.OnDeMuxStream(avStream)
+			}
+
+			source.active = "live/primary"
+			source.pending = "live/backup"
+			source.lastDts = test.lastDts
+			source.duration = test.duration
+			source.upstreams["live/backup"] = test.backup
+
+			source.switchTo(forwardPacket{source: "live/backup", stream: test.backup[0], dts: test.dts, pts: test.dts, key: true})
+
+			if source.active != "live/backup" || source.pending != "" || source.waitKeyFrame {
+				t.Fatalf("unexpected state active: %s pending: %s waitKeyFrame: %t", source.active, source.pending, source.waitKeyFrame)
+			} else if source.offset != test.offset {
+				t.Fatalf("offset: %d expected: %d", source.offset, test.offset)
+			} else if test.dts+source.offset < test.lastDts[0] {
+				t.Fatal("timestamp goes backward after switching")
+			}
+
+			streams := source.OriginStreams()
+			if len(streams) != len(test.extra) {
+				t.Fatalf("track count: %d expected: %d", len(streams), len(test.extra))
+			}
+
+			for _, avStream := range streams {
+				if string(avStream.Extra()) != test.extra[avStream.Index()] {
+					t.Fatalf("track: %d extra: %s expected: %s", avStream.Index(), avStream.Extra(), test.extra[avStream.Index()])
+				}
+			}
+		})
+	}
+}
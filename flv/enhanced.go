@@ -0,0 +1,171 @@
+package flv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/lkmio/avformat/utils"
+)
+
+// Enhanced RTMP v2多track封装. 每种类型的第一路track使用传统flv tag, 兼容不支持Enhanced RTMP的播放器;
+// 同类型的其余track使用Multitrack(OneTrack)封装, trackId为track在输出流同类型track中的序号.
+// @see https://github.com/veovera/enhanced-rtmp/blob/main/docs/enhanced/enhanced-rtmp-v2.md
+
+const (
+	videoExHeader                = 0x80 // IsExHeader
+	videoPacketTypeSequenceStart = 0
+	videoPacketTypeCodedFrames   = 1
+	videoPacketTypeMultitrack    = 6
+
+	audioSoundFormatExHeader     = 9
+	audioPacketTypeSequenceStart = 0
+	audioPacketTypeCodedFrames   = 1
+	audioPacketTypeMultitrack    = 5
+
+	multitrackTypeOneTrack = 0
+
+	tagTypeAudio = 8
+	tagTypeVideo = 9
+
+	// previous tag size[4]|tag header[11]
+	tagHeaderSize = 4 + 11
+)
+
+// MultitrackFourCC 返回Enhanced RTMP多track封装使用的FourCC, 不支持返回nil
+func MultitrackFourCC(codecId utils.AVCodecID) []byte {
+	switch codecId {
+	case utils.AVCodecIdH264:
+		return []byte("avc1")
+	case utils.AVCodecIdH265:
+		return []byte("hvc1")
+	case utils.AVCodecIdAAC:
+		return []byte("mp4a")
+	case utils.AVCodecIdMP3:
+		return []byte(".mp3")
+	}
+
+	return nil
+}
+
+// MultitrackTrackID 返回track在同类型track中的序号, 作为Enhanced RTMP多track的trackId.
+// 0表示每种类型的第一路track, 使用传统flv tag封装. 未找到返回-1
+func MultitrackTrackID(tracks []utils.AVStream, index int) int {
+	var mediaType utils.AVMediaType
+	for _, track := range tracks {
+		if track.Index() == index {
+			mediaType = track.Type()
+			break
+		}
+	}
+
+	var trackId int
+	for _, track := range tracks {
+		if track.Index() == index {
+			return trackId
+		} else if mediaType == track.Type() {
+			trackId++
+		}
+	}
+
+	return -1
+}
+
+// CheckMultitrack 检查track添加到输出流后能否封装. 同类型的第二路及以后的track使用多track封装, 必须有FourCC
+func CheckMultitrack(tracks []utils.AVStream, track utils.AVStream) error {
+	for _, avStream := range tracks {
+		if avStream.Type() == track.Type() && MultitrackFourCC(track.CodecId()) == nil {
+			return fmt.Errorf("%s cannot be muxed into an enhanced rtmp multitrack", track.CodecId())
+		}
+	}
+
+	return nil
+}
+
+// SequenceHeaderData 返回track的sequence header数据
+func SequenceHeaderData(track utils.AVStream) []byte {
+	if utils.AVMediaTypeVideo == track.Type() {
+		return track.CodecParameters().MP4ExtraData()
+	}
+
+	return track.Extra()
+}
+
+// ExistMultitrackSequenceHeader 多track封装是否需要发送sequence header. mp3没有sequence header
+func ExistMultitrackSequenceHeader(track utils.AVStream) bool {
+	return utils.AVCodecIdMP3 != track.CodecId()
+}
+
+// MultitrackHeaderSize 返回多track tag body头部(数据之前)的长度
+func MultitrackHeaderSize(mediaType utils.AVMediaType, sequenceHeader bool) int {
+	// header[1]|multitrack type+packet type[1]|fourcc[4]|track id[1]
+	size := 7
+	// avc1/hvc1的CodedFrames携带3字节composition time
+	if utils.AVMediaTypeVideo == mediaType && !sequenceHeader {
+		size += 3
+	}
+
+	return size
+}
+
+// WriteMultitrackHeader 写多track tag body头部, 返回写入长度
+// @ct composition time, 单位毫秒
+func WriteMultitrackHeader(dst []byte, track utils.AVStream, trackId int, key, sequenceHeader bool, ct int32) int {
+	fourCC := MultitrackFourCC(track.CodecId())
+	utils.Assert(fourCC != nil)
+
+	if utils.AVMediaTypeVideo == track.Type() {
+		// 1-关键帧 2-非关键帧
+		frameType := byte(2)
+		packetType := byte(videoPacketTypeCodedFrames)
+		if key || sequenceHeader {
+			frameType = 1
+		}
+
+		if sequenceHeader {
+			packetType = videoPacketTypeSequenceStart
+		}
+
+		dst[0] = videoExHeader | frameType<<4 | videoPacketTypeMultitrack
+		dst[1] = multitrackTypeOneTrack<<4 | packetType
+	} else {
+		packetType := byte(audioPacketTypeCodedFrames)
+		if sequenceHeader {
+			packetType = audioPacketTypeSequenceStart
+		}
+
+		dst[0] = audioSoundFormatExHeader<<4 | audioPacketTypeMultitrack
+		dst[1] = multitrackTypeOneTrack<<4 | packetType
+	}
+
+	copy(dst[2:], fourCC)
+	dst[6] = byte(trackId)
+
+	n := 7
+	if utils.AVMediaTypeVideo == track.Type() && !sequenceHeader {
+		// SI24
+		dst[7] = byte(ct >> 16)
+		dst[8] = byte(ct >> 8)
+		dst[9] = byte(ct)
+		n += 3
+	}
+
+	return n
+}
+
+// 写previous tag size和tag header, 返回写入长度
+func writeTagHeader(dst []byte, preTagSize int, tagType byte, dataSize int, timestamp int64) int {
+	binary.BigEndian.PutUint32(dst, uint32(preTagSize))
+	dst[4] = tagType
+	dst[5] = byte(dataSize >> 16)
+	dst[6] = byte(dataSize >> 8)
+	dst[7] = byte(dataSize)
+	// 低24位时间戳+高8位扩展时间戳
+	dst[8] = byte(timestamp >> 16)
+	dst[9] = byte(timestamp >> 8)
+	dst[10] = byte(timestamp)
+	dst[11] = byte(timestamp >> 24)
+	// stream id
+	dst[12] = 0
+	dst[13] = 0
+	dst[14] = 0
+	return tagHeaderSize
+}
@@ -0,0 +1,104 @@
+package flv
+
+import (
+	"bytes"
+	"github.com/lkmio/avformat/utils"
+	"testing"
+)
+
+func TestMultitrackTrackID(t *testing.T) {
+	tracks := []utils.AVStream{
+		utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdAAC, nil, nil),
+		utils.NewAVStream(utils.AVMediaTypeVideo, 1, utils.AVCodecIdH264, nil, nil),
+		utils.NewAVStream(utils.AVMediaTypeAudio, 2, utils.AVCodecIdAAC, nil, nil),
+		utils.NewAVStream(utils.AVMediaTypeVideo, 3, utils.AVCodecIdH265, nil, nil),
+		utils.NewAVStream(utils.AVMediaTypeAudio, 5, utils.AVCodecIdMP3, nil, nil),
+	}
+
+	tests := []struct {
+		index    int
+		expected int
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 1},
+		{3, 1},
+		{5, 2},
+		{4, -1},
+	}
+
+	for _, test := range tests {
+		if trackId := MultitrackTrackID(tracks, test.index); trackId != test.expected {
+			t.Fatalf("track %d: id %d, expected %d", test.index, trackId, test.expected)
+		}
+	}
+}
+
+// 同类型的第二路及以后的track必须有FourCC
+func TestCheckMultitrack(t *testing.T) {
+	aac := utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdAAC, nil, nil)
+	pcma := utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdPCMALAW, nil, nil)
+	h264 := utils.NewAVStream(utils.AVMediaTypeVideo, 1, utils.AVCodecIdH264, nil, nil)
+	mp3 := utils.NewAVStream(utils.AVMediaTypeAudio, 2, utils.AVCodecIdMP3, nil, nil)
+	pcmu := utils.NewAVStream(utils.AVMediaTypeAudio, 2, utils.AVCodecIdPCMMULAW, nil, nil)
+
+	tests := []struct {
+		name    string
+		tracks  []utils.AVStream
+		track   utils.AVStream
+		success bool
+	}{
+		{"first track", nil, pcma, true},
+		{"first of its type", []utils.AVStream{h264}, pcma, true},
+		{"second aac", []utils.AVStream{pcma, h264}, aac, true},
+		{"second mp3", []utils.AVStream{aac, h264}, mp3, true},
+		{"second g711", []utils.AVStream{aac, h264}, pcmu, false},
+	}
+
+	for _, test := range tests {
+		if err := CheckMultitrack(test.tracks, test.track); (err == nil) != test.success {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestWriteMultitrackHeader(t *testing.T) {
+	h264 := utils.NewAVStream(utils.AVMediaTypeVideo, 1, utils.AVCodecIdH264, nil, nil)
+	h265 := utils.NewAVStream(utils.AVMediaTypeVideo, 3, utils.AVCodecIdH265, nil, nil)
+	aac := utils.NewAVStream(utils.AVMediaTypeAudio, 2, utils.AVCodecIdAAC, nil, nil)
+
+	tests := []struct {
+		name           string
+		track          utils.AVStream
+		trackId        int
+		key            bool
+		sequenceHeader bool
+		ct             int32
+		expected       []byte
+	}{
+		{"video key frame", h264, 1, true, false, 40, []byte{0x96, 0x01, 'a', 'v', 'c', '1', 1, 0x00, 0x00, 0x28}},
+		{"video inter frame", h265, 2, false, false, -1, []byte{0xA6, 0x01, 'h', 'v', 'c', '1', 2, 0xFF, 0xFF, 0xFF}},
+		{"video sequence header", h265, 1, false, true, 0, []byte{0x96, 0x00, 'h', 'v', 'c', '1', 1}},
+		{"audio frame", aac, 1, false, false, 0, []byte{0x95, 0x01, 'm', 'p', '4', 'a', 1}},
+		{"audio sequence header", aac, 3, false, true, 0, []byte{0x95, 0x00, 'm', 'p', '4', 'a', 3}},
+	}
+
+	for _, test := range tests {
+		dst := make([]byte, 16)
+		n := WriteMultitrackHeader(dst, test.track, test.trackId, test.key, test.sequenceHeader, test.ct)
+		if n != MultitrackHeaderSize(test.track.Type(), test.sequenceHeader) {
+			t.Fatalf("%s: wrote %d bytes, expected %d", test.name, n, MultitrackHeaderSize(test.track.Type(), test.sequenceHeader))
+		} else if !bytes.Equal(dst[:n], test.expected) {
+			t.Fatalf("%s: %x, expected %x", test.name, dst[:n], test.expected)
+		}
+	}
+}
+
+func TestWriteTagHeader(t *testing.T) {
+	dst := make([]byte, tagHeaderSize)
+	n := writeTagHeader(dst, 0x123, tagTypeVideo, 0x10203, 0x12345678)
+	expected := []byte{0, 0, 0x01, 0x23, tagTypeVideo, 0x01, 0x02, 0x03, 0x34, 0x56, 0x78, 0x12, 0, 0, 0}
+	if n != tagHeaderSize || !bytes.Equal(dst, expected) {
+		t.Fatalf("%x, expected %x", dst[:n], expected)
+	}
+}
@@ -20,9 +20,11 @@ type TransStream struct {
 	stream.TCPTransStream
 
 	muxer         libflv.Muxer
+	writer        tagWriter
 	header        []byte
 	headerSize    int
 	headerTagSize int
+	dts           int64 // 最近一帧的dts, 推流中途发送sequence header时使用
 }
 
 func (t *TransStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error) {
@@ -36,6 +38,10 @@ func (t *TransStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error
 
 	dts = packet.ConvertDts(1000)
 	pts = packet.ConvertPts(1000)
+	t.dts = dts
+	// 同类型的第二路及以后的track使用Enhanced RTMP多track封装
+	_, track := t.FindTrack(packet.Index())
+	trackId := MultitrackTrackID(t.Tracks, packet.Index())
 	if utils.AVMediaTypeAudio == packet.MediaType() {
 		flvSize = 17 + len(packet.Data())
 		data = packet.Data()
@@ -43,7 +49,12 @@ func (t *TransStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error
 		flvSize = t.muxer.ComputeVideoDataSize(uint32(pts-dts)) + libflv.TagHeaderSize + len(packet.AVCCPacketData())
 
 		data = packet.AVCCPacketData()
-		videoKey = packet.KeyFrame()
+		// 只按照第一路视频的关键帧切片
+		videoKey = packet.KeyFrame() && trackId == 0
+	}
+
+	if trackId > 0 {
+		flvSize = tagHeaderSize + MultitrackHeaderSize(packet.MediaType(), false) + len(data)
 	}
 
 	// 关键帧都放在切片头部，所以遇到关键帧创建新切片, 发送当前切片剩余流
@@ -69,8 +80,7 @@ func (t *TransStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error
 
 	// 分配flv block
 	bytes := t.MWBuffer.Allocate(separatorSize+flvSize, dts, videoKey)
-	n += t.muxer.Input(bytes[n:], packet.MediaType(), len(data), dts, pts, packet.KeyFrame(), false)
-	copy(bytes[n:], data)
+	t.writer.write(bytes[n:], track, trackId, data, dts, pts, packet.KeyFrame(), false)
 
 	// 合并写满再发
 	if segment := t.MWBuffer.PeekCompletedSegment(); len(segment) > 0 {
@@ -82,46 +92,129 @@ func (t *TransStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error
 }
 
 func (t *TransStream) AddTrack(stream utils.AVStream) error {
-	if err := t.BaseTransStream.AddTrack(stream); err != nil {
+	if err := CheckMultitrack(t.Tracks, stream); err != nil {
+		return err
+	} else if err = t.BaseTransStream.AddTrack(stream); err != nil {
 		return err
 	}
 
+	// 封装器只添加每种类型的第一路track
+	if MultitrackTrackID(t.Tracks, stream.Index()) == 0 {
+		addMuxerTrack(t.muxer, stream)
+	}
+
+	return nil
+}
+
+func addMuxerTrack(muxer libflv.Muxer, stream utils.AVStream) {
 	if utils.AVMediaTypeAudio == stream.Type() {
-		t.muxer.AddAudioTrack(stream.CodecId(), 0, 0, 0)
+		muxer.AddAudioTrack(stream.CodecId(), 0, 0, 0)
 	} else if utils.AVMediaTypeVideo == stream.Type() {
-		t.muxer.AddVideoTrack(stream.CodecId())
+		muxer.AddVideoTrack(stream.CodecId())
 
-		t.muxer.AddProperty("width", stream.CodecParameters().Width())
-		t.muxer.AddProperty("height", stream.CodecParameters().Height())
+		muxer.AddProperty("width", stream.CodecParameters().Width())
+		muxer.AddProperty("height", stream.CodecParameters().Height())
 	}
-	return nil
 }
 
 func (t *TransStream) WriteHeader() error {
-	t.headerSize += t.muxer.WriteHeader(t.header[HttpFlvBlockHeaderSize:])
+	t.writeHeader(t.muxer)
+	t.MWBuffer = stream.NewMergeWritingBuffer(t.ExistVideo)
+	return nil
+}
 
+// 生成flv header和sequence header, 新的sink首先发送该数据
+func (t *TransStream) writeHeader(muxer libflv.Muxer) {
+	// 多track的sequence header可能超出默认大小
+	size := 1024
 	for _, track := range t.BaseTransStream.Tracks {
-		var data []byte
-		if utils.AVMediaTypeAudio == track.Type() {
-			data = track.Extra()
-		} else if utils.AVMediaTypeVideo == track.Type() {
-			data = track.CodecParameters().MP4ExtraData()
+		if MultitrackTrackID(t.Tracks, track.Index()) > 0 {
+			size += tagHeaderSize + 16 + len(SequenceHeaderData(track))
 		}
+	}
 
-		n := t.muxer.Input(t.header[t.headerSize:], track.Type(), len(data), 0, 0, false, true)
-		t.headerSize += n
-		copy(t.header[t.headerSize:], data)
-		t.headerSize += len(data)
+	if size > len(t.header) {
+		t.header = make([]byte, size)
+	}
 
-		t.headerTagSize = n - 15 + len(data) + 11
+	t.headerSize = HttpFlvBlockHeaderSize
+	t.headerSize += muxer.WriteHeader(t.header[HttpFlvBlockHeaderSize:])
+
+	writer := tagWriter{muxer: muxer}
+	for _, track := range t.BaseTransStream.Tracks {
+		trackId := MultitrackTrackID(t.Tracks, track.Index())
+		if trackId > 0 && !ExistMultitrackSequenceHeader(track) {
+			continue
+		}
+
+		t.headerSize += writer.write(t.header[t.headerSize:], track, trackId, SequenceHeaderData(track), 0, 0, false, true)
+		t.headerTagSize = writer.preTagSize
 	}
 
 	// 加上末尾换行符
 	t.headerSize += 2
 	t.writeSeparator(t.header[:t.headerSize])
+}
 
-	t.MWBuffer = stream.NewMergeWritingBuffer(t.ExistVideo)
-	return nil
+// UpdateTrack 编码参数发生变化, 向已有的sink发送新的sequence header, 重新生成新的sink使用的flv头
+func (t *TransStream) UpdateTrack(stream utils.AVStream) ([][]byte, int64, error) {
+	if _, _, err := t.BaseTransStream.UpdateTrack(stream); err != nil {
+		return nil, -1, err
+	}
+
+	return t.refreshSequenceHeader(stream), 0, nil
+}
+
+// AppendTrack 添加超时后到达的音频track, 向已有的sink发送音频sequence header.
+// 添加视频会改变合并写缓冲区按关键帧切片的方式, 不支持
+func (t *TransStream) AppendTrack(track utils.AVStream) ([][]byte, int64, error) {
+	if utils.AVMediaTypeAudio != track.Type() {
+		return nil, -1, stream.ErrAppendTrackNotSupported
+	}
+
+	// flv只能携带一路音频
+	for _, avStream := range t.BaseTransStream.Tracks {
+		if utils.AVMediaTypeAudio == avStream.Type() {
+			return nil, -1, stream.ErrAppendTrackNotSupported
+		}
+	}
+
+	_ = t.AddTrack(track)
+	return t.refreshSequenceHeader(track), 0, nil
+}
+
+// 发送合并写缓冲区剩余的帧和track的sequence header, 重新生成新的sink使用的flv头
+func (t *TransStream) refreshSequenceHeader(stream utils.AVStream) [][]byte {
+	t.ClearOutStreamBuffer()
+
+	// 先发送合并写缓冲区中旧编码参数的帧
+	if !t.MWBuffer.IsNewSegment() {
+		t.AppendOutStreamBuffer(t.forceFlushSegment())
+	}
+
+	// 封装sequence header tag, 使用单独的http-flv块
+	trackId := MultitrackTrackID(t.Tracks, stream.Index())
+	if trackId == 0 || ExistMultitrackSequenceHeader(stream) {
+		data := SequenceHeaderData(stream)
+		block := make([]byte, HttpFlvBlockHeaderSize+64+len(data)+2)
+		n := HttpFlvBlockHeaderSize
+		n += t.writer.write(block[n:], stream, trackId, data, t.dts, t.dts, false, true)
+		n += 2
+		t.writeSeparator(block[:n])
+		t.AppendOutStreamBuffer(t.GetHttpFLVBlock(block[:n]))
+	}
+
+	// 使用新的封装器生成flv头, 不影响正在封装的流. 已经交给sink异步发送的flv头不能修改, 重新分配内存
+	muxer := libflv.NewMuxer()
+	for _, track := range t.BaseTransStream.Tracks {
+		if MultitrackTrackID(t.Tracks, track.Index()) == 0 {
+			addMuxerTrack(muxer, track)
+		}
+	}
+
+	t.header = make([]byte, len(t.header))
+	t.writeHeader(muxer)
+	return t.OutBuffer[:t.OutBufferSize]
 }
 
 func (t *TransStream) ReadExtraData(_ int64) ([][]byte, int64, error) {
@@ -218,9 +311,44 @@ func (t *TransStream) writeSeparator(dst []byte) {
 	dst[len(dst)-1] = 0x0A
 }
 
+// 封装flv tag, 每种类型的第一路track使用传统flv tag, 其余track使用Enhanced RTMP多track tag.
+// 封装器不知道多track tag的长度, 多track tag之后的传统tag需要修正previous tag size
+type tagWriter struct {
+	muxer      libflv.Muxer
+	preTagSize int  // 上一个tag的长度
+	multitrack bool // 上一个tag是否是多track tag
+}
+
+// 返回写入长度
+func (w *tagWriter) write(dst []byte, track utils.AVStream, trackId int, data []byte, dts, pts int64, key, sequenceHeader bool) int {
+	var n int
+	if trackId > 0 {
+		size := MultitrackHeaderSize(track.Type(), sequenceHeader) + len(data)
+		tagType := byte(tagTypeAudio)
+		if utils.AVMediaTypeVideo == track.Type() {
+			tagType = tagTypeVideo
+		}
+
+		n = writeTagHeader(dst, w.preTagSize, tagType, size, dts)
+		n += WriteMultitrackHeader(dst[n:], track, trackId, key, sequenceHeader, int32(pts-dts))
+	} else {
+		n = w.muxer.Input(dst, track.Type(), len(data), dts, pts, key, sequenceHeader)
+		if w.multitrack {
+			binary.BigEndian.PutUint32(dst, uint32(w.preTagSize))
+		}
+	}
+
+	n += copy(dst[n:], data)
+	w.preTagSize = n - 4
+	w.multitrack = trackId > 0
+	return n
+}
+
 func NewHttpTransStream() stream.TransStream {
+	muxer := libflv.NewMuxer()
 	return &TransStream{
-		muxer:      libflv.NewMuxer(),
+		muxer:      muxer,
+		writer:     tagWriter{muxer: muxer},
 		header:     make([]byte, 1024),
 		headerSize: HttpFlvBlockHeaderSize,
 	}
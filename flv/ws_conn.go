@@ -2,22 +2,12 @@ package flv
 
 import (
 	"github.com/gorilla/websocket"
-	"github.com/lkmio/avformat/transport"
+	"github.com/lkmio/lkm/stream"
 	"net"
-	"time"
 )
 
-type WSConn struct {
-	*websocket.Conn
-}
-
-func (w WSConn) Read(b []byte) (n int, err error) {
-	panic("implement me")
-}
-
-func (w WSConn) Write(b []byte) (n int, err error) {
-	//输入http-flv数据
-	//去掉不需要的换行符
+// 去掉http-flv块的长度和换行符, 每个websocket消息只携带flv数据
+func trimHttpFlvBlock(b []byte) []byte {
 	var offset int
 	for i := 2; i < len(b); i++ {
 		if b[i-2] == 0x0D && b[i-1] == 0x0A {
@@ -26,13 +16,9 @@ func (w WSConn) Write(b []byte) (n int, err error) {
 		}
 	}
 
-	return 0, w.WriteMessage(websocket.BinaryMessage, b[offset:len(b)-2])
-}
-
-func (w WSConn) SetDeadline(t time.Time) error {
-	panic("implement me")
+	return b[offset : len(b)-2]
 }
 
 func NewWSConn(conn *websocket.Conn) net.Conn {
-	return transport.NewConn(&WSConn{conn})
+	return stream.NewWSConn(conn, trimHttpFlvBlock)
 }
@@ -0,0 +1,473 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/lkmio/avformat/utils"
+)
+
+// fMP4(ISO/IEC 14496-12)封装. 初始化段(ftyp+moov)在拉流时首先发送, 之后每帧封装成一个moof+mdat分片.
+// 帧时长需要下一帧的dts计算, 每路track缓存一帧, 收到同一路track的下一帧后再封装.
+
+const (
+	videoTimescale = 90000
+
+	// 无法根据dts计算帧时长时使用的默认时长
+	defaultVideoDuration = videoTimescale / 25
+	defaultAudioDuration = 1024
+
+	// trun携带的字段: data-offset|sample-duration|sample-size|sample-flags|sample-composition-time-offset
+	trunFlags = 0x000001 | 0x000100 | 0x000200 | 0x000400 | 0x000800
+	// tfhd default-base-is-moof
+	tfhdFlags = 0x020000
+
+	sampleFlagsSync    = 0x02000000 // sample_depends_on=2, 不依赖其他帧
+	sampleFlagsNonSync = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample=1
+)
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+type sample struct {
+	data []byte
+	dts  int64 // 单位为track的timescale
+	pts  int64
+	ms   int64 // dts, 单位毫秒. 用于合并写分配内存
+	key  bool
+}
+
+type track struct {
+	id        uint32 // track_ID, 从1开始
+	stream    utils.AVStream
+	timescale int
+
+	sampleRate int // 音频采样率
+	channels   int
+
+	pending  sample // 等待下一帧计算时长的帧
+	exist    bool   // pending是否有效
+	duration int64  // 上一帧的时长, 无法计算时长时使用
+}
+
+// 根据AVStream初始化track的编码参数
+func (t *track) setStream(stream utils.AVStream) error {
+	switch stream.CodecId() {
+	case utils.AVCodecIdH264, utils.AVCodecIdH265:
+		if stream.CodecParameters() == nil || len(stream.CodecParameters().MP4ExtraData()) == 0 {
+			return fmt.Errorf("%s track %d has no decoder configuration record", stream.CodecId(), stream.Index())
+		}
+
+		t.timescale = videoTimescale
+	case utils.AVCodecIdAAC:
+		sampleRate, channels, err := parseAudioSpecificConfig(stream.Extra())
+		if err != nil {
+			return err
+		}
+
+		t.timescale = sampleRate
+		t.sampleRate = sampleRate
+		t.channels = channels
+	default:
+		return fmt.Errorf("%s cannot be muxed into fmp4", stream.CodecId())
+	}
+
+	t.stream = stream
+	return nil
+}
+
+// 返回缓存帧的时长. dts不递增(包括没有下一帧)时使用上一帧的时长
+func (t *track) sampleDuration(nextDts int64) int64 {
+	if duration := nextDts - t.pending.dts; duration > 0 {
+		t.duration = duration
+	} else if t.duration < 1 {
+		if utils.AVMediaTypeVideo == t.stream.Type() {
+			t.duration = defaultVideoDuration
+		} else {
+			t.duration = defaultAudioDuration
+		}
+	}
+
+	return t.duration
+}
+
+// 解析AAC AudioSpecificConfig, 返回采样率和声道数
+func parseAudioSpecificConfig(data []byte) (int, int, error) {
+	if len(data) < 2 {
+		return 0, 0, fmt.Errorf("invalid audio specific config %x", data)
+	}
+
+	value := uint64(0)
+	for i := 0; i < 8; i++ {
+		value <<= 8
+		if i < len(data) {
+			value |= uint64(data[i])
+		}
+	}
+
+	// 按位读取
+	offset := 0
+	read := func(bits int) int {
+		v := int(value << offset >> (64 - bits))
+		offset += bits
+		return v
+	}
+
+	if objectType := read(5); objectType == 31 {
+		read(6)
+	}
+
+	var sampleRate int
+	if index := read(4); index == 15 {
+		sampleRate = read(24)
+	} else if index < len(aacSampleRates) {
+		sampleRate = aacSampleRates[index]
+	}
+
+	channels := read(4)
+	if sampleRate < 1 || offset > len(data)*8 {
+		return 0, 0, fmt.Errorf("invalid audio specific config %x", data)
+	}
+
+	return sampleRate, channels, nil
+}
+
+// 按照先写box内容后回填长度的方式写box
+type boxWriter struct {
+	buffer  []byte
+	offsets []int // 未结束的box起始位置
+}
+
+func (w *boxWriter) begin(boxType string) {
+	w.offsets = append(w.offsets, len(w.buffer))
+	w.buffer = append(w.buffer, 0, 0, 0, 0)
+	w.buffer = append(w.buffer, boxType...)
+}
+
+func (w *boxWriter) beginFull(boxType string, version byte, flags uint32) {
+	w.begin(boxType)
+	w.u32(uint32(version)<<24 | flags&0xFFFFFF)
+}
+
+func (w *boxWriter) end() {
+	offset := w.offsets[len(w.offsets)-1]
+	w.offsets = w.offsets[:len(w.offsets)-1]
+	binary.BigEndian.PutUint32(w.buffer[offset:], uint32(len(w.buffer)-offset))
+}
+
+func (w *boxWriter) u8(v byte) {
+	w.buffer = append(w.buffer, v)
+}
+
+func (w *boxWriter) u16(v uint16) {
+	w.buffer = binary.BigEndian.AppendUint16(w.buffer, v)
+}
+
+func (w *boxWriter) u32(v uint32) {
+	w.buffer = binary.BigEndian.AppendUint32(w.buffer, v)
+}
+
+func (w *boxWriter) u64(v uint64) {
+	w.buffer = binary.BigEndian.AppendUint64(w.buffer, v)
+}
+
+func (w *boxWriter) bytes(v []byte) {
+	w.buffer = append(w.buffer, v...)
+}
+
+func (w *boxWriter) zero(n int) {
+	for i := 0; i < n; i++ {
+		w.buffer = append(w.buffer, 0)
+	}
+}
+
+// 写单位矩阵
+func (w *boxWriter) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
+
+// 写MPEG-4描述符的tag和长度, 长度固定使用4字节
+func (w *boxWriter) descriptor(tag byte, size int) {
+	w.u8(tag)
+	w.bytes([]byte{byte(size>>21) | 0x80, byte(size>>14) | 0x80, byte(size>>7) | 0x80, byte(size) & 0x7F})
+}
+
+type muxer struct {
+	tracks   []*track
+	sequence uint32    // moof序号
+	header   boxWriter // 复用的moof内存
+}
+
+func (m *muxer) addTrack(stream utils.AVStream) (*track, error) {
+	t := &track{id: uint32(len(m.tracks) + 1)}
+	if err := t.setStream(stream); err != nil {
+		return nil, err
+	}
+
+	m.tracks = append(m.tracks, t)
+	return t, nil
+}
+
+// 生成初始化段(ftyp+moov). 每次生成都使用新的内存, 已经交给sink异步发送的初始化段不受影响
+func (m *muxer) writeInitSegment() []byte {
+	w := &boxWriter{buffer: make([]byte, 0, 1024)}
+
+	w.begin("ftyp")
+	w.bytes([]byte("isom"))
+	w.u32(0x200)
+	w.bytes([]byte("isomiso6mp41"))
+	w.end()
+
+	w.begin("moov")
+	w.beginFull("mvhd", 0, 0)
+	// creation_time|modification_time|timescale|duration
+	w.u32(0)
+	w.u32(0)
+	w.u32(1000)
+	w.u32(0)
+	// rate|volume|reserved
+	w.u32(0x00010000)
+	w.u16(0x0100)
+	w.zero(10)
+	w.matrix()
+	// pre_defined
+	w.zero(24)
+	w.u32(uint32(len(m.tracks) + 1))
+	w.end()
+
+	for _, t := range m.tracks {
+		m.writeTrak(w, t)
+	}
+
+	w.begin("mvex")
+	for _, t := range m.tracks {
+		w.beginFull("trex", 0, 0)
+		w.u32(t.id)
+		// default_sample_description_index|default_sample_duration|default_sample_size|default_sample_flags
+		w.u32(1)
+		w.u32(0)
+		w.u32(0)
+		w.u32(0)
+		w.end()
+	}
+	w.end()
+	w.end()
+
+	return w.buffer
+}
+
+func (m *muxer) writeTrak(w *boxWriter, t *track) {
+	video := utils.AVMediaTypeVideo == t.stream.Type()
+	var width, height int
+	if video {
+		width, height = int(t.stream.CodecParameters().Width()), int(t.stream.CodecParameters().Height())
+	}
+
+	w.begin("trak")
+	// track_enabled|track_in_movie
+	w.beginFull("tkhd", 0, 0x3)
+	// creation_time|modification_time|track_ID|reserved|duration|reserved
+	w.u32(0)
+	w.u32(0)
+	w.u32(t.id)
+	w.u32(0)
+	w.u32(0)
+	w.zero(8)
+	// layer|alternate_group|volume|reserved
+	w.u16(0)
+	w.u16(0)
+	if video {
+		w.u16(0)
+	} else {
+		w.u16(0x0100)
+	}
+	w.u16(0)
+	w.matrix()
+	w.u32(uint32(width) << 16)
+	w.u32(uint32(height) << 16)
+	w.end()
+
+	w.begin("mdia")
+	w.beginFull("mdhd", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.u32(uint32(t.timescale))
+	w.u32(0)
+	// language: und
+	w.u16(0x55C4)
+	w.u16(0)
+	w.end()
+
+	w.beginFull("hdlr", 0, 0)
+	w.u32(0)
+	if video {
+		w.bytes([]byte("vide"))
+		w.zero(12)
+		w.bytes([]byte("VideoHandler\x00"))
+	} else {
+		w.bytes([]byte("soun"))
+		w.zero(12)
+		w.bytes([]byte("SoundHandler\x00"))
+	}
+	w.end()
+
+	w.begin("minf")
+	if video {
+		w.beginFull("vmhd", 0, 1)
+		w.zero(8)
+	} else {
+		w.beginFull("smhd", 0, 0)
+		w.zero(4)
+	}
+	w.end()
+
+	w.begin("dinf")
+	w.beginFull("dref", 0, 0)
+	w.u32(1)
+	// 媒体数据位于同一文件
+	w.beginFull("url ", 0, 1)
+	w.end()
+	w.end()
+	w.end()
+
+	w.begin("stbl")
+	w.beginFull("stsd", 0, 0)
+	w.u32(1)
+	if video {
+		writeVisualSampleEntry(w, t, width, height)
+	} else {
+		writeAudioSampleEntry(w, t)
+	}
+	w.end()
+
+	// 分片封装, 样本表为空
+	for _, boxType := range []string{"stts", "stsc", "stco"} {
+		w.beginFull(boxType, 0, 0)
+		w.u32(0)
+		w.end()
+	}
+
+	w.beginFull("stsz", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.end()
+
+	w.end() // stbl
+	w.end() // minf
+	w.end() // mdia
+	w.end() // trak
+}
+
+func writeVisualSampleEntry(w *boxWriter, t *track, width, height int) {
+	entry, config := "avc1", "avcC"
+	if utils.AVCodecIdH265 == t.stream.CodecId() {
+		entry, config = "hvc1", "hvcC"
+	}
+
+	w.begin(entry)
+	// reserved|data_reference_index
+	w.zero(6)
+	w.u16(1)
+	// pre_defined|reserved|pre_defined
+	w.zero(16)
+	w.u16(uint16(width))
+	w.u16(uint16(height))
+	// horizresolution|vertresolution 72dpi
+	w.u32(0x00480000)
+	w.u32(0x00480000)
+	w.u32(0)
+	// frame_count|compressorname|depth|pre_defined
+	w.u16(1)
+	w.zero(32)
+	w.u16(0x0018)
+	w.u16(0xFFFF)
+
+	w.begin(config)
+	w.bytes(t.stream.CodecParameters().MP4ExtraData())
+	w.end()
+	w.end()
+}
+
+func writeAudioSampleEntry(w *boxWriter, t *track) {
+	w.begin("mp4a")
+	// reserved|data_reference_index
+	w.zero(6)
+	w.u16(1)
+	w.zero(8)
+	// channelcount|samplesize|pre_defined|reserved|samplerate(16.16)
+	w.u16(uint16(t.channels))
+	w.u16(16)
+	w.zero(4)
+	if t.sampleRate > 0xFFFF {
+		w.u32(0)
+	} else {
+		w.u32(uint32(t.sampleRate) << 16)
+	}
+
+	config := t.stream.Extra()
+	w.beginFull("esds", 0, 0)
+	// ES_Descriptor: ES_ID|flags|DecoderConfigDescriptor|SLConfigDescriptor
+	w.descriptor(0x03, 3+5+13+5+len(config)+5+1)
+	w.u16(0)
+	w.u8(0)
+	// DecoderConfigDescriptor: objectTypeIndication=aac|streamType=audio|bufferSizeDB|maxBitrate|avgBitrate|DecoderSpecificInfo
+	w.descriptor(0x04, 13+5+len(config))
+	w.u8(0x40)
+	w.u8(0x15)
+	w.zero(3)
+	w.u32(0)
+	w.u32(0)
+	w.descriptor(0x05, len(config))
+	w.bytes(config)
+	// SLConfigDescriptor: predefined=2
+	w.descriptor(0x06, 1)
+	w.u8(0x02)
+	w.end()
+	w.end()
+}
+
+// 生成一帧的moof和mdat头, 返回的内存在下次调用时复用
+func (m *muxer) writeFragmentHeader(t *track, s *sample, duration int64) []byte {
+	m.sequence++
+	w := &m.header
+	w.buffer = w.buffer[:0]
+
+	flags := uint32(sampleFlagsSync)
+	if utils.AVMediaTypeVideo == t.stream.Type() && !s.key {
+		flags = sampleFlagsNonSync
+	}
+
+	w.begin("moof")
+	w.beginFull("mfhd", 0, 0)
+	w.u32(m.sequence)
+	w.end()
+
+	w.begin("traf")
+	w.beginFull("tfhd", 0, tfhdFlags)
+	w.u32(t.id)
+	w.end()
+
+	w.beginFull("tfdt", 1, 0)
+	w.u64(uint64(s.dts))
+	w.end()
+
+	// 版本1, composition time offset是有符号数
+	w.beginFull("trun", 1, trunFlags)
+	w.u32(1)
+	dataOffset := len(w.buffer)
+	w.u32(0)
+	w.u32(uint32(duration))
+	w.u32(uint32(len(s.data)))
+	w.u32(flags)
+	w.u32(uint32(int32(s.pts - s.dts)))
+	w.end()
+	w.end() // traf
+	w.end() // moof
+
+	// data_offset从moof起始位置计算, 跳过mdat头
+	binary.BigEndian.PutUint32(w.buffer[dataOffset:], uint32(len(w.buffer)+8))
+
+	w.u32(uint32(8 + len(s.data)))
+	w.bytes([]byte("mdat"))
+	return w.buffer
+}
@@ -0,0 +1,265 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/lkmio/avformat/utils"
+	"testing"
+)
+
+type box struct {
+	boxType string
+	payload []byte
+}
+
+// 解析同一层级的box, 长度必须正好覆盖data
+func readBoxes(t *testing.T, data []byte) []box {
+	var boxes []box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("truncated box header %x", data)
+		}
+
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("invalid box size %d, remain %d", size, len(data))
+		}
+
+		boxes = append(boxes, box{string(data[4:8]), data[8:size]})
+		data = data[size:]
+	}
+
+	return boxes
+}
+
+// 按照路径查找box, 例如moov/trak/mdia
+func findBox(t *testing.T, data []byte, path ...string) []byte {
+	for _, boxType := range path {
+		var found bool
+		for _, b := range readBoxes(t, data) {
+			if b.boxType == boxType {
+				data = b.payload
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			t.Fatalf("box %s not found in %v", boxType, path)
+		}
+	}
+
+	return data
+}
+
+func boxTypes(t *testing.T, data []byte) []string {
+	var types []string
+	for _, b := range readBoxes(t, data) {
+		types = append(types, b.boxType)
+	}
+
+	return types
+}
+
+func TestParseAudioSpecificConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		sampleRate int
+		channels   int
+		success    bool
+	}{
+		{"44100 stereo", []byte{0x12, 0x10}, 44100, 2, true},
+		{"48000 stereo", []byte{0x11, 0x90}, 48000, 2, true},
+		{"8000 mono", []byte{0x15, 0x88}, 8000, 1, true},
+		{"explicit frequency", []byte{0x17, 0x80, 0x56, 0x22, 0x10}, 44100, 2, true},
+		{"reserved frequency index", []byte{0x16, 0x90}, 0, 0, false},
+		{"truncated explicit frequency", []byte{0x17, 0x80, 0x56}, 0, 0, false},
+		{"too short", []byte{0x12}, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		sampleRate, channels, err := parseAudioSpecificConfig(test.data)
+		if (err == nil) != test.success {
+			t.Fatalf("%s: %v", test.name, err)
+		} else if err == nil && (sampleRate != test.sampleRate || channels != test.channels) {
+			t.Fatalf("%s: %d/%d, expected %d/%d", test.name, sampleRate, channels, test.sampleRate, test.channels)
+		}
+	}
+}
+
+func TestAddTrack(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  utils.AVStream
+		success bool
+	}{
+		{"aac", utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdAAC, []byte{0x12, 0x10}, nil), true},
+		{"aac without config", utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdAAC, nil, nil), false},
+		{"g711", utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdPCMALAW, nil, nil), false},
+		{"h264 without config", utils.NewAVStream(utils.AVMediaTypeVideo, 1, utils.AVCodecIdH264, nil, nil), false},
+	}
+
+	for _, test := range tests {
+		m := muxer{}
+		if _, err := m.addTrack(test.stream); (err == nil) != test.success {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+	}
+}
+
+// 两路音频(多语言)的初始化段
+func TestInitSegment(t *testing.T) {
+	m := muxer{}
+	configs := [][]byte{{0x12, 0x10}, {0x11, 0x90}}
+	for i, config := range configs {
+		if _, err := m.addTrack(utils.NewAVStream(utils.AVMediaTypeAudio, i, utils.AVCodecIdAAC, config, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := m.writeInitSegment()
+	if types := boxTypes(t, data); len(types) != 2 || types[0] != "ftyp" || types[1] != "moov" {
+		t.Fatalf("top level boxes %v", types)
+	}
+
+	moov := findBox(t, data, "moov")
+	types := boxTypes(t, moov)
+	expected := []string{"mvhd", "trak", "trak", "mvex"}
+	if len(types) != len(expected) {
+		t.Fatalf("moov boxes %v, expected %v", types, expected)
+	}
+
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("moov boxes %v, expected %v", types, expected)
+		}
+	}
+
+	// next_track_ID
+	mvhd := findBox(t, moov, "mvhd")
+	if id := binary.BigEndian.Uint32(mvhd[len(mvhd)-4:]); id != 3 {
+		t.Fatalf("next track id %d", id)
+	}
+
+	timescales := []uint32{44100, 48000}
+	for i, b := range readBoxes(t, moov)[1:3] {
+		tkhd := findBox(t, b.payload, "tkhd")
+		if id := binary.BigEndian.Uint32(tkhd[12:]); id != uint32(i+1) {
+			t.Fatalf("track %d: id %d", i, id)
+		}
+
+		mdhd := findBox(t, b.payload, "mdia", "mdhd")
+		if timescale := binary.BigEndian.Uint32(mdhd[12:]); timescale != timescales[i] {
+			t.Fatalf("track %d: timescale %d, expected %d", i, timescale, timescales[i])
+		}
+
+		// stsd: version/flags|entry_count|mp4a
+		stsd := findBox(t, b.payload, "mdia", "minf", "stbl", "stsd")
+		mp4a := findBox(t, stsd[8:], "mp4a")
+		if channels := binary.BigEndian.Uint16(mp4a[16:]); channels != 2 {
+			t.Fatalf("track %d: %d channels", i, channels)
+		}
+
+		esds := findBox(t, mp4a[28:], "esds")
+		if !bytes.HasSuffix(esds, append(append([]byte{0x05, 0x80, 0x80, 0x80, 0x02}, configs[i]...), 0x06, 0x80, 0x80, 0x80, 0x01, 0x02)) {
+			t.Fatalf("track %d: esds %x", i, esds)
+		}
+
+		// ES_Descriptor长度覆盖剩余数据
+		if size := int(esds[8]); esds[4] != 0x03 || size != len(esds)-9 {
+			t.Fatalf("track %d: es descriptor size %d, remain %d", i, size, len(esds)-9)
+		}
+	}
+
+	if trex := boxTypes(t, findBox(t, moov, "mvex")); len(trex) != 2 {
+		t.Fatalf("mvex boxes %v", trex)
+	}
+}
+
+func TestFragmentHeader(t *testing.T) {
+	m := muxer{}
+	audio, err := m.addTrack(utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdAAC, []byte{0x12, 0x10}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		sample   sample
+		duration int64
+		flags    uint32
+	}{
+		{"first", sample{data: []byte{1, 2, 3}, dts: 0, pts: 0}, 1024, sampleFlagsSync},
+		{"second", sample{data: []byte{4, 5, 6, 7}, dts: 1024, pts: 1024}, 1024, sampleFlagsSync},
+		{"negative composition time", sample{data: []byte{8}, dts: 1 << 33, pts: 1<<33 - 10}, 2048, sampleFlagsSync},
+	}
+
+	for i, test := range tests {
+		header := m.writeFragmentHeader(audio, &test.sample, test.duration)
+		fragment := append(append([]byte(nil), header...), test.sample.data...)
+
+		boxes := readBoxes(t, fragment)
+		if len(boxes) != 2 || boxes[0].boxType != "moof" || boxes[1].boxType != "mdat" {
+			t.Fatalf("%s: boxes %v", test.name, boxTypes(t, fragment))
+		} else if !bytes.Equal(boxes[1].payload, test.sample.data) {
+			t.Fatalf("%s: mdat %x", test.name, boxes[1].payload)
+		}
+
+		if sequence := binary.BigEndian.Uint32(findBox(t, boxes[0].payload, "mfhd")[4:]); sequence != uint32(i+1) {
+			t.Fatalf("%s: sequence %d", test.name, sequence)
+		}
+
+		tfhd := findBox(t, boxes[0].payload, "traf", "tfhd")
+		if id := binary.BigEndian.Uint32(tfhd[4:]); id != audio.id || binary.BigEndian.Uint32(tfhd)&0xFFFFFF != tfhdFlags {
+			t.Fatalf("%s: tfhd %x", test.name, tfhd)
+		}
+
+		tfdt := findBox(t, boxes[0].payload, "traf", "tfdt")
+		if dts := binary.BigEndian.Uint64(tfdt[4:]); dts != uint64(test.sample.dts) {
+			t.Fatalf("%s: base media decode time %d", test.name, dts)
+		}
+
+		// version/flags|sample_count|data_offset|duration|size|flags|composition time offset
+		trun := findBox(t, boxes[0].payload, "traf", "trun")
+		offset := int(binary.BigEndian.Uint32(trun[8:]))
+		if binary.BigEndian.Uint32(trun[4:]) != 1 || !bytes.Equal(fragment[offset:], test.sample.data) {
+			t.Fatalf("%s: data offset %d", test.name, offset)
+		} else if duration := binary.BigEndian.Uint32(trun[12:]); duration != uint32(test.duration) {
+			t.Fatalf("%s: duration %d", test.name, duration)
+		} else if size := binary.BigEndian.Uint32(trun[16:]); size != uint32(len(test.sample.data)) {
+			t.Fatalf("%s: size %d", test.name, size)
+		} else if flags := binary.BigEndian.Uint32(trun[20:]); flags != test.flags {
+			t.Fatalf("%s: flags %x", test.name, flags)
+		} else if ct := int32(binary.BigEndian.Uint32(trun[24:])); int64(ct) != test.sample.pts-test.sample.dts {
+			t.Fatalf("%s: composition time %d", test.name, ct)
+		}
+	}
+}
+
+func TestSampleDuration(t *testing.T) {
+	video := &track{stream: utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, nil, nil)}
+	audio := &track{stream: utils.NewAVStream(utils.AVMediaTypeAudio, 1, utils.AVCodecIdAAC, nil, nil)}
+
+	tests := []struct {
+		name     string
+		track    *track
+		dts      int64
+		nextDts  int64
+		expected int64
+	}{
+		{"video default", video, 0, 0, defaultVideoDuration},
+		{"video", video, 0, 3000, 3000},
+		{"video keeps last duration", video, 3000, 3000, 3000},
+		{"video dts rollback", video, 6000, 5000, 3000},
+		{"audio default", audio, 100, 100, defaultAudioDuration},
+		{"audio", audio, 100, 1124, 1024},
+	}
+
+	for _, test := range tests {
+		test.track.pending.dts = test.dts
+		if duration := test.track.sampleDuration(test.nextDts); duration != test.expected {
+			t.Fatalf("%s: %d, expected %d", test.name, duration, test.expected)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package fmp4
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/lkmio/avformat/transport"
+	"github.com/lkmio/lkm/stream"
+	"net"
+)
+
+// NewWSConn ws-fmp4链路, 每个合并写切片作为一个websocket消息发送
+func NewWSConn(conn *websocket.Conn) net.Conn {
+	return stream.NewWSConn(conn, nil)
+}
+
+func NewFMP4Sink(id stream.SinkID, sourceId string, conn net.Conn) stream.Sink {
+	return &stream.BaseSink{ID: id, SourceID: sourceId, Protocol: stream.TransStreamFmp4, Conn: transport.NewConn(conn), TCPStreaming: true}
+}
@@ -0,0 +1,176 @@
+package fmp4
+
+import (
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/stream"
+)
+
+// TransStream 连续的fMP4直播流, 用于http-fmp4/ws-fmp4拉流.
+// 每帧封装成一个moof+mdat分片, 通过合并写缓冲区发送给sink.
+type TransStream struct {
+	stream.TCPTransStream
+
+	muxer  muxer
+	header []byte // 初始化段, 每个sink拉流时首先发送
+
+	tracks     map[int]*track // AVPacket索引对应的track
+	videoTrack *track         // 第一路视频, 按照该track的关键帧切片
+}
+
+func (t *TransStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error) {
+	t.ClearOutStreamBuffer()
+
+	track, ok := t.tracks[packet.Index()]
+	if !ok {
+		return nil, -1, false, nil
+	}
+
+	dts := packet.ConvertDts(track.timescale)
+	pts := packet.ConvertPts(track.timescale)
+
+	// 封装上一帧
+	if track.exist {
+		t.writeSample(track, track.sampleDuration(dts))
+	}
+
+	// 缓存当前帧, 上一帧已经拷贝到合并写缓冲区, 复用内存
+	data := packet.Data()
+	if utils.AVMediaTypeVideo == packet.MediaType() {
+		data = packet.AVCCPacketData()
+	}
+
+	track.pending = sample{
+		data: append(track.pending.data[:0], data...),
+		dts:  dts,
+		pts:  pts,
+		ms:   packet.ConvertDts(1000),
+		key:  utils.AVMediaTypeVideo == packet.MediaType() && packet.KeyFrame(),
+	}
+	track.exist = true
+
+	return t.OutBuffer[:t.OutBufferSize], 0, true, nil
+}
+
+// 封装track缓存的帧
+func (t *TransStream) writeSample(track *track, duration int64) {
+	s := &track.pending
+	videoKey := s.key && track == t.videoTrack
+
+	// 关键帧都放在切片头部, 所以遇到关键帧创建新切片, 发送当前切片剩余流
+	if videoKey && !t.MWBuffer.IsNewSegment() {
+		if segment := t.MWBuffer.FlushSegment(); len(segment) > 0 {
+			t.AppendOutStreamBuffer(segment)
+		}
+	}
+
+	header := t.muxer.writeFragmentHeader(track, s, duration)
+	bytes := t.MWBuffer.Allocate(len(header)+len(s.data), s.ms, videoKey)
+	copy(bytes, header)
+	copy(bytes[len(header):], s.data)
+	track.exist = false
+
+	// 合并写满再发
+	if segment := t.MWBuffer.PeekCompletedSegment(); len(segment) > 0 {
+		t.AppendOutStreamBuffer(segment)
+	}
+}
+
+// AddTrack 只支持h264/h265/aac, 其余编码器返回error
+func (t *TransStream) AddTrack(stream utils.AVStream) error {
+	track, err := t.muxer.addTrack(stream)
+	if err != nil {
+		return err
+	} else if err = t.BaseTransStream.AddTrack(stream); err != nil {
+		return err
+	}
+
+	t.tracks[stream.Index()] = track
+	if t.videoTrack == nil && utils.AVMediaTypeVideo == stream.Type() {
+		t.videoTrack = track
+	}
+
+	return nil
+}
+
+func (t *TransStream) WriteHeader() error {
+	t.header = t.muxer.writeInitSegment()
+	t.MWBuffer = stream.NewMergeWritingBuffer(t.ExistVideo)
+	return nil
+}
+
+// UpdateTrack 编码参数发生变化, 向已有的sink发送新的初始化段
+func (t *TransStream) UpdateTrack(stream utils.AVStream) ([][]byte, int64, error) {
+	track, ok := t.tracks[stream.Index()]
+	if !ok {
+		return t.BaseTransStream.UpdateTrack(stream)
+	} else if err := track.setStream(stream); err != nil {
+		return nil, -1, err
+	} else if _, _, err = t.BaseTransStream.UpdateTrack(stream); err != nil {
+		return nil, -1, err
+	}
+
+	t.ClearOutStreamBuffer()
+
+	// 先发送旧编码参数的帧
+	if track.exist {
+		t.writeSample(track, track.sampleDuration(track.pending.dts))
+	}
+
+	if !t.MWBuffer.IsNewSegment() {
+		if segment := t.MWBuffer.FlushSegment(); len(segment) > 0 {
+			t.AppendOutStreamBuffer(segment)
+		}
+	}
+
+	t.header = t.muxer.writeInitSegment()
+	t.AppendOutStreamBuffer(t.header)
+	return t.OutBuffer[:t.OutBufferSize], 0, nil
+}
+
+func (t *TransStream) ReadExtraData(_ int64) ([][]byte, int64, error) {
+	utils.Assert(len(t.header) > 0)
+	return [][]byte{t.header}, 0, nil
+}
+
+func (t *TransStream) ReadKeyFrameBuffer() ([][]byte, int64, error) {
+	t.ClearOutStreamBuffer()
+
+	// 发送当前内存池已有的合并写切片
+	t.MWBuffer.ReadSegmentsFromKeyFrameIndex(func(bytes []byte) {
+		t.AppendOutStreamBuffer(bytes)
+	})
+
+	return t.OutBuffer[:t.OutBufferSize], 0, nil
+}
+
+func (t *TransStream) Close() ([][]byte, int64, error) {
+	t.ClearOutStreamBuffer()
+
+	// 未写过头的TransStream没有创建合并写缓冲区
+	if t.MWBuffer == nil {
+		return nil, 0, nil
+	}
+
+	// 发送缓存的帧和剩余的流
+	for _, track := range t.muxer.tracks {
+		if track.exist {
+			t.writeSample(track, track.sampleDuration(track.pending.dts))
+		}
+	}
+
+	if segment := t.MWBuffer.FlushSegment(); len(segment) > 0 {
+		t.AppendOutStreamBuffer(segment)
+	}
+
+	return t.OutBuffer[:t.OutBufferSize], 0, nil
+}
+
+func NewTransStream() stream.TransStream {
+	return &TransStream{
+		tracks: make(map[int]*track, 4),
+	}
+}
+
+func TransStreamFactory(source stream.Source, protocol stream.TransStreamProtocol, streams []utils.AVStream) (stream.TransStream, error) {
+	return NewTransStream(), nil
+}
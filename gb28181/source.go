@@ -122,15 +122,6 @@ func (source *BaseGBSource) OnCompletePacket(index int, mediaType utils.AVMediaT
 		}
 	}()
 
-	if source.IsCompleted() && source.NotTrackAdded(index) {
-		if !source.IsTimeoutTrack(index) {
-			source.SetTimeoutTrack(index)
-			log.Sugar.Errorf("添加track超时 source:%s", source.GetID())
-		}
-
-		return nil
-	}
-
 	if utils.AVMediaTypeAudio == mediaType {
 		stream_, packet, err = stream.ExtractAudioPacket(codec, source.audioStream == nil, data, pts, dts, index, 90000)
 		if err != nil {
@@ -146,7 +137,7 @@ func (source *BaseGBSource) OnCompletePacket(index int, mediaType utils.AVMediaT
 			return nil
 		}
 
-		stream_, packet, err = stream.ExtractVideoPacket(codec, key, source.videoStream == nil, data, pts, dts, index, 90000)
+		stream_, packet, err = stream.ExtractVideoPacket(codec, key, source.videoStream, data, pts, dts, index, 90000)
 		if err != nil {
 			return err
 		}
@@ -157,7 +148,7 @@ func (source *BaseGBSource) OnCompletePacket(index int, mediaType utils.AVMediaT
 
 	if stream_ != nil {
 		source.OnDeMuxStream(stream_)
-		if len(source.OriginStreams()) >= source.deMuxerCtx.TrackCount() {
+		if !source.IsCompleted() && len(source.OriginStreams()) >= source.deMuxerCtx.TrackCount() {
 			source.OnDeMuxStreamDone()
 		}
 	}
@@ -0,0 +1,245 @@
+package hls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// KeySize AES-128密钥长度
+	KeySize = 16
+
+	// 每个推流源最多保留的密钥个数, 超过后删除最旧的密钥. 需大于m3u8列表中引用的密钥个数.
+	maxKeysPerSource = 64
+)
+
+// Key 切片加密密钥
+type Key struct {
+	ID   string // 密钥ID, 用于生成密钥url, 只能包含url安全字符
+	Data []byte // 16字节AES-128密钥
+}
+
+// KeyProvider 密钥提供者, 可以对接KMS, 也可以从本地文件读取
+type KeyProvider interface {
+	// NewKey 开始加密或轮换密钥时调用, 为推流源生成新的密钥
+	NewKey(sourceId string) (*Key, error)
+
+	// FindKey 播放端请求密钥时调用, 根据密钥ID查找密钥
+	FindKey(sourceId string, id string) (*Key, error)
+
+	// Release HLS输出流关闭后调用, 释放推流源的所有密钥
+	Release(sourceId string)
+}
+
+// KeyStore 全局密钥提供者, 开启加密时必须设置
+var KeyStore KeyProvider
+
+// 按推流源缓存已生成的密钥
+type keyCache struct {
+	m sync.Map
+}
+
+func (k *keyCache) add(sourceId string, key *Key) {
+	value, _ := k.m.LoadOrStore(sourceId, &sourceKeys{})
+	keys := value.(*sourceKeys)
+
+	keys.lock.Lock()
+	defer keys.lock.Unlock()
+
+	for _, old := range keys.keys {
+		if old.ID == key.ID {
+			return
+		}
+	}
+
+	if len(keys.keys) >= maxKeysPerSource {
+		keys.keys = keys.keys[1:]
+	}
+
+	keys.keys = append(keys.keys, key)
+}
+
+func (k *keyCache) find(sourceId string, id string) *Key {
+	value, ok := k.m.Load(sourceId)
+	if !ok {
+		return nil
+	}
+
+	keys := value.(*sourceKeys)
+	keys.lock.Lock()
+	defer keys.lock.Unlock()
+
+	for _, key := range keys.keys {
+		if key.ID == id {
+			return key
+		}
+	}
+
+	return nil
+}
+
+func (k *keyCache) remove(sourceId string) {
+	k.m.Delete(sourceId)
+}
+
+type sourceKeys struct {
+	lock sync.Mutex
+	keys []*Key
+}
+
+// 随机生成密钥, 只保存在内存中
+type memoryKeyProvider struct {
+	cache keyCache
+}
+
+func (m *memoryKeyProvider) NewKey(sourceId string) (*Key, error) {
+	data := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: hex.EncodeToString(id), Data: data}
+	m.cache.add(sourceId, key)
+	return key, nil
+}
+
+func (m *memoryKeyProvider) FindKey(sourceId string, id string) (*Key, error) {
+	if key := m.cache.find(sourceId, id); key != nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("key %s of source %s not found", id, sourceId)
+}
+
+func (m *memoryKeyProvider) Release(sourceId string) {
+	m.cache.remove(sourceId)
+}
+
+// 从本地文件读取密钥, 文件内容为16字节二进制密钥或32位16进制字符串.
+// 每次轮换都重新读取文件, 外部程序更新文件内容即可更换密钥.
+type fileKeyProvider struct {
+	path  string
+	cache keyCache
+}
+
+func (f *fileKeyProvider) NewKey(sourceId string) (*Key, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) != KeySize {
+		data, err = hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, err
+		} else if len(data) != KeySize {
+			return nil, fmt.Errorf("invalid key size %d in file %s", len(data), f.path)
+		}
+	}
+
+	// 根据密钥内容生成ID, 文件未更新时ID不变
+	sum := sha256.Sum256(data)
+	key := &Key{ID: hex.EncodeToString(sum[:8]), Data: data}
+	f.cache.add(sourceId, key)
+	return key, nil
+}
+
+func (f *fileKeyProvider) FindKey(sourceId string, id string) (*Key, error) {
+	if key := f.cache.find(sourceId, id); key != nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("key %s of source %s not found", id, sourceId)
+}
+
+func (f *fileKeyProvider) Release(sourceId string) {
+	f.cache.remove(sourceId)
+}
+
+func NewMemoryKeyProvider() KeyProvider {
+	return &memoryKeyProvider{}
+}
+
+func NewFileKeyProvider(path string) KeyProvider {
+	return &fileKeyProvider{path: path}
+}
+
+// 使用AES-128-CBC加密ts切片, 末尾使用PKCS7填充
+type segmentCipher struct {
+	mode   cipher.BlockMode
+	remain []byte // 不足一个分组的数据, 等待下次写入或结束时填充
+}
+
+// IV未在EXT-X-KEY中声明时, 播放器使用切片的媒体序号(EXT-X-MEDIA-SEQUENCE加上切片在列表中的位置)作为IV
+func newSegmentCipher(key []byte, sequence int) (*segmentCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	return &segmentCipher{mode: cipher.NewCBCEncrypter(block, iv), remain: make([]byte, 0, aes.BlockSize)}, nil
+}
+
+// Write 加密数据并写入w, 会修改data的内容
+func (c *segmentCipher) Write(w io.Writer, data []byte) error {
+	// 先补齐上次剩余的分组
+	if len(c.remain) > 0 {
+		n := aes.BlockSize - len(c.remain)
+		if n > len(data) {
+			n = len(data)
+		}
+
+		c.remain = append(c.remain, data[:n]...)
+		data = data[n:]
+
+		if len(c.remain) < aes.BlockSize {
+			return nil
+		}
+
+		c.mode.CryptBlocks(c.remain, c.remain)
+		if _, err := w.Write(c.remain); err != nil {
+			return err
+		}
+
+		c.remain = c.remain[:0]
+	}
+
+	size := len(data) - len(data)%aes.BlockSize
+	c.remain = append(c.remain, data[size:]...)
+	if size == 0 {
+		return nil
+	}
+
+	c.mode.CryptBlocks(data[:size], data[:size])
+	_, err := w.Write(data[:size])
+	return err
+}
+
+// Final 填充并写入最后一个分组
+func (c *segmentCipher) Final(w io.Writer) error {
+	padding := aes.BlockSize - len(c.remain)
+	for i := 0; i < padding; i++ {
+		c.remain = append(c.remain, byte(padding))
+	}
+
+	c.mode.CryptBlocks(c.remain, c.remain)
+	_, err := w.Write(c.remain)
+	c.remain = c.remain[:0]
+	return err
+}
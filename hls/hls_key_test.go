@@ -0,0 +1,145 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 按照播放器的方式解密: IV为媒体序号, 去掉PKCS7填充
+func decryptSegment(t *testing.T, key []byte, sequence int, data []byte) []byte {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		t.Fatalf("invalid encrypted size %d", len(data))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	padding := int(plain[len(plain)-1])
+	if padding < 1 || padding > aes.BlockSize {
+		t.Fatalf("invalid padding %d", padding)
+	}
+
+	return plain[:len(plain)-padding]
+}
+
+func TestSegmentCipher(t *testing.T) {
+	key := bytes.Repeat([]byte{0x2B}, KeySize)
+	tests := []struct {
+		name     string
+		sequence int
+		writes   []int // 每次写入的数据长度
+	}{
+		{"empty", 0, nil},
+		{"one ts packet", 1, []int{188}},
+		{"block aligned", 2, []int{32, 16}},
+		{"less than one block", 3, []int{5, 7}},
+		{"unaligned writes", 4, []int{188, 188, 3, 1024 * 1024}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := newSegmentCipher(key, test.sequence)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var plain []byte
+			output := bytes.Buffer{}
+			for i, size := range test.writes {
+				data := bytes.Repeat([]byte{byte(i + 1)}, size)
+				plain = append(plain, data...)
+				// Write会修改数据, 传入副本
+				if err = c.Write(&output, append([]byte(nil), data...)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err = c.Final(&output); err != nil {
+				t.Fatal(err)
+			}
+
+			if decrypted := decryptSegment(t, key, test.sequence, output.Bytes()); !bytes.Equal(plain, decrypted) {
+				t.Fatalf("decrypted %d bytes, expected %d bytes", len(decrypted), len(plain))
+			}
+		})
+	}
+}
+
+func TestKeyCache(t *testing.T) {
+	cache := keyCache{}
+	for i := 0; i < maxKeysPerSource+1; i++ {
+		cache.add("live/test", &Key{ID: hex.EncodeToString([]byte{byte(i)})})
+	}
+
+	tests := []struct {
+		source string
+		id     string
+		exist  bool
+	}{
+		{"live/test", "00", false}, // 超过个数后删除最旧的密钥
+		{"live/test", "01", true},
+		{"live/test", hex.EncodeToString([]byte{maxKeysPerSource}), true},
+		{"live/other", "01", false},
+	}
+
+	for _, test := range tests {
+		if key := cache.find(test.source, test.id); (key != nil) != test.exist {
+			t.Fatalf("find key %s of source %s: %v", test.id, test.source, key)
+		}
+	}
+
+	cache.remove("live/test")
+	if cache.find("live/test", "01") != nil {
+		t.Fatal("the keys have been removed")
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	key := bytes.Repeat([]byte{0xA5}, KeySize)
+	tests := []struct {
+		name    string
+		content []byte
+		success bool
+	}{
+		{"binary", key, true},
+		{"hex", []byte(hex.EncodeToString(key) + "\n"), true},
+		{"short", key[:8], false},
+		{"invalid hex", []byte("not a key"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hls.key")
+			if err := os.WriteFile(path, test.content, 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			provider := NewFileKeyProvider(path)
+			newKey, err := provider.NewKey("live/test")
+			if (err == nil) != test.success {
+				t.Fatalf("new key err: %v", err)
+			} else if err != nil {
+				return
+			}
+
+			if !bytes.Equal(key, newKey.Data) {
+				t.Fatalf("key %x, expected %x", newKey.Data, key)
+			} else if found, err := provider.FindKey("live/test", newKey.ID); err != nil || found != newKey {
+				t.Fatalf("find key err: %v", err)
+			}
+		})
+	}
+}
@@ -19,6 +19,7 @@ type M3U8Sink struct {
 	playtime         time.Time
 	playTimer        *time.Timer
 	m3u8StringFormat *string
+	notFound         chan struct{} // 等待推流超时关闭, 通知http请求应答404
 }
 
 // SendM3U8Data 首次向拉流端应答M3U8文件， 后续更新M3U8文件, 通过调用@see GetM3U8String 函数获取最新的M3U8文件.
@@ -75,6 +76,16 @@ func (s *M3U8Sink) RefreshPlayTime() {
 	s.playtime = time.Now()
 }
 
+// StreamNotFound 等待推流超时, 通知http请求应答404并关闭sink
+func (s *M3U8Sink) StreamNotFound() {
+	close(s.notFound)
+}
+
+// NotFound 等待推流超时时关闭的管道
+func (s *M3U8Sink) NotFound() <-chan struct{} {
+	return s.notFound
+}
+
 func (s *M3U8Sink) Close() {
 	if s.playTimer != nil {
 		s.playTimer.Stop()
@@ -90,5 +101,6 @@ func NewM3U8Sink(id stream.SinkID, sourceId string, cb func(m3u8 []byte), sessio
 		BaseSink:  stream.BaseSink{ID: id, SourceID: sourceId, Protocol: stream.TransStreamHls, TCPStreaming: true},
 		cb:        cb,
 		sessionId: sessionId,
+		notFound:  make(chan struct{}),
 	}
 }
@@ -9,16 +9,23 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 type tsContext struct {
-	segmentSeq      int    // 切片序号
+	segmentSeq      int    // 切片文件序号, 文件名冲突时会跳过
+	mediaSequence   int    // 切片在m3u8列表中的媒体序号, 每个切片连续递增. 未声明IV时, 播放器使用媒体序号作为解密IV
 	writeBuffer     []byte // ts流的缓冲区, 由TSMuxer使用. 减少用户态和内核态交互，以及磁盘IO频率
 	writeBufferSize int    // 已缓存TS流大小
 
 	url  string   // @See TransStream.tsUrl
 	path string   // ts切片位于磁盘中的绝对路径
 	file *os.File // ts切片文件句柄
+
+	cipher *segmentCipher // 切片加密器, 未开启加密为nil
+	keyUrl string         // m3u8列表中密钥的url
+
+	discontinuity bool // 编码参数发生变化后的第一个切片, m3u8中声明EXT-X-DISCONTINUITY
 }
 
 type TransStream struct {
@@ -37,11 +44,20 @@ type TransStream struct {
 
 	m3u8Sinks        map[stream.SinkID]*M3U8Sink // 等待响应m3u8文件的sink队列
 	m3u8StringFormat string                      // 一个协程写, 多个协程读, 不用加锁保护
+
+	trackIndexes map[int]int // AVPacket索引对应的TSMuxer track索引, 纯音频切片只封装部分track
+
+	sourceId    string      // 加密使用, 密钥所属的推流源ID
+	keyProvider KeyProvider // 不为nil开启AES-128加密
+	keyRotation int         // 每隔多少个切片更换密钥, 0表示不更换
+	key         *Key        // 当前切片使用的密钥
+	keySegments int         // 当前密钥已加密的切片个数
 }
 
 func (t *TransStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error) {
-	if packet.Index() >= t.muxer.TrackCount() {
-		return nil, -1, false, fmt.Errorf("track not available")
+	index, ok := t.trackIndexes[packet.Index()]
+	if !ok {
+		return nil, -1, false, nil
 	}
 
 	// 创建一下个切片
@@ -64,9 +80,9 @@ func (t *TransStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error
 	pts := packet.ConvertPts(90000)
 	dts := packet.ConvertDts(90000)
 	if utils.AVMediaTypeVideo == packet.MediaType() {
-		t.muxer.Input(packet.Index(), packet.AnnexBPacketData(t.BaseTransStream.Tracks[packet.Index()]), pts, dts, packet.KeyFrame())
+		t.muxer.Input(index, packet.AnnexBPacketData(t.BaseTransStream.Tracks[index]), pts, dts, packet.KeyFrame())
 	} else {
-		t.muxer.Input(packet.Index(), packet.Data(), pts, dts, packet.KeyFrame())
+		t.muxer.Input(index, packet.Data(), pts, dts, packet.KeyFrame())
 	}
 
 	return nil, -1, true, nil
@@ -77,12 +93,17 @@ func (t *TransStream) AddTrack(stream utils.AVStream) error {
 		return err
 	}
 
+	var index int
 	var err error
 	if utils.AVMediaTypeVideo == stream.Type() {
 		data := stream.CodecParameters().AnnexBExtraData()
-		_, err = t.muxer.AddTrack(stream.Type(), stream.CodecId(), data)
+		index, err = t.muxer.AddTrack(stream.Type(), stream.CodecId(), data)
 	} else {
-		_, err = t.muxer.AddTrack(stream.Type(), stream.CodecId(), stream.Extra())
+		index, err = t.muxer.AddTrack(stream.Type(), stream.CodecId(), stream.Extra())
+	}
+
+	if err == nil {
+		t.trackIndexes[stream.Index()] = index
 	}
 	return err
 }
@@ -91,6 +112,40 @@ func (t *TransStream) WriteHeader() error {
 	return t.createSegment()
 }
 
+// UpdateTrack 编码参数发生变化, 结束当前切片, 新的切片在m3u8中声明不连续, 播放器重新初始化解码器
+func (t *TransStream) UpdateTrack(stream utils.AVStream) ([][]byte, int64, error) {
+	if _, _, err := t.BaseTransStream.UpdateTrack(stream); err != nil {
+		return nil, -1, err
+	}
+
+	return nil, -1, t.restartSegment()
+}
+
+// AppendTrack 添加超时后到达的track, 结束当前切片, 新的切片包含新track并在m3u8中声明不连续
+func (t *TransStream) AppendTrack(stream utils.AVStream) ([][]byte, int64, error) {
+	if err := t.AddTrack(stream); err != nil {
+		return nil, -1, err
+	}
+
+	return nil, -1, t.restartSegment()
+}
+
+// 结束当前切片, 创建新的不连续切片, PAT/PMT使用最新的track
+func (t *TransStream) restartSegment() error {
+	if t.context.file != nil {
+		if err := t.flushSegment(false); err != nil {
+			return err
+		}
+	}
+
+	if err := t.createSegment(); err != nil {
+		return err
+	}
+
+	t.context.discontinuity = true
+	return nil
+}
+
 func (t *TransStream) onTSWrite(data []byte) {
 	t.context.writeBufferSize += len(data)
 }
@@ -98,7 +153,7 @@ func (t *TransStream) onTSWrite(data []byte) {
 func (t *TransStream) onTSAlloc(size int) []byte {
 	n := len(t.context.writeBuffer) - t.context.writeBufferSize
 	if n < size {
-		_, _ = t.context.file.Write(t.context.writeBuffer[:t.context.writeBufferSize])
+		_ = t.writeSegment(t.context.writeBuffer[:t.context.writeBufferSize])
 		t.context.writeBufferSize = 0
 	}
 
@@ -112,10 +167,16 @@ func (t *TransStream) flushSegment(end bool) error {
 
 	// 将剩余数据写入缓冲区
 	if t.context.writeBufferSize > 0 {
-		_, _ = t.context.file.Write(t.context.writeBuffer[:t.context.writeBufferSize])
+		_ = t.writeSegment(t.context.writeBuffer[:t.context.writeBufferSize])
 		t.context.writeBufferSize = 0
 	}
 
+	// 写入最后一个加密分组
+	if t.context.cipher != nil {
+		_ = t.context.cipher.Final(t.context.file)
+		t.context.cipher = nil
+	}
+
 	if err := t.context.file.Close(); err != nil {
 		return err
 	}
@@ -128,7 +189,8 @@ func (t *TransStream) flushSegment(end bool) error {
 	// 更新m3u8
 	duration := float32(t.muxer.Duration()) / 90000
 
-	t.m3u8.AddSegment(duration, t.context.url, t.context.segmentSeq, t.context.path)
+	t.m3u8.AddSegment(duration, t.context.url, t.context.mediaSequence, t.context.path, t.context.keyUrl, t.context.discontinuity)
+	t.context.mediaSequence++
 	m3u8Txt := t.m3u8.ToString()
 	if end {
 		m3u8Txt += "#EXT-X-ENDLIST"
@@ -158,6 +220,7 @@ func (t *TransStream) flushSegment(end bool) error {
 // 创建一个新的ts切片
 func (t *TransStream) createSegment() error {
 	t.muxer.Reset()
+	t.context.discontinuity = false
 
 	var tsFile *os.File
 	for {
@@ -183,10 +246,61 @@ func (t *TransStream) createSegment() error {
 	}
 
 	t.context.file = tsFile
+	if t.keyProvider != nil {
+		if err := t.createCipher(); err != nil {
+			log.Sugar.Errorf("创建切片加密器失败 err:%s source:%s", err.Error(), t.sourceId)
+			return err
+		}
+	}
+
 	_ = t.muxer.WriteHeader()
 	return nil
 }
 
+// 为当前切片创建加密器, 达到轮换间隔时向密钥提供者申请新的密钥
+func (t *TransStream) createCipher() error {
+	if t.key == nil || (t.keyRotation > 0 && t.keySegments >= t.keyRotation) {
+		key, err := t.keyProvider.NewKey(t.sourceId)
+		if err != nil {
+			return err
+		}
+
+		t.key = key
+		t.keySegments = 0
+	}
+
+	// 使用切片写入m3u8列表时的媒体序号作为IV
+	cipher, err := newSegmentCipher(t.key.Data, t.context.mediaSequence)
+	if err != nil {
+		return err
+	}
+
+	t.keySegments++
+	t.context.cipher = cipher
+	// 和ts切片位于同一目录, 例如: xxx_keyid.key
+	t.context.keyUrl = fmt.Sprintf("%s%s_%s.key", t.tsUrl, strings.TrimSuffix(t.m3u8Name, ".m3u8"), t.key.ID)
+	return nil
+}
+
+func (t *TransStream) writeSegment(data []byte) error {
+	if t.context.cipher != nil {
+		return t.context.cipher.Write(t.context.file, data)
+	}
+
+	_, err := t.context.file.Write(data)
+	return err
+}
+
+// EnableEncryption 开启AES-128加密切片
+// @Params sourceId 密钥所属的推流源ID, 播放端请求密钥时使用
+// @Params provider 密钥提供者
+// @Params rotation 每隔多少个切片更换密钥, 0表示不更换
+func (t *TransStream) EnableEncryption(sourceId string, provider KeyProvider, rotation int) {
+	t.sourceId = sourceId
+	t.keyProvider = provider
+	t.keyRotation = rotation
+}
+
 func (t *TransStream) Close() ([][]byte, int64, error) {
 	var err error
 
@@ -213,6 +327,10 @@ func (t *TransStream) Close() ([][]byte, int64, error) {
 
 	t.m3u8Sinks = nil
 
+	if t.keyProvider != nil {
+		t.keyProvider.Release(t.sourceId)
+	}
+
 	return nil, 0, err
 }
 
@@ -280,14 +398,47 @@ func NewTransStream(dir, m3u8Name, tsFormat, tsUrl string, segmentDuration, play
 	transStream.m3u8File = file
 
 	transStream.m3u8Sinks = make(map[stream.SinkID]*M3U8Sink, 24)
+	transStream.trackIndexes = make(map[int]int, 4)
 	return transStream, nil
 }
 
+// 推流源存在视频, 输出流只有音频, 则是纯音频rendition
+func isAudioRendition(source stream.Source, streams []utils.AVStream) bool {
+	for _, avStream := range streams {
+		if utils.AVMediaTypeVideo == avStream.Type() {
+			return false
+		}
+	}
+
+	for _, avStream := range source.OriginStreams() {
+		if utils.AVMediaTypeVideo == avStream.Type() {
+			return true
+		}
+	}
+
+	return false
+}
+
 func TransStreamFactory(source stream.Source, protocol stream.TransStreamProtocol, streams []utils.AVStream) (stream.TransStream, error) {
 	id := source.GetID()
+	// 纯音频切片使用单独的m3u8和ts文件名
+	if isAudioRendition(source, streams) {
+		id += AudioRenditionSuffix
+	}
+
 	// 先删除旧的m3u8文件
 	_ = os.Remove(stream.AppConfig.Hls.M3U8Path(id))
 	// 删除旧的切片文件
 	go DeleteOldSegments(id)
-	return NewTransStream(stream.AppConfig.Hls.M3U8Dir(id), stream.AppConfig.Hls.M3U8Format(id), stream.AppConfig.Hls.TSFormat(id), "", stream.AppConfig.Hls.Duration, stream.AppConfig.Hls.PlaylistLength)
+	transStream, err := NewTransStream(stream.AppConfig.Hls.M3U8Dir(id), stream.AppConfig.Hls.M3U8Format(id), stream.AppConfig.Hls.TSFormat(id), "", stream.AppConfig.Hls.Duration, stream.AppConfig.Hls.PlaylistLength)
+	if err != nil {
+		return nil, err
+	}
+
+	if stream.AppConfig.Hls.Encryption.Enable {
+		utils.Assert(KeyStore != nil)
+		transStream.(*TransStream).EnableEncryption(id, KeyStore, stream.AppConfig.Hls.Encryption.KeyRotation)
+	}
+
+	return transStream, nil
 }
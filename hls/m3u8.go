@@ -45,7 +45,9 @@ type M3U8Writer interface {
 	//@Params  url m3u8列表中切片的url
 	//@Params  sequence m3u8列表中的切片序号
 	//@Params  path 切片位于磁盘中的绝对路径
-	AddSegment(duration float32, url string, sequence int, path string)
+	//@Params  keyUrl 切片加密密钥的url, 为空表示未加密
+	//@Params  discontinuity 切片与前一个切片不连续, 例如编码参数发生变化
+	AddSegment(duration float32, url string, sequence int, path string, keyUrl string, discontinuity bool)
 
 	ToString() string
 
@@ -64,23 +66,28 @@ func NewM3U8Writer(len int) M3U8Writer {
 }
 
 type Segment struct {
-	duration float32
-	url      string
-	sequence int
-	path     string
+	duration      float32
+	url           string
+	sequence      int
+	path          string
+	keyUrl        string
+	discontinuity bool
 }
 
 type m3u8Writer struct {
-	stringBuffer *bytes.Buffer
-	playlist     *collections.Queue
+	stringBuffer          *bytes.Buffer
+	playlist              *collections.Queue
+	discontinuitySequence int // 已经移出列表的EXT-X-DISCONTINUITY个数
 }
 
-func (m *m3u8Writer) AddSegment(duration float32 /*title string,*/, url string, sequence int, path string) {
+func (m *m3u8Writer) AddSegment(duration float32 /*title string,*/, url string, sequence int, path string, keyUrl string, discontinuity bool) {
 	if m.playlist.IsFull() {
-		m.playlist.Pop()
+		if m.playlist.Pop().(Segment).discontinuity {
+			m.discontinuitySequence++
+		}
 	}
 
-	m.playlist.Push(Segment{duration: duration, url: url, sequence: sequence, path: path})
+	m.playlist.Push(Segment{duration: duration, url: url, sequence: sequence, path: path, keyUrl: keyUrl, discontinuity: discontinuity})
 }
 
 func (m *m3u8Writer) targetDuration() int {
@@ -125,9 +132,30 @@ func (m *m3u8Writer) ToString() string {
 	m.stringBuffer.WriteString("#EXT-X-MEDIA-SEQUENCE:")
 	m.stringBuffer.WriteString(strconv.Itoa(head[0].(Segment).sequence))
 	m.stringBuffer.WriteString("\r\n")
+	if m.discontinuitySequence > 0 {
+		m.stringBuffer.WriteString("#EXT-X-DISCONTINUITY-SEQUENCE:")
+		m.stringBuffer.WriteString(strconv.Itoa(m.discontinuitySequence))
+		m.stringBuffer.WriteString("\r\n")
+	}
 
+	// 密钥变化时, 才声明新的EXT-X-KEY. 未声明IV, 播放器使用切片的媒体序号作为IV, 所以列表中的切片序号必须连续.
+	var keyUrl string
 	appendSegments := func(playlist []interface{}) {
 		for _, segment := range playlist {
+			if url := segment.(Segment).keyUrl; url != keyUrl {
+				if url == "" {
+					m.stringBuffer.WriteString("#EXT-X-KEY:METHOD=NONE\r\n")
+				} else {
+					m.stringBuffer.WriteString("#EXT-X-KEY:METHOD=AES-128,URI=\"" + url + "%s\"\r\n")
+				}
+
+				keyUrl = url
+			}
+
+			if segment.(Segment).discontinuity {
+				m.stringBuffer.WriteString("#EXT-X-DISCONTINUITY\r\n")
+			}
+
 			m.stringBuffer.WriteString("#EXTINF:")
 			m.stringBuffer.WriteString(strconv.FormatFloat(float64(segment.(Segment).duration), 'f', -1, 32))
 			m.stringBuffer.WriteString(",\r\n")
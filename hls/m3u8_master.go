@@ -0,0 +1,269 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/stream"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// AudioRenditionSuffix 纯音频切片的m3u8和ts文件名后缀
+	AudioRenditionSuffix = "_audio"
+
+	// DefaultBandwidth 还未统计到码率时, 使用的默认带宽
+	DefaultBandwidth = 2 * 1024 * 1024
+)
+
+// Variant 主播放列表中的一路流
+type Variant struct {
+	Bandwidth        int
+	AverageBandwidth int
+	Codecs           []string
+	Width            int
+	Height           int
+	Uri              string
+	Audio            string // 引用的音频rendition组ID
+}
+
+// AudioRendition 主播放列表中的音频rendition, 通过EXT-X-MEDIA声明, 视频variant通过AUDIO属性引用
+type AudioRendition struct {
+	GroupID string
+	Name    string
+	Uri     string
+}
+
+// NewVariant 根据推流源的AVStream和码率统计生成Variant, 推流源不存在或还未解析完track时, 只使用默认带宽
+func NewVariant(source stream.Source, uri string) Variant {
+	variant := Variant{Bandwidth: DefaultBandwidth, Uri: uri}
+	if source == nil || !source.IsCompleted() {
+		return variant
+	}
+
+	// 统计的是推流码率, 额外加上TS封装开销
+	if statistics := source.GetBitrateStatistics(); statistics != nil && statistics.Peak() > 0 {
+		variant.Bandwidth = statistics.Peak() * 8 * 110 / 100
+		variant.AverageBandwidth = statistics.Average() * 8 * 110 / 100
+	}
+
+	var unknownCodec bool
+	for _, avStream := range source.OriginStreams() {
+		// 存在多路视频时, 使用第一路视频的分辨率
+		if utils.AVMediaTypeVideo == avStream.Type() && variant.Width == 0 && variant.Height == 0 {
+			variant.Width = avStream.CodecParameters().Width()
+			variant.Height = avStream.CodecParameters().Height()
+		}
+
+		// 多路track可能使用相同的编码器, CODECS不重复声明
+		if codec := CodecString(avStream); codec != "" {
+			exist := false
+			for _, c := range variant.Codecs {
+				exist = exist || c == codec
+			}
+
+			if !exist {
+				variant.Codecs = append(variant.Codecs, codec)
+			}
+		} else {
+			unknownCodec = true
+		}
+	}
+
+	// 存在不认识的编码器, 不声明CODECS, 交给播放器自己探测
+	if unknownCodec {
+		variant.Codecs = nil
+	}
+
+	return variant
+}
+
+// CodecString 返回RFC6381规定的编码器字符串, 用于EXT-X-STREAM-INF的CODECS属性
+func CodecString(avStream utils.AVStream) string {
+	switch avStream.CodecId() {
+	case utils.AVCodecIdH264:
+		sps := avStream.CodecParameters().SPS()
+		if len(sps) < 1 || len(sps[0]) < 4 {
+			return ""
+		}
+
+		// avc1.PPCCLL profile_idc constraint_flags level_idc
+		return fmt.Sprintf("avc1.%02X%02X%02X", sps[0][1], sps[0][2], sps[0][3])
+	case utils.AVCodecIdH265:
+		sps := avStream.CodecParameters().SPS()
+		if len(sps) < 1 {
+			return ""
+		}
+
+		return hevcCodecString(sps[0])
+	case utils.AVCodecIdAAC:
+		extra := avStream.Extra()
+		if len(extra) < 1 {
+			return "mp4a.40.2"
+		}
+
+		// AudioSpecificConfig前5位是audioObjectType
+		return fmt.Sprintf("mp4a.40.%d", extra[0]>>3)
+	case utils.AVCodecIdMP3:
+		return "mp4a.40.34"
+	case utils.AVCodecIdOPUS:
+		return "opus"
+	}
+
+	return ""
+}
+
+// 去除防竞争字节0x000003
+func removeEmulationPrevention(data []byte) []byte {
+	dst := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if i >= 2 && data[i] == 0x03 && data[i-1] == 0x00 && data[i-2] == 0x00 {
+			continue
+		}
+
+		dst = append(dst, data[i])
+	}
+
+	return dst
+}
+
+// hvc1.[profile_space]profile_idc.compatibility_flags.[L|H]level_idc.constraint_flags
+func hevcCodecString(sps []byte) string {
+	sps = removeEmulationPrevention(sps)
+	// nal header[2] + vps_id/max_sub_layers/temporal_id_nesting[1] + profile_tier_level[12]
+	if len(sps) < 15 {
+		return ""
+	}
+
+	ptl := sps[3:]
+	profileSpace := ptl[0] >> 6
+	tier := (ptl[0] >> 5) & 0x1
+	profileIdc := ptl[0] & 0x1F
+
+	// 兼容标志按位逆序
+	var compatibility uint32
+	flags := uint32(ptl[1])<<24 | uint32(ptl[2])<<16 | uint32(ptl[3])<<8 | uint32(ptl[4])
+	for i := 0; i < 32; i++ {
+		compatibility |= ((flags >> i) & 0x1) << (31 - i)
+	}
+
+	buffer := bytes.NewBufferString("hvc1.")
+	if profileSpace > 0 {
+		buffer.WriteByte('A' + profileSpace - 1)
+	}
+
+	buffer.WriteString(strconv.Itoa(int(profileIdc)))
+	buffer.WriteString(".")
+	buffer.WriteString(strconv.FormatUint(uint64(compatibility), 16))
+	if tier == 0 {
+		buffer.WriteString(".L")
+	} else {
+		buffer.WriteString(".H")
+	}
+
+	buffer.WriteString(strconv.Itoa(int(ptl[11])))
+
+	// 省略末尾为0的约束标志
+	constraints := ptl[5:11]
+	n := len(constraints)
+	for n > 0 && constraints[n-1] == 0 {
+		n--
+	}
+
+	for i := 0; i < n; i++ {
+		buffer.WriteString(fmt.Sprintf(".%X", constraints[i]))
+	}
+
+	return buffer.String()
+}
+
+// MasterPlaylist 生成多码率主播放列表
+func MasterPlaylist(variants []Variant, renditions []AudioRendition) string {
+	buffer := bytes.NewBuffer(make([]byte, 0, 1024))
+	buffer.WriteString("#EXTM3U\r\n")
+	buffer.WriteString("#EXT-X-VERSION:3\r\n")
+
+	for _, rendition := range renditions {
+		buffer.WriteString(fmt.Sprintf("#%s:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"%s\",DEFAULT=YES,AUTOSELECT=YES,URI=\"%s\"\r\n", ExtXMedia, rendition.GroupID, rendition.Name, rendition.Uri))
+	}
+
+	for _, variant := range variants {
+		buffer.WriteString("#" + ExtXStreamINF + ":BANDWIDTH=" + strconv.Itoa(variant.Bandwidth))
+		if variant.AverageBandwidth > 0 {
+			buffer.WriteString(",AVERAGE-BANDWIDTH=" + strconv.Itoa(variant.AverageBandwidth))
+		}
+
+		if len(variant.Codecs) > 0 {
+			buffer.WriteString(",CODECS=\"" + strings.Join(variant.Codecs, ",") + "\"")
+		}
+
+		if variant.Width > 0 && variant.Height > 0 {
+			buffer.WriteString(fmt.Sprintf(",RESOLUTION=%dx%d", variant.Width, variant.Height))
+		}
+
+		if variant.Audio != "" {
+			buffer.WriteString(",AUDIO=\"" + variant.Audio + "\"")
+		}
+
+		buffer.WriteString("\r\n")
+		buffer.WriteString(variant.Uri + "\r\n")
+	}
+
+	return buffer.String()
+}
+
+// VariantGroups 将多个推流源(例如摄像头主子码流)组合成一个主播放列表
+var VariantGroups = &variantGroups{}
+
+type variantGroups struct {
+	m sync.Map
+}
+
+func (v *variantGroups) Add(id string, sources []string) error {
+	if len(sources) < 1 {
+		return fmt.Errorf("the variant group %s must contain at least one source", id)
+	}
+
+	// 组ID作为主播放列表的拉流地址, 不能与推流源ID相同, 否则推流源的m3u8拉流地址会被组覆盖
+	for _, source := range sources {
+		if source == id {
+			return fmt.Errorf("the variant group %s cannot contain itself", id)
+		}
+	}
+
+	if stream.SourceManager.Find(id) != nil {
+		return fmt.Errorf("the variant group %s conflicts with an existing source", id)
+	}
+
+	_, ok := v.m.LoadOrStore(id, sources)
+	if ok {
+		return fmt.Errorf("the variant group %s has been exist", id)
+	}
+
+	return nil
+}
+
+func (v *variantGroups) Find(id string) []string {
+	value, ok := v.m.Load(id)
+	if ok {
+		return value.([]string)
+	}
+
+	return nil
+}
+
+func (v *variantGroups) Remove(id string) {
+	v.m.Delete(id)
+}
+
+func (v *variantGroups) All() map[string][]string {
+	all := make(map[string][]string)
+	v.m.Range(func(key, value any) bool {
+		all[key.(string)] = value.([]string)
+		return true
+	})
+
+	return all
+}
@@ -0,0 +1,124 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMasterPlaylist(t *testing.T) {
+	tests := []struct {
+		name       string
+		variants   []Variant
+		renditions []AudioRendition
+		expected   []string
+	}{
+		{
+			name:     "default bandwidth",
+			variants: []Variant{{Bandwidth: DefaultBandwidth, Uri: "/live.m3u8?hls_sid=a"}},
+			expected: []string{
+				"#EXTM3U",
+				"#EXT-X-VERSION:3",
+				"#EXT-X-STREAM-INF:BANDWIDTH=2097152",
+				"/live.m3u8?hls_sid=a",
+			},
+		},
+		{
+			name: "variants",
+			variants: []Variant{
+				{Bandwidth: 4400000, AverageBandwidth: 3300000, Codecs: []string{"avc1.64001F", "mp4a.40.2"}, Width: 1920, Height: 1080, Uri: "/main.m3u8?hls_sid=a"},
+				{Bandwidth: 880000, Codecs: []string{"avc1.42C01E"}, Width: 640, Height: 360, Uri: "/sub.m3u8?hls_sid=b"},
+			},
+			expected: []string{
+				"#EXTM3U",
+				"#EXT-X-VERSION:3",
+				"#EXT-X-STREAM-INF:BANDWIDTH=4400000,AVERAGE-BANDWIDTH=3300000,CODECS=\"avc1.64001F,mp4a.40.2\",RESOLUTION=1920x1080",
+				"/main.m3u8?hls_sid=a",
+				"#EXT-X-STREAM-INF:BANDWIDTH=880000,CODECS=\"avc1.42C01E\",RESOLUTION=640x360",
+				"/sub.m3u8?hls_sid=b",
+			},
+		},
+		{
+			name:       "audio rendition",
+			variants:   []Variant{{Bandwidth: 4400000, Codecs: []string{"avc1.64001F", "mp4a.40.2"}, Uri: "/live.m3u8?hls_sid=a", Audio: "audio0"}},
+			renditions: []AudioRendition{{GroupID: "audio0", Name: "live", Uri: "/live.m3u8?hls_sid=b&video=0"}},
+			expected: []string{
+				"#EXTM3U",
+				"#EXT-X-VERSION:3",
+				"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio0\",NAME=\"live\",DEFAULT=YES,AUTOSELECT=YES,URI=\"/live.m3u8?hls_sid=b&video=0\"",
+				"#EXT-X-STREAM-INF:BANDWIDTH=4400000,CODECS=\"avc1.64001F,mp4a.40.2\",AUDIO=\"audio0\"",
+				"/live.m3u8?hls_sid=a",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			playlist := MasterPlaylist(test.variants, test.renditions)
+			expected := strings.Join(test.expected, "\r\n") + "\r\n"
+			if playlist != expected {
+				t.Fatalf("playlist:\n%s\nexpected:\n%s", playlist, expected)
+			}
+		})
+	}
+}
+
+func TestHevcCodecString(t *testing.T) {
+	tests := []struct {
+		name     string
+		sps      []byte
+		expected string
+	}{
+		{
+			name:     "main profile",
+			sps:      []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5D},
+			expected: "hvc1.1.6.L93.90",
+		},
+		{
+			name:     "high tier main10",
+			sps:      []byte{0x42, 0x01, 0x01, 0x22, 0x20, 0x00, 0x00, 0x00, 0xB0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x99},
+			expected: "hvc1.2.4.H153.B0",
+		},
+		{
+			// 兼容标志中的0x000003是防竞争字节
+			name:     "emulation prevention",
+			sps:      []byte{0x42, 0x01, 0x01, 0x01, 0x00, 0x00, 0x03, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5D},
+			expected: "hvc1.1.0.L93.90",
+		},
+		{
+			name:     "truncated",
+			sps:      []byte{0x42, 0x01, 0x01, 0x01},
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if codec := hevcCodecString(test.sps); codec != test.expected {
+				t.Fatalf("codec %s, expected %s", codec, test.expected)
+			}
+		})
+	}
+}
+
+func TestVariantGroupsAdd(t *testing.T) {
+	groups := &variantGroups{}
+	tests := []struct {
+		name    string
+		id      string
+		sources []string
+		success bool
+	}{
+		{"empty sources", "live/group", nil, false},
+		{"contains itself", "live/group", []string{"live/main", "live/group"}, false},
+		{"ok", "live/group", []string{"live/main", "live/sub"}, true},
+		{"exist", "live/group", []string{"live/main"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := groups.Add(test.id, test.sources); (err == nil) != test.success {
+				t.Fatalf("add group err: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// httpStreamConn http-flv/http-ts拉流链路, 延迟发送应答头.
+// 等待推流期间不应答, 第一次发送流数据时应答200. 未发送过流数据就关闭链路(例如等待推流超时), 应答404
+type httpStreamConn struct {
+	net.Conn
+	header    http.Header
+	lock      sync.Mutex
+	responded bool
+}
+
+func (c *httpStreamConn) Write(b []byte) (int, error) {
+	if err := c.respond(http.StatusOK, c.header); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(b)
+}
+
+func (c *httpStreamConn) Close() error {
+	_ = c.respond(http.StatusNotFound, http.Header{"Content-Length": []string{"0"}, "Connection": []string{"close"}})
+	return c.Conn.Close()
+}
+
+// CloseWithStatus 应答指定状态码后关闭链路, 用于拉流失败
+func (c *httpStreamConn) CloseWithStatus(code int) {
+	_ = c.respond(code, http.Header{"Content-Length": []string{"0"}, "Connection": []string{"close"}})
+	_ = c.Conn.Close()
+}
+
+// 只应答一次
+func (c *httpStreamConn) respond(code int, header http.Header) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.responded {
+		return nil
+	}
+
+	c.responded = true
+	buffer := bytes.Buffer{}
+	_, _ = fmt.Fprintf(&buffer, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	_ = header.Write(&buffer)
+	buffer.WriteString("\r\n")
+
+	_, err := c.Conn.Write(buffer.Bytes())
+	return err
+}
+
+func newHttpStreamConn(conn net.Conn, header http.Header) *httpStreamConn {
+	header = header.Clone()
+	// identity不是合法的传输编码, 不发送该头, 以关闭连接结束正文
+	if "identity" == header.Get("Transfer-Encoding") {
+		header.Del("Transfer-Encoding")
+	}
+
+	return &httpStreamConn{Conn: conn, header: header}
+}
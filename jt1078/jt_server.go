@@ -24,7 +24,7 @@ func (s *jtServer) OnNewSession(conn net.Conn) *Session {
 }
 
 func (s *jtServer) OnCloseSession(session *Session) {
-	session.Close()
+	session.Disconnect()
 }
 
 func (s *jtServer) OnPacket(conn net.Conn, data []byte) []byte {
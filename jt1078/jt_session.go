@@ -113,14 +113,6 @@ func (s *Session) OnJtPTPPacket(data []byte) {
 				s.videoIndex = 1
 			}
 
-			if s.IsCompleted() {
-				if !s.IsTimeoutTrack(s.audioIndex) {
-					s.SetTimeoutTrack(s.audioIndex)
-					log.Sugar.Errorf("添加audiotrack超时")
-				}
-				return
-			}
-
 			s.audioBuffer = s.FindOrCreatePacketBuffer(s.audioIndex, utils.AVMediaTypeAudio)
 		}
 
@@ -132,14 +124,6 @@ func (s *Session) OnJtPTPPacket(data []byte) {
 				s.audioIndex = 1
 			}
 
-			if s.IsCompleted() {
-				if !s.IsTimeoutTrack(s.videoIndex) {
-					s.SetTimeoutTrack(s.videoIndex)
-					log.Sugar.Errorf("添加videotrack超时")
-				}
-				return
-			}
-
 			s.videoBuffer = s.FindOrCreatePacketBuffer(s.videoIndex, utils.AVMediaTypeVideo)
 		}
 
@@ -153,6 +137,18 @@ func (s *Session) Input(data []byte) error {
 }
 
 func (s *Session) Close() {
+	// 先关闭source, 防止关闭链路触发的Disconnect进入重连等待
+	s.PublishSource.Close()
+	s.release()
+}
+
+// Disconnect 推流链路断开, 开启了重连等待时保留输出流
+func (s *Session) Disconnect() {
+	s.release()
+	s.PublishSource.Disconnect()
+}
+
+func (s *Session) release() {
 	log.Sugar.Infof("1078推流结束 phone number:%s %s", s.phone, s.PublishSource.String())
 
 	if s.audioBuffer != nil {
@@ -172,8 +168,6 @@ func (s *Session) Close() {
 		s.decoder.Close()
 		s.decoder = nil
 	}
-
-	s.PublishSource.Close()
 }
 
 func (s *Session) processVideoPacket(pt byte, pktType byte, ts uint64, data []byte, index int) error {
@@ -195,7 +189,7 @@ func (s *Session) processVideoPacket(pt byte, pktType byte, ts uint64, data []by
 		return fmt.Errorf("the codec %d is not implemented", pt)
 	}
 
-	videoStream, videoPacket, err := stream.ExtractVideoPacket(codecId, VideoIFrameMark == pktType, s.videoStream == nil, data, int64(ts), int64(ts), index, 1000)
+	videoStream, videoPacket, err := stream.ExtractVideoPacket(codecId, VideoIFrameMark == pktType, s.videoStream, data, int64(ts), int64(ts), index, 1000)
 	if err != nil {
 		return err
 	}
@@ -203,7 +197,7 @@ func (s *Session) processVideoPacket(pt byte, pktType byte, ts uint64, data []by
 	if videoStream != nil {
 		s.videoStream = videoStream
 		s.OnDeMuxStream(videoStream)
-		if s.videoStream != nil && s.audioStream != nil {
+		if !s.IsCompleted() && s.videoStream != nil && s.audioStream != nil {
 			s.OnDeMuxStreamDone()
 		}
 	}
@@ -4,14 +4,18 @@ import (
 	"encoding/json"
 	"github.com/lkmio/avformat/transport"
 	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/failover"
 	"github.com/lkmio/lkm/flv"
+	"github.com/lkmio/lkm/fmp4"
 	"github.com/lkmio/lkm/gb28181"
 	"github.com/lkmio/lkm/hls"
 	"github.com/lkmio/lkm/jt1078"
 	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/mpegts"
 	"github.com/lkmio/lkm/record"
 	"github.com/lkmio/lkm/rtc"
 	"github.com/lkmio/lkm/rtsp"
+	"github.com/lkmio/lkm/transcode/ffmpeg"
 	"go.uber.org/zap/zapcore"
 	"net"
 	"net/http"
@@ -115,6 +119,8 @@ func init() {
 	stream.RegisterTransStreamFactory(stream.TransStreamRtsp, rtsp.TransStreamFactory)
 	stream.RegisterTransStreamFactory(stream.TransStreamRtc, rtc.TransStreamFactory)
 	stream.RegisterTransStreamFactory(stream.TransStreamGBStreamForward, gb28181.TransStreamFactory)
+	stream.RegisterTransStreamFactory(stream.TransStreamTs, mpegts.TransStreamFactory)
+	stream.RegisterTransStreamFactory(stream.TransStreamFmp4, fmp4.TransStreamFactory)
 	stream.SetRecordStreamFactory(record.NewFLVFileSink)
 
 	config, err := stream.LoadConfigFile("./config.json")
@@ -145,6 +151,15 @@ func init() {
 		stream.InitHookUrls()
 	}
 
+	if stream.AppConfig.Hls.Enable && stream.AppConfig.Hls.Encryption.Enable {
+		// 默认从本地文件读取或随机生成密钥, 对接KMS替换hls.KeyStore即可
+		if stream.AppConfig.Hls.Encryption.KeyFile != "" {
+			hls.KeyStore = hls.NewFileKeyProvider(stream.AppConfig.Hls.Encryption.KeyFile)
+		} else {
+			hls.KeyStore = hls.NewMemoryKeyProvider()
+		}
+	}
+
 	if stream.AppConfig.WebRtc.Enable {
 		// 设置公网IP和端口
 		rtc.InitConfig()
@@ -161,6 +176,14 @@ func init() {
 		rtsp.TransportManger = transport.NewTransportManager(uint16(stream.AppConfig.Rtsp.Port[1]), uint16(stream.AppConfig.Rtsp.Port[2]))
 	}
 
+	if stream.AppConfig.Rtsp.Enable && stream.AppConfig.Rtsp.Multicast.Enable {
+		multicast := stream.AppConfig.Rtsp.Multicast
+		rtsp.MulticastManager, err = rtsp.NewMulticastAllocator(multicast.Groups, multicast.Port, multicast.TTL)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	// 打印配置信息
 	indent, _ := json.MarshalIndent(stream.AppConfig, "", "\t")
 	log.Sugar.Infof("server config:\r\n%s", indent)
@@ -194,9 +217,44 @@ func main() {
 			panic(err)
 		}
 
+		// http服务同时处理RTSP over HTTP/WebSocket
+		apiServer.rtspServer = server
+
+		// 单端口模式下, 启动时就创建共享的rtp/rtcp端口
+		if stream.AppConfig.Rtsp.IsSinglePort() && stream.AppConfig.Rtsp.IsEnableUDP() {
+			rtsp.SharedUDPServer, err = rtsp.NewSharedServer(stream.AppConfig.Rtsp.Port[1])
+			if err != nil {
+				panic(err)
+			}
+
+			log.Sugar.Infof("启动rtsp udp单端口成功 rtp: %d rtcp: %d", rtsp.SharedUDPServer.RtpPort(), rtsp.SharedUDPServer.RtcpPort())
+		}
+
 		log.Sugar.Info("启动rtsp服务成功 addr:", rtspAddr.String())
 	}
 
+	if stream.AppConfig.WebRtc.Enable {
+		rtc.StartMessageForwarder()
+	}
+
+	// 按照规则为源流启动转码进程, 生成多码率派生流
+	if stream.AppConfig.Transcode.Enable {
+		if err := ffmpeg.Start(); err != nil {
+			panic(err)
+		}
+
+		log.Sugar.Info("启动转码成功 ladders:", len(stream.AppConfig.Transcode.Ladders))
+	}
+
+	// 按照规则创建虚拟源, 在主备源之间切换
+	if stream.AppConfig.Failover.Enable {
+		if err := failover.Start(); err != nil {
+			panic(err)
+		}
+
+		log.Sugar.Info("启动主备切换成功 rules:", len(stream.AppConfig.Failover.Rules))
+	}
+
 	log.Sugar.Info("启动http服务 addr:", stream.ListenAddr(stream.AppConfig.Http.Port))
 	go startApiServer(net.JoinHostPort(stream.AppConfig.ListenIP, strconv.Itoa(stream.AppConfig.Http.Port)))
 
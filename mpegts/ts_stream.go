@@ -0,0 +1,169 @@
+package mpegts
+
+import (
+	"github.com/lkmio/avformat/libmpeg"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/stream"
+)
+
+// TransStream 连续的ts直播流, 用于http-ts/ws-ts拉流.
+// 与HLS不同, 不切片落盘, 直接将TS包通过合并写缓冲区发送给sink.
+type TransStream struct {
+	stream.TCPTransStream
+
+	muxer      libmpeg.TSMuxer
+	header     []byte // PAT/PMT, 每个sink拉流时首先发送
+	headerSize int
+
+	trackIndexes map[int]int // AVPacket索引对应的TSMuxer track索引
+	dts          int64       // 当前封装包的dts, 单位毫秒. 用于合并写分配内存
+	videoKey     bool        // 当前封装包是否是视频关键帧, 只有首次分配内存时有效
+}
+
+func (t *TransStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error) {
+	t.ClearOutStreamBuffer()
+
+	index, ok := t.trackIndexes[packet.Index()]
+	if !ok {
+		return nil, -1, false, nil
+	}
+
+	t.dts = packet.ConvertDts(1000)
+	t.videoKey = utils.AVMediaTypeVideo == packet.MediaType() && packet.KeyFrame()
+
+	// 关键帧都放在切片头部, 所以遇到关键帧创建新切片, 发送当前切片剩余流
+	if t.videoKey && !t.MWBuffer.IsNewSegment() {
+		if segment := t.MWBuffer.FlushSegment(); len(segment) > 0 {
+			t.AppendOutStreamBuffer(segment)
+		}
+	}
+
+	pts := packet.ConvertPts(90000)
+	dts := packet.ConvertDts(90000)
+	if utils.AVMediaTypeVideo == packet.MediaType() {
+		t.muxer.Input(index, packet.AnnexBPacketData(t.findTrack(packet.Index())), pts, dts, packet.KeyFrame())
+	} else {
+		t.muxer.Input(index, packet.Data(), pts, dts, packet.KeyFrame())
+	}
+
+	// 合并写满再发
+	if segment := t.MWBuffer.PeekCompletedSegment(); len(segment) > 0 {
+		t.AppendOutStreamBuffer(segment)
+	}
+
+	return t.OutBuffer[:t.OutBufferSize], 0, true, nil
+}
+
+func (t *TransStream) findTrack(index int) utils.AVStream {
+	for _, track := range t.Tracks {
+		if track.Index() == index {
+			return track
+		}
+	}
+
+	return nil
+}
+
+func (t *TransStream) AddTrack(stream utils.AVStream) error {
+	if err := t.BaseTransStream.AddTrack(stream); err != nil {
+		return err
+	}
+
+	var index int
+	var err error
+	if utils.AVMediaTypeVideo == stream.Type() {
+		index, err = t.muxer.AddTrack(stream.Type(), stream.CodecId(), stream.CodecParameters().AnnexBExtraData())
+	} else {
+		index, err = t.muxer.AddTrack(stream.Type(), stream.CodecId(), stream.Extra())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	t.trackIndexes[stream.Index()] = index
+	return nil
+}
+
+func (t *TransStream) WriteHeader() error {
+	// 先生成PAT/PMT, 再创建合并写缓冲区. @see onTSAlloc
+	_ = t.muxer.WriteHeader()
+	t.MWBuffer = stream.NewMergeWritingBuffer(t.ExistVideo)
+	return nil
+}
+
+func (t *TransStream) onTSWrite(_ []byte) {
+	// TS包已经写入合并写缓冲区, 无需处理
+}
+
+func (t *TransStream) onTSAlloc(size int) []byte {
+	// 生成PAT/PMT
+	if t.MWBuffer == nil {
+		if t.headerSize+size > len(t.header) {
+			header := make([]byte, (t.headerSize+size)*2)
+			copy(header, t.header[:t.headerSize])
+			t.header = header
+		}
+
+		bytes := t.header[t.headerSize : t.headerSize+size]
+		t.headerSize += size
+		return bytes
+	}
+
+	bytes := t.MWBuffer.Allocate(size, t.dts, t.videoKey)
+	// 关键帧只在切片开始时标记
+	t.videoKey = false
+	return bytes
+}
+
+func (t *TransStream) ReadExtraData(_ int64) ([][]byte, int64, error) {
+	utils.Assert(t.headerSize > 0)
+	return [][]byte{t.header[:t.headerSize]}, 0, nil
+}
+
+func (t *TransStream) ReadKeyFrameBuffer() ([][]byte, int64, error) {
+	t.ClearOutStreamBuffer()
+
+	// 发送当前内存池已有的合并写切片
+	t.MWBuffer.ReadSegmentsFromKeyFrameIndex(func(bytes []byte) {
+		t.AppendOutStreamBuffer(bytes)
+	})
+
+	return t.OutBuffer[:t.OutBufferSize], 0, nil
+}
+
+func (t *TransStream) Close() ([][]byte, int64, error) {
+	t.ClearOutStreamBuffer()
+
+	// 发送剩余的流. 未写过头的TransStream没有创建合并写缓冲区
+	if t.MWBuffer != nil {
+		if segment := t.MWBuffer.FlushSegment(); len(segment) > 0 {
+			t.AppendOutStreamBuffer(segment)
+		}
+	}
+
+	if t.muxer != nil {
+		t.muxer.Close()
+		t.muxer = nil
+	}
+
+	return t.OutBuffer[:t.OutBufferSize], 0, nil
+}
+
+func NewTransStream() stream.TransStream {
+	t := &TransStream{
+		header:       make([]byte, 188*4),
+		trackIndexes: make(map[int]int, 4),
+	}
+
+	// 创建TS封装器
+	muxer := libmpeg.NewTSMuxer()
+	muxer.SetWriteHandler(t.onTSWrite)
+	muxer.SetAllocHandler(t.onTSAlloc)
+	t.muxer = muxer
+	return t
+}
+
+func TransStreamFactory(source stream.Source, protocol stream.TransStreamProtocol, streams []utils.AVStream) (stream.TransStream, error) {
+	return NewTransStream(), nil
+}
@@ -0,0 +1,162 @@
+package rtc
+
+import (
+	"bytes"
+)
+
+const (
+	h265NaluHeaderSize = 2
+	h265FuHeaderSize   = 1
+
+	h265NaluTypeAP = 48 // Aggregation Packet
+	h265NaluTypeFU = 49 // Fragmentation Unit
+)
+
+var (
+	annexBStartCode = []byte{0x00, 0x00, 0x01}
+)
+
+// 按照起始码拆分annexB格式的nalu, 兼容3字节和4字节起始码
+func splitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := bytes.Index(data, annexBStartCode)
+	if start < 0 {
+		// 没有起始码, 当作单个nalu
+		if len(data) > 0 {
+			nalus = append(nalus, data)
+		}
+
+		return nalus
+	}
+
+	start += len(annexBStartCode)
+	for start < len(data) {
+		end := bytes.Index(data[start:], annexBStartCode)
+		if end < 0 {
+			nalus = append(nalus, data[start:])
+			break
+		}
+
+		nalu := data[start : start+end]
+		// 4字节起始码的第一个0属于上一个nalu的结尾
+		if len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+			nalu = nalu[:len(nalu)-1]
+		}
+
+		if len(nalu) > 0 {
+			nalus = append(nalus, nalu)
+		}
+
+		start += end + len(annexBStartCode)
+	}
+
+	return nalus
+}
+
+// H265Payloader 按照RFC7798封装H265 rtp负载.
+// 小于mtu的连续nalu(例如vps/sps/pps)聚合为AP包, 大于mtu的nalu拆分为FU包, 其余使用单一nalu包.
+type H265Payloader struct {
+}
+
+func (p *H265Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	var payloads [][]byte
+	var aggregation [][]byte
+	var aggregationSize int
+
+	// 输出聚合的nalu, 只有一个nalu时使用单一nalu包
+	flush := func() {
+		if len(aggregation) == 1 {
+			payloads = append(payloads, append([]byte{}, aggregation[0]...))
+		} else if len(aggregation) > 1 {
+			payloads = append(payloads, p.aggregate(aggregation, aggregationSize))
+		}
+
+		aggregation = aggregation[:0]
+		aggregationSize = 0
+	}
+
+	for _, nalu := range splitAnnexB(payload) {
+		if len(nalu) <= h265NaluHeaderSize {
+			continue
+		}
+
+		// 大于mtu, 拆分为FU包
+		if len(nalu) > int(mtu) {
+			flush()
+			payloads = append(payloads, p.fragment(mtu, nalu)...)
+			continue
+		}
+
+		// AP包头2字节, 每个nalu前2字节长度
+		size := 2 + len(nalu)
+		if len(aggregation) > 0 && h265NaluHeaderSize+aggregationSize+size > int(mtu) {
+			flush()
+		}
+
+		aggregation = append(aggregation, nalu)
+		aggregationSize += size
+	}
+
+	flush()
+	return payloads
+}
+
+// 创建AP包, F取所有nalu的或, LayerId和TID取最小值
+func (p *H265Payloader) aggregate(nalus [][]byte, size int) []byte {
+	forbidden := byte(0)
+	layerId := byte(0x3F)
+	tid := byte(0x07)
+	for _, nalu := range nalus {
+		forbidden |= nalu[0] & 0x80
+		if id := (nalu[0]&0x01)<<5 | nalu[1]>>3; id < layerId {
+			layerId = id
+		}
+
+		if t := nalu[1] & 0x07; t < tid {
+			tid = t
+		}
+	}
+
+	packet := make([]byte, 0, h265NaluHeaderSize+size)
+	packet = append(packet, forbidden|h265NaluTypeAP<<1|layerId>>5, layerId<<3|tid)
+	for _, nalu := range nalus {
+		packet = append(packet, byte(len(nalu)>>8), byte(len(nalu)))
+		packet = append(packet, nalu...)
+	}
+
+	return packet
+}
+
+// 拆分FU包, 包头的type替换为49, FU头携带原nalu的type和起始/结束标记
+func (p *H265Payloader) fragment(mtu uint16, nalu []byte) [][]byte {
+	var payloads [][]byte
+	naluType := (nalu[0] >> 1) & 0x3F
+	maxFragmentSize := int(mtu) - h265NaluHeaderSize - h265FuHeaderSize
+	if maxFragmentSize <= 0 {
+		return nil
+	}
+
+	data := nalu[h265NaluHeaderSize:]
+	for offset := 0; offset < len(data); offset += maxFragmentSize {
+		size := len(data) - offset
+		if size > maxFragmentSize {
+			size = maxFragmentSize
+		}
+
+		fuHeader := naluType
+		if offset == 0 {
+			fuHeader |= 0x80
+		}
+
+		if offset+size == len(data) {
+			fuHeader |= 0x40
+		}
+
+		packet := make([]byte, 0, h265NaluHeaderSize+h265FuHeaderSize+size)
+		packet = append(packet, nalu[0]&0x81|h265NaluTypeFU<<1, nalu[1], fuHeader)
+		packet = append(packet, data[offset:offset+size]...)
+		payloads = append(payloads, packet)
+	}
+
+	return payloads
+}
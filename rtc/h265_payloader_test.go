@@ -0,0 +1,136 @@
+package rtc
+
+import (
+	"bytes"
+	"testing"
+)
+
+// 创建指定类型和长度的H265 nalu, 包头LayerId为0, TID为1
+func newTestHevcNalu(naluType byte, size int) []byte {
+	nalu := make([]byte, size)
+	nalu[0] = naluType << 1
+	nalu[1] = 0x01
+	for i := 2; i < size; i++ {
+		nalu[i] = byte(i)
+	}
+
+	return nalu
+}
+
+func annexB(nalus ...[]byte) []byte {
+	var data []byte
+	for _, nalu := range nalus {
+		data = append(data, 0x00, 0x00, 0x00, 0x01)
+		data = append(data, nalu...)
+	}
+
+	return data
+}
+
+// 按照RFC7798解包, 还原nalu
+func depacketizeHevc(t *testing.T, payloads [][]byte) [][]byte {
+	var nalus [][]byte
+	var fragment []byte
+	for _, payload := range payloads {
+		switch (payload[0] >> 1) & 0x3F {
+		case h265NaluTypeAP:
+			for data := payload[h265NaluHeaderSize:]; len(data) > 0; {
+				size := int(data[0])<<8 | int(data[1])
+				if size+2 > len(data) {
+					t.Fatalf("invalid aggregation packet %x", payload)
+				}
+
+				nalus = append(nalus, data[2:2+size])
+				data = data[2+size:]
+			}
+		case h265NaluTypeFU:
+			fuHeader := payload[h265NaluHeaderSize]
+			if fuHeader&0x80 != 0 {
+				fragment = []byte{payload[0]&0x81 | (fuHeader&0x3F)<<1, payload[1]}
+			} else if fragment == nil {
+				t.Fatal("fragment without start")
+			}
+
+			fragment = append(fragment, payload[h265NaluHeaderSize+h265FuHeaderSize:]...)
+			if fuHeader&0x40 != 0 {
+				nalus = append(nalus, fragment)
+				fragment = nil
+			}
+		default:
+			nalus = append(nalus, payload)
+		}
+	}
+
+	return nalus
+}
+
+func TestH265Payloader(t *testing.T) {
+	vps, sps, pps := newTestHevcNalu(32, 24), newTestHevcNalu(33, 40), newTestHevcNalu(34, 8)
+	tests := []struct {
+		name  string
+		mtu   uint16
+		nalus [][]byte
+		types []byte // 每个rtp包的nalu type
+	}{
+		{"single nalu", 1200, [][]byte{newTestHevcNalu(1, 500)}, []byte{1}},
+		{"aggregation", 1200, [][]byte{vps, sps, pps}, []byte{h265NaluTypeAP}},
+		{"fragmentation", 1200, [][]byte{newTestHevcNalu(19, 3000)}, []byte{h265NaluTypeFU, h265NaluTypeFU, h265NaluTypeFU}},
+		{"parameter sets and keyframe", 1200, [][]byte{vps, sps, pps, newTestHevcNalu(19, 2000)}, []byte{h265NaluTypeAP, h265NaluTypeFU, h265NaluTypeFU}},
+		{"aggregation exceeds mtu", 60, [][]byte{vps, sps, pps}, []byte{32, h265NaluTypeAP}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payloads := (&H265Payloader{}).Payload(test.mtu, annexB(test.nalus...))
+			if len(payloads) != len(test.types) {
+				t.Fatalf("%d payloads, expected %d", len(payloads), len(test.types))
+			}
+
+			for i, payload := range payloads {
+				if len(payload) > int(test.mtu) {
+					t.Fatalf("payload %d size %d exceeds mtu", i, len(payload))
+				} else if naluType := (payload[0] >> 1) & 0x3F; naluType != test.types[i] {
+					t.Fatalf("payload %d type %d, expected %d", i, naluType, test.types[i])
+				}
+			}
+
+			nalus := depacketizeHevc(t, payloads)
+			if len(nalus) != len(test.nalus) {
+				t.Fatalf("depacketized %d nalus, expected %d", len(nalus), len(test.nalus))
+			}
+
+			for i, nalu := range nalus {
+				if !bytes.Equal(nalu, test.nalus[i]) {
+					t.Fatalf("nalu %d mismatch", i)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected [][]byte
+	}{
+		{"no start code", []byte{0x26, 0x01, 0xAA}, [][]byte{{0x26, 0x01, 0xAA}}},
+		{"3 and 4 bytes", []byte{0, 0, 1, 0x40, 0x01, 0, 0, 0, 1, 0x42, 0x01, 0xBB}, [][]byte{{0x40, 0x01}, {0x42, 0x01, 0xBB}}},
+		{"empty", nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nalus := splitAnnexB(test.data)
+			if len(nalus) != len(test.expected) {
+				t.Fatalf("split %d nalus, expected %d", len(nalus), len(test.expected))
+			}
+
+			for i, nalu := range nalus {
+				if !bytes.Equal(nalu, test.expected[i]) {
+					t.Fatalf("nalu %d: %x, expected %x", i, nalu, test.expected[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package rtc
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/stream"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDataChannelLabel 未配置label时, 服务器创建的DataChannel名称
+	DefaultDataChannelLabel = "lkm"
+)
+
+var (
+	// 已经打开DataChannel的sink, key为sink id字符串, 用于将websocket的应答转发给拉流端
+	dataChannelSinks sync.Map
+
+	messageForwarder *websocketForwarder
+)
+
+// 拉流端通过DataChannel发送的消息, 转发给业务服务器
+type rtcMessage struct {
+	Stream     string `json:"stream"`
+	Sink       string `json:"sink"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Data       string `json:"data"`
+}
+
+// 开启DataChannel时, 接受拉流端创建的DataChannel. offer中包含application媒体段时, 服务器也创建一个DataChannel,
+// 拉流端无需主动创建, 通过ondatachannel接收即可. offer中没有application媒体段时, answer无法添加, 不创建.
+func (s *Sink) setupDataChannel(connection *webrtc.PeerConnection) {
+	connection.OnDataChannel(s.onDataChannel)
+	if !strings.Contains(s.offer, "m=application") {
+		return
+	}
+
+	label := stream.AppConfig.WebRtc.DataChannel.Label
+	if label == "" {
+		label = DefaultDataChannelLabel
+	}
+
+	channel, err := connection.CreateDataChannel(label, nil)
+	if err != nil {
+		log.Sugar.Errorf("创建DataChannel失败 err: %s sink: %s", err.Error(), s.String())
+		return
+	}
+
+	s.onDataChannel(channel)
+}
+
+// 打开DataChannel后下发该流的元数据, 收到的消息转发给业务服务器
+func (s *Sink) onDataChannel(channel *webrtc.DataChannel) {
+	config := stream.AppConfig.WebRtc.DataChannel
+	if config.Label != "" && config.Label != channel.Label() {
+		log.Sugar.Warnf("忽略DataChannel label: %s sink: %s", channel.Label(), s.String())
+		return
+	}
+
+	id := stream.SinkId2String(s.GetID())
+	channel.OnOpen(func() {
+		dataChannelSinks.Store(id, channel)
+		stream.SubscribeMetadata(s.SourceID, s.GetID(), func(metadata *stream.Metadata) {
+			bytes, err := json.Marshal(metadata)
+			if err == nil {
+				_ = channel.SendText(string(bytes))
+			}
+		})
+	})
+
+	channel.OnClose(func() {
+		dataChannelSinks.Delete(id)
+		stream.UnsubscribeMetadata(s.SourceID, s.GetID())
+	})
+
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		message := rtcMessage{
+			Stream:     s.SourceID,
+			Sink:       id,
+			RemoteAddr: s.RemoteAddr(),
+			Data:       string(msg.Data),
+		}
+
+		if messageForwarder != nil {
+			messageForwarder.send(&message)
+		} else if stream.AppConfig.Hooks.IsEnableOnRtcMessage() {
+			// 不阻塞DataChannel的读协程
+			go hookRtcMessage(channel, &message)
+		}
+	})
+}
+
+// 通知on_rtc_message事件, 应答的body不为空时回复给拉流端
+func hookRtcMessage(channel *webrtc.DataChannel, message *rtcMessage) {
+	response, err := stream.Hook(stream.HookEventRtcMessage, "", message)
+	if err != nil {
+		return
+	}
+
+	defer response.Body.Close()
+	if http.StatusOK != response.StatusCode {
+		return
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err == nil && len(body) > 0 {
+		_ = channel.SendText(string(body))
+	}
+}
+
+// 与业务服务器保持websocket长连接, 转发拉流端的消息. 业务服务器发送的消息,
+// 指定sink时回复给该拉流端, 否则作为该流的元数据下发给所有拉流端.
+type websocketForwarder struct {
+	url  string
+	lock sync.Mutex
+	conn *websocket.Conn
+}
+
+func (f *websocketForwarder) send(message *rtcMessage) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.conn == nil {
+		log.Sugar.Warnf("websocket未连接, 丢弃DataChannel消息 sink: %s", message.Sink)
+		return
+	}
+
+	if err := f.conn.WriteJSON(message); err != nil {
+		log.Sugar.Errorf("转发DataChannel消息失败 err: %s url: %s", err.Error(), f.url)
+	}
+}
+
+func (f *websocketForwarder) run() {
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial(f.url, nil)
+		if err != nil {
+			log.Sugar.Errorf("连接websocket失败 err: %s url: %s", err.Error(), f.url)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		log.Sugar.Infof("连接websocket成功 url: %s", f.url)
+		f.lock.Lock()
+		f.conn = conn
+		f.lock.Unlock()
+
+		f.read(conn)
+
+		f.lock.Lock()
+		f.conn = nil
+		f.lock.Unlock()
+		_ = conn.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+func (f *websocketForwarder) read(conn *websocket.Conn) {
+	for {
+		message := rtcMessage{}
+		if err := conn.ReadJSON(&message); err != nil {
+			log.Sugar.Errorf("websocket断开连接 err: %s url: %s", err.Error(), f.url)
+			return
+		}
+
+		if message.Sink != "" {
+			if channel, ok := dataChannelSinks.Load(message.Sink); ok {
+				_ = channel.(*webrtc.DataChannel).SendText(message.Data)
+			}
+		} else if message.Stream != "" {
+			data, _ := json.Marshal(message.Data)
+			stream.PublishMetadata(&stream.Metadata{Source: message.Stream, Type: "message", Time: time.Now().UnixMilli(), Data: data})
+		}
+	}
+}
+
+// StartMessageForwarder 配置了websocket地址时, 连接业务服务器转发DataChannel消息
+func StartMessageForwarder() {
+	config := stream.AppConfig.WebRtc.DataChannel
+	if !config.Enable || config.WebSocket == "" {
+		return
+	}
+
+	messageForwarder = &websocketForwarder{url: config.WebSocket}
+	go messageForwarder.run()
+}
@@ -0,0 +1,164 @@
+package rtc
+
+import (
+	"github.com/lkmio/lkm/log"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"sync"
+)
+
+const (
+	// MaxRetransmitsPerNack 单个NACK最多重传的rtp包数
+	MaxRetransmitsPerNack = 512
+)
+
+// rtp包的发送接口, 由webrtc.TrackLocalStaticRTP实现
+type rtpWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+}
+
+// sink的一路输出流, 在transStream封装好的rtp包基础上改写序号, 用于插入缓存的关键帧.
+// 推流协程发送rtp包, RTCP读协程响应NACK和PLI/FIR, 发送时加锁保证序号连续.
+type sinkTrack struct {
+	local rtpWriter
+	video bool
+
+	lock          sync.Mutex
+	sent          bool
+	seqOffset     uint16 // 插入关键帧后, 后续rtp包的序号偏移量
+	injectSeq     uint16 // 插入关键帧后的第一个序号, 更早的序号不再响应NACK
+	injected      bool
+	lastSeq       uint16
+	lastTimestamp uint32
+	packet        rtp.Packet
+}
+
+// 重传rtp包, 使用拉流端的序号
+func (t *sinkTrack) retransmit(data []byte, seq uint16) error {
+	if err := t.packet.Unmarshal(data); err != nil {
+		return err
+	}
+
+	t.packet.SequenceNumber = seq
+	return t.local.WriteRTP(&t.packet)
+}
+
+// 发送transStream封装的rtp包, 序号加上偏移量
+func (t *sinkTrack) writeLive(data []byte) error {
+	if err := t.packet.Unmarshal(data); err != nil {
+		return err
+	}
+
+	t.packet.SequenceNumber += t.seqOffset
+	t.lastSeq = t.packet.SequenceNumber
+	t.lastTimestamp = t.packet.Timestamp
+	t.sent = true
+	return t.local.WriteRTP(&t.packet)
+}
+
+// 重新发送缓存的关键帧. 使用新的序号, 时间戳改写为最近发送的时间戳加1,
+// 保证单调递增并且小于下一帧的时间戳, 拉流端从该关键帧恢复解码.
+func (t *sinkTrack) writeKeyFrame(packets [][]byte) error {
+	if len(packets) == 0 || !t.sent {
+		return nil
+	}
+
+	for i, data := range packets {
+		if err := t.packet.Unmarshal(data); err != nil {
+			return err
+		}
+
+		t.packet.SequenceNumber = t.lastSeq + uint16(i) + 1
+		t.packet.Timestamp = t.lastTimestamp + 1
+		if err := t.local.WriteRTP(&t.packet); err != nil {
+			return err
+		}
+	}
+
+	t.seqOffset += uint16(len(packets))
+	t.lastSeq += uint16(len(packets))
+	t.lastTimestamp++
+	t.injectSeq = t.lastSeq + 1
+	t.injected = true
+	return nil
+}
+
+// 展开NACK请求重传的序号, 最多MaxRetransmitsPerNack个
+func nackSequences(nack *rtcp.TransportLayerNack) []uint16 {
+	var seqs []uint16
+	for _, pair := range nack.Nacks {
+		seqs = append(seqs, pair.PacketList()...)
+		if len(seqs) >= MaxRetransmitsPerNack {
+			return seqs[:MaxRetransmitsPerNack]
+		}
+	}
+
+	return seqs
+}
+
+// 读取拉流端的RTCP, 同时驱动interceptor处理RR/TWCC. 收到NACK和PLI/FIR立即响应, 不等待下一个rtp包.
+func (s *Sink) readRTCP(index int, track *sinkTrack, sender *webrtc.RTPSender) {
+	rtpTrack := s.transStream.rtpTracks[index]
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.TransportLayerNack:
+				err = s.onNack(rtpTrack, track, nackSequences(p))
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if !track.video {
+					break
+				}
+
+				// rtmp/国标/1078推流端无法请求关键帧, 只发送缓存的关键帧
+				err = s.onKeyFrameRequest(rtpTrack, track)
+			}
+
+			if err != nil {
+				log.Sugar.Errorf("响应rtcp失败 err: %s sink: %s", err.Error(), s.String())
+				return
+			}
+		}
+	}
+}
+
+// 发送最近的关键帧响应PLI/FIR
+func (s *Sink) onKeyFrameRequest(rtpTrack *rtpTrack, track *sinkTrack) error {
+	rtpTrack.lock.RLock()
+	defer rtpTrack.lock.RUnlock()
+
+	track.lock.Lock()
+	defer track.lock.Unlock()
+
+	log.Sugar.Debugf("响应关键帧请求 packets: %d sink: %s", rtpTrack.keyFrameSize, s.String())
+	return track.writeKeyFrame(rtpTrack.keyFrame[:rtpTrack.keyFrameSize])
+}
+
+// 从transStream的重传队列查找丢失的包, 使用拉流端的序号重新发送
+func (s *Sink) onNack(rtpTrack *rtpTrack, track *sinkTrack, seqs []uint16) error {
+	rtpTrack.lock.RLock()
+	defer rtpTrack.lock.RUnlock()
+
+	track.lock.Lock()
+	defer track.lock.Unlock()
+
+	for _, seq := range seqs {
+		// 插入关键帧之前的序号, 已经无法对应到transStream的rtp包
+		if track.injected && int16(seq-track.injectSeq) < 0 {
+			continue
+		}
+
+		if packet := rtpTrack.findHistory(seq - track.seqOffset); packet != nil {
+			if err := track.retransmit(packet, seq); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package rtc
+
+import (
+	"encoding/binary"
+	"github.com/lkmio/lkm/log"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"testing"
+)
+
+// 记录发送给拉流端的rtp包
+type testRtpWriter struct {
+	packets []rtp.Packet
+}
+
+func (w *testRtpWriter) WriteRTP(packet *rtp.Packet) error {
+	w.packets = append(w.packets, rtp.Packet{Header: packet.Header, Payload: append([]byte(nil), packet.Payload...)})
+	return nil
+}
+
+// 负载为transStream封装时的序号, 用于区分重传的是哪个包
+func newTestRtpPacket(seq uint16, timestamp uint32) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, seq)
+	data, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: timestamp}, Payload: payload}).Marshal()
+	return data
+}
+
+func payloadSeq(packet rtp.Packet) uint16 {
+	return binary.BigEndian.Uint16(packet.Payload)
+}
+
+func TestMain(m *testing.M) {
+	log.InitLogger(false, zapcore.ErrorLevel, "", 0, 0, 0, false)
+	os.Exit(m.Run())
+}
+
+// transStream发送100-104, 可选插入2个包的关键帧, 再发送105-109
+func newTestFeedbackTrack(t *testing.T, inject bool) (*rtpTrack, *sinkTrack, *testRtpWriter) {
+	rtpTrack := &rtpTrack{keyFrame: [][]byte{newTestRtpPacket(90, 900), newTestRtpPacket(91, 900)}, keyFrameSize: 2}
+	writer := &testRtpWriter{}
+	track := &sinkTrack{local: writer, video: true}
+
+	send := func(first, last uint16) {
+		for seq := first; seq <= last; seq++ {
+			packet := newTestRtpPacket(seq, uint32(seq)*10)
+			rtpTrack.saveHistory(packet, seq)
+			if err := track.writeLive(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	send(100, 104)
+	if inject {
+		if err := (&Sink{}).onKeyFrameRequest(rtpTrack, track); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(105, 109)
+	writer.packets = nil
+	return rtpTrack, track, writer
+}
+
+// 插入关键帧后, 拉流端的序号加上偏移量, NACK减去偏移量查找重传队列, 插入前的序号不再响应
+func TestOnNack(t *testing.T) {
+	tests := []struct {
+		name   string
+		inject bool
+		nack   []uint16
+		seqs   []uint16 // 重传的拉流端序号
+		origin []uint16 // 对应transStream的序号
+	}{
+		{"no injection", false, []uint16{100, 104, 109}, []uint16{100, 104, 109}, []uint16{100, 104, 109}},
+		{"not sent", false, []uint16{110}, nil, nil},
+		{"same slot", false, []uint16{100 + RetransmissionHistorySize}, nil, nil}, // 重传队列中同一位置的其他序号
+		{"before injection", true, []uint16{100, 104}, nil, nil},
+		{"injected key frame", true, []uint16{105, 106}, nil, nil},
+		{"after injection", true, []uint16{107, 111}, []uint16{107, 111}, []uint16{105, 109}},
+		{"after injection not sent", true, []uint16{112}, nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rtpTrack, track, writer := newTestFeedbackTrack(t, test.inject)
+			if err := (&Sink{}).onNack(rtpTrack, track, test.nack); err != nil {
+				t.Fatal(err)
+			} else if len(writer.packets) != len(test.seqs) {
+				t.Fatalf("retransmitted %d packets, expected: %d", len(writer.packets), len(test.seqs))
+			}
+
+			for i, packet := range writer.packets {
+				if packet.SequenceNumber != test.seqs[i] || payloadSeq(packet) != test.origin[i] {
+					t.Fatalf("retransmitted seq: %d origin: %d, expected seq: %d origin: %d",
+						packet.SequenceNumber, payloadSeq(packet), test.seqs[i], test.origin[i])
+				}
+			}
+		})
+	}
+}
+
+// 关键帧使用连续的新序号, 时间戳为最近发送的时间戳加1, 之后的rtp包序号累加偏移量
+func TestOnKeyFrameRequest(t *testing.T) {
+	rtpTrack := &rtpTrack{keyFrame: [][]byte{newTestRtpPacket(90, 900), newTestRtpPacket(91, 900)}, keyFrameSize: 2}
+	writer := &testRtpWriter{}
+	track := &sinkTrack{local: writer, video: true}
+	sink := &Sink{}
+
+	// 还未发送过rtp包, 拉流端等待正常的关键帧
+	if err := sink.onKeyFrameRequest(rtpTrack, track); err != nil {
+		t.Fatal(err)
+	} else if len(writer.packets) != 0 {
+		t.Fatal("key frame sent before any packet")
+	}
+
+	steps := []struct {
+		name       string
+		live       uint16 // transStream的序号, 0表示插入关键帧
+		seqs       []uint16
+		timestamps []uint32
+	}{
+		{"live", 100, []uint16{100}, []uint32{1000}},
+		{"key frame", 0, []uint16{101, 102}, []uint32{1001, 1001}},
+		{"live after key frame", 101, []uint16{103}, []uint32{1010}},
+		{"second key frame", 0, []uint16{104, 105}, []uint32{1011, 1011}},
+		{"live after second key frame", 102, []uint16{106}, []uint32{1020}},
+	}
+
+	for _, step := range steps {
+		writer.packets = nil
+		var err error
+		if step.live == 0 {
+			err = sink.onKeyFrameRequest(rtpTrack, track)
+		} else {
+			err = track.writeLive(newTestRtpPacket(step.live, uint32(step.live)*10))
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		} else if len(writer.packets) != len(step.seqs) {
+			t.Fatalf("%s: sent %d packets, expected: %d", step.name, len(writer.packets), len(step.seqs))
+		}
+
+		for i, packet := range writer.packets {
+			if packet.SequenceNumber != step.seqs[i] || packet.Timestamp != step.timestamps[i] {
+				t.Fatalf("%s: seq: %d timestamp: %d, expected seq: %d timestamp: %d",
+					step.name, packet.SequenceNumber, packet.Timestamp, step.seqs[i], step.timestamps[i])
+			}
+		}
+	}
+}
+
+func TestNackSequences(t *testing.T) {
+	full := make([]rtcp.NackPair, 40)
+	for i := range full {
+		full[i] = rtcp.NackPair{PacketID: uint16(i * 17), LostPackets: 0xFFFF}
+	}
+
+	tests := []struct {
+		name  string
+		nacks []rtcp.NackPair
+		count int
+		first uint16
+		last  uint16
+	}{
+		{"single", []rtcp.NackPair{{PacketID: 10}}, 1, 10, 10},
+		{"bitmask", []rtcp.NackPair{{PacketID: 10, LostPackets: 0b101}}, 3, 10, 13},
+		{"capped", full, MaxRetransmitsPerNack, 0, MaxRetransmitsPerNack - 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seqs := nackSequences(&rtcp.TransportLayerNack{Nacks: test.nacks})
+			if len(seqs) != test.count || seqs[0] != test.first || seqs[len(seqs)-1] != test.last {
+				t.Fatalf("seqs: %d [%d, %d], expected: %d [%d, %d]", len(seqs), seqs[0], seqs[len(seqs)-1], test.count, test.first, test.last)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package rtc
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// RFC7798 未声明时的默认值: Main profile, Main tier, level 3.1
+	h265DefaultProfileId = 1
+	h265DefaultLevelId   = 93
+)
+
+// offer中的一个编码器, 来自a=rtpmap和a=fmtp
+type offerCodec struct {
+	payloadType string
+	name        string // 大写的编码名称, 例如H265
+	fmtp        string
+}
+
+func (c offerCodec) parameter(key string, defaultValue int) int {
+	for _, pair := range strings.Split(c.fmtp, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], key) {
+			continue
+		}
+
+		if value, err := strconv.Atoi(strings.TrimSpace(kv[1])); err == nil {
+			return value
+		}
+	}
+
+	return defaultValue
+}
+
+// 按照出现顺序解析offer中的所有编码器
+func parseOfferCodecs(offer string) []*offerCodec {
+	var codecs []*offerCodec
+	find := func(pt string) *offerCodec {
+		for _, codec := range codecs {
+			if codec.payloadType == pt {
+				return codec
+			}
+		}
+
+		return nil
+	}
+
+	for _, line := range strings.Split(offer, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "a=rtpmap:") {
+			fields := strings.Fields(line[len("a=rtpmap:"):])
+			if len(fields) < 2 || find(fields[0]) != nil {
+				continue
+			}
+
+			name := strings.ToUpper(strings.SplitN(fields[1], "/", 2)[0])
+			codecs = append(codecs, &offerCodec{payloadType: fields[0], name: name})
+		} else if strings.HasPrefix(line, "a=fmtp:") {
+			fields := strings.SplitN(line[len("a=fmtp:"):], " ", 2)
+			if len(fields) < 2 {
+				continue
+			}
+
+			// fmtp可能在rtpmap之前
+			codec := find(fields[0])
+			if codec == nil {
+				codec = &offerCodec{payloadType: fields[0]}
+				codecs = append(codecs, codec)
+			}
+
+			codec.fmtp = strings.TrimSpace(fields[1])
+		}
+	}
+
+	return codecs
+}
+
+// 从H265 sps的profile_tier_level解析profile, tier和level
+func hevcProfileTierLevel(sps []byte) (int, int, int, bool) {
+	// 去除防竞争字节
+	var data []byte
+	for i := 0; i < len(sps) && len(data) < 15; i++ {
+		if i >= 2 && sps[i] == 0x03 && sps[i-1] == 0x00 && sps[i-2] == 0x00 {
+			continue
+		}
+
+		data = append(data, sps[i])
+	}
+
+	// nal header[2] + vps_id/max_sub_layers/temporal_id_nesting[1] + profile_tier_level[12]
+	if len(data) < 15 {
+		return 0, 0, 0, false
+	}
+
+	return int(data[3] & 0x1F), int(data[3]>>5) & 0x1, int(data[14]), true
+}
+
+// 浏览器是否可以解码该H265流. offer中的level-id是拉流端支持的最高级别, Main10解码器兼容Main profile.
+func matchH265Codec(codec *offerCodec, profile, tier, level int) bool {
+	offerProfile := codec.parameter("profile-id", h265DefaultProfileId)
+	if offerProfile != profile && !(profile == 1 && offerProfile == 2) {
+		return false
+	}
+
+	offerTier := codec.parameter("tier-flag", 0)
+	return offerTier > tier || (offerTier == tier && codec.parameter("level-id", h265DefaultLevelId) >= level)
+}
+
+// 在offer中查找与输出流匹配的编码器, 返回该编码器的fmtp, 用于创建track时选择对应的payload type.
+// 其他编码器只根据rtpmap的名称判断; H265还需要根据sps协商profile和level, sps为空时选择第一个H265编码器.
+func negotiateOfferCodec(offer, mimeType string, sps []byte) (string, bool) {
+	name := strings.ToUpper(mimeType[strings.Index(mimeType, "/")+1:])
+	profile, tier, level, ok := hevcProfileTierLevel(sps)
+
+	for _, codec := range parseOfferCodecs(offer) {
+		if codec.name != name {
+			continue
+		} else if name != "H265" {
+			return "", true
+		} else if !ok || matchH265Codec(codec, profile, tier, level) {
+			return codec.fmtp, true
+		}
+	}
+
+	return "", false
+}
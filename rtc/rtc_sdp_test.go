@@ -0,0 +1,119 @@
+package rtc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNegotiateOfferCodec(t *testing.T) {
+	offer := func(lines ...string) string {
+		return strings.Join(append([]string{"v=0", "m=video 9 UDP/TLS/RTP/SAVPF 96 97 98 99"}, lines...), "\r\n") + "\r\n"
+	}
+
+	// main profile, main tier, level 3.1 / level 5.1
+	mainL93 := []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5D}
+	mainL153 := []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x99}
+	main10L120 := []byte{0x42, 0x01, 0x01, 0x02, 0x20, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x78}
+
+	tests := []struct {
+		name     string
+		offer    string
+		mimeType string
+		sps      []byte
+		fmtp     string
+		success  bool
+	}{
+		{
+			name:     "h264",
+			offer:    offer("a=rtpmap:96 VP8/90000", "a=rtpmap:97 H264/90000", "a=fmtp:97 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"),
+			mimeType: "video/H264",
+			success:  true,
+		},
+		{
+			name:     "not offered",
+			offer:    offer("a=rtpmap:96 VP8/90000", "a=rtpmap:97 H264/90000"),
+			mimeType: "video/H265",
+			sps:      mainL93,
+			success:  false,
+		},
+		{
+			name:     "h265 default parameters",
+			offer:    offer("a=rtpmap:98 H265/90000"),
+			mimeType: "video/H265",
+			sps:      mainL93,
+			success:  true,
+		},
+		{
+			name:     "h265 level too high",
+			offer:    offer("a=rtpmap:98 H265/90000", "a=fmtp:98 level-id=93;profile-id=1;tier-flag=0;tx-mode=SRST"),
+			mimeType: "video/H265",
+			sps:      mainL153,
+			success:  false,
+		},
+		{
+			name:     "h265 select level",
+			offer:    offer("a=rtpmap:98 H265/90000", "a=fmtp:98 level-id=93;profile-id=1;tier-flag=0;tx-mode=SRST", "a=rtpmap:99 H265/90000", "a=fmtp:99 level-id=180;profile-id=1;tier-flag=0;tx-mode=SRST"),
+			mimeType: "video/H265",
+			sps:      mainL153,
+			fmtp:     "level-id=180;profile-id=1;tier-flag=0;tx-mode=SRST",
+			success:  true,
+		},
+		{
+			name:     "h265 select profile",
+			offer:    offer("a=fmtp:98 level-id=180;profile-id=1;tier-flag=0;tx-mode=SRST", "a=rtpmap:98 H265/90000", "a=rtpmap:99 H265/90000", "a=fmtp:99 level-id=180;profile-id=2;tier-flag=0;tx-mode=SRST"),
+			mimeType: "video/H265",
+			sps:      main10L120,
+			fmtp:     "level-id=180;profile-id=2;tier-flag=0;tx-mode=SRST",
+			success:  true,
+		},
+		{
+			name:     "main10 decoder supports main profile",
+			offer:    offer("a=rtpmap:99 H265/90000", "a=fmtp:99 level-id=180;profile-id=2;tier-flag=0;tx-mode=SRST"),
+			mimeType: "video/H265",
+			sps:      mainL153,
+			fmtp:     "level-id=180;profile-id=2;tier-flag=0;tx-mode=SRST",
+			success:  true,
+		},
+		{
+			name:     "h265 without sps",
+			offer:    offer("a=rtpmap:98 H265/90000", "a=fmtp:98 level-id=93;profile-id=1;tier-flag=0;tx-mode=SRST"),
+			mimeType: "video/H265",
+			fmtp:     "level-id=93;profile-id=1;tier-flag=0;tx-mode=SRST",
+			success:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fmtp, ok := negotiateOfferCodec(test.offer, test.mimeType, test.sps)
+			if ok != test.success || fmtp != test.fmtp {
+				t.Fatalf("negotiate %t fmtp %s, expected %t fmtp %s", ok, fmtp, test.success, test.fmtp)
+			}
+		})
+	}
+}
+
+func TestHevcProfileTierLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		sps     []byte
+		profile int
+		tier    int
+		level   int
+		success bool
+	}{
+		{"main", []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5D}, 1, 0, 93, true},
+		{"high tier main10", []byte{0x42, 0x01, 0x01, 0x22, 0x20, 0x00, 0x00, 0x00, 0xB0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x99}, 2, 1, 153, true},
+		{"emulation prevention", []byte{0x42, 0x01, 0x01, 0x01, 0x00, 0x00, 0x03, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5D}, 1, 0, 93, true},
+		{"truncated", []byte{0x42, 0x01, 0x01, 0x01}, 0, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile, tier, level, ok := hevcProfileTierLevel(test.sps)
+			if ok != test.success || profile != test.profile || tier != test.tier || level != test.level {
+				t.Fatalf("profile %d tier %d level %d %t", profile, tier, level, ok)
+			}
+		})
+	}
+}
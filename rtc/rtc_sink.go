@@ -6,8 +6,6 @@ import (
 	"github.com/lkmio/lkm/log"
 	"github.com/lkmio/lkm/stream"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
-	"time"
 )
 
 type Sink struct {
@@ -16,68 +14,76 @@ type Sink struct {
 	offer  string
 	answer string
 
-	peer   *webrtc.PeerConnection
-	tracks []*webrtc.TrackLocalStaticSample
-	state  webrtc.ICEConnectionState
+	peer        *webrtc.PeerConnection
+	tracks      []*sinkTrack
+	state       webrtc.ICEConnectionState
+	transStream *transStream
 
 	cb func(sdp string)
 }
 
-func (s *Sink) StartStreaming(transStream stream.TransStream) error {
+func (s *Sink) StartStreaming(t stream.TransStream) error {
 	// 创建PeerConnection
-	var remoteTrack *webrtc.TrackLocalStaticSample
-	s.tracks = make([]*webrtc.TrackLocalStaticSample, transStream.TrackCount())
+	var localTrack *webrtc.TrackLocalStaticRTP
+	s.tracks = make([]*sinkTrack, t.TrackCount())
+	s.transStream = t.(*transStream)
 
 	connection, err := webrtcApi.NewPeerConnection(webrtc.Configuration{})
 	connection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 
 	})
 
-	tracks := transStream.GetTracks()
-	for index, track := range tracks {
-		var mimeType string
-		var id string
-		if utils.AVCodecIdH264 == track.CodecId() {
-			mimeType = webrtc.MimeTypeH264
-		} else if utils.AVCodecIdH265 == track.CodecId() {
-			mimeType = webrtc.MimeTypeH265
-		} else if utils.AVCodecIdAV1 == track.CodecId() {
-			mimeType = webrtc.MimeTypeAV1
-		} else if utils.AVCodecIdVP8 == track.CodecId() {
-			mimeType = webrtc.MimeTypeVP8
-		} else if utils.AVCodecIdVP9 == track.CodecId() {
-			mimeType = webrtc.MimeTypeVP9
-		} else if utils.AVCodecIdOPUS == track.CodecId() {
-			mimeType = webrtc.MimeTypeOpus
-		} else if utils.AVCodecIdPCMALAW == track.CodecId() {
-			mimeType = webrtc.MimeTypePCMA
-		} else if utils.AVCodecIdPCMMULAW == track.CodecId() {
-			mimeType = webrtc.MimeTypePCMU
-		} else {
-			log.Sugar.Errorf("codec %s not compatible with webrtc", track.CodecId())
+	rtpTracks := s.transStream.rtpTracks
+	for index, track := range t.GetTracks() {
+		// 不支持的编码器, 不创建track
+		if rtpTracks[index].payloader == nil {
+			continue
+		}
+
+		var sps []byte
+		if utils.AVCodecIdH265 == track.CodecId() {
+			if parameters := track.CodecParameters().SPS(); len(parameters) > 0 {
+				sps = parameters[0]
+			}
+		}
+
+		// 浏览器不支持该编码器(例如大部分浏览器不支持H265, 或者不支持该profile和level), 不创建该track, 只播放其他track
+		fmtp, ok := negotiateOfferCodec(s.offer, rtpTracks[index].mimeType, sps)
+		if !ok {
+			log.Sugar.Warnf("offer中不包含匹配的编码器 %s, 忽略该track sink: %s", rtpTracks[index].mimeType, s.String())
 			continue
 		}
 
+		var id string
 		if utils.AVMediaTypeAudio == track.Type() {
 			id = "audio"
 		} else {
 			id = "video"
 		}
 
-		remoteTrack, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: mimeType}, id, "pion")
+		// 携带offer中的fmtp, 多个H265 payload type时绑定协商的那一个
+		capability := webrtc.RTPCodecCapability{MimeType: rtpTracks[index].mimeType, ClockRate: rtpTracks[index].clockRate, SDPFmtpLine: fmtp}
+		localTrack, err = webrtc.NewTrackLocalStaticRTP(capability, id, "pion")
 		if err != nil {
 			return err
-		} else if _, err := connection.AddTransceiverFromTrack(remoteTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
-			return err
-		} else if _, err = connection.AddTrack(remoteTrack); err != nil {
+		}
+
+		transceiver, err := connection.AddTransceiverFromTrack(localTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		if err != nil {
 			return err
 		}
 
-		s.tracks[index] = remoteTrack
+		s.tracks[index] = &sinkTrack{local: localTrack, video: utils.AVMediaTypeVideo == track.Type()}
+		go s.readRTCP(index, s.tracks[index], transceiver.Sender())
+	}
+
+	// DataChannel用于下发元数据和接收拉流端的控制消息
+	if stream.AppConfig.WebRtc.DataChannel.Enable {
+		s.setupDataChannel(connection)
 	}
 
 	if len(connection.GetTransceivers()) == 0 {
-		return fmt.Errorf("no track added")
+		return fmt.Errorf("no track added, the codecs of the stream are not supported by the peer")
 	} else if err = connection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: s.offer}); err != nil {
 		return err
 	}
@@ -111,7 +117,23 @@ func (s *Sink) StartStreaming(transStream stream.TransStream) error {
 	return nil
 }
 
+// StreamNotFound 等待推流超时, 回调空sdp, http应答404.
+// 播放中的源关闭后重新等待, 此时已经应答过sdp, 关闭peer, 由ice状态回调释放sink
+func (s *Sink) StreamNotFound() {
+	if s.cb != nil {
+		s.cb("")
+		s.cb = nil
+	} else if peer := s.peer; peer != nil {
+		_ = peer.Close()
+	}
+}
+
 func (s *Sink) Close() {
+	if stream.AppConfig.WebRtc.DataChannel.Enable {
+		dataChannelSinks.Delete(stream.SinkId2String(s.GetID()))
+		stream.UnsubscribeMetadata(s.SourceID, s.GetID())
+	}
+
 	if s.peer != nil {
 		s.peer.Close()
 		s.peer = nil
@@ -121,17 +143,17 @@ func (s *Sink) Close() {
 }
 
 func (s *Sink) Write(index int, data [][]byte, ts int64) error {
-	if s.tracks[index] == nil {
+	track := s.tracks[index]
+	if track == nil {
 		return nil
 	}
 
-	for _, bytes := range data {
-		err := s.tracks[index].WriteSample(media.Sample{
-			Data:     bytes,
-			Duration: time.Duration(ts) * time.Millisecond,
-		})
+	// RTCP读协程可能同时在重传或插入关键帧
+	track.lock.Lock()
+	defer track.lock.Unlock()
 
-		if err != nil {
+	for _, bytes := range data {
+		if err := track.writeLive(bytes); err != nil {
 			return err
 		}
 	}
@@ -140,5 +162,10 @@ func (s *Sink) Write(index int, data [][]byte, ts int64) error {
 }
 
 func NewSink(id stream.SinkID, sourceId string, offer string, cb func(sdp string)) stream.Sink {
-	return &Sink{stream.BaseSink{ID: id, SourceID: sourceId, Protocol: stream.TransStreamRtc, TCPStreaming: false}, offer, "", nil, nil, webrtc.ICEConnectionStateNew, cb}
+	return &Sink{
+		BaseSink: stream.BaseSink{ID: id, SourceID: sourceId, Protocol: stream.TransStreamRtc, TCPStreaming: false},
+		offer:    offer,
+		state:    webrtc.ICEConnectionStateNew,
+		cb:       cb,
+	}
 }
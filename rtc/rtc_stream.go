@@ -1,76 +1,329 @@
 package rtc
 
 import (
+	"encoding/binary"
+	"fmt"
 	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/log"
 	"github.com/lkmio/lkm/stream"
+	"github.com/pion/ice/v2"
 	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v3"
 	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	// RtpMTU rtp包的最大长度, 预留srtp和udp/ip头的空间
+	RtpMTU = 1200
+
+	// H265PayloadType 未与默认编码器冲突的动态负载类型
+	H265PayloadType = 116
+
+	// RetransmissionHistorySize 每路流保存最近多少个rtp包用于响应NACK
+	RetransmissionHistorySize = 1024
+
+	// KeyFrameCacheMaxPackets 缓存关键帧的最大rtp包数
+	KeyFrameCacheMaxPackets = 4096
 )
 
 var (
 	webrtcApi *webrtc.API
 )
 
+// 每路流的rtp封装器, 所有sink共用, 发送时由TrackLocalStaticRTP改写ssrc和pt
+type rtpTrack struct {
+	mimeType  string
+	clockRate uint32
+	payloader rtp.Payloader
+	sequencer rtp.Sequencer
+
+	// 推流协程写入, sink的RTCP读协程读取
+	lock         sync.RWMutex
+	history      [RetransmissionHistorySize][]byte // 最近发送的rtp包, 所有sink共用, 根据序号响应NACK
+	keyFrame     [][]byte                          // 最近一个关键帧的rtp包, 响应PLI/FIR
+	keyFrameSize int
+}
+
+func (r *rtpTrack) saveHistory(packet []byte, seq uint16) {
+	index := int(seq) % RetransmissionHistorySize
+	r.history[index] = append(r.history[index][:0], packet...)
+}
+
+// 根据序号查找重传队列中的rtp包, 序号被覆盖返回nil
+func (r *rtpTrack) findHistory(seq uint16) []byte {
+	packet := r.history[int(seq)%RetransmissionHistorySize]
+	if len(packet) < 12 || binary.BigEndian.Uint16(packet[2:]) != seq {
+		return nil
+	}
+
+	return packet
+}
+
+// 缓存关键帧的rtp包, 复用之前的内存. 超过KeyFrameCacheMaxPackets不缓存.
+func (r *rtpTrack) saveKeyFrame(packets [][]byte) {
+	r.keyFrameSize = 0
+	if len(packets) > KeyFrameCacheMaxPackets {
+		return
+	}
+
+	for _, packet := range packets {
+		if r.keyFrameSize < len(r.keyFrame) {
+			r.keyFrame[r.keyFrameSize] = append(r.keyFrame[r.keyFrameSize][:0], packet...)
+		} else {
+			r.keyFrame = append(r.keyFrame, append([]byte{}, packet...))
+		}
+
+		r.keyFrameSize++
+	}
+}
+
 type transStream struct {
 	stream.BaseTransStream
+
+	rtpTracks []*rtpTrack
+	buffer    *stream.ReceiveBuffer
+}
+
+// 返回编码器对应的webrtc mime type和rtp时钟频率
+func codecCapability(id utils.AVCodecID) (string, uint32, bool) {
+	switch id {
+	case utils.AVCodecIdH264:
+		return webrtc.MimeTypeH264, 90000, true
+	case utils.AVCodecIdH265:
+		return webrtc.MimeTypeH265, 90000, true
+	case utils.AVCodecIdAV1:
+		return webrtc.MimeTypeAV1, 90000, true
+	case utils.AVCodecIdVP8:
+		return webrtc.MimeTypeVP8, 90000, true
+	case utils.AVCodecIdVP9:
+		return webrtc.MimeTypeVP9, 90000, true
+	case utils.AVCodecIdOPUS:
+		return webrtc.MimeTypeOpus, 48000, true
+	case utils.AVCodecIdPCMALAW:
+		return webrtc.MimeTypePCMA, 8000, true
+	case utils.AVCodecIdPCMMULAW:
+		return webrtc.MimeTypePCMU, 8000, true
+	}
+
+	return "", 0, false
+}
+
+func newPayloader(id utils.AVCodecID) rtp.Payloader {
+	switch id {
+	case utils.AVCodecIdH264:
+		return &codecs.H264Payloader{}
+	case utils.AVCodecIdH265:
+		return &H265Payloader{}
+	case utils.AVCodecIdAV1:
+		return &codecs.AV1Payloader{}
+	case utils.AVCodecIdVP8:
+		return &codecs.VP8Payloader{}
+	case utils.AVCodecIdVP9:
+		return &codecs.VP9Payloader{}
+	case utils.AVCodecIdOPUS:
+		return &codecs.OpusPayloader{}
+	case utils.AVCodecIdPCMALAW, utils.AVCodecIdPCMMULAW:
+		return &codecs.G711Payloader{}
+	}
+
+	return nil
+}
+
+func (t *transStream) AddTrack(stream utils.AVStream) error {
+	if err := t.BaseTransStream.AddTrack(stream); err != nil {
+		return err
+	}
+
+	// 不支持的编码器也占用一个索引, 保证与Tracks一一对应
+	track := &rtpTrack{sequencer: rtp.NewRandomSequencer()}
+	mimeType, clockRate, ok := codecCapability(stream.CodecId())
+	if payloader := newPayloader(stream.CodecId()); ok && payloader != nil {
+		track.mimeType, track.clockRate, track.payloader = mimeType, clockRate, payloader
+	} else {
+		log.Sugar.Warnf("codec %s not compatible with webrtc", stream.CodecId())
+	}
+
+	t.rtpTracks = append(t.rtpTracks, track)
+	return nil
+}
+
+// 封装rtp包, 时间戳转换为rtp时钟频率, 最后一个包设置marker
+func (t *transStream) packRtp(track *rtpTrack, data []byte, timestamp uint32) {
+	payloads := track.payloader.Payload(RtpMTU-12, data)
+	t.buffer.Reserve(len(payloads))
+
+	track.lock.Lock()
+	defer track.lock.Unlock()
+	for i, payload := range payloads {
+		packet := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				SequenceNumber: track.sequencer.NextSequenceNumber(),
+				Timestamp:      timestamp,
+			},
+			Payload: payload,
+		}
+
+		block := t.buffer.GetBlock()
+		n, err := packet.MarshalTo(block)
+		if err != nil {
+			log.Sugar.Errorf("封装rtp包失败 err: %s", err.Error())
+			continue
+		}
+
+		track.saveHistory(block[:n], packet.SequenceNumber)
+		t.AppendOutStreamBuffer(block[:n])
+	}
 }
 
 func (t *transStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error) {
 	t.ClearOutStreamBuffer()
 
+	index, avStream := t.FindTrack(packet.Index())
+	if avStream == nil {
+		return nil, -1, false, nil
+	}
+
+	track := t.rtpTracks[index]
+	codecId := avStream.CodecId()
+	if track.payloader == nil {
+		return nil, -1, false, nil
+	}
+
+	timestamp := uint32(packet.ConvertPts(int(track.clockRate)))
 	if utils.AVMediaTypeAudio == packet.MediaType() {
-		t.AppendOutStreamBuffer(packet.Data())
+		t.packRtp(track, packet.Data(), timestamp)
 	} else if utils.AVMediaTypeVideo == packet.MediaType() {
-		if packet.KeyFrame() {
-			extra := t.BaseTransStream.Tracks[packet.Index()].CodecParameters().AnnexBExtraData()
-			t.AppendOutStreamBuffer(extra)
+		data := packet.Data()
+		if utils.AVCodecIdH264 == codecId || utils.AVCodecIdH265 == codecId {
+			data = packet.AnnexBPacketData(avStream)
+
+			// 关键帧前添加sps和pps, 与关键帧一起封装, 新加入的sink从关键帧开始解码
+			if packet.KeyFrame() {
+				extra := avStream.CodecParameters().AnnexBExtraData()
+				data = append(append(make([]byte, 0, len(extra)+len(data)), extra...), data...)
+			}
 		}
 
-		t.AppendOutStreamBuffer(packet.AnnexBPacketData(t.BaseTransStream.Tracks[packet.Index()]))
+		t.packRtp(track, data, timestamp)
+		if packet.KeyFrame() {
+			track.lock.Lock()
+			track.saveKeyFrame(t.OutBuffer[:t.OutBufferSize])
+			track.lock.Unlock()
+		}
 	}
 
-	return t.OutBuffer[:t.OutBufferSize], int64(uint32(packet.Duration(1000))), utils.AVMediaTypeVideo == packet.MediaType() && packet.KeyFrame(), nil
+	return t.OutBuffer[:t.OutBufferSize], int64(timestamp), utils.AVMediaTypeVideo == packet.MediaType() && packet.KeyFrame(), nil
 }
 
 func (t *transStream) WriteHeader() error {
 	return nil
 }
 
+// 默认编码器不包含H265, 注册H265和对应的rtx.
+// 不声明profile和level, 避免与offer中不同level的H265不能精确匹配而被丢弃, 由sink根据sps和offer的fmtp协商.
+func registerH265Codecs(m *webrtc.MediaEngine) error {
+	feedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, SDPFmtpLine: "tx-mode=SRST", RTCPFeedback: feedback},
+		PayloadType:        H265PayloadType,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+
+	return m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, SDPFmtpLine: fmt.Sprintf("apt=%d", H265PayloadType)},
+		PayloadType:        H265PayloadType + 1,
+	}, webrtc.RTPCodecTypeVideo)
+}
+
 func InitConfig() {
 	setting := webrtc.SettingEngine{}
-	var ips []string
-	ips = append(ips, stream.AppConfig.PublicIP)
+	config := stream.AppConfig.WebRtc
 
-	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP:   net.ParseIP(stream.AppConfig.ListenIP),
-		Port: stream.AppConfig.WebRtc.Port,
-	})
+	// 候选地址, 支持多个公网ip/内网ip映射
+	ips := config.PublicIPs
+	if len(ips) == 0 {
+		ips = append(ips, stream.AppConfig.PublicIP)
+	}
 
-	if err != nil {
-		panic(err)
+	var networkTypes []webrtc.NetworkType
+	if config.IsEnableUDP() || !config.IsEnableTCP() {
+		// 监听所有地址时, 为每个网卡创建udp端口, 同时支持ipv4和ipv6
+		listenIP := net.ParseIP(stream.AppConfig.ListenIP)
+		if listenIP == nil || listenIP.IsUnspecified() {
+			mux, err := ice.NewMultiUDPMuxFromPort(config.Port)
+			if err != nil {
+				panic(err)
+			}
+
+			setting.SetICEUDPMux(mux)
+		} else {
+			udpListener, err := net.ListenUDP("udp", &net.UDPAddr{
+				IP:   listenIP,
+				Port: config.Port,
+			})
+
+			if err != nil {
+				panic(err)
+			}
+
+			setting.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpListener))
+		}
+
+		networkTypes = append(networkTypes, webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6)
+	}
+
+	// ICE-TCP被动模式, 浏览器主动连接
+	if config.IsEnableTCP() {
+		tcpListener, err := net.Listen("tcp", net.JoinHostPort(stream.AppConfig.ListenIP, strconv.Itoa(config.TCPPort)))
+		if err != nil {
+			panic(err)
+		}
+
+		setting.SetICETCPMux(webrtc.NewICETCPMux(nil, tcpListener, 8))
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
 	}
 
-	// 设置公网ip和监听端口
-	setting.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpListener))
+	// 设置公网ip
+	setting.SetNetworkTypes(networkTypes)
 	setting.SetNAT1To1IPs(ips, webrtc.ICECandidateTypeHost)
 
 	// 注册音视频编码器
 	m := &webrtc.MediaEngine{}
 	if err := m.RegisterDefaultCodecs(); err != nil {
 		panic(err)
+	} else if err = registerH265Codecs(m); err != nil {
+		panic(err)
 	}
 
+	// 不使用默认的NACK拦截器, 由sink从transStream的重传队列响应NACK, 避免每个sink缓存一份rtp包
 	i := &interceptor.Registry{}
-	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+	if err := webrtc.ConfigureRTCPReports(i); err != nil {
+		panic(err)
+	} else if err = webrtc.ConfigureTWCCSender(m, i); err != nil {
 		panic(err)
 	}
 
 	webrtcApi = webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(setting))
+
+	if config.Turn.Enable {
+		if err := startTurnServer(ips); err != nil {
+			panic(err)
+		}
+	}
 }
 
 func NewTransStream() stream.TransStream {
-	t := &transStream{}
+	t := &transStream{
+		// 每帧封装的rtp包在下一帧覆盖前已经发送给所有sink
+		buffer: stream.NewReceiveBuffer(1500, 1024),
+	}
 	return t
 }
 
@@ -0,0 +1,149 @@
+package rtc
+
+import (
+	"fmt"
+	"github.com/lkmio/lkm/stream"
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2"
+	"net"
+	"strconv"
+	"time"
+)
+
+var (
+	turnServer *turn.Server
+	turnHost   string // 下发给浏览器的turn服务器地址
+)
+
+// ICEServer 下发给浏览器的stun/turn服务器, 与RTCIceServer格式一致
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// 中继地址使用public_ip, 未配置时使用listen_ip, 两者都无效时无法告知浏览器中继地址
+func turnRelayIP() (net.IP, error) {
+	if ip := net.ParseIP(stream.AppConfig.PublicIP); ip != nil && !ip.IsUnspecified() {
+		return ip, nil
+	} else if ip = net.ParseIP(stream.AppConfig.ListenIP); ip != nil && !ip.IsUnspecified() {
+		return ip, nil
+	}
+
+	return nil, fmt.Errorf("turn requires a valid public_ip or listen_ip, public_ip: %q listen_ip: %q", stream.AppConfig.PublicIP, stream.AppConfig.ListenIP)
+}
+
+// 服务器自身的ICE候选地址: NAT映射的公网地址和监听地址, 监听所有地址时为所有网卡地址
+func localICEAddresses(natIPs []string) []net.IP {
+	var ips []net.IP
+	for _, ip := range append(natIPs, stream.AppConfig.PublicIP, stream.AppConfig.ListenIP) {
+		if parsed := net.ParseIP(ip); parsed != nil && !parsed.IsUnspecified() {
+			ips = append(ips, parsed)
+		}
+	}
+
+	if listenIP := net.ParseIP(stream.AppConfig.ListenIP); listenIP == nil || listenIP.IsUnspecified() {
+		addrs, _ := net.InterfaceAddrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+
+	return ips
+}
+
+// 只允许中继到服务器自身的ICE地址, 防止turn服务器被用于访问内网或转发任意流量
+func newPermissionHandler(allowed []net.IP) turn.PermissionHandler {
+	return func(clientAddr net.Addr, peerIP net.IP) bool {
+		for _, ip := range allowed {
+			if ip.Equal(peerIP) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// 启动内置的turn服务器, 同时监听udp和tcp. 使用临时账号鉴权, 用户名为"过期时间戳:随机数", 密码为HMAC-SHA1(secret, 用户名).
+// natIPs为webrtc的NAT映射地址, 浏览器只能通过中继访问服务器自身的ICE地址.
+func startTurnServer(natIPs []string) error {
+	config := stream.AppConfig.WebRtc.Turn
+	if config.Secret == "" {
+		return fmt.Errorf("turn secret is required")
+	}
+
+	relayIP, err := turnRelayIP()
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(stream.AppConfig.ListenIP, strconv.Itoa(config.Port))
+	udpListener, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		_ = udpListener.Close()
+		return err
+	}
+
+	listenIP := stream.AppConfig.ListenIP
+	if listenIP == "" {
+		listenIP = "0.0.0.0"
+	}
+
+	generator := &turn.RelayAddressGeneratorStatic{
+		RelayAddress: relayIP,
+		Address:      listenIP,
+	}
+
+	permissionHandler := newPermissionHandler(localICEAddresses(natIPs))
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	turnServer, err = turn.NewServer(turn.ServerConfig{
+		Realm:         config.Realm,
+		AuthHandler:   turn.NewLongTermAuthHandler(config.Secret, loggerFactory.NewLogger("turn")),
+		LoggerFactory: loggerFactory,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: udpListener, RelayAddressGenerator: generator, PermissionHandler: permissionHandler},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: tcpListener, RelayAddressGenerator: generator, PermissionHandler: permissionHandler},
+		},
+	})
+
+	if err != nil {
+		_ = udpListener.Close()
+		_ = tcpListener.Close()
+		return err
+	}
+
+	turnHost = net.JoinHostPort(relayIP.String(), strconv.Itoa(config.Port))
+	return nil
+}
+
+// ICEServers 生成临时的turn账号, 随answer应答给浏览器. 未开启turn返回nil.
+func ICEServers() []ICEServer {
+	if turnServer == nil {
+		return nil
+	}
+
+	config := stream.AppConfig.WebRtc.Turn
+	username, password, err := turn.GenerateLongTermCredentials(config.Secret, time.Duration(config.TTL)*time.Second)
+	if err != nil {
+		return nil
+	}
+
+	return []ICEServer{
+		{URLs: []string{"stun:" + turnHost}},
+		{
+			URLs:       []string{"turn:" + turnHost + "?transport=udp", "turn:" + turnHost + "?transport=tcp"},
+			Username:   username,
+			Credential: password,
+		},
+	}
+}
@@ -0,0 +1,55 @@
+package rtc
+
+import (
+	"github.com/lkmio/lkm/stream"
+	"net"
+	"testing"
+)
+
+func TestTurnRelayIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		publicIP string
+		listenIP string
+		expected string
+		success  bool
+	}{
+		{"public ip", "1.2.3.4", "0.0.0.0", "1.2.3.4", true},
+		{"fallback to listen ip", "", "192.168.1.2", "192.168.1.2", true},
+		{"invalid public ip", "localhost", "192.168.1.2", "192.168.1.2", true},
+		{"none", "", "0.0.0.0", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream.AppConfig.PublicIP, stream.AppConfig.ListenIP = test.publicIP, test.listenIP
+			ip, err := turnRelayIP()
+			if (err == nil) != test.success {
+				t.Fatalf("relay ip err: %v", err)
+			} else if err == nil && ip.String() != test.expected {
+				t.Fatalf("relay ip %s, expected %s", ip, test.expected)
+			}
+		})
+	}
+}
+
+func TestPermissionHandler(t *testing.T) {
+	handler := newPermissionHandler([]net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("192.168.1.2")})
+	client := &net.UDPAddr{IP: net.ParseIP("5.6.7.8"), Port: 50000}
+	tests := []struct {
+		peer    string
+		success bool
+	}{
+		{"1.2.3.4", true},
+		{"192.168.1.2", true},
+		{"192.168.1.3", false},
+		{"127.0.0.1", false},
+		{"::1", false},
+	}
+
+	for _, test := range tests {
+		if ok := handler(client, net.ParseIP(test.peer)); ok != test.success {
+			t.Fatalf("permission for %s: %t", test.peer, ok)
+		}
+	}
+}
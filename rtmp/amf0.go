@@ -0,0 +1,171 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0EcmaArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0A
+	amf0Date        = 0x0B
+	amf0LongString  = 0x0C
+	amf0Unsupported = 0x0D
+	amf0XmlDocument = 0x0F
+
+	// 嵌套对象的最大深度, 避免恶意数据导致栈溢出
+	amf0MaxDepth = 32
+)
+
+// 解码AMF0数据, 用于解析推流端发送的数据消息. object和ecma array解码为map, strict array解码为slice, date解码为毫秒数
+type amf0Decoder struct {
+	data []byte
+}
+
+func (d *amf0Decoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data) < n {
+		return nil, fmt.Errorf("amf0 data too short, need %d bytes, remain %d", n, len(d.data))
+	}
+
+	bytes := d.data[:n]
+	d.data = d.data[n:]
+	return bytes, nil
+}
+
+func (d *amf0Decoder) readString(long bool) (string, error) {
+	var size int
+	if long {
+		bytes, err := d.read(4)
+		if err != nil {
+			return "", err
+		}
+
+		size = int(binary.BigEndian.Uint32(bytes))
+	} else {
+		bytes, err := d.read(2)
+		if err != nil {
+			return "", err
+		}
+
+		size = int(binary.BigEndian.Uint16(bytes))
+	}
+
+	bytes, err := d.read(size)
+	return string(bytes), err
+}
+
+// 读取object和ecma array的属性, 直到空key和object end标记
+func (d *amf0Decoder) readProperties(depth int) (map[string]interface{}, error) {
+	properties := make(map[string]interface{}, 8)
+	for {
+		key, err := d.readString(false)
+		if err != nil {
+			return nil, err
+		}
+
+		if key == "" && len(d.data) > 0 && d.data[0] == amf0ObjectEnd {
+			d.data = d.data[1:]
+			return properties, nil
+		}
+
+		if properties[key], err = d.readValue(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (d *amf0Decoder) readValue(depth int) (interface{}, error) {
+	if depth > amf0MaxDepth {
+		return nil, fmt.Errorf("amf0 nesting too deep")
+	}
+
+	marker, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch marker[0] {
+	case amf0Number:
+		bytes, err := d.read(8)
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(bytes)), nil
+	case amf0Boolean:
+		bytes, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+
+		return bytes[0] != 0, nil
+	case amf0String:
+		return d.readString(false)
+	case amf0LongString, amf0XmlDocument:
+		return d.readString(true)
+	case amf0Object:
+		return d.readProperties(depth)
+	case amf0EcmaArray:
+		// 数量仅作参考, 以object end标记结束
+		if _, err = d.read(4); err != nil {
+			return nil, err
+		}
+
+		return d.readProperties(depth)
+	case amf0StrictArray:
+		bytes, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+
+		count := int(binary.BigEndian.Uint32(bytes))
+		if count > len(d.data) {
+			return nil, fmt.Errorf("invalid amf0 strict array count %d", count)
+		}
+
+		array := make([]interface{}, count)
+		for i := range array {
+			if array[i], err = d.readValue(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+
+		return array, nil
+	case amf0Date:
+		// 8字节毫秒数和2字节时区
+		bytes, err := d.read(10)
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(bytes)), nil
+	case amf0Null, amf0Undefined, amf0Unsupported:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported amf0 marker 0x%x", marker[0])
+	}
+}
+
+// 解码所有AMF0值
+func decodeAMF0(data []byte) ([]interface{}, error) {
+	decoder := amf0Decoder{data: data}
+	var values []interface{}
+	for len(decoder.data) > 0 {
+		value, err := decoder.readValue(0)
+		if err != nil {
+			return values, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
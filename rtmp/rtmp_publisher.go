@@ -4,7 +4,6 @@ import (
 	"github.com/lkmio/avformat/libflv"
 	"github.com/lkmio/avformat/librtmp"
 	"github.com/lkmio/avformat/utils"
-	"github.com/lkmio/lkm/log"
 	"github.com/lkmio/lkm/stream"
 	"net"
 )
@@ -23,12 +22,8 @@ func (p *Publisher) Input(data []byte) error {
 func (p *Publisher) OnDeMuxStream(stream utils.AVStream) {
 	// AVStream的ExtraData已经拷贝, 释放掉内存池中最新分配的内存
 	p.FindOrCreatePacketBuffer(stream.Index(), stream.Type()).FreeTail()
-	if !p.IsCompleted() {
-		p.PublishSource.OnDeMuxStream(stream)
-	} else if !p.IsTimeoutTrack(stream.Index()) {
-		p.SetTimeoutTrack(stream.Index())
-		log.Sugar.Errorf("添加 %s track超时", stream.Type().ToString())
-	}
+	// 已经存在的track再次收到sequence header(编码参数变化)和超时后到达的track, 都交给PublishSource处理
+	p.PublishSource.OnDeMuxStream(stream)
 }
 
 // OnVideo 解析出来的完整视频包
@@ -58,6 +53,12 @@ func (p *Publisher) Close() {
 	p.stack = nil
 }
 
+// Disconnect 推流链路断开, 开启了重连等待时保留输出流
+func (p *Publisher) Disconnect() {
+	p.PublishSource.Disconnect()
+	p.stack = nil
+}
+
 func NewPublisher(source string, stack *librtmp.Stack, conn net.Conn) *Publisher {
 	deMuxer := libflv.NewDeMuxer()
 	publisher := &Publisher{PublishSource: stream.PublishSource{ID: source, Type: stream.SourceTypeRtmp, TransDeMuxer: deMuxer, Conn: conn}, stack: stack}
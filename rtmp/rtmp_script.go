@@ -0,0 +1,255 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/lkmio/lkm/stream"
+	"time"
+)
+
+const (
+	// 客户端握手数据C0+C1+C2的长度
+	handshakeSize = 1 + 1536 + 1536
+
+	messageTypeSetChunkSize = 1
+	messageTypeDataAMF3     = 15
+	messageTypeDataAMF0     = 18
+
+	defaultChunkSize = 128
+)
+
+// 一路chunk stream的消息头和正在组装的消息
+type scriptChunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    int
+	typeId    byte
+	extended  bool // 上一个chunk携带扩展时间戳, fmt3的chunk同样携带
+
+	received int    // 当前消息已经接收的长度
+	payload  []byte // 只保存需要解析的消息
+}
+
+// scriptReader 解析推流端发送的chunk, 获取数据消息(onCuePoint/onTextData等). librtmp只回调音视频, 不回调数据消息,
+// 所以与协议栈并行解析同一份数据, 只保存chunk size和数据消息, 其余消息只统计长度.
+type scriptReader struct {
+	skip      int // 剩余未跳过的握手字节数
+	chunkSize int
+	streams   map[uint32]*scriptChunkStream
+	pending   []byte // 不完整的chunk
+	handler   func(timestamp uint32, data []byte)
+	err       error
+}
+
+// 解析一个完整的chunk, 数据不足返回0
+func (r *scriptReader) readChunk(data []byte) (int, error) {
+	if len(data) < 1 {
+		return 0, nil
+	}
+
+	format := data[0] >> 6
+	csid := uint32(data[0] & 0x3F)
+	offset := 1
+	if csid == 0 {
+		if len(data) < 2 {
+			return 0, nil
+		}
+
+		csid = 64 + uint32(data[1])
+		offset = 2
+	} else if csid == 1 {
+		if len(data) < 3 {
+			return 0, nil
+		}
+
+		csid = 64 + uint32(data[1]) + uint32(data[2])<<8
+		offset = 3
+	}
+
+	chunkStream, ok := r.streams[csid]
+	if !ok {
+		if format != 0 {
+			return 0, fmt.Errorf("the first chunk of chunk stream %d is type %d", csid, format)
+		}
+
+		chunkStream = &scriptChunkStream{}
+	}
+
+	headerSize := [4]int{11, 7, 3, 0}[format]
+	if len(data) < offset+headerSize {
+		return 0, nil
+	}
+
+	header := data[offset : offset+headerSize]
+	offset += headerSize
+
+	var timestamp uint32
+	if format < 3 {
+		timestamp = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	}
+
+	extended := chunkStream.extended
+	if format < 3 {
+		extended = timestamp == 0xFFFFFF
+	}
+
+	if extended {
+		if len(data) < offset+4 {
+			return 0, nil
+		}
+
+		timestamp = binary.BigEndian.Uint32(data[offset:])
+		offset += 4
+	}
+
+	// 新消息的第一个chunk
+	first := format < 3 || chunkStream.received == 0
+	length, typeId := chunkStream.length, chunkStream.typeId
+	if format < 2 {
+		length = int(header[3])<<16 | int(header[4])<<8 | int(header[5])
+		typeId = header[6]
+	}
+
+	if first && chunkStream.received > 0 {
+		return 0, fmt.Errorf("chunk stream %d received a new message before the previous one completed", csid)
+	}
+
+	size := length - chunkStream.received
+	if size > r.chunkSize {
+		size = r.chunkSize
+	}
+
+	if len(data) < offset+size {
+		return 0, nil
+	}
+
+	// 数据足够后再更新消息头, 数据不足时下次重新解析该chunk
+	r.streams[csid] = chunkStream
+	chunkStream.extended = extended
+	chunkStream.length, chunkStream.typeId = length, typeId
+	if first {
+		switch format {
+		case 0:
+			chunkStream.timestamp = timestamp
+			chunkStream.delta = 0
+		case 1, 2:
+			chunkStream.delta = timestamp
+			chunkStream.timestamp += timestamp
+		default:
+			chunkStream.timestamp += chunkStream.delta
+		}
+	}
+
+	if messageTypeSetChunkSize == typeId || messageTypeDataAMF0 == typeId || messageTypeDataAMF3 == typeId {
+		chunkStream.payload = append(chunkStream.payload, data[offset:offset+size]...)
+	}
+
+	chunkStream.received += size
+	offset += size
+
+	if chunkStream.received >= chunkStream.length {
+		r.onMessage(chunkStream)
+		chunkStream.received = 0
+		chunkStream.payload = chunkStream.payload[:0]
+	}
+
+	return offset, nil
+}
+
+func (r *scriptReader) onMessage(chunkStream *scriptChunkStream) {
+	switch chunkStream.typeId {
+	case messageTypeSetChunkSize:
+		if len(chunkStream.payload) >= 4 {
+			if size := int(binary.BigEndian.Uint32(chunkStream.payload) & 0x7FFFFFFF); size > 0 {
+				r.chunkSize = size
+			}
+		}
+	case messageTypeDataAMF0:
+		r.handler(chunkStream.timestamp, chunkStream.payload)
+	case messageTypeDataAMF3:
+		// AMF3数据消息以0x00开头, 其余为AMF0编码
+		if len(chunkStream.payload) > 1 {
+			r.handler(chunkStream.timestamp, chunkStream.payload[1:])
+		}
+	}
+}
+
+// Input 输入推流端发送的数据, 包括握手. 解析失败后不再解析, 不影响协议栈
+func (r *scriptReader) Input(data []byte) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	if r.skip > 0 {
+		n := r.skip
+		if n > len(data) {
+			n = len(data)
+		}
+
+		r.skip -= n
+		data = data[n:]
+	}
+
+	if len(r.pending) > 0 {
+		r.pending = append(r.pending, data...)
+		data = r.pending
+	}
+
+	for len(data) > 0 {
+		n, err := r.readChunk(data)
+		if err != nil {
+			r.err = err
+			r.pending = nil
+			return err
+		} else if n == 0 {
+			break
+		}
+
+		data = data[n:]
+	}
+
+	// 保存不完整的chunk, 避免引用协议栈的接收缓冲区
+	r.pending = append(r.pending[:0], data...)
+	return nil
+}
+
+func newScriptReader(handler func(timestamp uint32, data []byte)) *scriptReader {
+	return &scriptReader{
+		skip:      handshakeSize,
+		chunkSize: defaultChunkSize,
+		streams:   make(map[uint32]*scriptChunkStream, 8),
+		handler:   handler,
+	}
+}
+
+// 将onCuePoint/onTextData数据消息转换为元数据, @setDataFrame包装的同样处理. 其余数据消息(例如onMetaData)返回nil
+func parseScriptMetadata(sourceId string, timestamp uint32, data []byte) *stream.Metadata {
+	values, err := decodeAMF0(data)
+	if err != nil || len(values) < 1 {
+		return nil
+	}
+
+	name, _ := values[0].(string)
+	if "@setDataFrame" == name && len(values) > 1 {
+		values = values[1:]
+		name, _ = values[0].(string)
+	}
+
+	if stream.MetadataTypeCuePoint != name && stream.MetadataTypeTextData != name {
+		return nil
+	}
+
+	// 通常只有一个object参数, 多个参数作为数组
+	var body interface{} = values[1:]
+	if len(values) == 2 {
+		body = values[1]
+	}
+
+	bytes, err := json.Marshal(body)
+	if err != nil {
+		return nil
+	}
+
+	return &stream.Metadata{Source: sourceId, Type: name, Time: time.Now().UnixMilli(), Pts: int64(timestamp), Data: bytes}
+}
@@ -0,0 +1,220 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func encodeAMF0String(value string) []byte {
+	data := []byte{amf0String, 0, 0}
+	binary.BigEndian.PutUint16(data[1:], uint16(len(value)))
+	return append(data, value...)
+}
+
+func encodeAMF0Number(value float64) []byte {
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint64(data[1:], math.Float64bits(value))
+	return data
+}
+
+// key和编码后的value交替
+func encodeAMF0Object(properties ...interface{}) []byte {
+	data := []byte{amf0Object}
+	for i := 0; i < len(properties); i += 2 {
+		key := properties[i].(string)
+		data = append(data, byte(len(key)>>8), byte(len(key)))
+		data = append(data, key...)
+		data = append(data, properties[i+1].([]byte)...)
+	}
+
+	return append(data, 0, 0, amf0ObjectEnd)
+}
+
+func joinBytes(values ...[]byte) []byte {
+	return bytes.Join(values, nil)
+}
+
+// 按照chunk size拆分消息, 第一个chunk使用format, 其余使用fmt3. 时间戳超过0xFFFFFF时每个chunk都携带扩展时间戳
+func newTestChunks(format, csid byte, timestamp uint32, typeId byte, payload []byte, chunkSize int) [][]byte {
+	var extended []byte
+	field := timestamp
+	if timestamp >= 0xFFFFFF {
+		field = 0xFFFFFF
+		extended = binary.BigEndian.AppendUint32(nil, timestamp)
+	}
+
+	header := []byte{format<<6 | csid, byte(field >> 16), byte(field >> 8), byte(field)}
+	if format < 2 {
+		header = append(header, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)), typeId)
+	}
+
+	if format == 0 {
+		// message stream id, 小端
+		header = append(header, 1, 0, 0, 0)
+	}
+
+	var chunks [][]byte
+	for first := true; first || len(payload) > 0; first = false {
+		size := len(payload)
+		if size > chunkSize {
+			size = chunkSize
+		}
+
+		chunk := []byte{3<<6 | csid}
+		if first {
+			chunk = append([]byte(nil), header...)
+		}
+
+		chunks = append(chunks, joinBytes(chunk, extended, payload[:size]))
+		payload = payload[size:]
+	}
+
+	return chunks
+}
+
+func TestDecodeAMF0(t *testing.T) {
+	strictArray := joinBytes([]byte{amf0StrictArray, 0, 0, 0, 2}, encodeAMF0Number(1), encodeAMF0String("a"))
+	ecmaArray := joinBytes([]byte{amf0EcmaArray, 0, 0, 0, 1}, encodeAMF0Object("k", encodeAMF0Number(2))[1:])
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []interface{}
+		success  bool
+	}{
+		{"number", encodeAMF0Number(1.5), []interface{}{1.5}, true},
+		{"boolean", []byte{amf0Boolean, 1}, []interface{}{true}, true},
+		{"string", encodeAMF0String("onCuePoint"), []interface{}{"onCuePoint"}, true},
+		{"null", []byte{amf0Null, amf0Undefined}, []interface{}{nil, nil}, true},
+		{"object", encodeAMF0Object("name", encodeAMF0String("cue"), "time", encodeAMF0Number(3)), []interface{}{map[string]interface{}{"name": "cue", "time": 3.0}}, true},
+		{"nested object", encodeAMF0Object("parameters", encodeAMF0Object("k", encodeAMF0String("v"))), []interface{}{map[string]interface{}{"parameters": map[string]interface{}{"k": "v"}}}, true},
+		{"strict array", strictArray, []interface{}{[]interface{}{1.0, "a"}}, true},
+		{"ecma array", ecmaArray, []interface{}{map[string]interface{}{"k": 2.0}}, true},
+		{"truncated string", encodeAMF0String("onCuePoint")[:5], nil, false},
+		{"unterminated object", encodeAMF0Object("k", encodeAMF0Number(1))[:12], nil, false},
+		{"unknown marker", []byte{0x11}, nil, false},
+		{"too deep", bytes.Repeat([]byte{amf0StrictArray, 0, 0, 0, 1}, amf0MaxDepth+2), nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := decodeAMF0(test.data)
+			if (err == nil) != test.success {
+				t.Fatalf("err: %v", err)
+			} else if test.success && !reflect.DeepEqual(values, test.expected) {
+				t.Fatalf("values: %v, expected: %v", values, test.expected)
+			}
+		})
+	}
+}
+
+// 跳过握手后组装数据消息, 与音视频chunk交错, 按照推流端设置的chunk size拆分, 任意拆包结果一致
+func TestScriptReader(t *testing.T) {
+	cuePoint := joinBytes(encodeAMF0String("onCuePoint"), encodeAMF0Object("name", encodeAMF0String("ad-break"), "time", encodeAMF0Number(12.5)))
+	textData := joinBytes(encodeAMF0String("onTextData"), encodeAMF0Object("text", encodeAMF0String(string(bytes.Repeat([]byte{'x'}, 100)))))
+	video := bytes.Repeat([]byte{0x17}, 150)
+
+	var stream [][]byte
+	stream = append(stream, make([]byte, handshakeSize))
+	stream = append(stream, newTestChunks(0, 2, 0, messageTypeSetChunkSize, []byte{0, 0, 0, 64}, 128)...)
+
+	// 视频和数据消息的chunk交错发送
+	videoChunks := newTestChunks(0, 6, 1000, 9, video, 64)
+	cueChunks := newTestChunks(0, 5, 1040, messageTypeDataAMF0, cuePoint, 64)
+	for i := 0; i < len(videoChunks) || i < len(cueChunks); i++ {
+		if i < len(videoChunks) {
+			stream = append(stream, videoChunks[i])
+		}
+		if i < len(cueChunks) {
+			stream = append(stream, cueChunks[i])
+		}
+	}
+
+	// fmt1的时间戳为增量, AMF3数据消息以0x00开头
+	stream = append(stream, newTestChunks(1, 5, 20, messageTypeDataAMF3, append([]byte{0}, textData...), 64)...)
+	// 扩展时间戳
+	stream = append(stream, newTestChunks(0, 5, 0x01000000, messageTypeDataAMF0, cuePoint, 64)...)
+	data := joinBytes(stream...)
+
+	type message struct {
+		timestamp uint32
+		data      []byte
+	}
+
+	expected := []message{{1040, cuePoint}, {1060, textData}, {0x01000000, cuePoint}}
+
+	for _, size := range []int{1, 7, 100, len(data)} {
+		var messages []message
+		reader := newScriptReader(func(timestamp uint32, data []byte) {
+			messages = append(messages, message{timestamp, append([]byte(nil), data...)})
+		})
+
+		for i := 0; i < len(data); i += size {
+			end := i + size
+			if end > len(data) {
+				end = len(data)
+			}
+
+			if err := reader.Input(data[i:end]); err != nil {
+				t.Fatalf("input size %d err: %s", size, err.Error())
+			}
+		}
+
+		if !reflect.DeepEqual(messages, expected) {
+			t.Fatalf("input size %d messages: %v", size, messages)
+		} else if reader.chunkSize != 64 {
+			t.Fatalf("chunk size: %d", reader.chunkSize)
+		} else if len(reader.pending) != 0 {
+			t.Fatalf("pending: %d", len(reader.pending))
+		}
+	}
+
+	// 未声明消息头的chunk stream, 停止解析
+	reader := newScriptReader(func(timestamp uint32, data []byte) {})
+	if err := reader.Input(joinBytes(make([]byte, handshakeSize), []byte{3<<6 | 7})); err == nil {
+		t.Fatal("invalid chunk accepted")
+	}
+}
+
+func TestParseScriptMetadata(t *testing.T) {
+	cue := encodeAMF0Object("name", encodeAMF0String("cue"))
+	tests := []struct {
+		name     string
+		data     []byte
+		typ      string
+		expected string
+	}{
+		{"cue point", joinBytes(encodeAMF0String("onCuePoint"), cue), "onCuePoint", `{"name":"cue"}`},
+		{"set data frame", joinBytes(encodeAMF0String("@setDataFrame"), encodeAMF0String("onTextData"), encodeAMF0Object("text", encodeAMF0String("hi"))), "onTextData", `{"text":"hi"}`},
+		{"arguments", joinBytes(encodeAMF0String("onCuePoint"), encodeAMF0Number(1), encodeAMF0String("a")), "onCuePoint", `[1,"a"]`},
+		{"meta data", joinBytes(encodeAMF0String("@setDataFrame"), encodeAMF0String("onMetaData"), encodeAMF0Object("width", encodeAMF0Number(1920))), "", ""},
+		{"invalid", []byte{0x11}, "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata := parseScriptMetadata("live/test", 100, test.data)
+			if test.typ == "" {
+				if metadata != nil {
+					t.Fatalf("unexpected metadata: %s", metadata.Type)
+				}
+				return
+			}
+
+			if metadata == nil || metadata.Type != test.typ || metadata.Pts != 100 || metadata.Source != "live/test" {
+				t.Fatalf("metadata: %+v", metadata)
+			}
+
+			var actual, expected interface{}
+			_ = json.Unmarshal(metadata.Data, &actual)
+			_ = json.Unmarshal([]byte(test.expected), &expected)
+			if !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("data: %s, expected: %s", metadata.Data, test.expected)
+			}
+		})
+	}
+}
@@ -16,6 +16,7 @@ type Session struct {
 
 	conn          net.Conn
 	receiveBuffer *stream.ReceiveBuffer // 推流源收流队列
+	scriptReader  *scriptReader         // 开启DataChannel时, 解析推流端的数据消息作为元数据
 }
 
 func (s *Session) generateSourceID(app, stream string) string {
@@ -66,17 +67,28 @@ func (s *Session) OnPlay(app, stream_ string) utils.HookState {
 
 	log.Sugar.Infof("rtmp onplay app: %s stream: %s sink: %v conn: %s", app, stream_, sink.GetID(), s.conn.RemoteAddr().String())
 
+	if err := stream.SetSinkTrackParams(sink, values); err != nil {
+		log.Sugar.Errorf("rtmp拉流失败 err: %s source: %s sink: %s", err.Error(), sourceId, sink.GetID())
+		return utils.HookStateFailure
+	}
+
 	_, state := stream.PreparePlaySink(sink)
 	if utils.HookStateOK != state {
 		log.Sugar.Errorf("rtmp拉流失败 source: %s sink: %s", sourceId, sink.GetID())
 	} else {
 		s.handle = sink
+		s.scriptReader = nil
 	}
 
 	return state
 }
 
 func (s *Session) Input(conn net.Conn, data []byte) error {
+	// 协议栈处理完再解析, 数据消息可能和publish命令在同一个包中
+	if s.scriptReader != nil {
+		defer s.readScriptData(data)
+	}
+
 	// 推流会话, 收到的包都将交由主协程处理
 	if s.isPublisher {
 		s.handle.(*Publisher).PublishSource.Input(data)
@@ -86,6 +98,30 @@ func (s *Session) Input(conn net.Conn, data []byte) error {
 	}
 }
 
+// 解析推流端发送的数据, 解析失败后不再提取元数据
+func (s *Session) readScriptData(data []byte) {
+	if s.scriptReader == nil {
+		return
+	}
+
+	if err := s.scriptReader.Input(data); err != nil {
+		log.Sugar.Warnf("解析rtmp数据消息失败, 停止提取元数据 err: %s", err.Error())
+		s.scriptReader = nil
+	}
+}
+
+// 推流端发送的onCuePoint/onTextData, 发布给订阅元数据的拉流端
+func (s *Session) onScriptData(timestamp uint32, data []byte) {
+	publisher, ok := s.handle.(*Publisher)
+	if !ok || !stream.HasMetadataSubscriber(publisher.ID) {
+		return
+	}
+
+	if metadata := parseScriptMetadata(publisher.ID, timestamp, data); metadata != nil {
+		stream.PublishMetadata(metadata)
+	}
+}
+
 func (s *Session) Close() {
 	// session/conn/stack相互引用, go释放不了...手动赋值为nil
 	s.conn = nil
@@ -107,7 +143,7 @@ func (s *Session) Close() {
 		log.Sugar.Infof("rtmp推流结束 %s", publisher.String())
 
 		if s.isPublisher {
-			publisher.Close()
+			publisher.Disconnect()
 			s.receiveBuffer = nil
 		}
 	} else {
@@ -124,5 +160,10 @@ func NewSession(conn net.Conn) *Session {
 	stack := librtmp.NewStack(session)
 	session.stack = stack
 	session.conn = conn
+
+	if stream.AppConfig.WebRtc.DataChannel.Enable {
+		session.scriptReader = newScriptReader(session.onScriptData)
+	}
+
 	return session
 }
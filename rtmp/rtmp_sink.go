@@ -1,9 +1,12 @@
 package rtmp
 
 import (
+	"bytes"
+	"encoding/binary"
 	"github.com/lkmio/avformat/librtmp"
 	"github.com/lkmio/avformat/utils"
 	"github.com/lkmio/lkm/stream"
+	"math"
 	"net"
 )
 
@@ -20,6 +23,15 @@ func (s *Sink) StopStreaming(_ stream.TransStream) {
 	_ = s.stack.SendStreamEOFChunk(s.Conn)
 }
 
+// StreamNotFound 等待推流超时, 发送NetStream.Play.StreamNotFound后关闭链路, 由会话的读取协程关闭Sink.
+// 一次Write发送完整的消息, 与会话协程的发送互不穿插
+func (s *Sink) StreamNotFound() {
+	if conn := s.Conn; conn != nil {
+		_, _ = conn.Write(newStatusMessage("error", "NetStream.Play.StreamNotFound", "stream not found"))
+		_ = conn.Close()
+	}
+}
+
 func (s *Sink) Close() {
 	s.stack = nil
 	s.BaseSink.Close()
@@ -31,3 +43,71 @@ func NewSink(id stream.SinkID, sourceId string, conn net.Conn, stack *librtmp.St
 		stack:    stack,
 	}
 }
+
+// 创建onStatus命令消息, 按librtmp的chunk size分包.
+// message stream id与librtmp发送音视频的一致, chunk stream id取音视频之后的id, 不影响其他chunk的头部压缩
+func newStatusMessage(level, code, description string) []byte {
+	body := bytes.Buffer{}
+	writeAMF0String(&body, "onStatus")
+	// transaction id
+	body.WriteByte(0x00)
+	_ = binary.Write(&body, binary.BigEndian, math.Float64bits(0))
+	// null
+	body.WriteByte(0x05)
+	// object
+	body.WriteByte(0x03)
+	writeAMF0Property(&body, "level", level)
+	writeAMF0Property(&body, "code", code)
+	writeAMF0Property(&body, "description", description)
+	body.Write([]byte{0x00, 0x00, 0x09})
+
+	audioCsid, _ := chunkHeader(librtmp.NewAudioChunk())
+	videoCsid, msid := chunkHeader(librtmp.NewVideoChunk())
+	csid := audioCsid
+	if videoCsid > csid {
+		csid = videoCsid
+	}
+	csid++
+
+	// fmt 0, 时间戳0, AMF0命令消息
+	length := body.Len()
+	message := []byte{csid, 0x00, 0x00, 0x00, byte(length >> 16), byte(length >> 8), byte(length), 0x14, 0x00, 0x00, 0x00, 0x00}
+	binary.LittleEndian.PutUint32(message[8:], msid)
+
+	// 超过chunk size的部分使用fmt 3分包
+	data := body.Bytes()
+	for i := 0; i < len(data); i += librtmp.ChunkSize {
+		if i > 0 {
+			message = append(message, 0xC0|csid)
+		}
+
+		end := i + librtmp.ChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		message = append(message, data[i:end]...)
+	}
+
+	return message
+}
+
+// 解析librtmp生成的fmt 0 chunk头, 返回chunk stream id和message stream id
+func chunkHeader(chunk librtmp.Chunk) (byte, uint32) {
+	header := make([]byte, 32)
+	n := chunk.ToBytes(header)
+	utils.Assert(n >= 12 && header[0]>>6 == 0)
+	return header[0] & 0x3F, binary.LittleEndian.Uint32(header[8:12])
+}
+
+func writeAMF0String(buffer *bytes.Buffer, value string) {
+	buffer.WriteByte(0x02)
+	_ = binary.Write(buffer, binary.BigEndian, uint16(len(value)))
+	buffer.WriteString(value)
+}
+
+func writeAMF0Property(buffer *bytes.Buffer, key, value string) {
+	_ = binary.Write(buffer, binary.BigEndian, uint16(len(key)))
+	buffer.WriteString(key)
+	writeAMF0String(buffer, value)
+}
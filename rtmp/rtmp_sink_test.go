@@ -0,0 +1,71 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/lkmio/avformat/librtmp"
+	"strings"
+	"testing"
+)
+
+// onStatus消息按chunk size分包, message stream id与音视频一致
+func TestNewStatusMessage(t *testing.T) {
+	audioCsid, _ := chunkHeader(librtmp.NewAudioChunk())
+	videoCsid, msid := chunkHeader(librtmp.NewVideoChunk())
+
+	tests := []struct {
+		name        string
+		description string
+	}{
+		{"short", "stream not found"},
+		{"chunk size", strings.Repeat("a", librtmp.ChunkSize)},
+		{"multiple chunks", strings.Repeat("a", librtmp.ChunkSize*2+1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := newStatusMessage("error", "NetStream.Play.StreamNotFound", test.description)
+
+			csid := message[0] & 0x3F
+			if message[0]>>6 != 0 {
+				t.Fatalf("first chunk fmt: %d", message[0]>>6)
+			} else if csid == audioCsid || csid == videoCsid {
+				t.Fatalf("chunk stream id %d used by media", csid)
+			} else if message[7] != 0x14 {
+				t.Fatalf("message type: %d", message[7])
+			} else if id := binary.LittleEndian.Uint32(message[8:12]); id != msid {
+				t.Fatalf("message stream id: %d expected: %d", id, msid)
+			}
+
+			// 去掉fmt 3的chunk头, 还原消息体
+			length := int(message[4])<<16 | int(message[5])<<8 | int(message[6])
+			body := bytes.Buffer{}
+			data := message[12:]
+			for len(data) > 0 {
+				if body.Len() > 0 {
+					if data[0] != 0xC0|csid {
+						t.Fatalf("unexpected chunk header: %x", data[0])
+					}
+
+					data = data[1:]
+				}
+
+				n := librtmp.ChunkSize
+				if n > len(data) {
+					n = len(data)
+				}
+
+				body.Write(data[:n])
+				data = data[n:]
+			}
+
+			if body.Len() != length {
+				t.Fatalf("body length: %d expected: %d", body.Len(), length)
+			} else if !bytes.Contains(body.Bytes(), []byte("NetStream.Play.StreamNotFound")) || !bytes.Contains(body.Bytes(), []byte(test.description)) {
+				t.Fatal("status missing from the message body")
+			} else if !bytes.HasSuffix(body.Bytes(), []byte{0x00, 0x00, 0x09}) {
+				t.Fatal("object end marker missing")
+			}
+		})
+	}
+}
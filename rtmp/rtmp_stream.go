@@ -4,6 +4,7 @@ import (
 	"github.com/lkmio/avformat/libflv"
 	"github.com/lkmio/avformat/librtmp"
 	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/flv"
 	"github.com/lkmio/lkm/stream"
 )
 
@@ -38,20 +39,28 @@ func (t *transStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error
 	pts = packet.ConvertPts(1000)
 	ct := pts - dts
 
+	// 同类型的第二路及以后的track使用Enhanced RTMP多track封装
+	_, track := t.FindTrack(packet.Index())
+	trackId := flv.MultitrackTrackID(t.Tracks, packet.Index())
 	if utils.AVMediaTypeAudio == packet.MediaType() {
 		data = packet.Data()
 		chunk = &t.audioChunk
 		chunkPayloadOffset = 2
-		payloadSize += chunkPayloadOffset + len(data)
 	} else if utils.AVMediaTypeVideo == packet.MediaType() {
 		videoPkt = true
-		videoKey = packet.KeyFrame()
+		// 只按照第一路视频的关键帧切片
+		videoKey = packet.KeyFrame() && trackId == 0
 		data = packet.AVCCPacketData()
 		chunk = &t.videoChunk
 		chunkPayloadOffset = t.muxer.ComputeVideoDataSize(uint32(ct))
-		payloadSize += chunkPayloadOffset + len(data)
 	}
 
+	if trackId > 0 {
+		chunkPayloadOffset = flv.MultitrackHeaderSize(packet.MediaType(), false)
+	}
+
+	payloadSize += chunkPayloadOffset + len(data)
+
 	// 遇到视频关键帧, 发送剩余的流, 创建新切片
 	if videoKey {
 		if segment := t.MWBuffer.FlushSegment(); len(segment) > 0 {
@@ -78,7 +87,9 @@ func (t *transStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error
 	n := chunk.ToBytes(allocate)
 
 	// 写flv
-	if videoPkt {
+	if trackId > 0 {
+		n += flv.WriteMultitrackHeader(allocate[n:], track, trackId, packet.KeyFrame(), false, int32(ct))
+	} else if videoPkt {
 		n += t.muxer.WriteVideoData(allocate[n:], uint32(ct), packet.KeyFrame(), false)
 	} else {
 		n += t.muxer.WriteAudioData(allocate[n:], false)
@@ -113,6 +124,15 @@ func (t *transStream) ReadKeyFrameBuffer() ([][]byte, int64, error) {
 	return t.OutBuffer[:t.OutBufferSize], 0, nil
 }
 
+// AddTrack 同类型的第二路及以后的track使用Enhanced RTMP多track封装, 不支持的编码器返回error
+func (t *transStream) AddTrack(stream utils.AVStream) error {
+	if err := flv.CheckMultitrack(t.Tracks, stream); err != nil {
+		return err
+	}
+
+	return t.BaseTransStream.AddTrack(stream)
+}
+
 func (t *transStream) WriteHeader() error {
 	utils.Assert(t.Tracks != nil)
 	utils.Assert(!t.BaseTransStream.Completed)
@@ -122,8 +142,11 @@ func (t *transStream) WriteHeader() error {
 	var audioCodecId utils.AVCodecID
 	var videoCodecId utils.AVCodecID
 
+	// 封装器只添加每种类型的第一路track
 	for _, track := range t.Tracks {
-		if utils.AVMediaTypeAudio == track.Type() {
+		if audioStream != nil && utils.AVMediaTypeAudio == track.Type() || videoStream != nil && utils.AVMediaTypeVideo == track.Type() {
+			continue
+		} else if utils.AVMediaTypeAudio == track.Type() {
 			audioStream = track
 			audioCodecId = audioStream.CodecId()
 			t.audioChunk = librtmp.NewAudioChunk()
@@ -138,7 +161,6 @@ func (t *transStream) WriteHeader() error {
 
 	// 初始化
 	t.BaseTransStream.Completed = true
-	t.header = make([]byte, 1024)
 	t.muxer = libflv.NewMuxer()
 	if utils.AVCodecIdNONE != audioCodecId {
 		t.muxer.AddAudioTrack(audioCodecId, 0, 0, 0)
@@ -148,7 +170,30 @@ func (t *transStream) WriteHeader() error {
 		t.muxer.AddVideoTrack(videoCodecId)
 	}
 
-	// 生成推流的数据头(chunk+sequence header)
+	t.writeSequenceHeader()
+	t.MWBuffer = stream.NewMergeWritingBuffer(t.ExistVideo)
+	return nil
+}
+
+// 生成推流的数据头(chunk+sequence header). 每次生成都使用新的内存, 已经交给sink异步发送的数据头不受影响.
+// 同类型的其余track在第一路之后发送多track sequence header
+func (t *transStream) writeSequenceHeader() {
+	var audioStream utils.AVStream
+	var videoStream utils.AVStream
+	var multitracks []utils.AVStream
+	size := 1024
+	for _, track := range t.Tracks {
+		if utils.AVMediaTypeAudio == track.Type() && audioStream == nil {
+			audioStream = track
+		} else if utils.AVMediaTypeVideo == track.Type() && videoStream == nil {
+			videoStream = track
+		} else if flv.ExistMultitrackSequenceHeader(track) {
+			multitracks = append(multitracks, track)
+			size += 12 + flv.MultitrackHeaderSize(track.Type(), true) + len(flv.SequenceHeaderData(track))
+		}
+	}
+
+	t.header = make([]byte, size)
 	var n int
 	if audioStream != nil {
 		n += t.muxer.WriteAudioData(t.header[12:], true)
@@ -173,9 +218,65 @@ func (t *transStream) WriteHeader() error {
 		n += 12
 	}
 
+	for _, track := range multitracks {
+		chunk := &t.audioChunk
+		if utils.AVMediaTypeVideo == track.Type() {
+			chunk = &t.videoChunk
+		}
+
+		tmp := n
+		n += 12
+		n += flv.WriteMultitrackHeader(t.header[n:], track, flv.MultitrackTrackID(t.Tracks, track.Index()), false, true, 0)
+		n += copy(t.header[n:], flv.SequenceHeaderData(track))
+
+		chunk.Length = n - tmp - 12
+		chunk.ToBytes(t.header[tmp:])
+	}
+
 	t.headerSize = n
-	t.MWBuffer = stream.NewMergeWritingBuffer(t.ExistVideo)
-	return nil
+}
+
+// UpdateTrack 编码参数发生变化, 重新生成sequence header发送给已有的sink
+func (t *transStream) UpdateTrack(stream utils.AVStream) ([][]byte, int64, error) {
+	if _, _, err := t.BaseTransStream.UpdateTrack(stream); err != nil {
+		return nil, -1, err
+	}
+
+	return t.refreshSequenceHeader(), 0, nil
+}
+
+// AppendTrack 添加超时后到达的音频track, 向已有的sink发送新的sequence header.
+// 添加视频会改变合并写缓冲区按关键帧切片的方式, 不支持
+func (t *transStream) AppendTrack(track utils.AVStream) ([][]byte, int64, error) {
+	if utils.AVMediaTypeAudio != track.Type() {
+		return nil, -1, stream.ErrAppendTrackNotSupported
+	}
+
+	// rtmp只能携带一路音频
+	for _, avStream := range t.Tracks {
+		if utils.AVMediaTypeAudio == avStream.Type() {
+			return nil, -1, stream.ErrAppendTrackNotSupported
+		}
+	}
+
+	_ = t.AddTrack(track)
+	t.audioChunk = librtmp.NewAudioChunk()
+	t.muxer.AddAudioTrack(track.CodecId(), 0, 0, 0)
+	return t.refreshSequenceHeader(), 0, nil
+}
+
+// 发送合并写缓冲区剩余的帧和新的sequence header
+func (t *transStream) refreshSequenceHeader() [][]byte {
+	t.ClearOutStreamBuffer()
+
+	// 先发送合并写缓冲区中旧编码参数的帧
+	if segment := t.MWBuffer.FlushSegment(); len(segment) > 0 {
+		t.AppendOutStreamBuffer(segment)
+	}
+
+	t.writeSequenceHeader()
+	t.AppendOutStreamBuffer(t.header[:t.headerSize])
+	return t.OutBuffer[:t.OutBufferSize]
 }
 
 func (t *transStream) Close() ([][]byte, int64, error) {
@@ -2,69 +2,352 @@ package rtsp
 
 import (
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/stream"
+	"hash"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuthSchemeDigest = "digest"
+	AuthSchemeBasic  = "basic"
+
+	DefaultRealm = "lkm"
 )
-import "math/rand"
 
 func generateNonce() string {
 	k := make([]byte, 12)
-	for bytes := 0; bytes < len(k); {
-		n, err := rand.Read(k[bytes:])
-		if err != nil {
-			panic("rand.Read() failed")
-		}
-		bytes += n
+	if _, err := io.ReadFull(rand.Reader, k); err != nil {
+		panic("rand.Read() failed")
 	}
+
 	return base64.StdEncoding.EncodeToString(k)
 }
 
-func generateAuthHeader(realm string) string {
-	return fmt.Sprintf(`Digest realm="%s", nonce="%s" algorithm=MD5`,
-		realm, generateNonce())
-}
+func newHash(algorithm string) func() hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "SHA-256":
+		return sha256.New
+	case "", "MD5":
+		return md5.New
+	}
 
-func h(data string) string {
-	hash := md5.New()
-	hash.Write([]byte(data))
-	return hex.EncodeToString(hash.Sum(nil))
+	return nil
 }
 
-func calculateResponse(username, realm, nonce, uri, password string) string {
-	//H(data) = MD5(data)
-	//KD(secret, data) = H(concat(secret, ":", data))
-	//request-digest  = <"> < KD ( H(A1), unq(nonce-value) ":" H(A2) ) > <">
-	A1 := fmt.Sprintf("%s:%s:%s", username, realm, password)
-	A2 := fmt.Sprintf("%s:%s", "DESCRIBE", uri)
+// 计算RFC2617/RFC7616的摘要
+// H(data) = MD5(data)
+// KD(secret, data) = H(concat(secret, ":", data))
+// request-digest  = <"> < KD ( H(A1), unq(nonce-value) ":" H(A2) ) > <">
+func calculateResponse(params map[string]string, method, password string) string {
+	newH := newHash(params["algorithm"])
+	if newH == nil {
+		return ""
+	}
+
+	hh := func(data string) string {
+		hash := newH()
+		hash.Write([]byte(data))
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+
+	A1 := hh(fmt.Sprintf("%s:%s:%s", params["username"], params["realm"], password))
+	if strings.HasSuffix(strings.ToUpper(params["algorithm"]), "-SESS") {
+		A1 = hh(fmt.Sprintf("%s:%s:%s", A1, params["nonce"], params["cnonce"]))
+	}
+
+	A2 := hh(fmt.Sprintf("%s:%s", method, params["uri"]))
+	if qop := params["qop"]; qop != "" {
+		return hh(strings.Join([]string{A1, params["nonce"], params["nc"], params["cnonce"], qop, A2}, ":"))
+	}
 
-	return h(h(A1) + ":" + nonce + ":" + h(A2))
+	return hh(A1 + ":" + params["nonce"] + ":" + A2)
 }
 
+// 解析Authorization头的Digest参数, 参数值可能使用引号包含逗号
 func parseAuthParams(value string) (map[string]string, error) {
-	index := strings.Index(value, "Digest ")
-	if index == -1 {
+	if len(value) < len("Digest ") || !strings.EqualFold(value[:len("Digest ")], "Digest ") {
 		return nil, fmt.Errorf("unknow scheme %s", value)
 	}
 
-	pairs := strings.Split(value[len("Digest "):], ",")
-	m := make(map[string]string, len(pairs))
-	for _, pair := range pairs {
-		i := strings.Index(pair, "=")
+	m := make(map[string]string, 8)
+	value = value[len("Digest "):]
+	for len(value) > 0 {
+		value = strings.TrimLeft(value, " ,")
+		i := strings.Index(value, "=")
 		if i < 0 {
-			m[pair] = ""
-		} else if i == len(pair)-1 {
-			m[pair[:i]] = ""
+			break
+		}
+
+		key := strings.ToLower(strings.TrimSpace(value[:i]))
+		value = strings.TrimLeft(value[i+1:], " ")
+
+		if strings.HasPrefix(value, "\"") {
+			end := strings.Index(value[1:], "\"")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid authorization %s", value)
+			}
+
+			m[key] = value[1 : end+1]
+			value = value[end+2:]
 		} else {
-			m[strings.TrimSpace(pair[:i])] = strings.Trim(pair[i+1:], "\"")
+			end := strings.Index(value, ",")
+			if end < 0 {
+				end = len(value)
+			}
+
+			m[key] = strings.TrimSpace(value[:end])
+			value = value[end:]
 		}
 	}
 
 	return m, nil
 }
 
-func DoAuthenticatePlainTextPassword(params map[string]string, password string) bool {
-	response := calculateResponse(params["username"], params["realm"], params["nonce"], params["uri"], password)
-	return response == params["response"]
+// 解析Authorization头的Basic参数
+func parseBasicAuth(value string) (string, string, bool) {
+	if len(value) < len("Basic ") || !strings.EqualFold(value[:len("Basic ")], "Basic ") {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[len("Basic "):]))
+	if err != nil {
+		return "", "", false
+	}
+
+	pair := strings.SplitN(string(decoded), ":", 2)
+	if len(pair) != 2 {
+		return "", "", false
+	}
+
+	return pair[0], pair[1], true
+}
+
+// authenticator RTSP拉流鉴权, 支持Digest和Basic方式.
+// 账号来自配置文件的用户列表, 或者通过on_rtsp_auth事件向业务服务器查询.
+type authenticator struct {
+	scheme      string
+	realm       string
+	nonceExpire time.Duration
+	username    string // 兼容旧配置的账号, 配合password使用
+	password    string
+	users       []stream.RtspUserConfig // 配置的用户列表
+	nonces      sync.Map                // 已经下发的nonce和下发时间
+}
+
+// 是否需要鉴权
+func (a *authenticator) enabled() bool {
+	return a.password != "" || len(a.users) > 0 || stream.AppConfig.Hooks.IsEnableOnRtspAuth()
+}
+
+func (a *authenticator) newNonce() string {
+	now := time.Now()
+	// 删除过期的nonce
+	a.nonces.Range(func(key, value any) bool {
+		if now.Sub(value.(time.Time)) > a.nonceExpire*2 {
+			a.nonces.Delete(key)
+		}
+
+		return true
+	})
+
+	nonce := generateNonce()
+	a.nonces.Store(nonce, now)
+	return nonce
+}
+
+// 生成WWW-Authenticate头. Digest方式按RFC7616同时下发SHA-256和MD5两个质询, 优先级高的在前, 拉流端选择支持的算法.
+func (a *authenticator) challenge(stale bool) []string {
+	if AuthSchemeBasic == a.scheme {
+		return []string{fmt.Sprintf(`Basic realm="%s"`, a.realm)}
+	}
+
+	nonce := a.newNonce()
+	var headers []string
+	for _, algorithm := range []string{"SHA-256", "MD5"} {
+		header := fmt.Sprintf(`Digest realm="%s", nonce="%s", algorithm=%s, qop="auth"`, a.realm, nonce, algorithm)
+		if stale {
+			header += ", stale=TRUE"
+		}
+
+		headers = append(headers, header)
+	}
+
+	return headers
+}
+
+// 查找用户在该流的密码. 优先使用配置的用户, 再通知on_rtsp_auth事件查询.
+// 鉴权通过后缓存在session中, 同一会话的后续请求不再重复查询.
+func (a *authenticator) findPassword(session *session, username, sourceId string) (string, bool) {
+	if session.authUser == username && session.authSource == sourceId && session.authUser != "" {
+		return session.authPassword, true
+	}
+
+	var remoteAddr string
+	if session.conn != nil {
+		remoteAddr = session.conn.RemoteAddr().String()
+	}
+
+	for _, user := range a.users {
+		if user.Username != username {
+			continue
+		}
+
+		if len(user.Streams) == 0 {
+			return user.Password, true
+		}
+
+		for _, id := range user.Streams {
+			if id == sourceId {
+				return user.Password, true
+			}
+		}
+	}
+
+	if stream.AppConfig.Hooks.IsEnableOnRtspAuth() {
+		if password, ok := hookRtspAuth(username, a.realm, sourceId, remoteAddr); ok {
+			return password, true
+		}
+	}
+
+	if a.password != "" && len(a.users) == 0 && a.username == username {
+		return a.password, true
+	}
+
+	return "", false
+}
+
+// 摘要中的uri是否与请求行的uri一致, 只比较路径和参数, 经过NAT或代理时主机地址可能不同
+func matchDigestUri(uri string, requestUri *url.URL) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+
+	return strings.TrimSuffix(u.Path, "/") == strings.TrimSuffix(requestUri.Path, "/") && u.RawQuery == requestUri.RawQuery
+}
+
+// Authenticate 校验请求的Authorization头.
+// 返回是否通过, 以及nonce是否过期. nonce过期但摘要正确时, 应答401并携带stale=TRUE, 拉流端使用新的nonce重试, 无需重新输入密码.
+// 已经建立的会话继续使用鉴权通过时的nonce, 不受有效期限制, 避免拉流过程中的GET_PARAMETER/TEARDOWN被拒绝.
+func (a *authenticator) Authenticate(session *session, method, sourceId string, requestUri *url.URL, headers textproto.MIMEHeader) (bool, bool) {
+	authorization := headers.Get("Authorization")
+	if authorization == "" {
+		return false, false
+	}
+
+	if AuthSchemeBasic == a.scheme {
+		username, password, ok := parseBasicAuth(authorization)
+		if !ok {
+			return false, false
+		}
+
+		expected, ok := a.findPassword(session, username, sourceId)
+		if !ok || !secureEqual(expected, password) {
+			return false, false
+		}
+
+		session.authUser, session.authSource, session.authPassword = username, sourceId, password
+		return true, false
+	}
+
+	params, err := parseAuthParams(authorization)
+	if err != nil || params["realm"] != a.realm || !matchDigestUri(params["uri"], requestUri) {
+		return false, false
+	}
+
+	password, ok := a.findPassword(session, params["username"], sourceId)
+	if !ok || !secureEqual(calculateResponse(params, method, password), params["response"]) {
+		return false, false
+	}
+
+	// 摘要正确, 校验nonce是否由服务器下发以及是否过期
+	if session.authNonce != params["nonce"] || session.authUser != params["username"] || session.authSource != sourceId {
+		value, ok := a.nonces.Load(params["nonce"])
+		if !ok || time.Since(value.(time.Time)) > a.nonceExpire {
+			return false, true
+		}
+	}
+
+	session.authUser, session.authSource, session.authPassword, session.authNonce = params["username"], sourceId, password, params["nonce"]
+	return true, false
+}
+
+func newAuthenticator(password string) *authenticator {
+	config := stream.AppConfig.Rtsp.Auth
+	a := &authenticator{
+		scheme:      strings.ToLower(config.Scheme),
+		realm:       config.Realm,
+		nonceExpire: time.Duration(config.NonceExpire) * time.Second,
+		username:    stream.AppConfig.Rtsp.Username,
+		password:    password,
+		users:       config.Users,
+	}
+
+	if a.scheme != AuthSchemeBasic {
+		a.scheme = AuthSchemeDigest
+	}
+
+	if a.realm == "" {
+		a.realm = DefaultRealm
+	}
+
+	if a.nonceExpire <= 0 {
+		a.nonceExpire = 60 * time.Second
+	}
+
+	if a.password != "" && a.username == "" && len(a.users) == 0 {
+		log.Sugar.Warnf("rtsp配置了password但未配置username, 所有拉流鉴权都将失败")
+	}
+
+	return a
+}
+
+// 通知on_rtsp_auth事件, 业务服务器应答{"password": "xxx"}
+func hookRtspAuth(username, realm, sourceId, remoteAddr string) (string, bool) {
+	body := struct {
+		Stream     string `json:"stream"`
+		Protocol   string `json:"protocol"`
+		RemoteAddr string `json:"remote_addr"`
+		Username   string `json:"username"`
+		Realm      string `json:"realm"`
+	}{sourceId, stream.TransStreamRtsp.String(), remoteAddr, username, realm}
+
+	response, err := stream.Hook(stream.HookEventRtspAuth, "", body)
+	if err != nil {
+		log.Sugar.Errorf("rtsp鉴权事件-通知失败 err: %s username: %s source: %s", err.Error(), username, sourceId)
+		return "", false
+	}
+
+	defer response.Body.Close()
+	v := struct {
+		Password string `json:"password"`
+	}{}
+
+	if http.StatusOK != response.StatusCode {
+		return "", false
+	} else if err = json.NewDecoder(response.Body).Decode(&v); err != nil {
+		log.Sugar.Errorf("rtsp鉴权事件-解析应答失败 err: %s username: %s source: %s", err.Error(), username, sourceId)
+		return "", false
+	}
+
+	return v.Password, true
+}
+
+// 常量时间比较密码和摘要, 避免根据比较耗时猜测
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
@@ -0,0 +1,234 @@
+package rtsp
+
+import (
+	"fmt"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAuthParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected map[string]string
+		success  bool
+	}{
+		{
+			name:     "quoted",
+			value:    `Digest username="test", realm="lkm", nonce="abc", uri="rtsp://127.0.0.1/live/test", response="123"`,
+			expected: map[string]string{"username": "test", "realm": "lkm", "nonce": "abc", "uri": "rtsp://127.0.0.1/live/test", "response": "123"},
+			success:  true,
+		},
+		{
+			name:     "unquoted and comma in quotes",
+			value:    `digest username="a,b", algorithm=SHA-256, qop=auth, nc=00000001`,
+			expected: map[string]string{"username": "a,b", "algorithm": "SHA-256", "qop": "auth", "nc": "00000001"},
+			success:  true,
+		},
+		{"basic scheme", `Basic dGVzdDoxMjM0NTY=`, nil, false},
+		{"unterminated quote", `Digest username="test`, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, err := parseAuthParams(test.value)
+			if (err == nil) != test.success {
+				t.Fatalf("parse err: %v", err)
+			} else if err != nil {
+				return
+			}
+
+			if len(params) != len(test.expected) {
+				t.Fatalf("params %v, expected %v", params, test.expected)
+			}
+
+			for key, value := range test.expected {
+				if params[key] != value {
+					t.Fatalf("param %s: %s, expected %s", key, params[key], value)
+				}
+			}
+		})
+	}
+}
+
+// RFC7616 3.9.1的示例
+func TestCalculateResponse(t *testing.T) {
+	params := func(algorithm string) map[string]string {
+		return map[string]string{
+			"username":  "Mufasa",
+			"realm":     "http-auth@example.org",
+			"uri":       "/dir/index.html",
+			"algorithm": algorithm,
+			"nonce":     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+			"nc":        "00000001",
+			"cnonce":    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+			"qop":       "auth",
+		}
+	}
+
+	tests := []struct {
+		algorithm string
+		expected  string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+		{"SHA-512-256", ""},
+	}
+
+	for _, test := range tests {
+		if response := calculateResponse(params(test.algorithm), "GET", "Circle of Life"); response != test.expected {
+			t.Fatalf("%s response %s, expected %s", test.algorithm, response, test.expected)
+		}
+	}
+}
+
+func TestParseBasicAuth(t *testing.T) {
+	tests := []struct {
+		value    string
+		username string
+		password string
+		success  bool
+	}{
+		{"Basic dGVzdDoxMjM0NTY=", "test", "123456", true},
+		{"basic dGVzdDoxMjM6NDU2", "test", "123:456", true},
+		{"Basic dGVzdA==", "", "", false},
+		{"Basic !!!", "", "", false},
+		{`Digest username="test"`, "", "", false},
+	}
+
+	for _, test := range tests {
+		username, password, ok := parseBasicAuth(test.value)
+		if ok != test.success || username != test.username || password != test.password {
+			t.Fatalf("parse %s: %s %s %t", test.value, username, password, ok)
+		}
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	tests := []struct {
+		name     string
+		scheme   string
+		stale    bool
+		prefixes []string
+	}{
+		{"basic", AuthSchemeBasic, false, []string{`Basic realm="lkm"`}},
+		{"digest", AuthSchemeDigest, false, []string{`Digest realm="lkm"`, `Digest realm="lkm"`}},
+		{"stale", AuthSchemeDigest, true, []string{`Digest realm="lkm"`, `Digest realm="lkm"`}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &authenticator{scheme: test.scheme, realm: DefaultRealm, nonceExpire: time.Minute}
+			headers := a.challenge(test.stale)
+			if len(headers) != len(test.prefixes) {
+				t.Fatalf("challenges %v", headers)
+			}
+
+			for i, header := range headers {
+				if !strings.HasPrefix(header, test.prefixes[i]) || strings.Contains(header, "stale=TRUE") != test.stale {
+					t.Fatalf("challenge %d: %s", i, header)
+				}
+			}
+
+			if test.scheme == AuthSchemeBasic {
+				return
+			}
+
+			// SHA-256在前, 两个质询使用同一个nonce
+			params := make([]map[string]string, len(headers))
+			for i, header := range headers {
+				params[i], _ = parseAuthParams(header)
+			}
+
+			if params[0]["algorithm"] != "SHA-256" || params[1]["algorithm"] != "MD5" {
+				t.Fatalf("unexpected algorithm order %v", headers)
+			} else if params[0]["qop"] != "auth" || params[1]["qop"] != "auth" {
+				t.Fatalf("missing qop %v", headers)
+			} else if params[0]["nonce"] != params[1]["nonce"] {
+				t.Fatalf("different nonces %v", headers)
+			}
+		})
+	}
+}
+
+func TestMatchDigestUri(t *testing.T) {
+	requestUri, _ := url.Parse("rtsp://192.168.1.2:554/live/test/trackID=0?token=1")
+	tests := []struct {
+		uri     string
+		success bool
+	}{
+		{"rtsp://192.168.1.2:554/live/test/trackID=0?token=1", true},
+		{"rtsp://10.0.0.1/live/test/trackID=0?token=1", true},
+		{"/live/test/trackID=0?token=1", true},
+		{"rtsp://192.168.1.2:554/live/test/trackID=1?token=1", false},
+		{"rtsp://192.168.1.2:554/live/test/trackID=0", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if ok := matchDigestUri(test.uri, requestUri); ok != test.success {
+			t.Fatalf("match %s: %t", test.uri, ok)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	const requestUri = "rtsp://127.0.0.1/live/test"
+	a := &authenticator{scheme: AuthSchemeDigest, realm: DefaultRealm, nonceExpire: time.Minute, username: "test", password: "123456"}
+	nonce := a.newNonce()
+	expiredNonce := a.newNonce()
+	a.nonces.Store(expiredNonce, time.Now().Add(-2*time.Minute))
+
+	authorization := func(username, password, nonce, uri string) textproto.MIMEHeader {
+		params := map[string]string{"username": username, "realm": DefaultRealm, "nonce": nonce, "uri": uri, "algorithm": "SHA-256", "qop": "auth", "nc": "00000001", "cnonce": "0a4f113b"}
+		value := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=SHA-256, qop=auth, nc=00000001, cnonce="0a4f113b", response="%s"`,
+			username, DefaultRealm, nonce, uri, calculateResponse(params, "DESCRIBE", password))
+		return textproto.MIMEHeader{"Authorization": []string{value}}
+	}
+
+	established := &session{}
+	tests := []struct {
+		name    string
+		session *session
+		headers textproto.MIMEHeader
+		success bool
+		stale   bool
+	}{
+		{"no authorization", &session{}, textproto.MIMEHeader{}, false, false},
+		{"ok", &session{}, authorization("test", "123456", nonce, requestUri), true, false},
+		{"wrong password", &session{}, authorization("test", "654321", nonce, requestUri), false, false},
+		{"wrong username", &session{}, authorization("admin", "123456", nonce, requestUri), false, false},
+		{"uri mismatch", &session{}, authorization("test", "123456", nonce, "rtsp://127.0.0.1/live/other"), false, false},
+		{"unknown nonce", &session{}, authorization("test", "123456", "abc", requestUri), false, true},
+		{"expired nonce", &session{}, authorization("test", "123456", expiredNonce, requestUri), false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u, _ := url.Parse(requestUri)
+			ok, stale := a.Authenticate(test.session, "DESCRIBE", "live/test", u, test.headers)
+			if ok != test.success || stale != test.stale {
+				t.Fatalf("authenticate %t stale %t, expected %t stale %t", ok, stale, test.success, test.stale)
+			}
+		})
+	}
+
+	// 已经建立的会话, nonce过期后继续使用
+	u, _ := url.Parse(requestUri)
+	if ok, _ := a.Authenticate(established, "DESCRIBE", "live/test", u, authorization("test", "123456", nonce, requestUri)); !ok {
+		t.Fatal("failed to authenticate")
+	}
+
+	a.nonces.Store(nonce, time.Now().Add(-2*time.Minute))
+	if ok, stale := a.Authenticate(established, "DESCRIBE", "live/test", u, authorization("test", "123456", nonce, requestUri)); !ok || stale {
+		t.Fatal("established session rejected after nonce expired")
+	}
+
+	// 其他会话使用过期的nonce
+	if ok, stale := a.Authenticate(&session{}, "DESCRIBE", "live/test", u, authorization("test", "123456", nonce, requestUri)); ok || !stale {
+		t.Fatal("expired nonce accepted by a new session")
+	}
+}
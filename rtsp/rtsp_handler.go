@@ -54,7 +54,7 @@ type Handler interface {
 
 type handler struct {
 	methods      map[string]reflect.Value
-	password     string
+	auth         *authenticator
 	publicHeader string
 }
 
@@ -70,8 +70,24 @@ func (h handler) Process(session *session, method string, url_ *url.URL, headers
 		return fmt.Errorf("please establish a session first")
 	}
 
+	// 任意RTSP请求都视为心跳, 包括OPTIONS/GET_PARAMETER
+	if session.sink != nil {
+		session.sink.RefreshKeepalive()
+	}
+
 	source, _ := stream.Path2SourceId(url_.Path, "")
 
+	// 除OPTIONS外, 所有请求都需要鉴权
+	if "OPTIONS" != method && h.auth.enabled() {
+		if ok, stale := h.auth.Authenticate(session, method, source, url_, headers); !ok {
+			response := NewResponse(http.StatusUnauthorized, headers.Get("Cseq"))
+			for _, challenge := range h.auth.challenge(stale) {
+				response.Header.Add("WWW-Authenticate", challenge)
+			}
+			return session.response(response, nil)
+		}
+	}
+
 	//反射调用各个处理函数
 	results := m.Call([]reflect.Value{
 		reflect.ValueOf(&h),
@@ -107,25 +123,16 @@ func (h handler) OnDescribe(request Request) (*http.Response, []byte, error) {
 	var response *http.Response
 	var body []byte
 
-	// 校验密码
-	if h.password != "" {
-		var ok bool
-
-		authorization := request.headers.Get("Authorization")
-		if authorization != "" {
-			params, err := parseAuthParams(authorization)
-			ok = err == nil && DoAuthenticatePlainTextPassword(params, h.password)
+	conn := request.session.conn
+	sinkId := stream.NetAddr2SinkId(conn.RemoteAddr())
+	sink := NewSink(sinkId, request.sourceId, conn, func(sdp string) {
+		// 等待推流超时, 流不存在. 应答后关闭链路, 由会话的读取协程关闭sink
+		if sdp == "" {
+			request.session.response(NewResponse(http.StatusNotFound, request.headers.Get("Cseq")), nil)
+			_ = conn.Close()
+			return
 		}
 
-		if !ok {
-			response401 := NewResponse(http.StatusUnauthorized, request.headers.Get("Cseq"))
-			response401.Header.Set("WWW-Authenticate", generateAuthHeader("lkm"))
-			return response401, nil, nil
-		}
-	}
-
-	sinkId := stream.NetAddr2SinkId(request.session.conn.RemoteAddr())
-	sink := NewSink(sinkId, request.sourceId, request.session.conn, func(sdp string) {
 		// 响应sdp回调
 		response = NewOKResponse(request.headers.Get("Cseq"))
 		response.Header.Set("Content-Type", "application/sdp")
@@ -133,6 +140,10 @@ func (h handler) OnDescribe(request Request) (*http.Response, []byte, error) {
 	})
 
 	sink.SetUrlValues(request.url.Query())
+	if err = stream.SetSinkTrackParams(sink, request.url.Query()); err != nil {
+		return nil, nil, err
+	}
+
 	_, code := stream.PreparePlaySinkWithReady(sink, false)
 	if utils.HookStateOK != code {
 		return nil, nil, fmt.Errorf("hook failed. code: %d", code)
@@ -164,11 +175,19 @@ func (h handler) OnSetup(request Request) (*http.Response, []byte, error) {
 	}
 
 	split := strings.Split(transportHeader, ";")
+	// 组播: RTP/AVP;multicast
+	for _, value := range split {
+		if "multicast" == strings.TrimSpace(value) {
+			return h.onMulticastSetup(request, index)
+		}
+	}
+
 	if len(split) < 3 {
 		return nil, nil, fmt.Errorf("failed to parsing TRANSPORT header:%s", transportHeader)
 	}
 
 	tcp := "RTP/AVP" != split[0] && "RTP/AVP/UDP" != split[0]
+	var clientPort [2]int
 	if !tcp {
 		for _, value := range split {
 			if !strings.HasPrefix(value, "client_port=") {
@@ -184,21 +203,29 @@ func (h handler) OnSetup(request Request) (*http.Response, []byte, error) {
 			if err != nil {
 				return nil, nil, err
 			}
-			_ = port
 
 			port2, err := strconv.Atoi(pairPort[1])
 			if err != nil {
 				return nil, nil, err
 			}
-			_ = port2
 
+			clientPort = [2]int{port, port2}
 			log.Sugar.Debugf("client port:%d-%d", port, port2)
 		}
 	}
 
-	ssrc := 0xFFFFFFFF
-	rtpPort, rtcpPort, err := request.session.sink.AddSender(index, tcp, uint32(ssrc))
+	ssrc := uint32(0xFFFFFFFF)
+	// 单端口模式, 为每路拉流分配唯一的ssrc, 用于区分拉流端
+	if !tcp && SharedUDPServer != nil {
+		ssrc = SharedUDPServer.allocateSSRC()
+	}
+
+	rtpPort, rtcpPort, err := request.session.sink.AddSender(index, tcp, ssrc, clientPort)
 	if err != nil {
+		if !tcp && SharedUDPServer != nil {
+			SharedUDPServer.removeSender(ssrc)
+		}
+
 		return nil, nil, err
 	}
 
@@ -214,43 +241,84 @@ func (h handler) OnSetup(request Request) (*http.Response, []byte, error) {
 
 	response = NewOKResponse(request.headers.Get("Cseq"))
 	response.Header.Set("Transport", responseHeader)
-	response.Header.Set("Session", request.session.sessionId)
+	response.Header.Set("Session", request.session.sessionHeader())
 
 	return response, nil, nil
 }
 
+// 组播拉流, 应答TranStream的组播地址和端口, 不为sink单独创建传输链路
+func (h handler) onMulticastSetup(request Request, index int) (*http.Response, []byte, error) {
+	ip, port, err := request.session.sink.AddMulticastSender(index)
+	if err != nil {
+		log.Sugar.Errorf("组播拉流失败 err: %s sink: %s", err.Error(), request.session.sink.String())
+
+		response := NewResponse(StatusUnsupportedTransport, request.headers.Get("Cseq"))
+		response.Status = "Unsupported Transport"
+		return response, nil, nil
+	}
+
+	responseHeader := fmt.Sprintf("RTP/AVP;multicast;destination=%s;port=%d-%d;ttl=%d", ip.String(), port, port+1, MulticastManager.TTL())
+	response := NewOKResponse(request.headers.Get("Cseq"))
+	response.Header.Set("Transport", responseHeader)
+	response.Header.Set("Session", request.session.sessionHeader())
+	return response, nil, nil
+}
+
 func (h handler) OnPlay(request Request) (*http.Response, []byte, error) {
 	response := NewOKResponse(request.headers.Get("Cseq"))
-	sessionHeader := request.headers.Get("Session")
-	if sessionHeader != "" {
-		response.Header.Set("Session", sessionHeader)
-	}
+	response.Header.Set("Session", request.session.sessionHeader())
 
 	sink := request.session.sink
-	sink.SetReady(true)
 	source := stream.SourceManager.Find(sink.GetSourceID())
 	if source == nil {
 		return nil, nil, fmt.Errorf("Source with ID %s does not exist.", request.sourceId)
 	}
 
-	source.AddSink(sink)
+	if request.session.paused {
+		// 从下一个关键帧开始恢复推流
+		request.session.paused = false
+		source.ResumeSink(sink)
+	} else if !sink.IsReady() {
+		sink.SetReady(true)
+		source.AddSink(sink)
+	}
+
+	// UDP拉流, 开始检查会话超时
+	request.session.startKeepaliveTimer()
 	return response, nil, nil
 }
 
 func (h handler) OnTeardown(request Request) (*http.Response, []byte, error) {
 	response := NewOKResponse(request.headers.Get("Cseq"))
-	return response, nil, nil
+	response.Header.Set("Session", request.session.sessionHeader())
+
+	// 先应答再关闭sink和连接
+	err := request.session.response(response, nil)
+	request.session.close()
+	return nil, nil, err
 }
 
 func (h handler) OnPause(request Request) (*http.Response, []byte, error) {
 	response := NewOKResponse(request.headers.Get("Cseq"))
+	response.Header.Set("Session", request.session.sessionHeader())
+
+	sink := request.session.sink
+	if request.session.paused || !sink.IsReady() {
+		return response, nil, nil
+	}
+
+	if source := stream.SourceManager.Find(sink.GetSourceID()); source != nil {
+		request.session.paused = true
+		source.PauseSink(sink)
+	}
+
 	return response, nil, nil
 }
 
 func NewHandler(password string) *handler {
 	h := handler{
-		methods:  make(map[string]reflect.Value, 10),
-		password: password,
+		methods: make(map[string]reflect.Value, 10),
+		auth:    newAuthenticator(password),
 	}
 
 	//反射获取所有成员函数, 映射对应的RTSP请求方法
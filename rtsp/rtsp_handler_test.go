@@ -0,0 +1,185 @@
+package rtsp
+
+import (
+	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/stream"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 记录拉流请求转发给Source的操作
+type testSource struct {
+	stream.Source
+	id     string
+	events []string
+}
+
+func (s *testSource) GetID() string {
+	return s.id
+}
+
+func (s *testSource) AddSink(sink stream.Sink) {
+	sink.Lock()
+	sink.SetState(stream.SessionStateTransferring)
+	sink.UnLock()
+	s.events = append(s.events, "add")
+}
+
+func (s *testSource) RemoveSink(sink stream.Sink) {
+	s.events = append(s.events, "remove")
+}
+
+func (s *testSource) PauseSink(sink stream.Sink) {
+	s.events = append(s.events, "pause")
+}
+
+func (s *testSource) ResumeSink(sink stream.Sink) {
+	s.events = append(s.events, "resume")
+}
+
+func TestMain(m *testing.M) {
+	log.InitLogger(false, zapcore.ErrorLevel, "", 0, 0, 0, false)
+	os.Exit(m.Run())
+}
+
+// PLAY添加sink, PAUSE暂停推流, 再次PLAY从关键帧恢复, TEARDOWN应答后关闭sink和连接
+func TestHandlerPauseResumeTeardown(t *testing.T) {
+	source := &testSource{id: "live/handler"}
+	if err := stream.SourceManager.Add(source); err != nil {
+		t.Fatal(err)
+	}
+	defer stream.SourceManager.Remove(source.id)
+
+	conn, remote := net.Pipe()
+	received := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(remote)
+		received <- string(data)
+	}()
+
+	session := NewSession(conn)
+	sink := NewSink(stream.SinkID(uint64(1)), source.id, conn, nil).(*Sink)
+	sink.TCPStreaming = true
+	session.sink = sink
+
+	h := handler{}
+	tests := []struct {
+		method string
+		events []string // 累计的Source操作
+		paused bool
+	}{
+		{"PLAY", []string{"add"}, false},
+		{"PAUSE", []string{"add", "pause"}, true},
+		{"PAUSE", []string{"add", "pause"}, true}, // 重复暂停
+		{"PLAY", []string{"add", "pause", "resume"}, false},
+		{"PLAY", []string{"add", "pause", "resume"}, false}, // 播放中
+		{"TEARDOWN", []string{"add", "pause", "resume", "remove"}, false},
+	}
+
+	for i, test := range tests {
+		request := Request{session: session, sourceId: source.id, method: test.method, headers: textproto.MIMEHeader{"Cseq": {"1"}}}
+
+		var err error
+		switch test.method {
+		case "PLAY":
+			_, _, err = h.OnPlay(request)
+		case "PAUSE":
+			_, _, err = h.OnPause(request)
+		case "TEARDOWN":
+			_, _, err = h.OnTeardown(request)
+		}
+
+		if err != nil {
+			t.Fatalf("%d %s err: %s", i, test.method, err.Error())
+		} else if strings.Join(source.events, ",") != strings.Join(test.events, ",") {
+			t.Fatalf("%d %s events: %v, expected: %v", i, test.method, source.events, test.events)
+		} else if session.paused != test.paused {
+			t.Fatalf("%d %s paused: %t", i, test.method, session.paused)
+		}
+	}
+
+	if session.sink != nil || session.conn != nil {
+		t.Fatal("session not closed after teardown")
+	} else if stream.SessionStateClosed != sink.GetState() {
+		t.Fatalf("sink not closed, state: %d", sink.GetState())
+	}
+
+	select {
+	case response := <-received:
+		if !strings.HasPrefix(response, "RTSP/1.0 200") {
+			t.Fatalf("unexpected teardown response: %q", response)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("conn not closed after teardown")
+	}
+}
+
+// UDP拉流超时未收到RTSP请求和RTCP包, 关闭连接. TCP拉流不检查
+func TestSessionKeepaliveTimeout(t *testing.T) {
+	config := stream.AppConfig
+	defer func() {
+		stream.AppConfig = config
+	}()
+
+	stream.AppConfig.Rtsp.SessionTimeout = 1
+
+	tests := []struct {
+		name    string
+		tcp     bool
+		refresh bool // 定时收到RTCP RR或GET_PARAMETER
+		closed  bool
+	}{
+		{"expired", false, false, true},
+		{"refreshed", false, true, false},
+		{"tcp", true, false, false},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, remote := net.Pipe()
+			defer remote.Close()
+
+			session := NewSession(conn)
+			sink := NewSink(stream.SinkID(uint64(i)), "live/keepalive", conn, nil).(*Sink)
+			sink.TCPStreaming = test.tcp
+			session.sink = sink
+			session.startKeepaliveTimer()
+
+			done := make(chan struct{})
+			if test.refresh {
+				go func() {
+					ticker := time.NewTicker(200 * time.Millisecond)
+					defer ticker.Stop()
+
+					for {
+						select {
+						case <-done:
+							return
+						case <-ticker.C:
+							sink.RefreshKeepalive()
+						}
+					}
+				}()
+			}
+
+			_ = remote.SetReadDeadline(time.Now().Add(1800 * time.Millisecond))
+			_, err := remote.Read(make([]byte, 1))
+			close(done)
+
+			if closed := err != nil && !isTimeout(err); closed != test.closed {
+				t.Fatalf("conn closed: %t, expected: %t", closed, test.closed)
+			}
+
+			session.close()
+			if session.keepalive != nil {
+				t.Fatal("keepalive timer not stopped")
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/lkmio/lkm/log"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"golang.org/x/net/ipv4"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// MulticastManager 组播地址和端口分配器, 开启组播时创建
+	MulticastManager *MulticastAllocator
+)
+
+// MulticastAllocator 从配置的地址和端口范围分配组播组, 每个TranStream使用一个组播地址和一段连续端口
+type MulticastAllocator struct {
+	lock sync.Mutex
+
+	startIP   uint32
+	endIP     uint32
+	usedIPs   map[uint32]bool
+	startPort int
+	endPort   int
+	usedPorts map[int]bool
+	ttl       int
+}
+
+// 分配组播地址和trackCount对rtp/rtcp端口, rtp端口为偶数
+func (m *MulticastAllocator) allocate(trackCount int) (net.IP, int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var ip uint32
+	for i := m.startIP; i <= m.endIP && i != 0; i++ {
+		if !m.usedIPs[i] {
+			ip = i
+			break
+		}
+	}
+
+	if ip == 0 {
+		return nil, 0, fmt.Errorf("no multicast address available")
+	}
+
+	size := trackCount * 2
+	port := -1
+	for i := m.startPort + m.startPort%2; i+size-1 <= m.endPort; i += 2 {
+		free := true
+		for j := i; j < i+size; j++ {
+			if m.usedPorts[j] {
+				free = false
+				break
+			}
+		}
+
+		if free {
+			port = i
+			break
+		}
+	}
+
+	if port < 0 {
+		return nil, 0, fmt.Errorf("no multicast port available")
+	}
+
+	m.usedIPs[ip] = true
+	for j := port; j < port+size; j++ {
+		m.usedPorts[j] = true
+	}
+
+	addr := make(net.IP, 4)
+	binary.BigEndian.PutUint32(addr, ip)
+	return addr, port, nil
+}
+
+func (m *MulticastAllocator) free(ip net.IP, port int, trackCount int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.usedIPs, binary.BigEndian.Uint32(ip.To4()))
+	for j := port; j < port+trackCount*2; j++ {
+		delete(m.usedPorts, j)
+	}
+}
+
+// TTL 组播包的生存时间
+func (m *MulticastAllocator) TTL() int {
+	return m.ttl
+}
+
+// NewMulticastAllocator 创建组播分配器
+// @Params groups 组播地址范围, [起始地址, 结束地址]
+// @Params ports 组播端口范围, [起始端口, 结束端口]
+func NewMulticastAllocator(groups []string, ports []int, ttl int) (*MulticastAllocator, error) {
+	if len(groups) != 2 || len(ports) != 2 {
+		return nil, fmt.Errorf("invalid multicast range. groups: %v ports: %v", groups, ports)
+	}
+
+	start := net.ParseIP(groups[0]).To4()
+	end := net.ParseIP(groups[1]).To4()
+	if start == nil || end == nil || !start.IsMulticast() || !end.IsMulticast() {
+		return nil, fmt.Errorf("invalid multicast address range %v", groups)
+	}
+
+	if ports[0] <= 0 || ports[1] > 0xFFFF || ports[0] >= ports[1] {
+		return nil, fmt.Errorf("invalid multicast port range %v", ports)
+	}
+
+	if ttl <= 0 {
+		ttl = 16
+	}
+
+	return &MulticastAllocator{
+		startIP:   binary.BigEndian.Uint32(start),
+		endIP:     binary.BigEndian.Uint32(end),
+		usedIPs:   make(map[uint32]bool, 8),
+		startPort: ports[0],
+		endPort:   ports[1],
+		usedPorts: make(map[int]bool, 16),
+		ttl:       ttl,
+	}, nil
+}
+
+const (
+	// 组播拉流端不发送RTCP, 按照固定间隔向每个track的rtcp端口发送SR, 播放器用于音视频同步
+	multicastSenderReportInterval = 5 * time.Second
+)
+
+// 组播组中的一个track
+type multicastTrack struct {
+	rtpAddr     *net.UDPAddr
+	rtcpAddr    *net.UDPAddr
+	packetCount uint32
+	octetCount  uint32    // 已发送的rtp负载字节数
+	lastReport  time.Time // 最近一次发送SR的时间
+}
+
+// 一个TranStream的组播组, 所有组播拉流的sink共用, 每个rtp包只发送一次
+type multicastGroup struct {
+	ip         net.IP
+	port       int // 第一个track的rtp端口, 第n个track使用port+n*2和port+n*2+1
+	trackCount int
+	conn       *net.UDPConn
+	tracks     []*multicastTrack
+	refCount   int // 组播拉流的sink计数, 为0时停止发送
+}
+
+func (g *multicastGroup) write(index int, data []byte) {
+	if index >= len(g.tracks) {
+		return
+	}
+
+	track := g.tracks[index]
+	_, _ = g.conn.WriteToUDP(data, track.rtpAddr)
+
+	header := rtp.Header{}
+	n, err := header.Unmarshal(data)
+	if err != nil {
+		return
+	}
+
+	track.packetCount++
+	track.octetCount += uint32(len(data) - n)
+
+	// 发送rtp包时同时发送SR, SR中的rtp时间戳与ntp时间对应同一时刻
+	if now := time.Now(); now.Sub(track.lastReport) >= multicastSenderReportInterval {
+		track.lastReport = now
+		g.sendSenderReport(track, header.SSRC, header.Timestamp, now)
+	}
+}
+
+func (g *multicastGroup) sendSenderReport(track *multicastTrack, ssrc uint32, rtpTime uint32, now time.Time) {
+	sr := rtcp.SenderReport{
+		SSRC:        ssrc,
+		NTPTime:     ntpTime(now),
+		RTPTime:     rtpTime,
+		PacketCount: track.packetCount,
+		OctetCount:  track.octetCount,
+	}
+
+	marshal, err := sr.Marshal()
+	if err != nil {
+		log.Sugar.Errorf("创建组播rtcp sr消息失败 err:%s msg:%v", err.Error(), sr)
+		return
+	}
+
+	_, _ = g.conn.WriteToUDP(marshal, track.rtcpAddr)
+}
+
+func (g *multicastGroup) close() {
+	_ = g.conn.Close()
+	MulticastManager.free(g.ip, g.port, g.trackCount)
+}
+
+// 转换为64位ntp时间戳, 高32位为1900年起的秒数, 低32位为秒的小数部分
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix()) + 2208988800
+	fraction := uint64(t.Nanosecond()) << 32 / 1000000000
+	return seconds<<32 | fraction
+}
+
+func newMulticastGroup(trackCount int) (*multicastGroup, error) {
+	ip, port, err := MulticastManager.allocate(trackCount)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		MulticastManager.free(ip, port, trackCount)
+		return nil, err
+	}
+
+	if err = ipv4.NewPacketConn(conn).SetMulticastTTL(MulticastManager.TTL()); err != nil {
+		_ = conn.Close()
+		MulticastManager.free(ip, port, trackCount)
+		return nil, err
+	}
+
+	group := &multicastGroup{
+		ip:         ip,
+		port:       port,
+		trackCount: trackCount,
+		conn:       conn,
+	}
+
+	for i := 0; i < trackCount; i++ {
+		group.tracks = append(group.tracks, &multicastTrack{
+			rtpAddr:  &net.UDPAddr{IP: ip, Port: port + i*2},
+			rtcpAddr: &net.UDPAddr{IP: ip, Port: port + i*2 + 1},
+		})
+	}
+
+	return group, nil
+}
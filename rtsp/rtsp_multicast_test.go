@@ -0,0 +1,190 @@
+package rtsp
+
+import (
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewMulticastAllocator(t *testing.T) {
+	tests := []struct {
+		name    string
+		groups  []string
+		ports   []int
+		success bool
+	}{
+		{"ok", []string{"239.0.0.1", "239.0.0.255"}, []int{40000, 41000}, true},
+		{"not multicast", []string{"192.168.1.1", "239.0.0.255"}, []int{40000, 41000}, false},
+		{"invalid address", []string{"239.0.0.1", "x"}, []int{40000, 41000}, false},
+		{"missing end", []string{"239.0.0.1"}, []int{40000, 41000}, false},
+		{"reversed ports", []string{"239.0.0.1", "239.0.0.255"}, []int{41000, 40000}, false},
+		{"port out of range", []string{"239.0.0.1", "239.0.0.255"}, []int{40000, 70000}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewMulticastAllocator(test.groups, test.ports, 16); (err == nil) != test.success {
+				t.Fatalf("create allocator err: %v", err)
+			}
+		})
+	}
+}
+
+func TestMulticastAllocate(t *testing.T) {
+	allocator, err := NewMulticastAllocator([]string{"239.0.0.1", "239.0.0.2"}, []int{40001, 40008}, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if allocator.TTL() != 16 {
+		t.Fatalf("default ttl %d", allocator.TTL())
+	}
+
+	type allocation struct {
+		ip   net.IP
+		port int
+	}
+
+	var allocated []allocation
+	tests := []struct {
+		name       string
+		trackCount int
+		free       int // 分配前释放第几次分配的组播组, -1不释放
+		ip         string
+		port       int
+		success    bool
+	}{
+		// 起始端口为奇数, 从下一个偶数端口开始分配
+		{"first", 2, -1, "239.0.0.1", 40002, true},
+		{"second", 1, -1, "239.0.0.2", 40006, true},
+		{"no address", 1, -1, "", 0, false},
+		{"reuse freed", 1, 0, "239.0.0.1", 40002, true},
+		{"no port", 3, 1, "", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.free >= 0 {
+				allocator.free(allocated[test.free].ip, allocated[test.free].port, 2)
+			}
+
+			ip, port, err := allocator.allocate(test.trackCount)
+			if (err == nil) != test.success {
+				t.Fatalf("allocate err: %v", err)
+			} else if err != nil {
+				return
+			}
+
+			allocated = append(allocated, allocation{ip, port})
+			if ip.String() != test.ip || port != test.port {
+				t.Fatalf("allocate %s:%d, expected %s:%d", ip, port, test.ip, test.port)
+			}
+		})
+	}
+}
+
+func TestNtpTime(t *testing.T) {
+	tests := []struct {
+		time     time.Time
+		expected uint64
+	}{
+		{time.Unix(0, 0), 2208988800 << 32},
+		{time.Unix(1, 500000000), (2208988801 << 32) | 0x80000000},
+		{time.Unix(10, 250000000), (2208988810 << 32) | 0x40000000},
+	}
+
+	for _, test := range tests {
+		if ntp := ntpTime(test.time); ntp != test.expected {
+			t.Fatalf("ntp time of %v: %x, expected %x", test.time, ntp, test.expected)
+		}
+	}
+}
+
+// 使用本地单播地址代替组播地址, 验证每个track的rtcp端口收到SR
+func TestMulticastSenderReport(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return conn
+	}
+
+	rtpConn, rtcpConn := listen(), listen()
+	defer rtpConn.Close()
+	defer rtcpConn.Close()
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	group := &multicastGroup{
+		conn:   conn,
+		tracks: []*multicastTrack{{rtpAddr: rtpConn.LocalAddr().(*net.UDPAddr), rtcpAddr: rtcpConn.LocalAddr().(*net.UDPAddr)}},
+	}
+
+	payload := make([]byte, 100)
+	packets := []rtp.Packet{
+		{Header: rtp.Header{Version: 2, SequenceNumber: 1, Timestamp: 90000, SSRC: 0x1234}, Payload: payload},
+		{Header: rtp.Header{Version: 2, SequenceNumber: 2, Timestamp: 93600, SSRC: 0x1234}, Payload: payload},
+	}
+
+	for _, packet := range packets {
+		data, err := packet.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		group.write(0, data)
+	}
+
+	// 第一个包发送SR, 第二个包未到发送间隔
+	buffer := make([]byte, 1500)
+	_ = rtcpConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := rtcpConn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := rtcp.Unmarshal(buffer[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr, ok := report[0].(*rtcp.SenderReport)
+	if !ok {
+		t.Fatalf("unexpected rtcp packet %T", report[0])
+	} else if sr.SSRC != 0x1234 || sr.RTPTime != 90000 || sr.PacketCount != 1 || sr.OctetCount != uint32(len(payload)) {
+		t.Fatalf("unexpected sender report %v", sr)
+	}
+
+	_ = rtcpConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err = rtcpConn.Read(buffer); err == nil {
+		t.Fatal("sender report sent before the interval")
+	}
+
+	// rtp包都发送到rtp端口
+	for i := range packets {
+		_ = rtpConn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = rtpConn.Read(buffer); err != nil {
+			t.Fatalf("rtp packet %d: %s", i, err.Error())
+		}
+	}
+
+	// 达到发送间隔
+	group.tracks[0].lastReport = time.Now().Add(-multicastSenderReportInterval)
+	data, _ := packets[1].Marshal()
+	group.write(0, data)
+
+	_ = rtcpConn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err = rtcpConn.Read(buffer); err != nil {
+		t.Fatal(err)
+	} else if report, err = rtcp.Unmarshal(buffer[:n]); err != nil {
+		t.Fatal(err)
+	} else if sr = report[0].(*rtcp.SenderReport); sr.PacketCount != 3 || sr.RTPTime != 93600 {
+		t.Fatalf("unexpected sender report %v", sr)
+	}
+}
@@ -1,10 +1,12 @@
 package rtsp
 
 import (
+	"github.com/gorilla/websocket"
 	"github.com/lkmio/avformat/transport"
 	"github.com/lkmio/avformat/utils"
 	"github.com/lkmio/lkm/log"
 	"net"
+	"net/http"
 	"runtime"
 )
 
@@ -12,6 +14,12 @@ type Server interface {
 	Start(addr net.Addr) error
 
 	Close()
+
+	// ServeHttpTunnel 处理RTSP over HTTP隧道的GET/POST请求
+	ServeHttpTunnel(w http.ResponseWriter, r *http.Request)
+
+	// ServeWebSocket 处理RTSP over WebSocket
+	ServeWebSocket(conn *websocket.Conn)
 }
 
 type server struct {
@@ -62,6 +70,19 @@ func (s *server) OnConnected(conn net.Conn) []byte {
 
 func (s *server) OnPacket(conn net.Conn, data []byte) []byte {
 	t := conn.(*transport.Conn)
+	// 隧道上行链路的请求, 下行链路可能已经断开
+	if t.Data == nil {
+		return nil
+	}
+
+	// TCP拉流端发送的interleaved RTCP包, 视为心跳
+	if len(data) > 0 && OverTcpMagic == data[0] {
+		if sink := t.Data.(*session).sink; sink != nil {
+			sink.RefreshKeepalive()
+		}
+
+		return nil
+	}
 
 	method, url, header, err := parseMessage(data)
 	if err != nil {
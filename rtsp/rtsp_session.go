@@ -4,12 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/stream"
 	"net"
 	"net/http"
 	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,6 +27,9 @@ const (
 	SessionStatePlay     = SessionState(0x4)
 	SessionStateTeardown = SessionState(0x5)
 	SessionStatePause    = SessionState(0x6)
+
+	// StatusUnsupportedTransport RTSP扩展的状态码
+	StatusUnsupportedTransport = 461
 )
 
 var (
@@ -47,10 +53,65 @@ type session struct {
 	sink        *Sink
 	sessionId   string
 	writeBuffer *bytes.Buffer //响应体缓冲区
+	writeLock   sync.Mutex    // describe的应答可能在推流协程或等待超时的计时器协程中发送
 	state       SessionState
+	paused      bool          // 是否已经暂停推流
+	keepalive   chan struct{} // 关闭后停止会话超时检查
+
+	// 鉴权通过的用户, 避免每个请求都查询密码
+	authUser     string
+	authSource   string
+	authPassword string
+	authNonce    string
+}
+
+// Session头, 告知拉流端会话超时时间
+func (s *session) sessionHeader() string {
+	return fmt.Sprintf("%s;timeout=%d", s.sessionId, stream.AppConfig.Rtsp.SessionTimeout)
+}
+
+// 开启会话超时检查. TCP拉流断开连接即结束会话, 只检查UDP拉流.
+// 超时时间内既没有收到RTSP请求, 也没有收到RTCP包, 断开连接. 由读取协程在断开回调中关闭会话, 检查协程不访问会话.
+func (s *session) startKeepaliveTimer() {
+	if s.keepalive != nil || s.sink == nil || s.sink.TCPStreaming {
+		return
+	}
+
+	conn := s.conn
+	sink := s.sink
+	done := make(chan struct{})
+	s.keepalive = done
+	timeout := time.Duration(stream.AppConfig.Rtsp.SessionTimeout) * time.Second
+	sink.RefreshKeepalive()
+
+	go func() {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if elapsed := time.Since(sink.LastKeepalive()); elapsed > timeout {
+					log.Sugar.Warnf("rtsp会话超时 sink: %s", sink.String())
+					_ = conn.Close()
+					return
+				}
+			}
+		}
+	}()
 }
 
 func (s *session) response(response *http.Response, body []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	// 会话已经关闭
+	if s.conn == nil {
+		return net.ErrClosed
+	}
+
 	//添加Content-Length
 	if body != nil {
 		response.Header.Set("Content-Length", strconv.Itoa(len(body)))
@@ -84,10 +145,17 @@ func (s *session) response(response *http.Response, body []byte) error {
 }
 
 func (s *session) close() {
+	if s.keepalive != nil {
+		close(s.keepalive)
+		s.keepalive = nil
+	}
+
+	s.writeLock.Lock()
 	if s.conn != nil {
 		s.conn.Close()
 		s.conn = nil
 	}
+	s.writeLock.Unlock()
 
 	if s.sink != nil {
 		s.sink.Close()
@@ -1,6 +1,8 @@
 package rtsp
 
 import (
+	"encoding/binary"
+	"fmt"
 	"github.com/lkmio/avformat/librtp"
 	"github.com/lkmio/avformat/transport"
 	"github.com/lkmio/avformat/utils"
@@ -8,6 +10,9 @@ import (
 	"github.com/lkmio/lkm/stream"
 	"github.com/pion/rtcp"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,14 +27,47 @@ type Sink struct {
 	stream.BaseSink
 
 	senders []*librtp.RtpSender // 一个rtsp源, 可能存在多个流, 每个流都需要拉取
-	sdpCb   func(sdp string)    // sdp回调, 响应describe
+	sdpCb   func(sdp string)    // sdp回调, 响应describe. 等待推流超时回调空sdp
+
+	transStream *TranStream // 组播拉流使用
+	multicast   bool        // 是否已经加入组播组
+	udp         bool        // 是否已经作为udp单播拉流端计数, transStream为此保存重传队列
+
+	keepalive atomic.Int64 // 最近一次收到RTSP请求或RTCP包的时间, 单位纳秒
+
+	shared    bool   // 是否使用单端口模式的共享rtp/rtcp端口
+	rtpBuffer []byte // 单端口模式下, 改写ssrc后的rtp包
+
+	statisticsLock sync.Mutex
+	statistics     []stream.TrackStatistics // 每路流的丢包和抖动统计
+}
+
+// RefreshKeepalive 收到RTSP请求或RTCP包时调用, 刷新会话超时时间
+func (s *Sink) RefreshKeepalive() {
+	s.keepalive.Store(time.Now().UnixNano())
+}
+
+func (s *Sink) LastKeepalive() time.Time {
+	return time.Unix(0, s.keepalive.Load())
 }
 
 func (s *Sink) StartStreaming(transStream stream.TransStream) error {
 	if s.senders == nil {
 		s.senders = make([]*librtp.RtpSender, transStream.TrackCount())
+		s.statistics = make([]stream.TrackStatistics, transStream.TrackCount())
+		for i := range s.statistics {
+			s.statistics[i].Index = i
+		}
+	}
+
+	// 重新创建输出流后, 重传队列的计数转移到新的输出流
+	if s.udp && s.transStream != transStream {
+		s.transStream.RemoveUDPSink()
+		transStream.(*TranStream).AddUDPSink()
 	}
 
+	s.transStream = transStream.(*TranStream)
+
 	// sdp回调给sink, sink应答给describe请求
 	if s.sdpCb != nil {
 		s.sdpCb(transStream.(*TranStream).sdp)
@@ -39,7 +77,8 @@ func (s *Sink) StartStreaming(transStream stream.TransStream) error {
 	return nil
 }
 
-func (s *Sink) AddSender(index int, tcp bool, ssrc uint32) (uint16, uint16, error) {
+// AddSender 添加一路流的传输链路, clientPort为udp拉流时SETUP请求携带的client_port
+func (s *Sink) AddSender(index int, tcp bool, ssrc uint32, clientPort [2]int) (uint16, uint16, error) {
 	utils.Assert(index < cap(s.senders))
 	utils.Assert(s.senders[index] == nil)
 
@@ -53,6 +92,19 @@ func (s *Sink) AddSender(index int, tcp bool, ssrc uint32) (uint16, uint16, erro
 
 	if tcp {
 		s.TCPStreaming = true
+	} else if SharedUDPServer != nil {
+		// 单端口模式, 使用共享端口, 根据拉流端地址和ssrc区分sink
+		var rtpAddr, rtcpAddr string
+		if host, _, err := net.SplitHostPort(s.Conn.RemoteAddr().String()); err == nil && clientPort[0] > 0 {
+			rtpAddr = net.JoinHostPort(host, strconv.Itoa(clientPort[0]))
+			rtcpAddr = net.JoinHostPort(host, strconv.Itoa(clientPort[1]))
+		}
+
+		s.shared = true
+		s.addUDPSink()
+		s.senders[index] = &sender
+		SharedUDPServer.addSender(s, index, ssrc, rtpAddr, rtcpAddr)
+		return uint16(SharedUDPServer.RtpPort()), uint16(SharedUDPServer.RtcpPort()), nil
 	} else {
 		sender.Rtp, err = TransportManger.NewUDPServer("0.0.0.0")
 		if err != nil {
@@ -66,35 +118,178 @@ func (s *Sink) AddSender(index int, tcp bool, ssrc uint32) (uint16, uint16, erro
 			return 0, 0, err
 		}
 
-		sender.Rtp.SetHandler2(nil, sender.OnRTPPacket, nil)
-		sender.Rtcp.SetHandler2(nil, sender.OnRTCPPacket, nil)
+		sender.Rtp.SetHandler2(nil, func(conn net.Conn, data []byte) []byte {
+			return s.receiveRTP(index, conn, data)
+		}, nil)
+		sender.Rtcp.SetHandler2(nil, func(conn net.Conn, data []byte) []byte {
+			return s.receiveRTCP(index, conn, data)
+		}, nil)
 		sender.Rtp.(*transport.UDPServer).Receive()
 		sender.Rtcp.(*transport.UDPServer).Receive()
 
 		rtpPort = uint16(sender.Rtp.ListenPort())
 		rtcpPort = uint16(sender.Rtcp.ListenPort())
+		s.addUDPSink()
 	}
 
 	s.senders[index] = &sender
 	return rtpPort, rtcpPort, err
 }
 
-func (s *Sink) Write(index int, data [][]byte, rtpTime int64) error {
-	// 拉流方还没有连接上来
-	if index >= cap(s.senders) || s.senders[index] == nil {
-		return nil
+// udp单播拉流, 通知输出流保存重传队列. 多个track只计数一次
+func (s *Sink) addUDPSink() {
+	if !s.udp && s.transStream != nil {
+		s.transStream.AddUDPSink()
+		s.udp = true
+	}
+}
+
+// 收到拉流端的rtp包, 一般为nat穿透包
+func (s *Sink) receiveRTP(index int, conn net.Conn, data []byte) []byte {
+	return s.senders[index].OnRTPPacket(conn, data)
+}
+
+// 收到拉流端的rtcp包, 视为心跳
+func (s *Sink) receiveRTCP(index int, conn net.Conn, data []byte) []byte {
+	s.RefreshKeepalive()
+	s.onRTCPPacket(index, data)
+	return s.senders[index].OnRTCPPacket(conn, data)
+}
+
+// 单端口模式下, 所有拉流端收到的rtp包ssrc相同, 发送前改写为sender的ssrc
+func rewriteSSRC(dst, packet []byte, ssrc uint32) []byte {
+	dst = append(dst[:0], packet...)
+	binary.BigEndian.PutUint32(dst[8:], ssrc)
+	return dst
+}
+
+// 处理拉流端发送的RTCP RR和NACK
+func (s *Sink) onRTCPPacket(index int, data []byte) {
+	packets, err := rtcp.Unmarshal(data)
+	if err != nil {
+		log.Sugar.Warnf("解析rtcp包失败 err: %s sink: %s", err.Error(), s.String())
+		return
+	}
+
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.ReceiverReport:
+			for _, report := range p.Reports {
+				s.onReceptionReport(index, report)
+			}
+		case *rtcp.TransportLayerNack:
+			var seqs []uint16
+			for _, pair := range p.Nacks {
+				seqs = append(seqs, pair.PacketList()...)
+			}
+
+			s.onNack(index, seqs)
+		}
+	}
+}
+
+func (s *Sink) onReceptionReport(index int, report rtcp.ReceptionReport) {
+	if s.transStream == nil || index >= len(s.transStream.rtpTracks) {
+		return
+	}
+
+	rate := s.transStream.rtpTracks[index].rate
+	if rate <= 0 {
+		return
+	}
+
+	s.statisticsLock.Lock()
+	defer s.statisticsLock.Unlock()
+
+	statistics := &s.statistics[index]
+	statistics.FractionLost = float64(report.FractionLost) * 100 / 256
+	statistics.TotalLost = int(report.TotalLost)
+	statistics.Jitter = float64(report.Jitter) * 1000 / float64(rate)
+}
+
+// 从TranStream的重传队列查找丢失的包, 重新发送给拉流端
+func (s *Sink) onNack(index int, seqs []uint16) {
+	sender := s.senders[index]
+	if s.transStream == nil || sender == nil || sender.RtpConn == nil {
+		return
 	}
 
+	count := s.transStream.Retransmit(index, seqs, func(packet []byte) {
+		if s.shared {
+			packet = rewriteSSRC(nil, packet, sender.SSRC)
+		}
+
+		sender.RtpConn.Write(packet)
+	})
+
+	s.statisticsLock.Lock()
+	s.statistics[index].NackCount += len(seqs)
+	s.statistics[index].Retransmits += count
+	s.statisticsLock.Unlock()
+}
+
+// Statistics 返回每路流的丢包、抖动和重传统计
+func (s *Sink) Statistics() []stream.TrackStatistics {
+	s.statisticsLock.Lock()
+	defer s.statisticsLock.Unlock()
+
+	var statistics []stream.TrackStatistics
+	for i, sender := range s.senders {
+		if sender != nil {
+			statistics = append(statistics, s.statistics[i])
+		}
+	}
+
+	return statistics
+}
+
+// AddMulticastSender 组播拉流, 返回track的组播地址和rtp端口. 组播流由TranStream统一发送, 不创建sender.
+func (s *Sink) AddMulticastSender(index int) (net.IP, int, error) {
+	utils.Assert(index < cap(s.senders))
+
+	if s.transStream == nil {
+		return nil, 0, fmt.Errorf("the stream is not ready")
+	} else if MulticastManager == nil {
+		return nil, 0, fmt.Errorf("multicast is not enabled")
+	}
+
+	ip, port, err := s.transStream.JoinMulticast()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 多个track只计数一次
+	if s.multicast {
+		s.transStream.LeaveMulticast()
+	}
+
+	s.multicast = true
+	return ip, port + index*2, nil
+}
+
+func (s *Sink) Write(index int, data [][]byte, rtpTime int64) error {
 	for _, bytes := range data {
-		sender := s.senders[index]
+		// 按照rtp包的通道号发送, 扩展数据可能包含多路视频track的rtp包
+		channel := int(bytes[1])
+		if channel >= len(s.senders) || s.senders[channel] == nil {
+			// 拉流方还没有连接上来
+			continue
+		}
+
+		sender := s.senders[channel]
 		sender.PktCount++
 		sender.OctetCount += len(bytes)
 		if s.TCPStreaming {
 			s.Conn.Write(bytes)
 		} else {
-			//发送rtcp sr包
-			sender.RtpConn.Write(bytes[OverTcpHeaderSize:])
+			if s.shared {
+				s.rtpBuffer = rewriteSSRC(s.rtpBuffer, bytes[OverTcpHeaderSize:], sender.SSRC)
+				sender.RtpConn.Write(s.rtpBuffer)
+			} else {
+				sender.RtpConn.Write(bytes[OverTcpHeaderSize:])
+			}
 
+			//发送rtcp sr包
 			if sender.RtcpConn == nil || sender.PktCount%100 != 0 {
 				continue
 			}
@@ -129,11 +324,25 @@ func (s *Sink) isConnected(index int) bool {
 func (s *Sink) Close() {
 	s.BaseSink.Close()
 
+	if s.multicast {
+		s.transStream.LeaveMulticast()
+		s.multicast = false
+	}
+
+	if s.udp {
+		s.transStream.RemoveUDPSink()
+		s.udp = false
+	}
+
 	for _, sender := range s.senders {
 		if sender == nil {
 			continue
 		}
 
+		if s.shared {
+			SharedUDPServer.removeSender(sender.SSRC)
+		}
+
 		if sender.Rtp != nil {
 			sender.Rtp.Close()
 		}
@@ -144,10 +353,20 @@ func (s *Sink) Close() {
 	}
 }
 
+// StreamNotFound 等待推流超时, describe应答404.
+// 播放中的源关闭后重新等待, 此时已经应答过describe, 关闭连接由会话释放sink
+func (s *Sink) StreamNotFound() {
+	if s.sdpCb != nil {
+		s.sdpCb("")
+		s.sdpCb = nil
+	} else {
+		s.BaseSink.StreamNotFound()
+	}
+}
+
 func NewSink(id stream.SinkID, sourceId string, conn net.Conn, cb func(sdp string)) stream.Sink {
 	return &Sink{
-		stream.BaseSink{ID: id, SourceID: sourceId, Protocol: stream.TransStreamRtsp, Conn: conn},
-		nil,
-		cb,
+		BaseSink: stream.BaseSink{ID: id, SourceID: sourceId, Protocol: stream.TransStreamRtsp, Conn: conn},
+		sdpCb:    cb,
 	}
 }
@@ -0,0 +1,60 @@
+package rtsp
+
+import (
+	"github.com/lkmio/lkm/stream"
+	"net"
+	"testing"
+	"time"
+)
+
+// 等待推流超时, 未应答describe时回调空sdp, 已经播放过则关闭连接
+func TestSinkStreamNotFound(t *testing.T) {
+	tests := []struct {
+		name     string
+		answered bool // 已经应答过describe
+	}{
+		{"describe", false},
+		{"playing", true},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, remote := net.Pipe()
+			defer remote.Close()
+
+			var sdp *string
+			sink := NewSink(stream.SinkID(uint64(i)), "live/test", conn, func(s string) {
+				sdp = &s
+			}).(*Sink)
+
+			if test.answered {
+				sink.sdpCb("v=0")
+				sink.sdpCb = nil
+				sdp = nil
+			}
+
+			sink.StreamNotFound()
+
+			_ = remote.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, err := remote.Read(make([]byte, 1))
+			closed := err != nil && !isTimeout(err)
+
+			if test.answered {
+				if sdp != nil {
+					t.Fatal("unexpected sdp callback")
+				} else if !closed {
+					t.Fatal("conn not closed")
+				}
+			} else if sdp == nil || *sdp != "" {
+				t.Fatal("empty sdp not answered")
+			} else if closed {
+				t.Fatal("conn closed before answering 404")
+			}
+		})
+	}
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/lkmio/lkm/stream"
 	"net"
 	"strconv"
+	"sync"
 )
 
 const (
@@ -28,6 +29,12 @@ type TranStream struct {
 	rtpTracks []*Track
 	sdp       string
 	buffer    *stream.ReceiveBuffer
+
+	multicastLock sync.Mutex
+	multicast     *multicastGroup // 组播拉流时创建, 所有组播sink共用
+
+	historyLock sync.RWMutex // 保护rtp重传队列, NACK在udp接收协程处理
+	udpSinks    int          // udp单播拉流的sink数量, 只有udp拉流端会发送NACK, 没有时不保存重传队列
 }
 
 func (t *TranStream) OverTCP(data []byte, channel int) {
@@ -40,22 +47,52 @@ func (t *TranStream) Input(packet utils.AVPacket) ([][]byte, int64, bool, error)
 	t.ClearOutStreamBuffer()
 
 	var ts uint32
-	track := t.rtpTracks[packet.Index()]
+	index, avStream := t.FindTrack(packet.Index())
+	if avStream == nil {
+		return nil, -1, false, nil
+	}
+
+	track := t.rtpTracks[index]
 	track.seq = track.muxer.GetHeader().Seq
 	if utils.AVMediaTypeAudio == packet.MediaType() {
 		ts = uint32(packet.ConvertPts(track.rate))
-		t.PackRtpPayload(track.muxer, packet.Index(), packet.Data(), ts)
+		t.PackRtpPayload(track.muxer, index, packet.Data(), ts)
 	} else if utils.AVMediaTypeVideo == packet.MediaType() {
 		ts = uint32(packet.ConvertPts(track.rate))
-		data := libavc.RemoveStartCode(packet.AnnexBPacketData(t.BaseTransStream.Tracks[packet.Index()]))
-		t.PackRtpPayload(track.muxer, packet.Index(), data, ts)
+		data := libavc.RemoveStartCode(packet.AnnexBPacketData(avStream))
+		t.PackRtpPayload(track.muxer, index, data, ts)
 	}
 
+	track.timestamp = ts
+	t.onRtpPackets(index, track)
+
 	return t.OutBuffer[:t.OutBufferSize], int64(ts), utils.AVMediaTypeVideo == packet.MediaType() && packet.KeyFrame(), nil
 }
 
+// 保存输出的rtp包到重传队列, 开启组播时发送给组播组
+func (t *TranStream) onRtpPackets(index int, track *Track) {
+	// 保存到重传队列
+	t.historyLock.Lock()
+	if t.udpSinks > 0 {
+		for _, bytes := range t.OutBuffer[:t.OutBufferSize] {
+			track.saveHistory(bytes[OverTcpHeaderSize:])
+		}
+	}
+	t.historyLock.Unlock()
+
+	// 组播每个rtp包只发送一次
+	t.multicastLock.Lock()
+	if t.multicast != nil {
+		for _, bytes := range t.OutBuffer[:t.OutBufferSize] {
+			t.multicast.write(index, bytes[OverTcpHeaderSize:])
+		}
+	}
+	t.multicastLock.Unlock()
+}
+
 func (t *TranStream) ReadExtraData(ts int64) ([][]byte, int64, error) {
-	// 返回视频编码数据的rtp包
+	// 返回所有视频track编码数据的rtp包, 每个rtp包的通道号对应各自的track
+	var extraData [][]byte
 	for _, track := range t.rtpTracks {
 		if utils.AVMediaTypeVideo != track.mediaType {
 			continue
@@ -68,13 +105,16 @@ func (t *TranStream) ReadExtraData(ts int64) ([][]byte, int64, error) {
 			binary.BigEndian.PutUint32(bytes[OverTcpHeaderSize+4:], uint32(ts))
 		}
 
-		return track.extraDataBuffer, ts, nil
+		extraData = append(extraData, track.extraDataBuffer...)
 	}
 
-	return nil, ts, nil
+	return extraData, ts, nil
 }
 
 func (t *TranStream) PackRtpPayload(muxer librtp.Muxer, channel int, data []byte, timestamp uint32) {
+	// 按分片后的rtp包个数预留缓存块, 分片时rtp包还有fu头等额外开销
+	t.buffer.Reserve(len(data)/(t.buffer.BlockSize()-OverTcpHeaderSize-64) + 1)
+
 	var index int
 	muxer.Input(data, timestamp, func() []byte {
 		index = t.buffer.Index()
@@ -112,35 +152,136 @@ func (t *TranStream) AddTrack(stream utils.AVStream) error {
 	t.rtpTracks = append(t.rtpTracks, NewRTSPTrack(muxer, byte(payloadType.Pt), payloadType.ClockRate, stream.Type()))
 	index := len(t.rtpTracks) - 1
 
-	// 将sps和pps按照单一模式打包
-	bufferIndex := t.buffer.Index()
 	if utils.AVMediaTypeVideo == stream.Type() {
-		parameters := stream.CodecParameters()
+		t.packExtraData(index, stream, 0)
+	}
+
+	return nil
+}
+
+// 将sps和pps按照单一模式打包, 拷贝一份作为扩展数据的rtp包, 新的sink从关键帧开始拉流时发送
+func (t *TranStream) packExtraData(index int, stream utils.AVStream, ts uint32) {
+	track := t.rtpTracks[index]
+	outBufferSize := t.OutBufferSize
+	parameters := stream.CodecParameters()
+
+	if utils.AVCodecIdH265 == stream.CodecId() {
+		bytes := parameters.(*utils.HEVCCodecData).VPS()
+		t.PackRtpPayload(track.muxer, index, bytes[0], ts)
+	}
+
+	spsBytes := parameters.SPS()
+	ppsBytes := parameters.PPS()
+	t.PackRtpPayload(track.muxer, index, spsBytes[0], ts)
+	t.PackRtpPayload(track.muxer, index, ppsBytes[0], ts)
+
+	// 拷贝扩展数据的rtp包
+	extraRtpBuffer := make([][]byte, t.OutBufferSize-outBufferSize)
+	for i, src := range t.OutBuffer[outBufferSize:t.OutBufferSize] {
+		extraRtpBuffer[i] = append([]byte(nil), src...)
+	}
+
+	track.extraDataBuffer = extraRtpBuffer
+}
+
+// UpdateTrack 编码参数发生变化, 将新的sps和pps打包成rtp包, 在带内发送给已有的sink, 并重新生成sdp.
+// 已经在拉流的sink无法再次获取sdp, 依靠带内的编码参数解码
+func (t *TranStream) UpdateTrack(stream utils.AVStream) ([][]byte, int64, error) {
+	if _, _, err := t.BaseTransStream.UpdateTrack(stream); err != nil {
+		return nil, -1, err
+	}
+
+	_ = t.WriteHeader()
+
+	index, _ := t.FindTrack(stream.Index())
+	if utils.AVMediaTypeVideo != stream.Type() {
+		return nil, -1, nil
+	}
 
-		if utils.AVCodecIdH265 == stream.CodecId() {
-			bytes := parameters.(*utils.HEVCCodecData).VPS()
-			t.PackRtpPayload(muxer, index, bytes[0], 0)
+	t.ClearOutStreamBuffer()
+
+	track := t.rtpTracks[index]
+	t.packExtraData(index, stream, track.timestamp)
+	t.onRtpPackets(index, track)
+	return t.OutBuffer[:t.OutBufferSize], int64(track.timestamp), nil
+}
+
+// Retransmit 从重传队列查找NACK请求的rtp包, 交给write发送
+func (t *TranStream) Retransmit(index int, seqs []uint16, write func(packet []byte)) int {
+	if index >= len(t.rtpTracks) {
+		return 0
+	}
+
+	t.historyLock.RLock()
+	defer t.historyLock.RUnlock()
+
+	var count int
+	for _, seq := range seqs {
+		if packet := t.rtpTracks[index].findHistory(seq); packet != nil {
+			write(packet)
+			count++
 		}
+	}
+
+	return count
+}
+
+// AddUDPSink udp单播拉流的sink建立传输链路, 开始保存重传队列
+func (t *TranStream) AddUDPSink() {
+	t.historyLock.Lock()
+	defer t.historyLock.Unlock()
+
+	t.udpSinks++
+}
+
+// RemoveUDPSink udp单播拉流的sink关闭, 最后一个sink关闭时释放重传队列
+func (t *TranStream) RemoveUDPSink() {
+	t.historyLock.Lock()
+	defer t.historyLock.Unlock()
+
+	t.udpSinks--
+	if t.udpSinks > 0 {
+		return
+	}
+
+	t.udpSinks = 0
+	for _, track := range t.rtpTracks {
+		track.clearHistory()
+	}
+}
+
+// JoinMulticast 组播拉流的sink加入组播组, 第一个sink加入时分配组播地址和端口
+func (t *TranStream) JoinMulticast() (net.IP, int, error) {
+	t.multicastLock.Lock()
+	defer t.multicastLock.Unlock()
 
-		spsBytes := parameters.SPS()
-		ppsBytes := parameters.PPS()
-		t.PackRtpPayload(muxer, index, spsBytes[0], 0)
-		t.PackRtpPayload(muxer, index, ppsBytes[0], 0)
-
-		// 拷贝扩展数据的rtp包
-		size := t.buffer.Index() - bufferIndex
-		extraRtpBuffer := make([][]byte, size)
-		for i := 0; i < size; i++ {
-			src := t.buffer.Get(bufferIndex + i)
-			dst := make([]byte, len(src))
-			copy(dst, src)
-			extraRtpBuffer[i] = dst[:OverTcpHeaderSize+binary.BigEndian.Uint16(dst[2:])]
+	if t.multicast == nil {
+		group, err := newMulticastGroup(len(t.rtpTracks))
+		if err != nil {
+			return nil, 0, err
 		}
 
-		t.rtpTracks[index].extraDataBuffer = extraRtpBuffer
+		t.multicast = group
 	}
 
-	return nil
+	t.multicast.refCount++
+	return t.multicast.ip, t.multicast.port, nil
+}
+
+// LeaveMulticast 组播拉流的sink离开组播组, 最后一个sink离开时停止发送并释放组播地址
+func (t *TranStream) LeaveMulticast() {
+	t.multicastLock.Lock()
+	defer t.multicastLock.Unlock()
+
+	if t.multicast == nil {
+		return
+	}
+
+	t.multicast.refCount--
+	if t.multicast.refCount < 1 {
+		t.multicast.close()
+		t.multicast = nil
+	}
 }
 
 func (t *TranStream) Close() ([][]byte, int64, error) {
@@ -150,6 +291,13 @@ func (t *TranStream) Close() ([][]byte, int64, error) {
 		}
 	}
 
+	t.multicastLock.Lock()
+	if t.multicast != nil {
+		t.multicast.close()
+		t.multicast = nil
+	}
+	t.multicastLock.Unlock()
+
 	return nil, 0, nil
 }
 
@@ -1,19 +1,52 @@
 package rtsp
 
 import (
+	"encoding/binary"
 	"github.com/lkmio/avformat/librtp"
 	"github.com/lkmio/avformat/utils"
 )
 
+const (
+	// RetransmissionHistorySize 每路流保存最近多少个rtp包用于重传
+	RetransmissionHistorySize = 1024
+)
+
 // Track RtspTrack 对rtsp每路输出流的封装
 type Track struct {
 	pt        byte
 	rate      int
 	mediaType utils.AVMediaType
 	seq       uint16
+	timestamp uint32 // 最近一帧的rtp时间戳, 推流中途在带内发送编码参数时使用
 
 	muxer           librtp.Muxer
 	extraDataBuffer [][]byte // 缓存带有编码信息的rtp包, 对所有sink通用
+
+	history [RetransmissionHistorySize][]byte // 最近发送的rtp包, 根据序号响应NACK重传
+}
+
+// 保存rtp包到重传队列, 复用之前的内存
+func (r *Track) saveHistory(packet []byte) {
+	seq := binary.BigEndian.Uint16(packet[2:])
+	index := int(seq) % RetransmissionHistorySize
+	r.history[index] = append(r.history[index][:0], packet...)
+}
+
+// 释放重传队列的内存
+func (r *Track) clearHistory() {
+	for i := range r.history {
+		r.history[i] = nil
+	}
+}
+
+// 根据序号查找重传队列中的rtp包, 序号被覆盖返回nil
+func (r *Track) findHistory(seq uint16) []byte {
+	packet := r.history[int(seq)%RetransmissionHistorySize]
+	if len(packet) < 12 || binary.BigEndian.Uint16(packet[2:]) != seq {
+		return nil
+	}
+
+	return packet
 }
 
 func (r *Track) Close() {
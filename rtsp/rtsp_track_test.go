@@ -0,0 +1,57 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func newTestRtpPacket(seq uint16) []byte {
+	packet := make([]byte, 20)
+	packet[0] = 0x80
+	binary.BigEndian.PutUint16(packet[2:], seq)
+	return packet
+}
+
+func TestTrackHistory(t *testing.T) {
+	track := &Track{}
+	for seq := 0; seq < RetransmissionHistorySize+10; seq++ {
+		track.saveHistory(newTestRtpPacket(uint16(seq)))
+	}
+
+	tests := []struct {
+		seq   uint16
+		exist bool
+	}{
+		{0, false}, // 被之后的包覆盖
+		{9, false},
+		{10, true},
+		{RetransmissionHistorySize + 9, true},
+		{RetransmissionHistorySize + 10, false}, // 还未发送
+	}
+
+	for _, test := range tests {
+		if packet := track.findHistory(test.seq); (packet != nil) != test.exist {
+			t.Fatalf("find seq %d: %v", test.seq, packet)
+		}
+	}
+}
+
+// 只有udp拉流端存在时保留重传队列
+func TestUDPSinkHistory(t *testing.T) {
+	track := &Track{}
+	transStream := &TranStream{rtpTracks: []*Track{track}}
+
+	transStream.AddUDPSink()
+	transStream.AddUDPSink()
+	track.saveHistory(newTestRtpPacket(1))
+
+	transStream.RemoveUDPSink()
+	if transStream.Retransmit(0, []uint16{1}, func([]byte) {}) != 1 {
+		t.Fatal("history released while a udp sink exists")
+	}
+
+	transStream.RemoveUDPSink()
+	if transStream.Retransmit(0, []uint16{1}, func([]byte) {}) != 0 {
+		t.Fatal("history retained after the last udp sink closed")
+	}
+}
@@ -0,0 +1,266 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/lkmio/avformat/transport"
+	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/stream"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TunnelContentType RTSP over HTTP隧道请求和响应的Content-Type
+	TunnelContentType = "application/x-rtsp-tunnelled"
+
+	// TunnelSessionCookie 关联隧道GET和POST请求的头
+	TunnelSessionCookie = "x-sessioncookie"
+)
+
+// 隧道GET链路, 根据x-sessioncookie查找
+var tunnels sync.Map
+
+// IsTunnelRequest 是否是RTSP over HTTP隧道请求
+func IsTunnelRequest(r *http.Request) bool {
+	if r.Header.Get(TunnelSessionCookie) == "" {
+		return false
+	}
+
+	return http.MethodGet == r.Method && strings.Contains(r.Header.Get("Accept"), TunnelContentType) ||
+		http.MethodPost == r.Method && strings.Contains(r.Header.Get("Content-Type"), TunnelContentType)
+}
+
+// ServeHttpTunnel 处理Apple RTSP over HTTP隧道.
+// GET请求建立下行链路, 用于发送RTSP响应和音视频流; POST请求建立上行链路, 发送base64编码的RTSP请求.
+// 两个请求通过x-sessioncookie关联, GET链路断开时结束会话.
+func (s *server) ServeHttpTunnel(w http.ResponseWriter, r *http.Request) {
+	cookie := r.Header.Get(TunnelSessionCookie)
+	if http.MethodGet == r.Method {
+		s.serveTunnelGet(cookie, w)
+	} else {
+		s.serveTunnelPost(cookie, w, r)
+	}
+}
+
+func (s *server) serveTunnelGet(cookie string, w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+
+	hijack, _, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 不能使用http.ResponseWriter应答, 会话期间保持连接
+	_, err = hijack.Write([]byte("HTTP/1.0 200 OK\r\n" +
+		"Connection: close\r\n" +
+		"Date: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"Pragma: no-cache\r\n" +
+		"Content-Type: " + TunnelContentType + "\r\n\r\n"))
+	if err != nil {
+		_ = hijack.Close()
+		return
+	}
+
+	var conn net.Conn = transport.NewConn(hijack)
+	if _, ok := tunnels.LoadOrStore(cookie, conn); ok {
+		log.Sugar.Errorf("rtsp隧道已经存在 cookie: %s conn: %s", cookie, hijack.RemoteAddr().String())
+		_ = hijack.Close()
+		return
+	}
+
+	log.Sugar.Infof("rtsp隧道连接 cookie: %s conn: %s", cookie, hijack.RemoteAddr().String())
+	s.OnConnected(conn)
+
+	// 下行链路不会再收到数据, 读取只为检测断开
+	bytes := make([]byte, 64)
+	for {
+		if _, err = hijack.Read(bytes); err != nil {
+			break
+		}
+	}
+
+	tunnels.Delete(cookie)
+	s.OnDisConnected(conn, err)
+}
+
+func (s *server) serveTunnelPost(cookie string, w http.ResponseWriter, r *http.Request) {
+	value, ok := tunnels.Load(cookie)
+	if !ok {
+		log.Sugar.Errorf("rtsp隧道不存在 cookie: %s conn: %s", cookie, r.RemoteAddr)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// 请求交给下行链路的session处理, 响应也从下行链路发送
+	conn := value.(net.Conn)
+	decoder := &tunnelDecoder{}
+	buffer := make([]byte, 4096)
+	for {
+		n, err := r.Body.Read(buffer)
+		if n > 0 {
+			messages, decodeErr := decoder.Input(buffer[:n])
+			if decodeErr != nil {
+				log.Sugar.Errorf("rtsp隧道解码失败 err: %s cookie: %s", decodeErr.Error(), cookie)
+				_ = conn.Close()
+				return
+			}
+
+			for _, message := range messages {
+				s.OnPacket(conn, message)
+			}
+		}
+
+		// POST请求体结束不影响会话, 播放器会发起新的POST请求
+		if err != nil {
+			if err != io.EOF {
+				log.Sugar.Infof("rtsp隧道上行链路断开 err: %s cookie: %s", err.Error(), cookie)
+			}
+
+			return
+		}
+	}
+}
+
+// 解码隧道上行base64数据, 拆分出完整的RTSP请求.
+// 播放端可能将每个请求单独编码后连续发送(中间带有填充符), QuickTime还会插入换行符.
+type tunnelDecoder struct {
+	base64Buffer []byte
+	buffer       []byte
+}
+
+func (t *tunnelDecoder) Input(data []byte) ([][]byte, error) {
+	// 去掉空白字符
+	for _, b := range data {
+		if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+			t.base64Buffer = append(t.base64Buffer, b)
+		}
+	}
+
+	// 只解码完整的4字节分组. 携带填充符的分组是一个base64块的结尾, 每个块单独解码
+	n := len(t.base64Buffer) / 4 * 4
+	var start int
+	for end := 4; end <= n; end += 4 {
+		if end < n && t.base64Buffer[end-1] != '=' {
+			continue
+		}
+
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(end-start))
+		size, err := base64.StdEncoding.Decode(decoded, t.base64Buffer[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		t.buffer = append(t.buffer, decoded[:size]...)
+		start = end
+	}
+
+	t.base64Buffer = append(t.base64Buffer[:0], t.base64Buffer[n:]...)
+	return splitMessages(&t.buffer)
+}
+
+// 按照头部结束符和Content-Length拆分RTSP请求, 未完整的请求留在缓冲区
+func splitMessages(buffer *[]byte) ([][]byte, error) {
+	var messages [][]byte
+	for {
+		// 丢弃播放端发送的interleaved包(RTCP)
+		if len(*buffer) > 0 && (*buffer)[0] == '$' {
+			if len(*buffer) < OverTcpHeaderSize {
+				break
+			}
+
+			size := OverTcpHeaderSize + int(binary.BigEndian.Uint16((*buffer)[2:]))
+			if len(*buffer) < size {
+				break
+			}
+
+			*buffer = append((*buffer)[:0], (*buffer)[size:]...)
+			continue
+		}
+
+		index := bytes.Index(*buffer, []byte("\r\n\r\n"))
+		if index < 0 {
+			break
+		}
+
+		size := index + 4
+		if contentLength := findContentLength((*buffer)[:index]); contentLength < 0 {
+			return nil, fmt.Errorf("invalid Content-Length")
+		} else {
+			size += contentLength
+		}
+
+		if len(*buffer) < size {
+			break
+		}
+
+		message := make([]byte, size)
+		copy(message, *buffer)
+		messages = append(messages, message)
+		*buffer = append((*buffer)[:0], (*buffer)[size:]...)
+	}
+
+	return messages, nil
+}
+
+func findContentLength(header []byte) int {
+	for _, line := range strings.Split(string(header), "\r\n") {
+		pair := strings.SplitN(line, ":", 2)
+		if len(pair) != 2 || !strings.EqualFold(strings.TrimSpace(pair[0]), "Content-Length") {
+			continue
+		}
+
+		length, err := strconv.Atoi(strings.TrimSpace(pair[1]))
+		if err != nil {
+			return -1
+		}
+
+		return length
+	}
+
+	return 0
+}
+
+// ServeWebSocket 处理RTSP over WebSocket, 每个消息是一个或多个RTSP请求, 音视频流使用interleaved方式发送
+func (s *server) ServeWebSocket(ws *websocket.Conn) {
+	// RTSP响应和interleaved的RTP包都作为一个二进制消息发送
+	conn := stream.NewWSConn(ws, nil)
+	log.Sugar.Infof("rtsp over websocket连接 conn: %s", ws.RemoteAddr().String())
+	s.OnConnected(conn)
+
+	var err error
+	var buffer []byte
+	for {
+		var data []byte
+		if _, data, err = ws.ReadMessage(); err != nil {
+			break
+		}
+
+		buffer = append(buffer, data...)
+		messages, splitErr := splitMessages(&buffer)
+		if splitErr != nil {
+			err = splitErr
+			break
+		}
+
+		for _, message := range messages {
+			s.OnPacket(conn, message)
+		}
+	}
+
+	s.OnDisConnected(conn, err)
+}
@@ -0,0 +1,153 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+const (
+	testOptions  = "OPTIONS rtsp://127.0.0.1/live/test RTSP/1.0\r\nCSeq: 1\r\n\r\n"
+	testDescribe = "DESCRIBE rtsp://127.0.0.1/live/test RTSP/1.0\r\nCSeq: 2\r\nAccept: application/sdp\r\n\r\n"
+	testAnnounce = "SET_PARAMETER rtsp://127.0.0.1/live/test RTSP/1.0\r\nCSeq: 3\r\nContent-Length: 5\r\n\r\nhello"
+)
+
+func encodeBase64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// 每隔n个字符插入换行符
+func insertCRLF(s string, n int) string {
+	var builder strings.Builder
+	for i := 0; i < len(s); i += n {
+		end := i + n
+		if end > len(s) {
+			end = len(s)
+		}
+
+		builder.WriteString(s[i:end])
+		builder.WriteString("\r\n")
+	}
+
+	return builder.String()
+}
+
+func TestTunnelDecoder(t *testing.T) {
+	tests := []struct {
+		name     string
+		inputs   []string
+		expected []string
+	}{
+		{
+			name:     "single request",
+			inputs:   []string{encodeBase64(testOptions)},
+			expected: []string{testOptions},
+		},
+		{
+			// 每个请求单独编码, 第一个块以填充符结尾
+			name:     "concatenated padded blocks",
+			inputs:   []string{encodeBase64(testOptions) + encodeBase64(testDescribe)},
+			expected: []string{testOptions, testDescribe},
+		},
+		{
+			name:     "padded blocks split across reads",
+			inputs:   []string{encodeBase64(testOptions)[:10], encodeBase64(testOptions)[10:] + encodeBase64(testDescribe)[:7], encodeBase64(testDescribe)[7:]},
+			expected: []string{testOptions, testDescribe},
+		},
+		{
+			name:     "CRLF split",
+			inputs:   []string{insertCRLF(encodeBase64(testOptions), 13), insertCRLF(encodeBase64(testAnnounce), 76)},
+			expected: []string{testOptions, testAnnounce},
+		},
+		{
+			name:     "one byte per read",
+			inputs:   strings.Split(insertCRLF(encodeBase64(testOptions)+encodeBase64(testAnnounce), 7), ""),
+			expected: []string{testOptions, testAnnounce},
+		},
+		{
+			// 一个请求拆成两个块编码
+			name:     "request split into blocks",
+			inputs:   []string{encodeBase64(testDescribe[:11]) + "\r\n" + encodeBase64(testDescribe[11:])},
+			expected: []string{testDescribe},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoder := &tunnelDecoder{}
+			var messages []string
+			for _, input := range test.inputs {
+				result, err := decoder.Input([]byte(input))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, message := range result {
+					messages = append(messages, string(message))
+				}
+			}
+
+			if len(messages) != len(test.expected) {
+				t.Fatalf("decoded %d messages %q, expected %d", len(messages), messages, len(test.expected))
+			}
+
+			for i, message := range messages {
+				if message != test.expected[i] {
+					t.Fatalf("message %d: %q, expected %q", i, message, test.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTunnelDecoderInvalid(t *testing.T) {
+	decoder := &tunnelDecoder{}
+	if _, err := decoder.Input([]byte("T1BU*U9OUw==")); err == nil {
+		t.Fatal("expected an error for invalid base64")
+	}
+}
+
+func TestSplitMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected []string
+		remain   int
+		success  bool
+	}{
+		{"one request", testOptions, []string{testOptions}, 0, true},
+		{"two requests", testOptions + testDescribe, []string{testOptions, testDescribe}, 0, true},
+		{"content length", testAnnounce + testOptions, []string{testAnnounce, testOptions}, 0, true},
+		{"incomplete header", testOptions[:20], nil, 20, true},
+		{"incomplete body", testAnnounce[:len(testAnnounce)-2], nil, len(testAnnounce) - 2, true},
+		{"interleaved rtcp", "$\x01\x00\x04abcd" + testOptions, []string{testOptions}, 0, true},
+		{"incomplete interleaved", "$\x01\x00\x04ab", nil, 6, true},
+		{"invalid content length", "SET_PARAMETER * RTSP/1.0\r\nContent-Length: x\r\n\r\n", nil, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := []byte(test.data)
+			messages, err := splitMessages(&buffer)
+			if (err == nil) != test.success {
+				t.Fatalf("split err: %v", err)
+			} else if err != nil {
+				return
+			}
+
+			if len(messages) != len(test.expected) {
+				t.Fatalf("split %d messages, expected %d", len(messages), len(test.expected))
+			}
+
+			for i, message := range messages {
+				if string(message) != test.expected[i] {
+					t.Fatalf("message %d: %q, expected %q", i, message, test.expected[i])
+				}
+			}
+
+			if len(buffer) != test.remain {
+				t.Fatalf("remain %d bytes, expected %d", len(buffer), test.remain)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"github.com/lkmio/avformat/transport"
+	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/stream"
+	"github.com/pion/rtcp"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+)
+
+var (
+	// SharedUDPServer 单端口模式下, 所有udp拉流共用的rtp/rtcp端口
+	SharedUDPServer *SharedServer
+)
+
+// 单端口模式下的一路拉流, 对应sink的一个track
+type sharedSender struct {
+	sink  *Sink
+	index int
+	ssrc  uint32
+	addrs []string // 拉流端的rtp和rtcp地址, 收到nat穿透包后更新为实际地址
+}
+
+// SharedServer 所有udp拉流共用一对rtp/rtcp端口, 根据拉流端地址和ssrc区分sink.
+// 每个sender分配唯一的ssrc, 发送时改写rtp包的ssrc, 拉流端的RTCP RR和NACK携带该ssrc,
+// 即使拉流端在nat后, 端口与SETUP时声明的client_port不一致, 也能匹配到sink.
+type SharedServer struct {
+	rtp      *transport.UDPServer
+	rtcp     *transport.UDPServer
+	rtpPort  int
+	rtcpPort int
+
+	lock    sync.RWMutex
+	addrs   map[string]*sharedSender // key为拉流端ip:port
+	senders map[uint32]*sharedSender // key为ssrc
+}
+
+// 为sender分配唯一的ssrc
+func (s *SharedServer) allocateSSRC() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for {
+		ssrc := rand.Uint32()
+		if _, ok := s.senders[ssrc]; ssrc != 0 && ssrc != 0xFFFFFFFF && !ok {
+			// 先占位, 避免并发分配到相同的ssrc
+			s.senders[ssrc] = nil
+			return ssrc
+		}
+	}
+}
+
+// 添加拉流端, rtpAddr和rtcpAddr为SETUP请求的client_port, 可以为空
+func (s *SharedServer) addSender(sink *Sink, index int, ssrc uint32, rtpAddr, rtcpAddr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sender := &sharedSender{sink: sink, index: index, ssrc: ssrc}
+	s.senders[ssrc] = sender
+	for _, addr := range []string{rtpAddr, rtcpAddr} {
+		if addr != "" {
+			s.addrs[addr] = sender
+			sender.addrs = append(sender.addrs, addr)
+		}
+	}
+}
+
+func (s *SharedServer) removeSender(ssrc uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sender, ok := s.senders[ssrc]
+	if !ok {
+		return
+	}
+
+	delete(s.senders, ssrc)
+	if sender == nil {
+		return
+	}
+
+	for _, addr := range sender.addrs {
+		if s.addrs[addr] == sender {
+			delete(s.addrs, addr)
+		}
+	}
+}
+
+// 根据地址查找sender, 地址未匹配再根据ssrc查找, 匹配成功后绑定该地址
+func (s *SharedServer) findSender(addr string, ssrcs []uint32) *sharedSender {
+	s.lock.RLock()
+	sender := s.addrs[addr]
+	s.lock.RUnlock()
+	if sender != nil {
+		return sender
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, ssrc := range ssrcs {
+		if sender = s.senders[ssrc]; sender != nil {
+			s.addrs[addr] = sender
+			sender.addrs = append(sender.addrs, addr)
+			return sender
+		}
+	}
+
+	return nil
+}
+
+func (s *SharedServer) onRTPPacket(conn net.Conn, data []byte) []byte {
+	var ssrcs []uint32
+	if len(data) >= 12 && data[0]>>6 == 2 {
+		ssrcs = append(ssrcs, binary.BigEndian.Uint32(data[8:]))
+	}
+
+	sender := s.findSender(conn.RemoteAddr().String(), ssrcs)
+	if sender == nil {
+		log.Sugar.Debugf("rtp包匹配sink失败 conn: %s", conn.RemoteAddr().String())
+		return nil
+	}
+
+	return sender.sink.receiveRTP(sender.index, conn, data)
+}
+
+func (s *SharedServer) onRTCPPacket(conn net.Conn, data []byte) []byte {
+	sender := s.findSender(conn.RemoteAddr().String(), rtcpDestinationSSRCs(data))
+	if sender == nil {
+		log.Sugar.Debugf("rtcp包匹配sink失败 conn: %s", conn.RemoteAddr().String())
+		return nil
+	}
+
+	return sender.sink.receiveRTCP(sender.index, conn, data)
+}
+
+// RR的report block和NACK/PLI的media ssrc, 为服务器分配给拉流端的ssrc
+func rtcpDestinationSSRCs(data []byte) []uint32 {
+	var ssrcs []uint32
+	if packets, err := rtcp.Unmarshal(data); err == nil {
+		for _, packet := range packets {
+			ssrcs = append(ssrcs, packet.DestinationSSRC()...)
+		}
+	}
+
+	return ssrcs
+}
+
+func (s *SharedServer) RtpPort() int {
+	return s.rtpPort
+}
+
+func (s *SharedServer) RtcpPort() int {
+	return s.rtcpPort
+}
+
+func (s *SharedServer) Close() {
+	s.rtp.Close()
+	s.rtcp.Close()
+}
+
+func newSharedUDPServer(port int, handler func(conn net.Conn, data []byte) []byte) (*transport.UDPServer, error) {
+	addr, err := net.ResolveUDPAddr("udp", stream.ListenAddr(port))
+	if err != nil {
+		return nil, err
+	}
+
+	server := &transport.UDPServer{
+		ReuseServer: transport.ReuseServer{
+			EnableReuse:      true,
+			ConcurrentNumber: runtime.NumCPU(),
+		},
+	}
+
+	if err = server.Bind(addr); err != nil {
+		return nil, err
+	}
+
+	server.SetHandler2(nil, handler, nil)
+	server.Receive()
+	return server, nil
+}
+
+// NewSharedServer 创建单端口模式的rtp/rtcp服务, rtcp端口为rtp端口+1
+func NewSharedServer(rtpPort int) (*SharedServer, error) {
+	server := &SharedServer{
+		rtpPort:  rtpPort,
+		rtcpPort: rtpPort + 1,
+		addrs:    make(map[string]*sharedSender, 128),
+		senders:  make(map[uint32]*sharedSender, 128),
+	}
+
+	var err error
+	if server.rtp, err = newSharedUDPServer(server.rtpPort, server.onRTPPacket); err != nil {
+		return nil, err
+	} else if server.rtcp, err = newSharedUDPServer(server.rtcpPort, server.onRTCPPacket); err != nil {
+		server.rtp.Close()
+		return nil, err
+	}
+
+	return server, nil
+}
@@ -0,0 +1,141 @@
+package rtsp
+
+import (
+	"github.com/pion/rtcp"
+	"testing"
+)
+
+func newTestSharedServer() *SharedServer {
+	return &SharedServer{
+		addrs:   make(map[string]*sharedSender),
+		senders: make(map[uint32]*sharedSender),
+	}
+}
+
+// 根据拉流端地址和ssrc查找sender, 地址优先, ssrc匹配后绑定nat后的实际地址
+func TestSharedServerFindSender(t *testing.T) {
+	server := newTestSharedServer()
+	sink1, sink2 := &Sink{}, &Sink{}
+	server.addSender(sink1, 0, 1000, "10.0.0.1:5000", "10.0.0.1:5001")
+	server.addSender(sink2, 1, 2000, "10.0.0.2:6000", "")
+	// 已分配未SETUP的ssrc
+	placeholder := server.allocateSSRC()
+
+	tests := []struct {
+		name  string
+		addr  string
+		ssrcs []uint32
+		sink  *Sink
+		index int
+	}{
+		{"rtp addr", "10.0.0.1:5000", nil, sink1, 0},
+		{"rtcp addr", "10.0.0.1:5001", nil, sink1, 0},
+		{"addr before ssrc", "10.0.0.2:6000", []uint32{1000}, sink2, 1},
+		{"ssrc", "192.168.1.1:7000", []uint32{2000}, sink2, 1},
+		{"bound addr", "192.168.1.1:7000", nil, sink2, 1},
+		{"second ssrc", "192.168.1.2:7000", []uint32{3000, 1000}, sink1, 0},
+		{"unknown", "192.168.1.3:7000", []uint32{3000}, nil, 0},
+		{"placeholder", "192.168.1.4:7000", []uint32{placeholder}, nil, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender := server.findSender(test.addr, test.ssrcs)
+			if test.sink == nil {
+				if sender != nil {
+					t.Fatalf("unexpected sender: %d", sender.ssrc)
+				}
+				return
+			}
+
+			if sender == nil || sender.sink != test.sink || sender.index != test.index {
+				t.Fatalf("unexpected sender: %v", sender)
+			}
+		})
+	}
+}
+
+// sink离开时删除ssrc和绑定的所有地址, 不影响其他sender
+func TestSharedServerRemoveSender(t *testing.T) {
+	server := newTestSharedServer()
+	sink1, sink2, sink3 := &Sink{}, &Sink{}, &Sink{}
+	server.addSender(sink1, 0, 1000, "10.0.0.1:5000", "10.0.0.1:5001")
+	server.addSender(sink2, 0, 2000, "10.0.0.2:6000", "10.0.0.2:6001")
+	// 拉流端断开后端口被新的拉流端复用
+	server.addSender(sink3, 0, 3000, "10.0.0.1:5001", "")
+	// nat后的地址
+	server.findSender("192.168.1.1:7000", []uint32{1000})
+	placeholder := server.allocateSSRC()
+
+	server.removeSender(1000)
+	server.removeSender(placeholder)
+
+	tests := []struct {
+		name  string
+		addr  string
+		ssrcs []uint32
+		sink  *Sink
+	}{
+		{"removed rtp addr", "10.0.0.1:5000", nil, nil},
+		{"reused addr", "10.0.0.1:5001", nil, sink3},
+		{"removed bound addr", "192.168.1.1:7000", nil, nil},
+		{"removed ssrc", "192.168.1.2:7000", []uint32{1000}, nil},
+		{"other addr", "10.0.0.2:6001", nil, sink2},
+		{"other ssrc", "192.168.1.3:7000", []uint32{2000}, sink2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender := server.findSender(test.addr, test.ssrcs)
+			if test.sink == nil && sender != nil {
+				t.Fatalf("unexpected sender: %d", sender.ssrc)
+			} else if test.sink != nil && (sender == nil || sender.sink != test.sink) {
+				t.Fatalf("unexpected sender: %v", sender)
+			}
+		})
+	}
+
+	if _, ok := server.senders[placeholder]; ok {
+		t.Fatal("placeholder not removed")
+	}
+}
+
+// 从拉流端的RTCP包提取服务器分配的ssrc
+func TestRTCPDestinationSSRCs(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []rtcp.Packet
+		ssrcs   []uint32
+	}{
+		{"receiver report", []rtcp.Packet{&rtcp.ReceiverReport{SSRC: 1, Reports: []rtcp.ReceptionReport{{SSRC: 1000}}}}, []uint32{1000}},
+		{"nack", []rtcp.Packet{&rtcp.TransportLayerNack{SenderSSRC: 1, MediaSSRC: 2000, Nacks: []rtcp.NackPair{{PacketID: 1}}}}, []uint32{2000}},
+		{"compound", []rtcp.Packet{
+			&rtcp.ReceiverReport{SSRC: 1, Reports: []rtcp.ReceptionReport{{SSRC: 1000}}},
+			&rtcp.PictureLossIndication{SenderSSRC: 1, MediaSSRC: 2000},
+		}, []uint32{1000, 2000}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := rtcp.Marshal(test.packets)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ssrcs := rtcpDestinationSSRCs(data)
+			if len(ssrcs) != len(test.ssrcs) {
+				t.Fatalf("ssrcs: %v, expected: %v", ssrcs, test.ssrcs)
+			}
+
+			for i := range ssrcs {
+				if ssrcs[i] != test.ssrcs[i] {
+					t.Fatalf("ssrcs: %v, expected: %v", ssrcs, test.ssrcs)
+				}
+			}
+		})
+	}
+
+	if ssrcs := rtcpDestinationSSRCs([]byte{0x80}); len(ssrcs) != 0 {
+		t.Fatalf("unexpected ssrcs: %v", ssrcs)
+	}
+}
@@ -10,6 +10,7 @@ type BitrateStatistics struct {
 
 	previousSecondBytes int // 前一秒传输的字节数
 	latestSecondBytes   int // 当前秒正在传输的字节数
+	peakSecondBytes     int // 单秒传输的最大字节数
 }
 
 func (b *BitrateStatistics) Input(size int) {
@@ -25,6 +26,10 @@ func (b *BitrateStatistics) Input(size int) {
 		b.currentSecond = second
 		b.previousSecondBytes = b.latestSecondBytes
 		b.latestSecondBytes = 0
+
+		if b.previousSecondBytes > b.peakSecondBytes {
+			b.peakSecondBytes = b.previousSecondBytes
+		}
 	}
 
 	b.latestSecondBytes += size
@@ -49,6 +54,15 @@ func (b *BitrateStatistics) PreviousSecond() int {
 	return b.previousSecondBytes
 }
 
+// Peak 返回单秒最大码流大小
+func (b *BitrateStatistics) Peak() int {
+	if b.peakSecondBytes < 1 {
+		return b.latestSecondBytes
+	}
+
+	return b.peakSecondBytes
+}
+
 func NewBitrateStatistics() *BitrateStatistics {
 	return &BitrateStatistics{
 		currentSecond: -1,
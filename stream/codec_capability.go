@@ -0,0 +1,247 @@
+package stream
+
+import (
+	"fmt"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/transcode"
+	"sort"
+)
+
+var (
+	// 各输出协议支持封装的编码器. 需要转码时, 按照顺序选择第一个可以转码的编码器
+	muxCodecs = map[TransStreamProtocol][]utils.AVCodecID{
+		TransStreamRtmp:            {utils.AVCodecIdH264, utils.AVCodecIdH265, utils.AVCodecIdAAC, utils.AVCodecIdMP3, utils.AVCodecIdPCMALAW, utils.AVCodecIdPCMMULAW},
+		TransStreamFlv:             {utils.AVCodecIdH264, utils.AVCodecIdH265, utils.AVCodecIdAAC, utils.AVCodecIdMP3, utils.AVCodecIdPCMALAW, utils.AVCodecIdPCMMULAW},
+		TransStreamRtsp:            {utils.AVCodecIdH264, utils.AVCodecIdH265, utils.AVCodecIdAAC, utils.AVCodecIdPCMALAW, utils.AVCodecIdPCMMULAW},
+		TransStreamHls:             {utils.AVCodecIdH264, utils.AVCodecIdH265, utils.AVCodecIdAAC, utils.AVCodecIdMP3},
+		TransStreamRtc:             {utils.AVCodecIdH264, utils.AVCodecIdH265, utils.AVCodecIdVP8, utils.AVCodecIdVP9, utils.AVCodecIdAV1, utils.AVCodecIdOPUS, utils.AVCodecIdPCMALAW, utils.AVCodecIdPCMMULAW},
+		TransStreamGBStreamForward: {utils.AVCodecIdH264, utils.AVCodecIdH265, utils.AVCodecIdAAC, utils.AVCodecIdPCMALAW, utils.AVCodecIdPCMMULAW},
+		TransStreamTs:              {utils.AVCodecIdH264, utils.AVCodecIdH265, utils.AVCodecIdAAC, utils.AVCodecIdMP3},
+		TransStreamFmp4:            {utils.AVCodecIdH264, utils.AVCodecIdH265, utils.AVCodecIdAAC},
+	}
+
+	// 支持同类型多路track的输出协议, 值表示未指定track时是否默认输出全部track.
+	// rtmp和flv使用Enhanced RTMP多track封装, 传统播放器无法解析; 浏览器MSE通常只支持fMP4中每种类型一路track.
+	// 以上协议只有拉流端通过atrack/vtrack选择多路时才输出. rtc的track数量由拉流端offer决定, 国标级联的上级平台通常也只处理一路音频和一路视频
+	multiTrackProtocols = map[TransStreamProtocol]bool{
+		TransStreamTs:   true,
+		TransStreamHls:  true,
+		TransStreamRtsp: true,
+		TransStreamRtmp: false,
+		TransStreamFlv:  false,
+		TransStreamFmp4: false,
+	}
+)
+
+// IsSupportCodec 输出协议是否支持封装该编码器
+func IsSupportCodec(protocol TransStreamProtocol, codecId utils.AVCodecID) bool {
+	for _, id := range muxCodecs[protocol] {
+		if id == codecId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsSupportMux 输出协议是否支持封装期望的音视频编码器, AVCodecIdNONE表示不指定
+func IsSupportMux(protocol TransStreamProtocol, audioCodecId, videoCodecId utils.AVCodecID) bool {
+	if utils.AVCodecIdNONE != audioCodecId && !IsSupportCodec(protocol, audioCodecId) {
+		return false
+	}
+
+	return utils.AVCodecIdNONE == videoCodecId || IsSupportCodec(protocol, videoCodecId)
+}
+
+// NegotiateCodec 协商输出协议使用的编码器. 支持封装直接使用原编码器, 否则选择可以转码的编码器, 都不支持返回AVCodecIdNONE
+func NegotiateCodec(protocol TransStreamProtocol, codecId utils.AVCodecID) utils.AVCodecID {
+	if IsSupportCodec(protocol, codecId) {
+		return codecId
+	}
+
+	for _, id := range muxCodecs[protocol] {
+		if transcode.IsSupported(codecId, id) {
+			return id
+		}
+	}
+
+	return utils.AVCodecIdNONE
+}
+
+// IsSupportMultiTrack 输出协议是否支持封装同类型的多路track. 其余协议只能输出一路音频和一路视频
+func IsSupportMultiTrack(protocol TransStreamProtocol) bool {
+	_, ok := multiTrackProtocols[protocol]
+	return ok
+}
+
+// 选择sink拉取的track. 客户端指定了track序号, 按照序号选择, 否则默认输出全部track的协议拉取全部track, 其余协议拉取每种类型的第一路
+func selectSinkTracks(sink Sink, streams []utils.AVStream) ([]utils.AVStream, error) {
+	selected := make(map[utils.AVStream]bool, len(streams))
+	for _, mediaType := range []utils.AVMediaType{utils.AVMediaTypeAudio, utils.AVMediaTypeVideo} {
+		if (utils.AVMediaTypeAudio == mediaType && !sink.EnableAudio()) || (utils.AVMediaTypeVideo == mediaType && !sink.EnableVideo()) {
+			continue
+		}
+
+		// 同类型track按照索引排序, 序号与推流的track顺序一致
+		var tracks []utils.AVStream
+		for _, avStream := range streams {
+			if mediaType == avStream.Type() {
+				tracks = append(tracks, avStream)
+			}
+		}
+
+		sort.SliceStable(tracks, func(i, j int) bool {
+			return tracks[i].Index() < tracks[j].Index()
+		})
+
+		numbers := sink.SelectedTracks(mediaType)
+		if numbers == nil {
+			if len(tracks) > 1 && !multiTrackProtocols[sink.GetProtocol()] {
+				tracks = tracks[:1]
+			}
+
+			for _, track := range tracks {
+				selected[track] = true
+			}
+
+			continue
+		}
+
+		for _, number := range numbers {
+			if number >= len(tracks) {
+				return nil, fmt.Errorf("track %d does not exist, the stream has %d tracks of this type", number, len(tracks))
+			}
+
+			selected[tracks[number]] = true
+		}
+	}
+
+	// 保持推流track的顺序
+	var result []utils.AVStream
+	for _, avStream := range streams {
+		if selected[avStream] {
+			result = append(result, avStream)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("none of the requested tracks exist in the stream")
+	}
+
+	return result, nil
+}
+
+// 协商sink每路track使用的编码器, 不能封装也不能转码的track返回AVCodecIdNONE, 表示丢弃.
+// 所有track都丢弃返回error
+func negotiateSinkCodecs(sink Sink, tracks []utils.AVStream) ([]utils.AVCodecID, error) {
+	protocol := sink.GetProtocol()
+	audioCodecId, videoCodecId := sink.DesiredAudioCodecId(), sink.DesiredVideoCodecId()
+
+	// 不支持对期望编码的流封装. 降级
+	if (utils.AVCodecIdNONE != audioCodecId || utils.AVCodecIdNONE != videoCodecId) && !IsSupportMux(protocol, audioCodecId, videoCodecId) {
+		audioCodecId = utils.AVCodecIdNONE
+		videoCodecId = utils.AVCodecIdNONE
+	}
+
+	var supported bool
+	codecIds := make([]utils.AVCodecID, len(tracks))
+	for i, track := range tracks {
+		codecId := videoCodecId
+		if utils.AVMediaTypeAudio == track.Type() {
+			codecId = audioCodecId
+		}
+
+		// 期望的编码器无法转码, 降级协商
+		if utils.AVCodecIdNONE == codecId || (codecId != track.CodecId() && !transcode.IsSupported(track.CodecId(), codecId)) {
+			codecId = NegotiateCodec(protocol, track.CodecId())
+		}
+
+		codecIds[i] = codecId
+		supported = supported || utils.AVCodecIdNONE != codecId
+	}
+
+	if !supported {
+		var codecs []utils.AVCodecID
+		for _, track := range tracks {
+			codecs = append(codecs, track.CodecId())
+		}
+
+		return codecIds, fmt.Errorf("%s does not support any of the stream codecs %v", protocol.String(), codecs)
+	}
+
+	return codecIds, nil
+}
+
+// CheckSinkCompatibility 检查Source的音视频编码器是否可以输出给sink
+func CheckSinkCompatibility(source Source, sink Sink) error {
+	tracks, err := selectSinkTracks(sink, source.OriginStreams())
+	if err != nil {
+		return err
+	}
+
+	_, err = negotiateSinkCodecs(sink, tracks)
+	return err
+}
+
+type TrackCompatibility struct {
+	Codec  string `json:"codec"`            // 原始编码器
+	Output string `json:"output,omitempty"` // 输出的编码器, 与原始编码器不同表示需要转码, 为空表示丢弃该track
+}
+
+type ProtocolCompatibility struct {
+	Protocol  string               `json:"protocol"`
+	Supported bool                 `json:"supported"` // 至少有一路track可以输出
+	Tracks    []TrackCompatibility `json:"tracks"`
+}
+
+// 按照协议ID升序返回所有已注册的输出协议
+func sortedProtocols() []TransStreamProtocol {
+	var protocols []TransStreamProtocol
+	for protocol := range muxCodecs {
+		if _, ok := transStreamFactories[protocol]; ok {
+			protocols = append(protocols, protocol)
+		}
+	}
+
+	sort.Slice(protocols, func(i, j int) bool {
+		return protocols[i] < protocols[j]
+	})
+
+	return protocols
+}
+
+// CodecCapabilities 返回各输出协议支持封装的编码器
+func CodecCapabilities() map[string][]string {
+	capabilities := make(map[string][]string, len(muxCodecs))
+	for _, protocol := range sortedProtocols() {
+		var codecs []string
+		for _, id := range muxCodecs[protocol] {
+			codecs = append(codecs, id.String())
+		}
+
+		capabilities[protocol.String()] = codecs
+	}
+
+	return capabilities
+}
+
+// CheckCompatibility 返回各输出协议对音视频流的支持情况
+func CheckCompatibility(streams []utils.AVStream) []ProtocolCompatibility {
+	var result []ProtocolCompatibility
+	for _, protocol := range sortedProtocols() {
+		compatibility := ProtocolCompatibility{Protocol: protocol.String()}
+		for _, avStream := range streams {
+			track := TrackCompatibility{Codec: avStream.CodecId().String()}
+			if id := NegotiateCodec(protocol, avStream.CodecId()); utils.AVCodecIdNONE != id {
+				track.Output = id.String()
+				compatibility.Supported = true
+			}
+
+			compatibility.Tracks = append(compatibility.Tracks, track)
+		}
+
+		result = append(result, compatibility)
+	}
+
+	return result
+}
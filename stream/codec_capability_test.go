@@ -0,0 +1,147 @@
+package stream
+
+import (
+	"github.com/lkmio/avformat/utils"
+	"testing"
+)
+
+func TestSelectSinkTracks(t *testing.T) {
+	// 两路音频(多语言), 两路视频
+	audio0 := utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdAAC, nil, nil)
+	video0 := utils.NewAVStream(utils.AVMediaTypeVideo, 1, utils.AVCodecIdH264, nil, nil)
+	audio1 := utils.NewAVStream(utils.AVMediaTypeAudio, 2, utils.AVCodecIdAAC, nil, nil)
+	video1 := utils.NewAVStream(utils.AVMediaTypeVideo, 3, utils.AVCodecIdH265, nil, nil)
+	streams := []utils.AVStream{audio0, video0, audio1, video1}
+
+	tests := []struct {
+		name         string
+		protocol     TransStreamProtocol
+		disableAudio bool
+		disableVideo bool
+		audioTracks  []int
+		videoTracks  []int
+		expected     []utils.AVStream
+		success      bool
+	}{
+		{name: "multi-track protocol outputs all", protocol: TransStreamRtsp, expected: streams, success: true},
+		{name: "single-track protocol outputs first", protocol: TransStreamRtmp, expected: []utils.AVStream{audio0, video0}, success: true},
+		{name: "select second audio", protocol: TransStreamRtmp, audioTracks: []int{1}, expected: []utils.AVStream{video0, audio1}, success: true},
+		{name: "enhanced rtmp multitrack", protocol: TransStreamFlv, audioTracks: []int{0, 1}, expected: []utils.AVStream{audio0, video0, audio1}, success: true},
+		{name: "fmp4 outputs first", protocol: TransStreamFmp4, expected: []utils.AVStream{audio0, video0}, success: true},
+		{name: "fmp4 multiple video", protocol: TransStreamFmp4, videoTracks: []int{0, 1}, expected: []utils.AVStream{audio0, video0, video1}, success: true},
+		{name: "keep push order", protocol: TransStreamTs, videoTracks: []int{1, 0}, expected: []utils.AVStream{audio0, video0, audio1, video1}, success: true},
+		{name: "audio disabled", protocol: TransStreamFlv, disableAudio: true, expected: []utils.AVStream{video0}, success: true},
+		{name: "video disabled", protocol: TransStreamHls, disableVideo: true, expected: []utils.AVStream{audio0, audio1}, success: true},
+		{name: "track out of range", protocol: TransStreamRtsp, audioTracks: []int{2}, success: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := newTestSink(SinkID(uint64(1)), test.protocol, nil)
+			sink.SetEnableAudio(!test.disableAudio)
+			sink.SetEnableVideo(!test.disableVideo)
+			sink.SetSelectedTracks(utils.AVMediaTypeAudio, test.audioTracks)
+			sink.SetSelectedTracks(utils.AVMediaTypeVideo, test.videoTracks)
+
+			tracks, err := selectSinkTracks(sink, streams)
+			if (err == nil) != test.success {
+				t.Fatalf("select err: %v", err)
+			} else if err != nil {
+				return
+			}
+
+			if len(tracks) != len(test.expected) {
+				t.Fatalf("selected %d tracks, expected %d", len(tracks), len(test.expected))
+			}
+
+			for i, track := range tracks {
+				if track != test.expected[i] {
+					t.Fatalf("track %d: index %d, expected %d", i, track.Index(), test.expected[i].Index())
+				}
+			}
+		})
+	}
+
+	// 选择的track都不存在
+	sink := newTestSink(SinkID(uint64(1)), TransStreamRtmp, nil)
+	sink.SetEnableAudio(false)
+	if _, err := selectSinkTracks(sink, []utils.AVStream{audio0}); err == nil {
+		t.Fatal("selected tracks from an empty set")
+	}
+}
+
+func TestGenerateTransStreamID(t *testing.T) {
+	audio0 := utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdAAC, nil, nil)
+	video0 := utils.NewAVStream(utils.AVMediaTypeVideo, 1, utils.AVCodecIdH264, nil, nil)
+	audio1 := utils.NewAVStream(utils.AVMediaTypeAudio, 2, utils.AVCodecIdAAC, nil, nil)
+	// 转码流和原始流索引相同, 编码器不同
+	transcoded := utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdPCMALAW, nil, nil)
+
+	tests := []struct {
+		name  string
+		a     TransStreamID
+		b     TransStreamID
+		equal bool
+	}{
+		{"track order", GenerateTransStreamID(TransStreamTs, audio0, video0), GenerateTransStreamID(TransStreamTs, video0, audio0), true},
+		{"protocol", GenerateTransStreamID(TransStreamTs, audio0, video0), GenerateTransStreamID(TransStreamRtsp, audio0, video0), false},
+		{"same codec different index", GenerateTransStreamID(TransStreamTs, audio0, video0), GenerateTransStreamID(TransStreamTs, audio1, video0), false},
+		{"same index different codec", GenerateTransStreamID(TransStreamTs, audio0, video0), GenerateTransStreamID(TransStreamTs, transcoded, video0), false},
+		{"more tracks", GenerateTransStreamID(TransStreamTs, audio0, video0), GenerateTransStreamID(TransStreamTs, audio0, video0, audio1), false},
+	}
+
+	for _, test := range tests {
+		if (test.a == test.b) != test.equal {
+			t.Fatalf("%s: %x %x", test.name, test.a, test.b)
+		}
+	}
+
+	// 高8位是协议
+	if id := GenerateTransStreamID(TransStreamRtc, audio0, video0); id.Protocol() != TransStreamRtc {
+		t.Fatalf("protocol %d, expected %d", id.Protocol(), TransStreamRtc)
+	}
+}
+
+func TestNegotiateSinkCodecs(t *testing.T) {
+	aac := utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdAAC, nil, nil)
+	pcma := utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdPCMALAW, nil, nil)
+	h264 := utils.NewAVStream(utils.AVMediaTypeVideo, 1, utils.AVCodecIdH264, nil, nil)
+
+	tests := []struct {
+		name     string
+		protocol TransStreamProtocol
+		tracks   []utils.AVStream
+		acodec   utils.AVCodecID
+		expected []utils.AVCodecID
+		success  bool
+	}{
+		{"original codecs", TransStreamRtmp, []utils.AVStream{aac, h264}, utils.AVCodecIdNONE, []utils.AVCodecID{utils.AVCodecIdAAC, utils.AVCodecIdH264}, true},
+		{"transcode to desired codec", TransStreamRtmp, []utils.AVStream{pcma, h264}, utils.AVCodecIdPCMMULAW, []utils.AVCodecID{utils.AVCodecIdPCMMULAW, utils.AVCodecIdH264}, true},
+		{"desired codec not muxable", TransStreamRtmp, []utils.AVStream{pcma, h264}, utils.AVCodecIdOPUS, []utils.AVCodecID{utils.AVCodecIdPCMALAW, utils.AVCodecIdH264}, true},
+		{"desired codec not transcodable", TransStreamRtc, []utils.AVStream{pcma, h264}, utils.AVCodecIdOPUS, []utils.AVCodecID{utils.AVCodecIdPCMALAW, utils.AVCodecIdH264}, true},
+		{"drop unsupported track", TransStreamHls, []utils.AVStream{pcma, h264}, utils.AVCodecIdNONE, []utils.AVCodecID{utils.AVCodecIdNONE, utils.AVCodecIdH264}, true},
+		{"drop aac for rtc", TransStreamRtc, []utils.AVStream{aac, h264}, utils.AVCodecIdNONE, []utils.AVCodecID{utils.AVCodecIdNONE, utils.AVCodecIdH264}, true},
+		{"drop g711 for fmp4", TransStreamFmp4, []utils.AVStream{pcma, h264}, utils.AVCodecIdNONE, []utils.AVCodecID{utils.AVCodecIdNONE, utils.AVCodecIdH264}, true},
+		{"no supported track", TransStreamHls, []utils.AVStream{pcma}, utils.AVCodecIdNONE, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := newTestSink(SinkID(uint64(1)), test.protocol, nil)
+			sink.SetDesiredAudioCodecId(test.acodec)
+
+			codecIds, err := negotiateSinkCodecs(sink, test.tracks)
+			if (err == nil) != test.success {
+				t.Fatalf("negotiate err: %v", err)
+			} else if err != nil {
+				return
+			}
+
+			for i, codecId := range codecIds {
+				if codecId != test.expected[i] {
+					t.Fatalf("track %d: %s, expected %s", i, codecId, test.expected[i])
+				}
+			}
+		})
+	}
+}
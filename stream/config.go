@@ -67,6 +67,25 @@ type HlsConfig struct {
 	Dir            string `json:"dir"`
 	Duration       int    `json:"segment_duration"`
 	PlaylistLength int    `json:"playlist_length"`
+	AudioRendition bool   `json:"audio_rendition"` // 是否额外生成纯音频切片, 在主播放列表中作为音频rendition
+
+	Encryption HlsEncryptionConfig `json:"encryption"`
+}
+
+// TsConfig http-ts/ws-ts直播流
+type TsConfig struct {
+	enableConfig
+}
+
+// Fmp4Config http-fmp4/ws-fmp4直播流
+type Fmp4Config struct {
+	enableConfig
+}
+
+type HlsEncryptionConfig struct {
+	Enable      bool   `json:"enable"`       // 是否使用AES-128加密切片
+	KeyRotation int    `json:"key_rotation"` // 每隔多少个切片更换密钥, 0表示不更换
+	KeyFile     string `json:"key_file"`     // 本地密钥文件, 为空则随机生成密钥
 }
 
 type JT1078Config struct {
@@ -78,8 +97,33 @@ type RtspConfig struct {
 	TransportConfig
 
 	enableConfig
-	Port     []int  `json:"port"`
-	Password string `json:"password"`
+	Port           []int  `json:"port"`
+	Username       string `json:"username"` // 配合password使用, 未配置auth.users时的拉流账号
+	Password       string `json:"password"`
+	SessionTimeout int    `json:"session_timeout"` // 会话超时时间, 单位秒. 超时未收到RTSP请求或RTCP包, 关闭会话
+
+	Auth      RtspAuthConfig  `json:"auth"`
+	Multicast MulticastConfig `json:"multicast"`
+}
+
+type RtspAuthConfig struct {
+	Scheme      string           `json:"scheme"` // digest/basic, 默认digest
+	Realm       string           `json:"realm"`
+	NonceExpire int              `json:"nonce_expire"` // nonce有效期, 单位秒
+	Users       []RtspUserConfig `json:"users"`
+}
+
+type RtspUserConfig struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Streams  []string `json:"streams"` // 允许拉取的流, 为空允许拉取所有流
+}
+
+type MulticastConfig struct {
+	Enable bool     `json:"enable"`
+	Groups []string `json:"groups"` // 组播地址范围, [起始地址, 结束地址]
+	Port   []int    `json:"port"`   // 组播端口范围, [起始端口, 结束端口]
+	TTL    int      `json:"ttl"`
 }
 
 type RecordConfig struct {
@@ -88,6 +132,61 @@ type RecordConfig struct {
 	Dir    string `json:"dir"`
 }
 
+type TranscodeConfig struct {
+	enableConfig
+	Command         string                `json:"command"`          // 转码进程命令模板, 从stdin读取ts流, 转码后以rtmp推流回本机. 占位符: {args}-档位编码参数 {output}-派生流rtmp推流地址 {source}-源流id
+	RestartInterval int                   `json:"restart_interval"` // 转码进程异常退出后的重启间隔, 单位秒
+	Ladders         map[string]string     `json:"ladders"`          // 转码档位, key为派生流后缀, 派生流id为{id}_{key}. value为编码参数
+	Rules           []TranscodeRuleConfig `json:"rules"`
+}
+
+type FailoverConfig struct {
+	enableConfig
+	Timeout int                  `json:"timeout"` // 主源超过该时长(单位毫秒)没有收到流, 切换到备用源
+	Rules   []FailoverRuleConfig `json:"rules"`
+}
+
+type FailoverRuleConfig struct {
+	Source  string `json:"source"`  // 虚拟源id, 拉流使用该id
+	Primary string `json:"primary"` // 主源id
+	Backup  string `json:"backup"`  // 备用源id
+}
+
+// PublishConflictPolicy 推流的source id已经存在时的处理策略
+type PublishConflictPolicy string
+
+const (
+	PublishConflictReject  = PublishConflictPolicy("reject")  // 拒绝新推流
+	PublishConflictReplace = PublishConflictPolicy("replace") // 关闭已有推流, 输出流和sink由新推流接管
+	PublishConflictHook    = PublishConflictPolicy("hook")    // 通知on_publish_conflict, 200应答替换, 否则拒绝
+)
+
+type PublishConflictConfig struct {
+	Policy  PublishConflictPolicy            `json:"policy"`  // 默认策略
+	Apps    map[string]PublishConflictPolicy `json:"apps"`    // 按app配置的策略, app为source id的第一级路径, 例如live/ch1的app为live
+	Timeout int                              `json:"timeout"` // 替换时, 等待已有推流关闭和新推流接管输出流的时长(单位毫秒)
+}
+
+// FindPolicy 查找source id所属app的处理策略, 没有配置使用默认策略
+func (c *PublishConflictConfig) FindPolicy(sourceId string) PublishConflictPolicy {
+	if i := strings.Index(sourceId, "/"); i > 0 {
+		if policy, ok := c.Apps[sourceId[:i]]; ok {
+			return policy
+		}
+	}
+
+	return c.Policy
+}
+
+func isValidPublishConflictPolicy(policy PublishConflictPolicy) bool {
+	return PublishConflictReject == policy || PublishConflictReplace == policy || PublishConflictHook == policy
+}
+
+type TranscodeRuleConfig struct {
+	Source  string   `json:"source"`  // 匹配的源流id, 支持通配符, 例如live/*
+	Ladders []string `json:"ladders"` // 使用的转码档位
+}
+
 type LogConfig struct {
 	FileLogging bool   `json:"file_logging"`
 	Level       int    `json:"level"`
@@ -112,6 +211,24 @@ type WebRtcConfig struct {
 	enableConfig
 	TransportConfig
 	portConfig
+	TCPPort     int               `json:"tcp_port"`   // ICE-TCP被动模式的监听端口
+	PublicIPs   []string          `json:"public_ips"` // 下发给浏览器的候选地址, 支持多网卡和ipv6. 每个地址格式为"公网ip"或"公网ip/内网ip", 不指定内网ip时, ipv4和ipv6各只能配置一个. 为空使用public_ip
+	Turn        TurnConfig        `json:"turn"`
+	DataChannel DataChannelConfig `json:"datachannel"`
+}
+
+type DataChannelConfig struct {
+	enableConfig
+	Label     string `json:"label"`     // DataChannel名称, 为空接受拉流端创建的所有DataChannel, 服务器创建的DataChannel名称为lkm
+	WebSocket string `json:"websocket"` // 转发拉流端消息的websocket地址, 为空则通知on_rtc_message事件
+}
+
+type TurnConfig struct {
+	enableConfig
+	portConfig
+	Realm  string `json:"realm"`
+	Secret string `json:"secret"` // 生成临时账号的密钥
+	TTL    int    `json:"ttl"`    // 临时账号的有效期, 单位秒
 }
 
 func (g TransportConfig) IsEnableTCP() bool {
@@ -130,6 +247,11 @@ func (g RtspConfig) IsMultiPort() bool {
 	return len(g.Port) == 3
 }
 
+// IsSinglePort 所有udp拉流共用一对rtp/rtcp端口, port配置为[rtsp端口, rtp端口], rtcp端口为rtp端口+1
+func (g RtspConfig) IsSinglePort() bool {
+	return len(g.Port) == 2
+}
+
 // M3U8Path 根据sourceId返回m3u8的磁盘路径
 // 切片及目录生成规则, 以SourceId为34020000001320000001/34020000001320000001为例:
 // 创建文件夹34020000001320000001, 34020000001320000001.m3u8文件, 文件列表中切片url为34020000001320000001_seq.ts
@@ -162,15 +284,20 @@ func (c HlsConfig) TSFormat(sourceId string) string {
 
 type HooksConfig struct {
 	enableConfig
-	Timeout             int64  `json:"timeout"`
-	OnStartedUrl        string `json:"on_started"`         //应用启动后回调
-	OnPublishUrl        string `json:"on_publish"`         //推流回调
-	OnPublishDoneUrl    string `json:"on_publish_done"`    //推流结束回调
-	OnPlayUrl           string `json:"on_play"`            //拉流回调
-	OnPlayDoneUrl       string `json:"on_play_done"`       //拉流结束回调
-	OnRecordUrl         string `json:"on_record"`          //录制流回调
-	OnIdleTimeoutUrl    string `json:"on_idle_timeout"`    //没有sink拉流回调
-	OnReceiveTimeoutUrl string `json:"on_receive_timeout"` //没有推流回调
+	Timeout              int64  `json:"timeout"`
+	OnStartedUrl         string `json:"on_started"`          //应用启动后回调
+	OnPublishUrl         string `json:"on_publish"`          //推流回调
+	OnPublishDoneUrl     string `json:"on_publish_done"`     //推流结束回调
+	OnPlayUrl            string `json:"on_play"`             //拉流回调
+	OnPlayDoneUrl        string `json:"on_play_done"`        //拉流结束回调
+	OnRecordUrl          string `json:"on_record"`           //录制流回调
+	OnIdleTimeoutUrl     string `json:"on_idle_timeout"`     //没有sink拉流回调
+	OnReceiveTimeoutUrl  string `json:"on_receive_timeout"`  //没有推流回调
+	OnRtspAuthUrl        string `json:"on_rtsp_auth"`        //rtsp拉流鉴权, 查询用户密码
+	OnRtcMessageUrl      string `json:"on_rtc_message"`      //webrtc拉流端通过DataChannel发送的消息
+	OnFailoverUrl        string `json:"on_failover"`         //虚拟源在主备源之间切换
+	OnStreamNotFoundUrl  string `json:"on_stream_not_found"` //拉流的流不存在, 第一个sink进入等待队列时回调, 可在回调中通知设备推流
+	OnPublishConflictUrl string `json:"on_publish_conflict"` //推流的source id已经存在, 200应答关闭已有推流, 否则拒绝新推流
 }
 
 func (hook *HooksConfig) IsEnablePublishEvent() bool {
@@ -201,6 +328,26 @@ func (hook *HooksConfig) IsEnableOnReceiveTimeout() bool {
 	return hook.Enable && hook.OnReceiveTimeoutUrl != ""
 }
 
+func (hook *HooksConfig) IsEnableOnRtspAuth() bool {
+	return hook.Enable && hook.OnRtspAuthUrl != ""
+}
+
+func (hook *HooksConfig) IsEnableOnRtcMessage() bool {
+	return hook.Enable && hook.OnRtcMessageUrl != ""
+}
+
+func (hook *HooksConfig) IsEnableOnFailover() bool {
+	return hook.Enable && hook.OnFailoverUrl != ""
+}
+
+func (hook *HooksConfig) IsEnableOnStreamNotFound() bool {
+	return hook.Enable && hook.OnStreamNotFoundUrl != ""
+}
+
+func (hook *HooksConfig) IsEnableOnPublishConflict() bool {
+	return hook.Enable && hook.OnPublishConflictUrl != ""
+}
+
 func (hook *HooksConfig) IsEnableOnStarted() bool {
 	return hook.Enable && hook.OnStartedUrl != ""
 }
@@ -214,6 +361,8 @@ func GetStreamPlayUrls(source string) []string {
 	if AppConfig.Rtsp.Enable {
 		// 不拼接userinfo
 		urls = append(urls, fmt.Sprintf("rtsp://%s:%d/%s", AppConfig.PublicIP, AppConfig.Rtsp.Port[0], source))
+		// rtsp over websocket
+		urls = append(urls, fmt.Sprintf("ws://%s:%d/%s.rtsp", AppConfig.PublicIP, AppConfig.Http.Port, source))
 	}
 
 	//if AppConfig.Http.Enable {
@@ -227,6 +376,17 @@ func GetStreamPlayUrls(source string) []string {
 	urls = append(urls, fmt.Sprintf("http://%s:%d/%s.flv", AppConfig.PublicIP, AppConfig.Http.Port, source))
 	urls = append(urls, fmt.Sprintf("http://%s:%d/%s.rtc", AppConfig.PublicIP, AppConfig.Http.Port, source))
 	urls = append(urls, fmt.Sprintf("ws://%s:%d/%s.flv", AppConfig.PublicIP, AppConfig.Http.Port, source))
+
+	if AppConfig.Ts.Enable {
+		urls = append(urls, fmt.Sprintf("http://%s:%d/%s.ts", AppConfig.PublicIP, AppConfig.Http.Port, source))
+		urls = append(urls, fmt.Sprintf("ws://%s:%d/%s.ts", AppConfig.PublicIP, AppConfig.Http.Port, source))
+	}
+
+	if AppConfig.Fmp4.Enable {
+		urls = append(urls, fmt.Sprintf("http://%s:%d/%s.mp4", AppConfig.PublicIP, AppConfig.Http.Port, source))
+		urls = append(urls, fmt.Sprintf("ws://%s:%d/%s.mp4", AppConfig.PublicIP, AppConfig.Http.Port, source))
+	}
+
 	return urls
 }
 
@@ -276,24 +436,32 @@ type AppConfig_ struct {
 	WriteBufferCapacity int    `json:"-"`               // 发送缓冲区容量大小, 缓冲区由多个内存块构成.
 	PublicIP            string `json:"public_ip"`
 	ListenIP            string `json:"listen_ip"`
-	IdleTimeout         int64  `json:"idle_timeout"`    // 多长时间(单位秒)没有拉流. 如果开启hook通知, 根据hook响应, 决定是否关闭Source(200-不关闭/非200关闭). 否则会直接关闭Source.
-	ReceiveTimeout      int64  `json:"receive_timeout"` // 多长时间(单位秒)没有收到流. 如果开启hook通知, 根据hook响应, 决定是否关闭Source(200-不关闭/非200关闭). 否则会直接关闭Source.
-	Debug               bool   `json:"debug"`           // debug模式, 开启将保存推流
+	IdleTimeout         int64  `json:"idle_timeout"`      // 多长时间(单位秒)没有拉流. 如果开启hook通知, 根据hook响应, 决定是否关闭Source(200-不关闭/非200关闭). 否则会直接关闭Source.
+	ReceiveTimeout      int64  `json:"receive_timeout"`   // 多长时间(单位秒)没有收到流. 如果开启hook通知, 根据hook响应, 决定是否关闭Source(200-不关闭/非200关闭). 否则会直接关闭Source.
+	WaitingTimeout      int64  `json:"waiting_timeout"`   // 拉流的流不存在时, sink在等待队列中等待推流的时长(单位秒), 超时应答流不存在. 0表示一直等待
+	ReconnectTimeout    int64  `json:"reconnect_timeout"` // rtmp/1078推流断开后, 保留输出流等待重新推流的时长(单位秒), 期间拉流端和录制不中断. 0表示不等待
+	Debug               bool   `json:"debug"`             // debug模式, 开启将保存推流
 
 	//缓存指定时长的包，满了之后才发送给Sink. 可以降低用户态和内核态的交互频率，大幅提升性能.
 	//合并写的大小范围，应当大于一帧的时长，不超过一组GOP的时长，在实际发送流的时候也会遵循此条例.
 	MergeWriteLatency int `json:"mw_latency"`
 	Rtmp              RtmpConfig
 	Hls               HlsConfig
+	Ts                TsConfig
+	Fmp4              Fmp4Config
 	JT1078            JT1078Config
 	Rtsp              RtspConfig
 	GB28181           GB28181Config
 	WebRtc            WebRtcConfig
 
-	Hooks  HooksConfig
-	Record RecordConfig
-	Log    LogConfig
-	Http   HttpConfig
+	Hooks     HooksConfig
+	Record    RecordConfig
+	Transcode TranscodeConfig
+	Failover  FailoverConfig
+
+	PublishConflict PublishConflictConfig `json:"publish_conflict"`
+	Log             LogConfig
+	Http            HttpConfig
 }
 
 func LoadConfigFile(path string) (*AppConfig_, error) {
@@ -331,7 +499,26 @@ func SetDefaultConfig(config *AppConfig_) {
 
 	config.IdleTimeout *= int64(time.Second)
 	config.ReceiveTimeout *= int64(time.Second)
+	config.ReconnectTimeout *= int64(time.Second)
+	config.WaitingTimeout *= int64(time.Second)
 	config.Hooks.Timeout *= int64(time.Second)
+	config.Rtsp.SessionTimeout = limitInt(10, 600, config.Rtsp.SessionTimeout)
+	config.WebRtc.Turn.TTL = limitInt(60, 86400*7, config.WebRtc.Turn.TTL)
+	config.Transcode.RestartInterval = limitInt(1, 60, config.Transcode.RestartInterval)
+	config.Failover.Timeout = limitInt(500, 60000, config.Failover.Timeout)
+	config.PublishConflict.Timeout = limitInt(1000, 60000, config.PublishConflict.Timeout)
+
+	// 未配置或无效的策略, 保持拒绝新推流
+	if !isValidPublishConflictPolicy(config.PublishConflict.Policy) {
+		config.PublishConflict.Policy = PublishConflictReject
+	}
+
+	for app, policy := range config.PublishConflict.Apps {
+		if !isValidPublishConflictPolicy(policy) {
+			log.Sugar.Warnf("无效的推流冲突策略 app: %s policy: %s", app, policy)
+			config.PublishConflict.Apps[app] = PublishConflictReject
+		}
+	}
 }
 
 func limitMin(min, value int) int {
@@ -28,11 +28,12 @@ type GOPBuffer interface {
 type streamBuffer struct {
 	buffer             collections.RingBuffer
 	existVideoKeyFrame bool
+	videoIndex         int // 划分GOP的视频track索引. 存在多路视频时, 以第一路出现关键帧的视频为准, 其余视频的关键帧不丢弃GOP
 	discardHandler     func(packet utils.AVPacket)
 }
 
 func NewStreamBuffer() GOPBuffer {
-	return &streamBuffer{buffer: collections.NewRingBuffer(1000), existVideoKeyFrame: false}
+	return &streamBuffer{buffer: collections.NewRingBuffer(1000), existVideoKeyFrame: false, videoIndex: -1}
 }
 
 func (s *streamBuffer) AddPacket(packet utils.AVPacket) bool {
@@ -48,7 +49,11 @@ func (s *streamBuffer) AddPacket(packet utils.AVPacket) bool {
 
 	//丢弃前一组GOP
 	videoKeyFrame := utils.AVMediaTypeVideo == packet.MediaType() && packet.KeyFrame()
-	if videoKeyFrame {
+	if videoKeyFrame && s.videoIndex < 0 {
+		s.videoIndex = packet.Index()
+	}
+
+	if videoKeyFrame && packet.Index() == s.videoIndex {
 		if s.existVideoKeyFrame {
 			s.discard()
 		}
@@ -18,7 +18,11 @@ type eventInfo struct {
 }
 
 func responseBodyToString(resp *http.Response) string {
-	bodyBytes, err := io.ReadAll(resp.Body)
+	// 读取后关闭原Body, 释放连接
+	body := resp.Body
+	defer body.Close()
+
+	bodyBytes, err := io.ReadAll(body)
 	if err != nil {
 		return ""
 	}
@@ -78,6 +82,34 @@ func NewHookPublishEventInfo(source Source) eventInfo {
 	return eventInfo{Stream: source.GetID(), Protocol: source.GetType().String(), RemoteAddr: source.RemoteAddr()}
 }
 
+func NewFailoverEventInfo(source Source, from, to string) interface{} {
+	data := struct {
+		eventInfo
+		From string `json:"from"` // 切换前的源
+		To   string `json:"to"`   // 切换后的源
+	}{
+		eventInfo: NewHookPublishEventInfo(source),
+		From:      from,
+		To:        to,
+	}
+
+	return data
+}
+
+func NewPublishConflictEventInfo(source, existing Source) interface{} {
+	data := struct {
+		eventInfo
+		ExistingProtocol   string `json:"existing_protocol"`    // 已有推流的协议
+		ExistingRemoteAddr string `json:"existing_remote_addr"` // 已有推流的peer地址
+	}{
+		eventInfo:          NewHookPublishEventInfo(source),
+		ExistingProtocol:   existing.GetType().String(),
+		ExistingRemoteAddr: existing.RemoteAddr(),
+	}
+
+	return data
+}
+
 func NewRecordEventInfo(source Source, path string) interface{} {
 	data := struct {
 		eventInfo
@@ -5,14 +5,19 @@ import "fmt"
 type HookEvent int
 
 const (
-	HookEventPublish        = HookEvent(0x1)
-	HookEventPublishDone    = HookEvent(0x2)
-	HookEventPlay           = HookEvent(0x3)
-	HookEventPlayDone       = HookEvent(0x4)
-	HookEventRecord         = HookEvent(0x5)
-	HookEventIdleTimeout    = HookEvent(0x6)
-	HookEventReceiveTimeout = HookEvent(0x7)
-	HookEventStarted        = HookEvent(0x8)
+	HookEventPublish         = HookEvent(0x1)
+	HookEventPublishDone     = HookEvent(0x2)
+	HookEventPlay            = HookEvent(0x3)
+	HookEventPlayDone        = HookEvent(0x4)
+	HookEventRecord          = HookEvent(0x5)
+	HookEventIdleTimeout     = HookEvent(0x6)
+	HookEventReceiveTimeout  = HookEvent(0x7)
+	HookEventStarted         = HookEvent(0x8)
+	HookEventRtspAuth        = HookEvent(0x9)
+	HookEventRtcMessage      = HookEvent(0xA)
+	HookEventFailover        = HookEvent(0xB)
+	HookEventPublishConflict = HookEvent(0xC)
+	HookEventStreamNotFound  = HookEvent(0xD)
 )
 
 var (
@@ -21,14 +26,19 @@ var (
 
 func InitHookUrls() {
 	hookUrls = map[HookEvent]string{
-		HookEventPublish:        AppConfig.Hooks.OnPublishUrl,
-		HookEventPublishDone:    AppConfig.Hooks.OnPublishDoneUrl,
-		HookEventPlay:           AppConfig.Hooks.OnPlayUrl,
-		HookEventPlayDone:       AppConfig.Hooks.OnPlayDoneUrl,
-		HookEventRecord:         AppConfig.Hooks.OnRecordUrl,
-		HookEventIdleTimeout:    AppConfig.Hooks.OnIdleTimeoutUrl,
-		HookEventReceiveTimeout: AppConfig.Hooks.OnReceiveTimeoutUrl,
-		HookEventStarted:        AppConfig.Hooks.OnStartedUrl,
+		HookEventPublish:         AppConfig.Hooks.OnPublishUrl,
+		HookEventPublishDone:     AppConfig.Hooks.OnPublishDoneUrl,
+		HookEventPlay:            AppConfig.Hooks.OnPlayUrl,
+		HookEventPlayDone:        AppConfig.Hooks.OnPlayDoneUrl,
+		HookEventRecord:          AppConfig.Hooks.OnRecordUrl,
+		HookEventIdleTimeout:     AppConfig.Hooks.OnIdleTimeoutUrl,
+		HookEventReceiveTimeout:  AppConfig.Hooks.OnReceiveTimeoutUrl,
+		HookEventStarted:         AppConfig.Hooks.OnStartedUrl,
+		HookEventRtspAuth:        AppConfig.Hooks.OnRtspAuthUrl,
+		HookEventRtcMessage:      AppConfig.Hooks.OnRtcMessageUrl,
+		HookEventFailover:        AppConfig.Hooks.OnFailoverUrl,
+		HookEventPublishConflict: AppConfig.Hooks.OnPublishConflictUrl,
+		HookEventStreamNotFound:  AppConfig.Hooks.OnStreamNotFoundUrl,
 	}
 }
 
@@ -49,6 +59,16 @@ func (h *HookEvent) ToString() string {
 		return "receive timeout"
 	} else if HookEventStarted == *h {
 		return "started"
+	} else if HookEventRtspAuth == *h {
+		return "rtsp auth"
+	} else if HookEventRtcMessage == *h {
+		return "rtc message"
+	} else if HookEventFailover == *h {
+		return "failover"
+	} else if HookEventPublishConflict == *h {
+		return "publish conflict"
+	} else if HookEventStreamNotFound == *h {
+		return "stream not found"
 	}
 
 	panic(fmt.Sprintf("unknow hook type %d", h))
@@ -13,8 +13,26 @@ func PreparePlaySink(sink Sink) (*http.Response, utils.HookState) {
 func PreparePlaySinkWithReady(sink Sink, ok bool) (*http.Response, utils.HookState) {
 	var response *http.Response
 
+	// Source已经解析完track, 先检查输出协议是否支持推流的编码器. 不支持时拒绝拉流, 在on_play中携带原因
+	var compatibilityErr error
+	source := SourceManager.Find(sink.GetSourceID())
+	if source != nil && source.IsCompleted() {
+		compatibilityErr = CheckSinkCompatibility(source, sink)
+	}
+
 	if AppConfig.Hooks.IsEnableOnPlay() {
-		hook, err := Hook(HookEventPlay, sink.UrlValues().Encode(), NewHookPlayEventInfo(sink))
+		body := struct {
+			eventInfo
+			Error string `json:"error,omitempty"`
+		}{
+			eventInfo: NewHookPlayEventInfo(sink),
+		}
+
+		if compatibilityErr != nil {
+			body.Error = compatibilityErr.Error()
+		}
+
+		hook, err := Hook(HookEventPlay, sink.UrlValues().Encode(), body)
 		if err != nil {
 			log.Sugar.Errorf("播放事件-通知失败 err: %s sink: %s-%v source: %s", err.Error(), sink.GetProtocol().String(), sink.GetID(), sink.GetSourceID())
 
@@ -24,8 +42,13 @@ func PreparePlaySinkWithReady(sink Sink, ok bool) (*http.Response, utils.HookSta
 		response = hook
 	}
 
+	if compatibilityErr != nil {
+		log.Sugar.Errorf("拉流失败 err: %s sink: %s-%v source: %s", compatibilityErr.Error(), sink.GetProtocol().String(), sink.GetID(), sink.GetSourceID())
+		return response, utils.HookStateFailure
+	}
+
 	sink.SetReady(ok)
-	source := SourceManager.Find(sink.GetSourceID())
+	source = SourceManager.Find(sink.GetSourceID())
 	if source == nil {
 		log.Sugar.Infof("添加%s sink到等待队列 id: %v source: %s", sink.GetProtocol().String(), sink.GetID(), sink.GetSourceID())
 
@@ -38,7 +61,11 @@ func PreparePlaySinkWithReady(sink Sink, ok bool) (*http.Response, utils.HookSta
 				return response, utils.HookStateFailure
 			} else {
 				sink.SetState(SessionStateWaiting)
-				AddSinkToWaitingQueue(sink.GetSourceID(), sink)
+
+				// 第一个等待的sink, 通知业务系统拉起推流
+				if AddSinkToWaitingQueue(sink.GetSourceID(), sink) {
+					go HookStreamNotFoundEvent(sink)
+				}
 			}
 		}
 	} else {
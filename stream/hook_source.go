@@ -21,7 +21,12 @@ func PreparePublishSource(source Source, hook bool) (*http.Response, utils.HookS
 	}
 
 	if err := SourceManager.Add(source); err != nil {
-		return nil, utils.HookStateOccupy
+		// 根据冲突策略关闭已有推流后, 再次添加
+		if !replaceExistingSource(source) {
+			return nil, utils.HookStateOccupy
+		} else if err = SourceManager.Add(source); err != nil {
+			return nil, utils.HookStateOccupy
+		}
 	}
 
 	source.SetCreateTime(time.Now())
@@ -34,6 +39,57 @@ func PreparePublishSource(source Source, hook bool) (*http.Response, utils.HookS
 	return response, utils.HookStateOK
 }
 
+// 推流的source id已经存在, 根据所属app的冲突策略决定是否关闭已有推流. 返回false拒绝新推流
+func replaceExistingSource(source Source) bool {
+	existing := SourceManager.Find(source.GetID())
+	if existing == nil {
+		return true
+	} else if SourceTypeFailover == existing.GetType() || SourceTypeFailover == source.GetType() {
+		// 主备切换的虚拟源不参与替换, 虚拟源和推流都不能替换对方
+		log.Sugar.Warnf("source已经存在, 虚拟源不参与替换, 拒绝推流 %s", existing.String())
+		return false
+	}
+
+	policy := AppConfig.PublishConflict.FindPolicy(source.GetID())
+	if PublishConflictHook == policy {
+		policy = PublishConflictReject
+		if AppConfig.Hooks.IsEnableOnPublishConflict() {
+			response, err := Hook(HookEventPublishConflict, source.UrlValues().Encode(), NewPublishConflictEventInfo(source, existing))
+			if response != nil {
+				_ = response.Body.Close()
+			}
+
+			if err == nil {
+				policy = PublishConflictReplace
+			}
+		}
+	}
+
+	if PublishConflictReplace != policy {
+		log.Sugar.Warnf("source已经存在, 拒绝推流 policy: %s %s", policy, existing.String())
+		return false
+	}
+
+	// 已有推流的输出流和sink, 在新推流解析完track后接管
+	log.Sugar.Infof("source已经存在, 关闭已有推流 %s", existing.String())
+	existing.SetReplaced()
+
+	// 等待已有推流的事件协程处理关闭, 不无限阻塞新推流
+	done := make(chan struct{})
+	go func() {
+		existing.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Duration(AppConfig.PublishConflict.Timeout) * time.Millisecond):
+		log.Sugar.Errorf("关闭已有推流超时, 拒绝推流 %s", existing.String())
+		return false
+	}
+}
+
 func HookPublishEvent(source Source) (*http.Response, utils.HookState) {
 	var response *http.Response
 
@@ -55,6 +111,12 @@ func HookPublishDoneEvent(source Source) {
 	}
 }
 
+func HookFailoverEvent(source Source, from, to string) {
+	if AppConfig.Hooks.IsEnableOnFailover() {
+		_, _ = Hook(HookEventFailover, "", NewFailoverEventInfo(source, from, to))
+	}
+}
+
 func HookReceiveTimeoutEvent(source Source) (*http.Response, utils.HookState) {
 	var response *http.Response
 
@@ -0,0 +1,71 @@
+package stream
+
+import (
+	"testing"
+)
+
+// 重复推流按冲突策略处理, 主备切换的虚拟源不参与替换
+func TestReplaceExistingSource(t *testing.T) {
+	config := AppConfig
+	defer func() {
+		AppConfig = config
+	}()
+
+	tests := []struct {
+		name     string
+		policy   PublishConflictPolicy
+		existing SourceType // 0表示不存在
+		source   SourceType
+		expected bool
+	}{
+		{"not exist", PublishConflictReject, 0, SourceTypeRtmp, true},
+		{"reject", PublishConflictReject, SourceTypeRtmp, SourceTypeRtmp, false},
+		{"replace", PublishConflictReplace, SourceTypeRtmp, SourceTypeRtmp, true},
+		{"hook disabled", PublishConflictHook, SourceTypeRtmp, SourceTypeRtmp, false},
+		{"replace failover", PublishConflictReplace, SourceTypeFailover, SourceTypeRtmp, false},
+		{"replaced by failover", PublishConflictReplace, SourceTypeRtmp, SourceTypeFailover, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			AppConfig.Hooks.Enable = false
+			AppConfig.PublishConflict = PublishConflictConfig{Policy: test.policy, Timeout: 1000}
+
+			var existing *PublishSource
+			if test.existing != 0 {
+				existing = &PublishSource{ID: "live/conflict", Type: test.existing}
+				existing.Init(64)
+				if err := SourceManager.Add(existing); err != nil {
+					t.Fatal(err)
+				}
+
+				defer SourceManager.Remove(existing.ID)
+
+				// 已有推流的事件协程
+				go func() {
+					for !existing.IsClosed() {
+						(<-existing.MainContextEvents())()
+					}
+				}()
+			}
+
+			source := &PublishSource{ID: "live/conflict", Type: test.source}
+			if replaceExistingSource(source) != test.expected {
+				t.Fatalf("expected: %t", test.expected)
+			} else if existing == nil {
+				return
+			}
+
+			if replaced := existing.IsClosed(); replaced != test.expected {
+				t.Fatalf("existing closed: %t", replaced)
+			} else if replaced && (!existing.replaced.Load() || SourceManager.Find(existing.ID) != nil) {
+				t.Fatal("existing source not released for the new publisher")
+			}
+
+			// 拒绝时关闭已有推流, 结束事件协程
+			if !replaced {
+				existing.Close()
+			}
+		})
+	}
+}
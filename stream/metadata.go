@@ -0,0 +1,79 @@
+package stream
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+const (
+	MetadataTypeSEI       = "sei"        // 视频帧携带的用户数据SEI
+	MetadataTypeCuePoint  = "onCuePoint" // rtmp推流端发送的AMF数据消息
+	MetadataTypeTextData  = "onTextData"
+	MetadataTypeTimestamp = "timestamp" // 视频关键帧的媒体时间戳和服务器收到的时间
+)
+
+// Metadata 推流源的元数据事件, 下发给拉流端. 业务服务器通过/api/v1/source/metadata发布告警等事件,
+// 有拉流端订阅时, 推流源从媒体流中提取SEI、rtmp的onCuePoint/onTextData, 每个视频关键帧发布时间戳事件.
+type Metadata struct {
+	Source string          `json:"source"`
+	Type   string          `json:"type"`          // 业务自定义类型, 例如alarm. 从媒体流中提取的类型@see MetadataTypeSEI
+	Time   int64           `json:"time"`          // 时间戳, 单位毫秒
+	Pts    int64           `json:"pts,omitempty"` // 从媒体流中提取的元数据对应的媒体时间戳, 单位毫秒, 与拉流端的画面同步
+	Data   json.RawMessage `json:"data"`
+}
+
+// MetadataListener 元数据回调, 在发布元数据的协程执行, 不要阻塞
+type MetadataListener func(metadata *Metadata)
+
+var (
+	metadataLock      sync.RWMutex
+	metadataListeners = make(map[string]map[SinkID]MetadataListener, 16) // 每个Source的订阅者
+)
+
+// SubscribeMetadata 拉流端订阅Source的元数据
+func SubscribeMetadata(sourceId string, id SinkID, listener MetadataListener) {
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	listeners, ok := metadataListeners[sourceId]
+	if !ok {
+		listeners = make(map[SinkID]MetadataListener, 8)
+		metadataListeners[sourceId] = listeners
+	}
+
+	listeners[id] = listener
+}
+
+func UnsubscribeMetadata(sourceId string, id SinkID) {
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	if listeners, ok := metadataListeners[sourceId]; ok {
+		delete(listeners, id)
+		if len(listeners) == 0 {
+			delete(metadataListeners, sourceId)
+		}
+	}
+}
+
+// HasMetadataSubscriber 是否有拉流端订阅该Source的元数据, 没有订阅时不解析媒体流中的元数据
+func HasMetadataSubscriber(sourceId string) bool {
+	metadataLock.RLock()
+	defer metadataLock.RUnlock()
+
+	return len(metadataListeners[sourceId]) > 0
+}
+
+// PublishMetadata 发布元数据给该Source的所有订阅者. 复制订阅者后在锁外回调, 回调中可以订阅或取消订阅.
+func PublishMetadata(metadata *Metadata) {
+	metadataLock.RLock()
+	listeners := make([]MetadataListener, 0, len(metadataListeners[metadata.Source]))
+	for _, listener := range metadataListeners[metadata.Source] {
+		listeners = append(listeners, listener)
+	}
+	metadataLock.RUnlock()
+
+	for _, listener := range listeners {
+		listener(metadata)
+	}
+}
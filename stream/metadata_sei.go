@@ -0,0 +1,162 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/lkmio/avformat/utils"
+	"time"
+)
+
+const (
+	SEIPayloadTypeRegistered   = 4 // user_data_registered_itu_t_t35, 例如CEA-708字幕
+	SEIPayloadTypeUnregistered = 5 // user_data_unregistered, 16字节uuid加自定义数据
+)
+
+// 视频帧中的用户数据SEI
+type seiMessage struct {
+	PayloadType int    `json:"payload_type"`
+	UUID        string `json:"uuid,omitempty"` // user_data_unregistered的uuid, 16进制
+	Data        []byte `json:"data"`           // 去除uuid后的负载, json编码为base64
+}
+
+// 按照起始码拆分Annex B格式的NALU
+func splitNALUs(data []byte) [][]byte {
+	startCode := []byte{0x00, 0x00, 0x01}
+	start := bytes.Index(data, startCode)
+	if start < 0 {
+		return nil
+	}
+
+	var nalus [][]byte
+	data = data[start+len(startCode):]
+	for len(data) > 0 {
+		end := bytes.Index(data, startCode)
+		if end < 0 {
+			nalus = append(nalus, data)
+			break
+		}
+
+		// 4字节起始码的前导0
+		nalu := bytes.TrimRight(data[:end], "\x00")
+		if len(nalu) > 0 {
+			nalus = append(nalus, nalu)
+		}
+
+		data = data[end+len(startCode):]
+	}
+
+	return nalus
+}
+
+// 去除防竞争字节0x03
+func removeEmulationPrevention(data []byte) []byte {
+	rbsp := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		rbsp = append(rbsp, b)
+	}
+
+	return rbsp
+}
+
+// 读取SEI的payloadType或payloadSize, 0xFF表示累加后续字节
+func readSEIValue(rbsp []byte) (int, []byte, bool) {
+	var value int
+	for len(rbsp) > 0 {
+		b := rbsp[0]
+		rbsp = rbsp[1:]
+		value += int(b)
+		if b != 0xFF {
+			return value, rbsp, true
+		}
+	}
+
+	return 0, nil, false
+}
+
+// 从Annex B格式的H264/H265视频帧中解析用户数据SEI, 忽略其他类型的SEI
+func parseSEI(data []byte, hevc bool) []seiMessage {
+	var messages []seiMessage
+	for _, nalu := range splitNALUs(data) {
+		var rbsp []byte
+		if hevc {
+			// prefix和suffix SEI
+			if naluType := (nalu[0] >> 1) & 0x3F; len(nalu) < 2 || (naluType != 39 && naluType != 40) {
+				continue
+			}
+
+			rbsp = removeEmulationPrevention(nalu[2:])
+		} else if nalu[0]&0x1F == 6 {
+			rbsp = removeEmulationPrevention(nalu[1:])
+		} else {
+			continue
+		}
+
+		// 一个SEI NALU可以包含多条sei_message, 0x80为rbsp_trailing_bits
+		for len(rbsp) > 1 && rbsp[0] != 0x80 {
+			var payloadType, payloadSize int
+			var ok bool
+			if payloadType, rbsp, ok = readSEIValue(rbsp); !ok {
+				break
+			} else if payloadSize, rbsp, ok = readSEIValue(rbsp); !ok || payloadSize > len(rbsp) {
+				break
+			}
+
+			payload := rbsp[:payloadSize]
+			rbsp = rbsp[payloadSize:]
+
+			if SEIPayloadTypeRegistered == payloadType {
+				messages = append(messages, seiMessage{PayloadType: payloadType, Data: payload})
+			} else if SEIPayloadTypeUnregistered == payloadType && payloadSize >= 16 {
+				messages = append(messages, seiMessage{PayloadType: payloadType, UUID: hex.EncodeToString(payload[:16]), Data: payload[16:]})
+			}
+		}
+	}
+
+	return messages
+}
+
+// 有拉流端订阅元数据时调用. 视频关键帧发布时间戳事件, 拉流端据此对应画面和服务器收到的时间; 视频帧携带用户数据SEI时发布sei事件
+func (s *PublishSource) publishVideoMetadata(packet utils.AVPacket) {
+	var avStream utils.AVStream
+	for _, track := range s.originStreams.All() {
+		if track.Index() == packet.Index() {
+			avStream = track
+			break
+		}
+	}
+
+	if avStream == nil {
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	pts := packet.ConvertPts(1000)
+	if packet.KeyFrame() {
+		PublishMetadata(&Metadata{Source: s.ID, Type: MetadataTypeTimestamp, Time: now, Pts: pts})
+	}
+
+	codecId := avStream.CodecId()
+	if utils.AVCodecIdH264 != codecId && utils.AVCodecIdH265 != codecId {
+		return
+	}
+
+	for _, message := range parseSEI(packet.AnnexBPacketData(avStream), utils.AVCodecIdH265 == codecId) {
+		data, err := json.Marshal(&message)
+		if err == nil {
+			PublishMetadata(&Metadata{Source: s.ID, Type: MetadataTypeSEI, Time: now, Pts: pts, Data: data})
+		}
+	}
+}
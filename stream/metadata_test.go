@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestPublishMetadata(t *testing.T) {
+	var received []SinkID
+	SubscribeMetadata("live/test", 1, func(metadata *Metadata) {
+		received = append(received, 1)
+		// 在回调中取消订阅, 不能死锁
+		UnsubscribeMetadata(metadata.Source, 1)
+	})
+	SubscribeMetadata("live/other", 2, func(metadata *Metadata) {
+		received = append(received, 2)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		PublishMetadata(&Metadata{Source: "live/test", Type: "alarm"})
+		PublishMetadata(&Metadata{Source: "live/test", Type: "alarm"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish metadata deadlocked")
+	}
+
+	if len(received) != 1 || received[0] != 1 {
+		t.Fatalf("received %v", received)
+	}
+
+	UnsubscribeMetadata("live/other", 2)
+}
+
+// 构造SEI NALU, payload未添加防竞争字节
+func newTestSEI(hevc bool, payloads ...[]byte) []byte {
+	data := []byte{0x00, 0x00, 0x00, 0x01, 0x06}
+	if hevc {
+		data = []byte{0x00, 0x00, 0x00, 0x01, 39 << 1, 0x01}
+	}
+
+	for _, payload := range payloads {
+		data = append(data, payload...)
+	}
+
+	return append(data, 0x80)
+}
+
+func newTestSEIMessage(payloadType int, payload []byte) []byte {
+	var data []byte
+	for _, value := range []int{payloadType, len(payload)} {
+		for ; value >= 0xFF; value -= 0xFF {
+			data = append(data, 0xFF)
+		}
+
+		data = append(data, byte(value))
+	}
+
+	return append(data, payload...)
+}
+
+func TestParseSEI(t *testing.T) {
+	uuid := bytes.Repeat([]byte{0xAB}, 16)
+	long := bytes.Repeat([]byte{'a'}, 300)
+	idr := []byte{0x00, 0x00, 0x01, 0x65, 0x88, 0x84}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		hevc     bool
+		expected []seiMessage
+	}{
+		{"unregistered", newTestSEI(false, newTestSEIMessage(5, append(uuid, "hello"...))), false,
+			[]seiMessage{{5, hex.EncodeToString(uuid), []byte("hello")}}},
+		{"registered", newTestSEI(false, newTestSEIMessage(4, []byte{0xB5, 0x00, 0x31})), false,
+			[]seiMessage{{4, "", []byte{0xB5, 0x00, 0x31}}}},
+		{"skip other types", newTestSEI(false, newTestSEIMessage(1, []byte{0x01}), newTestSEIMessage(4, []byte{0x02})), false,
+			[]seiMessage{{4, "", []byte{0x02}}}},
+		{"long payload", newTestSEI(false, newTestSEIMessage(5, append(uuid, long...))), false,
+			[]seiMessage{{5, hex.EncodeToString(uuid), long}}},
+		{"emulation prevention", newTestSEI(false, []byte{0x04, 0x04, 0x00, 0x00, 0x03, 0x01, 0x02}), false,
+			[]seiMessage{{4, "", []byte{0x00, 0x00, 0x01, 0x02}}}},
+		{"with frame", append(newTestSEI(false, newTestSEIMessage(4, []byte{0x01})), idr...), false,
+			[]seiMessage{{4, "", []byte{0x01}}}},
+		{"short uuid", newTestSEI(false, newTestSEIMessage(5, []byte("short"))), false, nil},
+		{"truncated", newTestSEI(false, []byte{0x05, 0x20, 0x01}), false, nil},
+		{"no sei", idr, false, nil},
+		{"hevc prefix", newTestSEI(true, newTestSEIMessage(5, append(uuid, "hevc"...))), true,
+			[]seiMessage{{5, hex.EncodeToString(uuid), []byte("hevc")}}},
+		{"hevc ignores h264 sei", newTestSEI(false, newTestSEIMessage(4, []byte{0x01})), true, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := parseSEI(test.data, test.hevc)
+			if len(messages) != len(test.expected) {
+				t.Fatalf("messages: %d, expected: %d", len(messages), len(test.expected))
+			}
+
+			for i, message := range messages {
+				expected := test.expected[i]
+				if message.PayloadType != expected.PayloadType || message.UUID != expected.UUID || !bytes.Equal(message.Data, expected.Data) {
+					t.Fatalf("message: %+v, expected: %+v", message, expected)
+				}
+			}
+		})
+	}
+}
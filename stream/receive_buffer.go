@@ -31,6 +31,23 @@ func (r *ReceiveBuffer) GetBlock() []byte {
 	return bytes[:r.blockSize]
 }
 
+// Reserve 确保接下来连续获取count个缓存块不会回环覆盖.
+// 封装rtp时, 一帧数据(例如超大的关键帧)可能占用大量缓存块, 超过缓存块数量的一半时, 按帧大小重新分配缓冲区.
+// 已经输出的缓存块仍然引用旧的缓冲区, 不会被覆盖, 发送完成后由GC回收.
+func (r *ReceiveBuffer) Reserve(count int) {
+	if count <= r.blockCount/2 {
+		return
+	}
+
+	r.blockCount = count * 2
+	r.data = make([]byte, r.blockSize*r.blockCount)
+	r.index = 0
+}
+
+func (r *ReceiveBuffer) BlockSize() int {
+	return r.blockSize
+}
+
 func (r *ReceiveBuffer) BlockCount() int {
 	return r.blockCount
 }
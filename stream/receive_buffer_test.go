@@ -0,0 +1,47 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+)
+
+// 一帧数据需要的缓存块超过缓冲区时, 已经输出的缓存块不能被覆盖
+func TestReceiveBufferReserve(t *testing.T) {
+	tests := []struct {
+		name       string
+		blockCount int
+		frames     []int // 每帧占用的缓存块数量
+		grow       bool
+	}{
+		{"small frames", 8, []int{2, 3, 4, 4}, false},
+		{"large keyframe", 8, []int{2, 20, 3}, true},
+		{"half of the buffer", 8, []int{4, 4, 4}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := NewReceiveBuffer(4, test.blockCount)
+			for i, count := range test.frames {
+				buffer.Reserve(count)
+
+				var blocks [][]byte
+				for j := 0; j < count; j++ {
+					block := buffer.GetBlock()
+					copy(block, []byte{byte(i), byte(j), byte(i), byte(j)})
+					blocks = append(blocks, block)
+				}
+
+				// 同一帧的缓存块都保持写入时的数据
+				for j, block := range blocks {
+					if !bytes.Equal(block, []byte{byte(i), byte(j), byte(i), byte(j)}) {
+						t.Fatalf("frame %d block %d overwritten: %v", i, j, block)
+					}
+				}
+			}
+
+			if (buffer.BlockCount() != test.blockCount) != test.grow {
+				t.Fatalf("block count %d", buffer.BlockCount())
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package stream
 
 import (
 	"fmt"
+	"github.com/lkmio/avformat/transport"
 	"github.com/lkmio/avformat/utils"
 	"github.com/lkmio/lkm/log"
 	"net"
@@ -37,15 +38,33 @@ type Sink interface {
 	// SetEnableVideo 设置是否拉取视频流, 允许客户端只拉取音频流
 	SetEnableVideo(enable bool)
 
+	EnableAudio() bool
+
+	// SetEnableAudio 设置是否拉取音频流, 允许客户端只拉取视频流
+	SetEnableAudio(enable bool)
+
 	// DesiredAudioCodecId 允许客户端拉取指定的音频流
 	DesiredAudioCodecId() utils.AVCodecID
 
 	// DesiredVideoCodecId DescribeVideoCodecId 允许客户端拉取指定的视频流
 	DesiredVideoCodecId() utils.AVCodecID
 
+	SetDesiredAudioCodecId(id utils.AVCodecID)
+
+	SetDesiredVideoCodecId(id utils.AVCodecID)
+
+	// SelectedTracks 返回客户端选择的音频或视频track序号(同类型track中的顺序, 从0开始), nil表示使用默认选择
+	SelectedTracks(mediaType utils.AVMediaType) []int
+
+	SetSelectedTracks(mediaType utils.AVMediaType, tracks []int)
+
 	// Close 关闭释放Sink, 从传输流或等待队列中删除sink
 	Close()
 
+	// StreamNotFound 等待推流超时, Sink已经从等待队列删除. 在计时器协程中回调, 不能直接关闭Sink,
+	// 按拉流协议应答流不存在后, 通知拉流会话在自己的协程中关闭Sink(例如关闭链路, 由读取协程关闭Sink)
+	StreamNotFound()
+
 	String() string
 
 	RemoteAddr() string
@@ -71,6 +90,9 @@ type Sink interface {
 
 	IsTCPStreaming() bool
 
+	// EnableAsyncWriteMode TCP拉流开启异步发包, 只开启一次. sink重新添加到输出流(例如推流中途添加track)时不重复开启
+	EnableAsyncWriteMode(queueSize int)
+
 	GetSentPacketCount() int
 
 	SetSentPacketCount(int)
@@ -93,14 +115,18 @@ type BaseSink struct {
 	State         SessionState
 	TransStreamID TransStreamID
 	disableVideo  bool
+	disableAudio  bool
 
 	lock sync.RWMutex
 
 	DesiredAudioCodecId_ utils.AVCodecID
 	DesiredVideoCodecId_ utils.AVCodecID
+	audioTracks          []int // 选择拉取的音频track序号
+	videoTracks          []int // 选择拉取的视频track序号
 
 	Conn         net.Conn   // 拉流信令链路
 	TCPStreaming bool       // 是否是TCP流式拉流
+	asyncWrite   bool       // 是否已经开启异步发包
 	urlValues    url.Values // 拉流时携带的Url参数
 
 	SentPacketCount int  // 发包计数
@@ -173,6 +199,14 @@ func (s *BaseSink) SetEnableVideo(enable bool) {
 	s.disableVideo = !enable
 }
 
+func (s *BaseSink) EnableAudio() bool {
+	return !s.disableAudio
+}
+
+func (s *BaseSink) SetEnableAudio(enable bool) {
+	s.disableAudio = !enable
+}
+
 func (s *BaseSink) DesiredAudioCodecId() utils.AVCodecID {
 	return s.DesiredAudioCodecId_
 }
@@ -181,6 +215,30 @@ func (s *BaseSink) DesiredVideoCodecId() utils.AVCodecID {
 	return s.DesiredVideoCodecId_
 }
 
+func (s *BaseSink) SetDesiredAudioCodecId(id utils.AVCodecID) {
+	s.DesiredAudioCodecId_ = id
+}
+
+func (s *BaseSink) SetDesiredVideoCodecId(id utils.AVCodecID) {
+	s.DesiredVideoCodecId_ = id
+}
+
+func (s *BaseSink) SelectedTracks(mediaType utils.AVMediaType) []int {
+	if utils.AVMediaTypeAudio == mediaType {
+		return s.audioTracks
+	}
+
+	return s.videoTracks
+}
+
+func (s *BaseSink) SetSelectedTracks(mediaType utils.AVMediaType, tracks []int) {
+	if utils.AVMediaTypeAudio == mediaType {
+		s.audioTracks = tracks
+	} else {
+		s.videoTracks = tracks
+	}
+}
+
 // Close 做如下事情:
 // 1. Sink如果正在拉流, 删除任务交给Source处理, 否则直接从等待队列删除Sink.
 // 2. 发送PlayDoneHook事件
@@ -215,9 +273,11 @@ func (s *BaseSink) Close() {
 	}
 
 	if state == SessionStateTransferring {
-		// 从source中删除sink, 如果source为nil, 已经结束推流.
+		// 从source中删除sink, 如果source为nil, 已经结束推流. 推流断开等待重连期间, 从等待重连的source删除
 		if source := SourceManager.Find(s.SourceID); source != nil {
 			source.RemoveSink(s)
+		} else if source := findReconnectSource(s.SourceID); source != nil {
+			source.RemoveSink(s)
 		}
 	} else if state == SessionStateWaiting {
 		// 从等待队列中删除Sink
@@ -226,6 +286,13 @@ func (s *BaseSink) Close() {
 	}
 }
 
+// StreamNotFound 默认直接关闭链路, 由拉流会话的读取协程关闭Sink. 需要应答的协议重写该函数
+func (s *BaseSink) StreamNotFound() {
+	if conn := s.Conn; conn != nil {
+		_ = conn.Close()
+	}
+}
+
 func (s *BaseSink) String() string {
 	return fmt.Sprintf("%s-%v source:%s", s.GetProtocol().String(), s.ID, s.SourceID)
 }
@@ -262,6 +329,16 @@ func (s *BaseSink) IsTCPStreaming() bool {
 	return s.TCPStreaming
 }
 
+func (s *BaseSink) EnableAsyncWriteMode(queueSize int) {
+	conn, ok := s.Conn.(*transport.Conn)
+	if !ok || s.asyncWrite {
+		return
+	}
+
+	s.asyncWrite = true
+	conn.EnableAsyncWriteMode(queueSize)
+}
+
 func (s *BaseSink) GetSentPacketCount() int {
 	return s.SentPacketCount
 }
@@ -0,0 +1,16 @@
+package stream
+
+// TrackStatistics 拉流端每路流的传输统计, 来自拉流端的RTCP RR和NACK
+type TrackStatistics struct {
+	Index        int     `json:"index"`         // track索引
+	FractionLost float64 `json:"fraction_lost"` // 最近一次RR的丢包率, 百分比
+	TotalLost    int     `json:"total_lost"`    // 累计丢包数
+	Jitter       float64 `json:"jitter"`        // 到达间隔抖动, 单位毫秒
+	NackCount    int     `json:"nack_count"`    // 收到的NACK请求重传的包数
+	Retransmits  int     `json:"retransmits"`   // 实际重传的包数
+}
+
+// StatisticsSink 支持传输统计的Sink, 例如rtsp udp拉流
+type StatisticsSink interface {
+	Statistics() []TrackStatistics
+}
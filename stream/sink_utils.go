@@ -3,8 +3,11 @@ package stream
 import (
 	"encoding/binary"
 	"fmt"
+	"github.com/lkmio/avformat/utils"
 	"net"
+	"net/url"
 	"strconv"
+	"strings"
 )
 
 // SinkID IPV4使用uint64、IPV6使用string作为ID类型
@@ -53,3 +56,124 @@ func SinkId2String(id SinkID) string {
 func CreateSinkDisconnectionMessage(sink Sink) string {
 	return fmt.Sprintf("%s sink断开连接. id: %s", sink.GetProtocol(), sink.GetID())
 }
+
+var (
+	// 拉流url参数acodec/vcodec支持的编码器名称, 不区分大小写
+	audioCodecNames = map[string]utils.AVCodecID{
+		"aac":   utils.AVCodecIdAAC,
+		"mp3":   utils.AVCodecIdMP3,
+		"opus":  utils.AVCodecIdOPUS,
+		"pcma":  utils.AVCodecIdPCMALAW,
+		"g711a": utils.AVCodecIdPCMALAW,
+		"pcmu":  utils.AVCodecIdPCMMULAW,
+		"g711u": utils.AVCodecIdPCMMULAW,
+		"pcm":   utils.AVCodecIdPCMS16LE,
+	}
+
+	videoCodecNames = map[string]utils.AVCodecID{
+		"h264": utils.AVCodecIdH264,
+		"avc":  utils.AVCodecIdH264,
+		"h265": utils.AVCodecIdH265,
+		"hevc": utils.AVCodecIdH265,
+		"vp8":  utils.AVCodecIdVP8,
+		"vp9":  utils.AVCodecIdVP9,
+		"av1":  utils.AVCodecIdAV1,
+	}
+)
+
+// 解析逗号分隔的track序号, 例如atrack=0,1
+func parseTrackNumbers(value string) ([]int, error) {
+	var tracks []int
+	for _, field := range strings.Split(value, ",") {
+		number, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || number < 0 {
+			return nil, fmt.Errorf("invalid track number %s", field)
+		}
+
+		for _, track := range tracks {
+			if track == number {
+				return nil, fmt.Errorf("duplicate track number %d", number)
+			}
+		}
+
+		tracks = append(tracks, number)
+	}
+
+	return tracks, nil
+}
+
+// CheckHlsTrackParams hls切片在推流时生成, 所有hls拉流共享同一组m3u8和切片, 只支持video=0拉取纯音频rendition,
+// 其余选择track和编码器的参数无法生效, 返回error由拉流端应答400
+func CheckHlsTrackParams(values url.Values) error {
+	if "0" == values.Get("audio") {
+		return fmt.Errorf("hls does not support the audio=0 parameter")
+	}
+
+	for _, key := range []string{"acodec", "vcodec", "atrack", "vtrack"} {
+		if values.Has(key) {
+			return fmt.Errorf("hls does not support the %s parameter", key)
+		}
+	}
+
+	return nil
+}
+
+// SetSinkTrackParams 根据拉流url参数选择拉取的track和期望的编码器, 所有拉流协议通用:
+// audio=0 不拉取音频, video=0 不拉取视频, acodec/vcodec 期望的音频/视频编码器, 例如acodec=pcma.
+// atrack/vtrack 选择拉取的音频/视频track序号, 例如atrack=1拉取第二路音频, 只有支持多track的协议才能选择多路.
+// 输出协议不支持期望的编码器时, 降级协商, @see negotiateSinkCodecs
+func SetSinkTrackParams(sink Sink, values url.Values) error {
+	if TransStreamHls == sink.GetProtocol() {
+		if err := CheckHlsTrackParams(values); err != nil {
+			return err
+		}
+	}
+
+	if "0" == values.Get("audio") {
+		sink.SetEnableAudio(false)
+	}
+
+	if "0" == values.Get("video") {
+		sink.SetEnableVideo(false)
+	}
+
+	if !sink.EnableAudio() && !sink.EnableVideo() {
+		return fmt.Errorf("audio and video cannot both be disabled")
+	}
+
+	if name := values.Get("acodec"); name != "" {
+		id, ok := audioCodecNames[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown audio codec %s", name)
+		}
+
+		sink.SetDesiredAudioCodecId(id)
+	}
+
+	if name := values.Get("vcodec"); name != "" {
+		id, ok := videoCodecNames[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown video codec %s", name)
+		}
+
+		sink.SetDesiredVideoCodecId(id)
+	}
+
+	for key, mediaType := range map[string]utils.AVMediaType{"atrack": utils.AVMediaTypeAudio, "vtrack": utils.AVMediaTypeVideo} {
+		value := values.Get(key)
+		if value == "" {
+			continue
+		}
+
+		tracks, err := parseTrackNumbers(value)
+		if err != nil {
+			return err
+		} else if len(tracks) > 1 && !IsSupportMultiTrack(sink.GetProtocol()) {
+			return fmt.Errorf("%s does not support multiple tracks, %s=%s", sink.GetProtocol().String(), key, value)
+		}
+
+		sink.SetSelectedTracks(mediaType, tracks)
+	}
+
+	return nil
+}
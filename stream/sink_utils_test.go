@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseTrackNumbers(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []int
+		success  bool
+	}{
+		{"0", []int{0}, true},
+		{"1,0", []int{1, 0}, true},
+		{" 0 , 2 ", []int{0, 2}, true},
+		{"", nil, false},
+		{"-1", nil, false},
+		{"a", nil, false},
+		{"0,,1", nil, false},
+		{"1,1", nil, false},
+	}
+
+	for _, test := range tests {
+		tracks, err := parseTrackNumbers(test.value)
+		if (err == nil) != test.success {
+			t.Fatalf("parse %q err: %v", test.value, err)
+		} else if len(tracks) != len(test.expected) {
+			t.Fatalf("parse %q: %v, expected %v", test.value, tracks, test.expected)
+		}
+
+		for i, track := range tracks {
+			if track != test.expected[i] {
+				t.Fatalf("parse %q: %v, expected %v", test.value, tracks, test.expected)
+			}
+		}
+	}
+}
+
+// 只有支持多track的协议可以选择多路
+func TestSetSinkTrackParams(t *testing.T) {
+	tests := []struct {
+		protocol TransStreamProtocol
+		query    string
+		success  bool
+	}{
+		{TransStreamRtsp, "atrack=0,1", true},
+		{TransStreamRtmp, "atrack=0,1", true},
+		{TransStreamRtmp, "atrack=1", true},
+		{TransStreamRtc, "atrack=0,1", false},
+		{TransStreamFmp4, "vtrack=0,1", true},
+		{TransStreamFlv, "audio=0&video=0", false},
+		{TransStreamFlv, "acodec=pcm", true},
+		{TransStreamFlv, "acodec=g726", false},
+		{TransStreamFlv, "vcodec=hevc", true},
+		{TransStreamHls, "video=0", true},
+		{TransStreamHls, "audio=0", false},
+		{TransStreamHls, "acodec=aac", false},
+		{TransStreamHls, "vtrack=0", false},
+	}
+
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		sink := newTestSink(SinkID(uint64(1)), test.protocol, values)
+		if err := SetSinkTrackParams(sink, values); (err == nil) != test.success {
+			t.Fatalf("%s %s err: %v", test.protocol.String(), test.query, err)
+		}
+	}
+}
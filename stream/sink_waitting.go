@@ -1,29 +1,53 @@
 package stream
 
-import "sync"
+import (
+	"github.com/lkmio/lkm/log"
+	"sync"
+	"time"
+)
 
 // 等待队列所有的Sink
-var waitingSinks map[string]map[SinkID]Sink
+var waitingSinks map[string]map[SinkID]*waitingSink
 
 var mutex sync.RWMutex
 
+// 等待队列中的Sink, 开启了等待超时(waiting_timeout)时, 超时未推流应答拉流端流不存在
+type waitingSink struct {
+	sink  Sink
+	timer *time.Timer
+}
+
 func init() {
-	waitingSinks = make(map[string]map[SinkID]Sink, 1024)
+	waitingSinks = make(map[string]map[SinkID]*waitingSink, 1024)
 }
 
-func AddSinkToWaitingQueue(streamId string, sink Sink) {
+// AddSinkToWaitingQueue 添加Sink到等待队列, 返回是否是该流第一个等待的Sink
+func AddSinkToWaitingQueue(streamId string, sink Sink) bool {
 	mutex.Lock()
 	defer mutex.Unlock()
 
 	m, ok := waitingSinks[streamId]
 	if !ok {
 		if m, ok = waitingSinks[streamId]; !ok {
-			m = make(map[SinkID]Sink, 64)
+			m = make(map[SinkID]*waitingSink, 64)
 			waitingSinks[streamId] = m
 		}
 	}
 
-	m[sink.GetID()] = sink
+	waiting := &waitingSink{sink: sink}
+	if AppConfig.WaitingTimeout > 0 {
+		waiting.timer = time.AfterFunc(time.Duration(AppConfig.WaitingTimeout), func() {
+			onWaitingTimeout(streamId, sink)
+		})
+	}
+
+	// 替换已经存在的sink, 停止之前的计时器
+	if old, exist := m[sink.GetID()]; exist {
+		old.stop()
+	}
+
+	m[sink.GetID()] = waiting
+	return len(m) == 1
 }
 
 func RemoveSinkFromWaitingQueue(sourceId string, sinkId SinkID) (Sink, bool) {
@@ -35,12 +59,18 @@ func RemoveSinkFromWaitingQueue(sourceId string, sinkId SinkID) (Sink, bool) {
 		return nil, false
 	}
 
-	sink, ok := m[sinkId]
-	if ok {
-		delete(m, sinkId)
+	waiting, ok := m[sinkId]
+	if !ok {
+		return nil, false
 	}
 
-	return sink, ok
+	waiting.stop()
+	delete(m, sinkId)
+	if len(m) == 0 {
+		delete(waitingSinks, sourceId)
+	}
+
+	return waiting.sink, true
 }
 
 func PopWaitingSinks(sourceId string) []Sink {
@@ -54,8 +84,9 @@ func PopWaitingSinks(sourceId string) []Sink {
 
 	sinks := make([]Sink, len(source))
 	var index = 0
-	for _, sink := range source {
-		sinks[index] = sink
+	for _, waiting := range source {
+		waiting.stop()
+		sinks[index] = waiting.sink
 		index++
 	}
 
@@ -85,3 +116,20 @@ func ExistSink(sourceId string, sinkId SinkID) bool {
 
 	return SinkManager.Exist(sinkId)
 }
+
+func (w *waitingSink) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// 等待推流超时, 从等待队列删除Sink, 应答拉流端流不存在. Sink由拉流会话关闭, 不在计时器协程中关闭
+func onWaitingTimeout(streamId string, sink Sink) {
+	// 已经被推流取出或已经断开
+	if _, ok := RemoveSinkFromWaitingQueue(streamId, sink.GetID()); !ok {
+		return
+	}
+
+	log.Sugar.Infof("等待推流超时 sink: %s", sink.String())
+	sink.StreamNotFound()
+}
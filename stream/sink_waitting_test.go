@@ -0,0 +1,189 @@
+package stream
+
+import (
+	"encoding/json"
+	"github.com/lkmio/avformat/utils"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录等待超时回调的sink
+type waitingTestSink struct {
+	testSink
+	notFound chan struct{}
+}
+
+func (s *waitingTestSink) StreamNotFound() {
+	close(s.notFound)
+}
+
+func newWaitingTestSink(id SinkID, sourceId string) *waitingTestSink {
+	return &waitingTestSink{
+		testSink: testSink{BaseSink: BaseSink{ID: id, SourceID: sourceId, Protocol: TransStreamRtmp}},
+		notFound: make(chan struct{}),
+	}
+}
+
+// 同一路流只有第一个等待的sink触发on_stream_not_found, 等待队列清空后再次等待重新触发
+func TestStreamNotFoundHook(t *testing.T) {
+	config := AppConfig
+	defer func() {
+		AppConfig = config
+		InitHookUrls()
+	}()
+
+	var lock sync.Mutex
+	counts := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info eventInfo
+		_ = json.NewDecoder(r.Body).Decode(&info)
+
+		lock.Lock()
+		counts[info.Stream]++
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	AppConfig.Hooks = HooksConfig{Enable: true, Timeout: int64(time.Second), OnStreamNotFoundUrl: server.URL}
+	AppConfig.WaitingTimeout = 0
+	InitHookUrls()
+
+	tests := []struct {
+		name     string
+		sources  []string // 依次拉流的流id
+		expected map[string]int
+	}{
+		{"single", []string{"live/a"}, map[string]int{"live/a": 1}},
+		{"same stream", []string{"live/a", "live/a", "live/a"}, map[string]int{"live/a": 1}},
+		{"different streams", []string{"live/a", "live/b", "live/a", "live/b"}, map[string]int{"live/a": 1, "live/b": 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lock.Lock()
+			counts = make(map[string]int)
+			lock.Unlock()
+
+			var sinks []Sink
+			for i, sourceId := range test.sources {
+				sink := newWaitingTestSink(SinkID(uint64(i)), sourceId)
+				if _, state := PreparePlaySink(sink); utils.HookStateOK != state {
+					t.Fatalf("failed to prepare the sink, state: %d", state)
+				}
+
+				sinks = append(sinks, sink)
+			}
+
+			// 等待异步的hook请求
+			time.Sleep(200 * time.Millisecond)
+
+			lock.Lock()
+			for sourceId, count := range test.expected {
+				if counts[sourceId] != count {
+					t.Errorf("%s hooked %d times, expected: %d", sourceId, counts[sourceId], count)
+				}
+			}
+			lock.Unlock()
+
+			// 清空等待队列, 下一组用例重新触发
+			for _, sink := range sinks {
+				sink.Close()
+			}
+		})
+	}
+}
+
+// 超时未推流, sink从等待队列删除并收到流不存在的回调, 由拉流会话关闭
+func TestWaitingTimeout(t *testing.T) {
+	config := AppConfig
+	defer func() {
+		AppConfig = config
+	}()
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		remove  bool // 超时前断开
+		pop     bool // 超时前推流
+		fired   bool
+	}{
+		{"timeout", 50 * time.Millisecond, false, false, true},
+		{"disabled", 0, false, false, false},
+		{"disconnected", 50 * time.Millisecond, true, false, false},
+		{"published", 50 * time.Millisecond, false, true, false},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			AppConfig.WaitingTimeout = int64(test.timeout)
+
+			sourceId := "live/waiting"
+			sink := newWaitingTestSink(SinkID(uint64(i)), sourceId)
+			sink.Lock()
+			sink.SetState(SessionStateWaiting)
+			sink.UnLock()
+			AddSinkToWaitingQueue(sourceId, sink)
+
+			if test.remove {
+				RemoveSinkFromWaitingQueue(sourceId, sink.GetID())
+			} else if test.pop {
+				PopWaitingSinks(sourceId)
+			}
+
+			select {
+			case <-sink.notFound:
+				if !test.fired {
+					t.Fatal("unexpected timeout")
+				} else if ExistSinkInWaitingQueue(sourceId, sink.GetID()) {
+					t.Fatal("sink still in the waiting queue")
+				} else if SessionStateClosed == sink.GetState() {
+					t.Fatal("sink closed on the timer goroutine")
+				}
+			case <-time.After(test.timeout + 200*time.Millisecond):
+				if test.fired {
+					t.Fatal("timeout not fired")
+				}
+			}
+
+			RemoveSinkFromWaitingQueue(sourceId, sink.GetID())
+		})
+	}
+}
+
+// 播放中的源关闭, sink回到等待队列, 超时后同样收到流不存在的回调
+func TestWaitingTimeoutAfterSourceClosed(t *testing.T) {
+	config := AppConfig
+	defer func() {
+		AppConfig = config
+	}()
+
+	AppConfig.WaitingTimeout = int64(50 * time.Millisecond)
+
+	video := utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, nil, nil)
+	source := newTestSource(video)
+	source.ID = "live/replay"
+
+	sink := newWaitingTestSink(SinkID(uint64(100)), source.ID)
+	if !source.doAddSink(sink) {
+		t.Fatal("failed to add sink")
+	} else if SessionStateTransferring != sink.GetState() {
+		t.Fatalf("sink not playing, state: %d", sink.GetState())
+	}
+
+	source.closeOutputs()
+	if !ExistSinkInWaitingQueue(source.ID, sink.GetID()) {
+		t.Fatal("sink not moved to the waiting queue")
+	}
+
+	select {
+	case <-sink.notFound:
+		if ExistSinkInWaitingQueue(source.ID, sink.GetID()) {
+			t.Fatal("sink still in the waiting queue")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout not fired")
+	}
+}
@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/lkmio/avformat/transport"
 	"github.com/lkmio/lkm/collections"
@@ -46,6 +47,12 @@ type Source interface {
 
 	RemoveSinkWithID(id SinkID)
 
+	// PauseSink 暂停向Sink推流, 从输出流中分离Sink, 保留拉流会话
+	PauseSink(sink Sink)
+
+	// ResumeSink 恢复向Sink推流, 从下一个关键帧开始发送
+	ResumeSink(sink Sink)
+
 	FindSink(id SinkID) Sink
 
 	SetState(state SessionState)
@@ -57,6 +64,9 @@ type Source interface {
 
 	DoClose()
 
+	// SetReplaced 标记被同一路流的新推流替换, 随后Close时保留输出流和sink, 由新推流接管
+	SetReplaced()
+
 	// IsCompleted 所有推流track是否解析完毕
 	IsCompleted() bool
 
@@ -66,7 +76,7 @@ type Source interface {
 	// OnDiscardPacket GOP缓存溢出回调, 释放AVPacket
 	OnDiscardPacket(pkt utils.AVPacket)
 
-	// OnDeMuxStream 解析出AVStream回调
+	// OnDeMuxStream 解析出AVStream回调. 已经存在的track再次回调, 视为编码参数发生变化
 	OnDeMuxStream(stream utils.AVStream)
 
 	// OnDeMuxStreamDone 所有track解析完毕回调, 后续的OnDeMuxStream回调不再处理
@@ -119,6 +129,18 @@ type Source interface {
 	Sinks() []Sink
 
 	GetBitrateStatistics() *BitrateStatistics
+
+	// AddPacketListener 监听解析出的AVPacket, 必须在Source的事件协程中调用, 例如SourceListener的回调
+	AddPacketListener(listener PacketListener)
+
+	// RemovePacketListener 删除AVPacket监听, 必须在Source的事件协程中调用
+	RemovePacketListener(listener PacketListener)
+}
+
+// PacketListener 监听Source解析出的AVPacket
+type PacketListener interface {
+	// OnPacket 在Source的事件协程中回调, 不能阻塞. packet的内存由Source管理, 异步处理需要拷贝
+	OnPacket(source Source, stream utils.AVStream, packet utils.AVPacket)
 }
 
 type PublishSource struct {
@@ -127,21 +149,28 @@ type PublishSource struct {
 	state SessionState
 	Conn  net.Conn
 
-	TransDeMuxer     stream.DeMuxer            // 负责从推流协议中解析出AVStream和AVPacket
-	recordSink       Sink                      // 每个Source的录制流
-	recordFilePath   string                    // 录制流文件路径
-	hlsStream        TransStream               // HLS传输流, 如果开启, 在@see writeHeader 函数中直接创建, 如果等拉流时再创建, 会进一步加大HLS延迟.
-	audioTranscoders []transcode.Transcoder    // 音频解码器
-	videoTranscoders []transcode.Transcoder    // 视频解码器
-	originStreams    StreamManager             // 推流的音视频Streams
-	allStreams       StreamManager             // 推流Streams+转码器获得的Stream
-	pktBuffers       [8]collections.MemoryPool // 推流每路的AVPacket缓存, AVPacket的data从该内存池中分配. 在GOP缓存溢出时,释放池中内存.
-	gopBuffer        GOPBuffer                 // GOP缓存, 音频和视频混合使用, 以视频关键帧为界, 缓存第二个视频关键帧时, 释放前一组gop. 如果不存在视频流, 不缓存音频
+	TransDeMuxer     stream.DeMuxer           // 负责从推流协议中解析出AVStream和AVPacket
+	recordSink       Sink                     // 每个Source的录制流
+	recordFilePath   string                   // 录制流文件路径
+	hlsStream        TransStream              // HLS传输流, 如果开启, 在@see writeHeader 函数中直接创建, 如果等拉流时再创建, 会进一步加大HLS延迟.
+	hlsAudioStream   TransStream              // HLS纯音频rendition, 开启后和hlsStream一起创建
+	audioTranscoders []transcode.Transcoder   // 音频转码器, 按输入流和输出编码共享
+	videoTranscoders []transcode.Transcoder   // 视频转码器, 按输入流和输出编码共享
+	originStreams    StreamManager            // 推流的音视频Streams
+	allStreams       StreamManager            // 推流Streams+转码器获得的Stream
+	pktBuffers       []collections.MemoryPool // 推流每路的AVPacket缓存, 按照track索引存放, AVPacket的data从该内存池中分配. 在GOP缓存溢出时,释放池中内存.
+	gopBuffer        GOPBuffer                // GOP缓存, 音频和视频混合使用, 以视频关键帧为界, 缓存第二个视频关键帧时, 释放前一组gop. 如果不存在视频流, 不缓存音频
 
 	closed     atomic.Bool // source是否已经关闭
 	completed  bool        // 所有推流track是否解析完毕, @see writeHeader 函数中赋值为true
 	existVideo bool        // 是否存在视频
 
+	reconnectable      bool                    // 推流链路断开, 关闭时等待重连
+	replaced           atomic.Bool             // 被同一路流的新推流替换, 关闭时等待新推流接管输出流
+	timestamps         map[int]*trackTimestamp // 每路track的时间戳, 重连后新推流的时间戳延续上一次推流
+	previousTimestamps map[int]*trackTimestamp // 重连前上一次推流每路track的时间戳
+	packetListeners    []PacketListener
+
 	probeTimer *time.Timer // track解析超时计时器, 触发时执行@see writeHeader
 
 	TransStreams     map[TransStreamID]TransStream     // 所有的输出流, 持有Sink
@@ -151,17 +180,16 @@ type PublishSource struct {
 	streamPipe        chan []byte // 推流数据管道
 	mainContextEvents chan func() // 切换到主协程执行函数的事件管道
 
-	lastPacketTime    time.Time  // 最近收到推流包的时间
-	lastStreamEndTime time.Time  // 最近拉流端结束拉流的时间
-	sinkCount         int        // 拉流端计数
-	urlValues         url.Values // 推流url携带的参数
-	timeoutTracks     []int
+	lastPacketTime    atomic.Int64       // 最近收到推流包的时间(UnixNano), 主备切换在其他协程读取
+	lastStreamEndTime time.Time          // 最近拉流端结束拉流的时间
+	sinkCount         int                // 拉流端计数
+	urlValues         url.Values         // 推流url携带的参数
 	createTime        time.Time          // source创建时间
 	statistics        *BitrateStatistics // 码流统计
 }
 
 func (s *PublishSource) SetLastPacketTime(time2 time.Time) {
-	s.lastPacketTime = time2
+	s.lastPacketTime.Store(time2.UnixNano())
 }
 
 func (s *PublishSource) IsClosed() bool {
@@ -181,7 +209,11 @@ func (s *PublishSource) LastStreamEndTime() time.Time {
 }
 
 func (s *PublishSource) LastPacketTime() time.Time {
-	return s.lastPacketTime
+	if nano := s.lastPacketTime.Load(); nano > 0 {
+		return time.Unix(0, nano)
+	}
+
+	return time.Time{}
 }
 
 func (s *PublishSource) SinkCount() int {
@@ -207,6 +239,7 @@ func (s *PublishSource) Init(receiveQueueSize int) {
 	s.TransStreams = make(map[TransStreamID]TransStream, 10)
 	s.sinks = make(map[SinkID]Sink, 128)
 	s.TransStreamSinks = make(map[TransStreamID]map[SinkID]Sink, len(transStreamFactories)+1)
+	s.timestamps = make(map[int]*trackTimestamp, 4)
 	s.statistics = NewBitrateStatistics()
 }
 
@@ -228,8 +261,20 @@ func (s *PublishSource) CreateDefaultOutStreams() {
 
 	// 创建HLS输出流
 	if AppConfig.Hls.Enable {
-		streams := s.OriginStreams()
-		utils.Assert(len(streams) > 0)
+		// 丢弃hls不支持的track, 例如G711
+		var streams []utils.AVStream
+		for _, stream_ := range s.OriginStreams() {
+			if IsSupportCodec(TransStreamHls, stream_.CodecId()) {
+				streams = append(streams, stream_)
+			} else {
+				log.Sugar.Warnf("hls不支持%s, 丢弃该track source: %s", stream_.CodecId(), s.ID)
+			}
+		}
+
+		if len(streams) == 0 {
+			log.Sugar.Errorf("没有hls支持的track, 不创建hls输出流 source: %s", s.ID)
+			return
+		}
 
 		id := GenerateTransStreamID(TransStreamHls, streams...)
 		hlsStream, err := s.CreateTransStream(id, TransStreamHls, streams)
@@ -240,13 +285,34 @@ func (s *PublishSource) CreateDefaultOutStreams() {
 		s.DispatchGOPBuffer(hlsStream)
 		s.hlsStream = hlsStream
 		s.TransStreams[id] = s.hlsStream
+
+		// 创建纯音频的HLS输出流, 作为主播放列表中的音频rendition
+		var audioStreams []utils.AVStream
+		for _, stream_ := range streams {
+			if utils.AVMediaTypeAudio == stream_.Type() {
+				audioStreams = append(audioStreams, stream_)
+			}
+		}
+
+		if AppConfig.Hls.AudioRendition && s.existVideo && len(audioStreams) > 0 {
+			id = GenerateTransStreamID(TransStreamHls, audioStreams...)
+			audioStream, err := s.CreateTransStream(id, TransStreamHls, audioStreams)
+			if err != nil {
+				log.Sugar.Errorf("创建纯音频hls输出流失败 err: %s source: %s", err.Error(), s.ID)
+			} else {
+				s.DispatchGOPBuffer(audioStream)
+				s.hlsAudioStream = audioStream
+				s.TransStreams[id] = audioStream
+			}
+		}
 	}
 }
 
 // FindOrCreatePacketBuffer 查找或者创建AVPacket的内存池
 func (s *PublishSource) FindOrCreatePacketBuffer(index int, mediaType utils.AVMediaType) collections.MemoryPool {
-	if index >= cap(s.pktBuffers) {
-		panic("流路数过多...")
+	// track数量不固定, 按索引扩容
+	for index >= len(s.pktBuffers) {
+		s.pktBuffers = append(s.pktBuffers, nil)
 	}
 
 	if s.pktBuffers[index] == nil {
@@ -279,14 +345,6 @@ func (s *PublishSource) TranscodeStreams() []utils.AVStream {
 	return s.allStreams.All()
 }
 
-func IsSupportMux(protocol TransStreamProtocol, audioCodecId, videoCodecId utils.AVCodecID) bool {
-	if TransStreamRtmp == protocol || TransStreamFlv == protocol {
-
-	}
-
-	return true
-}
-
 func (s *PublishSource) CreateTransStream(id TransStreamID, protocol TransStreamProtocol, streams []utils.AVStream) (TransStream, error) {
 	log.Sugar.Debugf("创建%s-stream source: %s", protocol.String(), s.ID)
 
@@ -297,7 +355,9 @@ func (s *PublishSource) CreateTransStream(id TransStreamID, protocol TransStream
 	}
 
 	for _, track := range streams {
-		transStream.AddTrack(track)
+		if err = transStream.AddTrack(track); err != nil {
+			log.Sugar.Warnf("%s输出流丢弃track: %d err: %s source: %s", protocol.String(), track.Index(), err.Error(), s.ID)
+		}
 	}
 
 	transStream.SetID(id)
@@ -305,12 +365,15 @@ func (s *PublishSource) CreateTransStream(id TransStreamID, protocol TransStream
 	s.TransStreamSinks[id] = make(map[SinkID]Sink, 128)
 	_ = transStream.WriteHeader()
 
-	return transStream, err
+	return transStream, nil
 }
 
 func (s *PublishSource) DispatchGOPBuffer(transStream TransStream) {
 	s.gopBuffer.PeekAll(func(packet utils.AVPacket) {
-		s.DispatchPacket(transStream, packet)
+		// 转码器有状态, 不重复转码缓存的包, 转码流从实时包开始输出
+		if s.isOriginTrack(transStream, packet.Index()) {
+			s.DispatchPacket(transStream, packet)
+		}
 	})
 }
 
@@ -321,7 +384,9 @@ func (s *PublishSource) DispatchPacket(transStream TransStream, packet utils.AVP
 		return
 	}
 
-	s.DispatchBuffer(transStream, packet.Index(), data, timestamp, videoKey)
+	// sink使用track在输出流中的索引
+	index, _ := transStream.FindTrack(packet.Index())
+	s.DispatchBuffer(transStream, index, data, timestamp, videoKey)
 }
 
 // DispatchBuffer 分发传输流
@@ -362,67 +427,228 @@ func (s *PublishSource) write(sink Sink, index int, data [][]byte, timestamp int
 	}
 }
 
-// 创建sink需要的输出流
-func (s *PublishSource) doAddSink(sink Sink) bool {
-	// 暂时不考虑多路视频流，意味着只能1路视频流和多路音频流，同理originStreams和allStreams里面的Stream互斥. 同时多路音频流的Codec必须一致
-	audioCodecId, videoCodecId := sink.DesiredAudioCodecId(), sink.DesiredVideoCodecId()
-	audioStream := s.originStreams.FindStreamWithType(utils.AVMediaTypeAudio)
-	videoStream := s.originStreams.FindStreamWithType(utils.AVMediaTypeVideo)
-
-	disableAudio := audioStream == nil
-	disableVideo := videoStream == nil || !sink.EnableVideo()
-	if disableAudio && disableVideo {
-		return false
+// 查找或创建转码器, 相同输入流和输出编码的sink共用一个转码器, 转码流添加到allStreams
+func (s *PublishSource) findOrCreateTranscoder(transcoders *[]transcode.Transcoder, stream utils.AVStream, codecId utils.AVCodecID) (transcode.Transcoder, error) {
+	for _, transcoder := range *transcoders {
+		if transcoder.GetStream().Index() == stream.Index() && transcoder.DstCodecId() == codecId {
+			return transcoder, nil
+		}
 	}
 
-	// 不支持对期望编码的流封装. 降级
-	if (utils.AVCodecIdNONE != audioCodecId || utils.AVCodecIdNONE != videoCodecId) && !IsSupportMux(sink.GetProtocol(), audioCodecId, videoCodecId) {
-		audioCodecId = utils.AVCodecIdNONE
-		videoCodecId = utils.AVCodecIdNONE
+	transcoder, err := transcode.NewTranscoder(stream, codecId)
+	if err != nil {
+		return nil, err
 	}
 
-	if !disableAudio && utils.AVCodecIdNONE == audioCodecId {
-		audioCodecId = audioStream.CodecId()
-	}
-	if !disableVideo && utils.AVCodecIdNONE == videoCodecId {
-		videoCodecId = videoStream.CodecId()
+	log.Sugar.Infof("创建转码器 %s->%s source: %s", stream.CodecId(), codecId, s.ID)
+
+	*transcoders = append(*transcoders, transcoder)
+	s.allStreams.Add(transcoder.GetStream())
+	return transcoder, nil
+}
+
+// 输出流是否还有sink. 暂停推流的sink已从TransStreamSinks删除, 根据s.sinks统计
+func (s *PublishSource) isTransStreamConsumed(id TransStreamID) bool {
+	for _, sink := range s.sinks {
+		if sink.GetTransStreamID() == id {
+			return true
+		}
 	}
 
-	// 创建音频转码器
-	if !disableAudio && audioCodecId != audioStream.CodecId() {
-		utils.Assert(false)
+	return false
+}
+
+// 转码流是否还有sink在拉取, 包括暂停推流的sink
+func (s *PublishSource) isTranscoderConsumed(transcoder transcode.Transcoder) bool {
+	output := transcoder.GetStream()
+	for id, transStream := range s.TransStreams {
+		if !s.isTransStreamConsumed(id) {
+			continue
+		}
+
+		for _, track := range transStream.GetTracks() {
+			if track == output {
+				return true
+			}
+		}
 	}
 
-	// 创建视频转码器
-	if !disableVideo && videoCodecId != videoStream.CodecId() {
-		utils.Assert(false)
+	return false
+}
+
+// 释放没有sink拉取的转码器, 同时关闭使用该转码流的输出流. 转码器在sink拉流时创建, 最后一个sink断开后释放.
+func (s *PublishSource) releaseTranscoders() {
+	release := func(transcoders []transcode.Transcoder) []transcode.Transcoder {
+		var remain []transcode.Transcoder
+		for _, transcoder := range transcoders {
+			if s.isTranscoderConsumed(transcoder) {
+				remain = append(remain, transcoder)
+				continue
+			}
+
+			output := transcoder.GetStream()
+			for id, transStream := range s.TransStreams {
+				for _, track := range transStream.GetTracks() {
+					if track == output {
+						transStream.Close()
+						delete(s.TransStreams, id)
+						delete(s.TransStreamSinks, id)
+						break
+					}
+				}
+			}
+
+			log.Sugar.Infof("释放转码器 %s->%s source: %s", transcoder.SrcCodecId(), transcoder.DstCodecId(), s.ID)
+			s.allStreams.Remove(output)
+			transcoder.Close()
+		}
+
+		return remain
 	}
 
-	var streams [5]utils.AVStream
-	var size int
+	s.audioTranscoders = release(s.audioTranscoders)
+	s.videoTranscoders = release(s.videoTranscoders)
+}
+
+// 输出流是否使用了该路原始流. 输出流可能丢弃了该路track, 或者使用的是转码流(与原始流的索引相同, 根据AVStream区分)
+func (s *PublishSource) isOriginTrack(transStream TransStream, index int) bool {
+	_, track := transStream.FindTrack(index)
+	if track == nil {
+		return false
+	}
 
 	for _, stream_ := range s.originStreams.All() {
-		if disableVideo && stream_.Type() == utils.AVMediaTypeVideo {
-			continue
+		if stream_ == track {
+			return true
 		}
+	}
+
+	return false
+}
 
-		streams[size] = stream_
-		size++
+// 转码后分发给使用转码流的输出流
+func (s *PublishSource) transcode(packet utils.AVPacket) {
+	transcoders := s.audioTranscoders
+	if utils.AVMediaTypeVideo == packet.MediaType() {
+		transcoders = s.videoTranscoders
 	}
 
-	transStreamId := GenerateTransStreamID(sink.GetProtocol(), streams[:size]...)
-	transStream, exist := s.TransStreams[transStreamId]
-	if !exist {
-		var err error
-		transStream, err = s.CreateTransStream(transStreamId, sink.GetProtocol(), streams[:size])
+	for _, transcoder := range transcoders {
+		output := transcoder.GetStream()
+		if output.Index() != packet.Index() {
+			continue
+		}
+
+		err := transcoder.Transcode(packet, func(pkt utils.AVPacket) {
+			for _, transStream := range s.TransStreams {
+				for _, track := range transStream.GetTracks() {
+					if track == output {
+						s.DispatchPacket(transStream, pkt)
+						break
+					}
+				}
+			}
+		})
+
 		if err != nil {
-			log.Sugar.Errorf("创建传输流失败 err: %s source: %s", err.Error(), s.ID)
-			return false
+			log.Sugar.Errorf("转码失败 err: %s %s->%s source: %s", err.Error(), transcoder.SrcCodecId(), transcoder.DstCodecId(), s.ID)
 		}
+	}
+}
+
+// 返回sink输出的track, 编码器与原始流不同时创建转码器, 每路track单独转码. 不支持或转码失败返回nil, 丢弃该track
+func (s *PublishSource) outputTrack(sink Sink, track utils.AVStream, codecId utils.AVCodecID) utils.AVStream {
+	if utils.AVCodecIdNONE == codecId {
+		log.Sugar.Warnf("%s不支持%s, 丢弃track: %d sink: %s", sink.GetProtocol(), track.CodecId(), track.Index(), sink.String())
+		return nil
+	} else if codecId == track.CodecId() {
+		return track
+	}
 
-		s.TransStreams[transStreamId] = transStream
+	transcoders := &s.audioTranscoders
+	if utils.AVMediaTypeVideo == track.Type() {
+		transcoders = &s.videoTranscoders
 	}
 
+	transcoder, err := s.findOrCreateTranscoder(transcoders, track, codecId)
+	if err != nil {
+		log.Sugar.Errorf("创建转码器失败 err: %s track: %d source: %s", err.Error(), track.Index(), s.ID)
+		return nil
+	}
+
+	return transcoder.GetStream()
+}
+
+// 根据sink选择的track和协商的编码器, 查找或创建输出流
+func (s *PublishSource) findOrCreateTransStream(sink Sink) (TransStream, bool, error) {
+	// 选择拉取的track, 音视频都可能存在多路
+	tracks, err := selectSinkTracks(sink, s.originStreams.All())
+	if err != nil {
+		return nil, false, err
+	}
+
+	// 根据输出协议支持的编码器协商, 不支持的track转码或丢弃
+	codecIds, err := negotiateSinkCodecs(sink, tracks)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var streams []utils.AVStream
+	for i, track := range tracks {
+		if output := s.outputTrack(sink, track, codecIds[i]); output != nil {
+			streams = append(streams, output)
+		}
+	}
+
+	if len(streams) == 0 {
+		return nil, false, fmt.Errorf("no track available for the sink")
+	}
+
+	transStreamId := GenerateTransStreamID(sink.GetProtocol(), streams...)
+	if transStream, exist := s.TransStreams[transStreamId]; exist {
+		return transStream, true, nil
+	}
+
+	transStream, err := s.CreateTransStream(transStreamId, sink.GetProtocol(), streams)
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.TransStreams[transStreamId] = transStream
+	return transStream, false, nil
+}
+
+// hls切片和m3u8以推流源ID命名, 所有hls拉流共享writeHeader时创建的输出流, 不按照url参数创建新的输出流, 否则会覆盖主播放列表和切片.
+// video=0拉取纯音频rendition, 没有开启rendition时拉取主播放列表.
+func (s *PublishSource) findHlsTransStream(sink Sink) (TransStream, error) {
+	if !sink.EnableVideo() && s.hlsAudioStream != nil {
+		return s.hlsAudioStream, nil
+	} else if s.hlsStream == nil {
+		return nil, fmt.Errorf("hls stream does not exist")
+	}
+
+	return s.hlsStream, nil
+}
+
+// 创建sink需要的输出流
+func (s *PublishSource) doAddSink(sink Sink) bool {
+	var transStream TransStream
+	var exist bool
+	var err error
+	if TransStreamHls == sink.GetProtocol() {
+		transStream, err = s.findHlsTransStream(sink)
+		exist = true
+	} else {
+		transStream, exist, err = s.findOrCreateTransStream(sink)
+	}
+
+	if err != nil {
+		log.Sugar.Errorf("拉流失败 err: %s sink: %s", err.Error(), sink.String())
+		s.releaseTranscoders()
+		return false
+	}
+
+	transStreamId := transStream.GetID()
 	sink.SetTransStreamID(transStreamId)
 
 	{
@@ -436,9 +662,10 @@ func (s *PublishSource) doAddSink(sink Sink) bool {
 		}
 	}
 
-	err := sink.StartStreaming(transStream)
+	err = sink.StartStreaming(transStream)
 	if err != nil {
 		log.Sugar.Errorf("开始推流失败 err: %s", err.Error())
+		s.releaseTranscoders()
 		return false
 	}
 
@@ -448,9 +675,8 @@ func (s *PublishSource) doAddSink(sink Sink) bool {
 	}
 
 	// TCP拉流开启异步发包, 一旦出现网络不好的链路, 其余正常链路不受影响.
-	conn, ok := sink.GetConn().(*transport.Conn)
-	if ok && sink.IsTCPStreaming() && transStream.OutStreamBufferCapacity() > 2 {
-		conn.EnableAsyncWriteMode(transStream.OutStreamBufferCapacity() - 2)
+	if sink.IsTCPStreaming() && transStream.OutStreamBufferCapacity() > 2 {
+		sink.EnableAsyncWriteMode(transStream.OutStreamBufferCapacity() - 2)
 	}
 
 	// 发送已有的缓存数据
@@ -508,6 +734,35 @@ func (s *PublishSource) RemoveSinkWithID(id SinkID) {
 	})
 }
 
+func (s *PublishSource) PauseSink(sink Sink) {
+	s.PostEvent(func() {
+		if _, ok := s.sinks[sink.GetID()]; !ok {
+			return
+		}
+
+		delete(s.TransStreamSinks[sink.GetTransStreamID()], sink.GetID())
+		log.Sugar.Infof("暂停推流 sink: %s", sink.String())
+	})
+}
+
+func (s *PublishSource) ResumeSink(sink Sink) {
+	s.PostEvent(func() {
+		if _, ok := s.sinks[sink.GetID()]; !ok {
+			return
+		}
+
+		transStreamSinks, ok := s.TransStreamSinks[sink.GetTransStreamID()]
+		if !ok {
+			return
+		}
+
+		// 重置发包计数, DispatchBuffer等到关键帧才发送
+		sink.SetSentPacketCount(0)
+		transStreamSinks[sink.GetID()] = sink
+		log.Sugar.Infof("恢复推流 sink: %s", sink.String())
+	})
+}
+
 func (s *PublishSource) FindSink(id SinkID) Sink {
 	var result Sink
 	group := sync.WaitGroup{}
@@ -527,6 +782,15 @@ func (s *PublishSource) FindSink(id SinkID) Sink {
 }
 
 func (s *PublishSource) doRemoveSink(sink Sink) bool {
+	// 重连等待期间断开的sink, 接管输出流后再删除
+	added, ok := s.sinks[sink.GetID()]
+	if !ok {
+		return false
+	}
+
+	// BaseSink.Close传入的是BaseSink, 使用添加时的sink, 执行具体协议的StopStreaming
+	sink = added
+
 	transStreamSinks := s.TransStreamSinks[sink.GetTransStreamID()]
 	delete(s.sinks, sink.GetID())
 	delete(transStreamSinks, sink.GetID())
@@ -541,7 +805,14 @@ func (s *PublishSource) doRemoveSink(sink Sink) bool {
 		SinkManager.Remove(sink.GetID())
 	}
 
-	sink.StopStreaming(s.TransStreams[sink.GetTransStreamID()])
+	// 重新创建输出流失败的sink, 输出流可能不存在
+	if transStream, ok := s.TransStreams[sink.GetTransStreamID()]; ok {
+		sink.StopStreaming(transStream)
+	}
+
+	// 最后一个拉取转码流的sink断开, 释放转码器
+	s.releaseTranscoders()
+
 	HookPlayDoneEvent(sink)
 	return true
 }
@@ -583,13 +854,12 @@ func (s *PublishSource) DoClose() {
 		s.probeTimer.Stop()
 	}
 
-	// 关闭录制流
-	if s.recordSink != nil {
-		s.recordSink.Close()
+	// 推流链路断开, 保留输出流、录制流和转码器, 等待重新推流
+	waitReconnect := s.completed && (s.replaced.Load() || s.reconnectable && AppConfig.ReconnectTimeout > 0)
+	if !waitReconnect {
+		s.closeRecordAndTranscoders()
 	}
 
-	// 释放解复用器
-	// 释放转码器
 	// 释放每路转协议流， 将所有sink添加到等待队列
 	_, err := SourceManager.Remove(s.ID)
 	if err != nil {
@@ -598,6 +868,55 @@ func (s *PublishSource) DoClose() {
 		return
 	}
 
+	if waitReconnect {
+		s.waitReconnect()
+
+		if s.Conn != nil {
+			go s.Conn.Close()
+		}
+		return
+	}
+
+	s.closeOutputs()
+
+	// 异步hook
+	go func() {
+		if s.Conn != nil {
+			s.Conn.Close()
+			s.Conn = nil
+		}
+
+		s.hookPublishDone()
+	}()
+}
+
+// 关闭录制流和转码器
+func (s *PublishSource) closeRecordAndTranscoders() {
+	// 关闭录制流
+	if s.recordSink != nil {
+		s.recordSink.Close()
+	}
+
+	// 释放解复用器
+	// 释放转码器
+	for _, transcoder := range s.audioTranscoders {
+		transcoder.Close()
+	}
+
+	for _, transcoder := range s.videoTranscoders {
+		transcoder.Close()
+	}
+
+	s.audioTranscoders = nil
+	s.videoTranscoders = nil
+}
+
+// 关闭所有输出流, 将所有sink添加到等待队列
+func (s *PublishSource) closeOutputs() {
+	for _, listener := range sourceListeners {
+		listener.OnSourceClosed(s.ID)
+	}
+
 	// 关闭所有输出流
 	for _, transStream := range s.TransStreams {
 		// 发送剩余包
@@ -611,14 +930,16 @@ func (s *PublishSource) DoClose() {
 	for _, sink := range s.sinks {
 		transStreamID := sink.GetTransStreamID()
 		sink.SetTransStreamID(0)
+		// 录制流单独关闭, 跳过后继续处理其余sink
 		if s.recordSink == sink {
-			return
+			continue
 		}
 
+		var closed bool
 		{
 			sink.Lock()
 
-			if SessionStateClosed == sink.GetState() {
+			if closed = SessionStateClosed == sink.GetState(); closed {
 				log.Sugar.Warnf("添加到sink到等待队列失败, sink已经断开连接 %s", sink.String())
 			} else {
 				sink.SetState(SessionStateWaiting)
@@ -628,31 +949,46 @@ func (s *PublishSource) DoClose() {
 			sink.UnLock()
 		}
 
-		if SessionStateClosed != sink.GetState() {
-			sink.StopStreaming(s.TransStreams[transStreamID])
+		sink.StopStreaming(s.TransStreams[transStreamID])
+
+		// 已经断开但还未从source删除的sink(删除事件未执行, source已经关闭), 在此通知拉流结束
+		if closed {
+			if sink.GetProtocol() == TransStreamHls {
+				SinkManager.Remove(sink.GetID())
+			}
+
+			go HookPlayDoneEvent(sink)
 		}
 	}
 
 	s.TransStreams = nil
 	s.sinks = nil
 	s.TransStreamSinks = nil
+}
 
-	// 异步hook
-	go func() {
-		if s.Conn != nil {
-			s.Conn.Close()
-			s.Conn = nil
-		}
-
-		HookPublishDoneEvent(s)
+// 通知推流结束和录制完成
+func (s *PublishSource) hookPublishDone() {
+	HookPublishDoneEvent(s)
 
-		if s.recordSink != nil {
-			HookRecordEvent(s, s.recordFilePath)
-		}
-	}()
+	if s.recordSink != nil {
+		HookRecordEvent(s, s.recordFilePath)
+	}
 }
 
 func (s *PublishSource) Close() {
+	s.close(false)
+}
+
+// Disconnect 推流链路断开. 开启了重连等待(reconnect_timeout)时, 保留输出流和sink, 同一路流重新推流后继续输出; 否则同Close
+func (s *PublishSource) Disconnect() {
+	s.close(true)
+}
+
+func (s *PublishSource) SetReplaced() {
+	s.replaced.Store(true)
+}
+
+func (s *PublishSource) close(reconnectable bool) {
 	if s.closed.Load() {
 		return
 	}
@@ -662,6 +998,7 @@ func (s *PublishSource) Close() {
 	group.Add(1)
 
 	s.PostEvent(func() {
+		s.reconnectable = reconnectable
 		s.DoClose()
 
 		group.Done()
@@ -675,8 +1012,12 @@ func (s *PublishSource) OnDiscardPacket(packet utils.AVPacket) {
 }
 
 func (s *PublishSource) OnDeMuxStream(stream utils.AVStream) {
-	if s.completed {
-		log.Sugar.Warnf("添加Stream失败 Source: %s已经WriteHeader", s.ID)
+	// 已经存在的track, 编码参数可能发生了变化
+	if !s.NotTrackAdded(stream.Index()) {
+		s.updateStream(stream)
+		return
+	} else if s.completed {
+		s.addLateTrack(stream)
 		return
 	}
 
@@ -704,6 +1045,220 @@ func (s *PublishSource) OnDeMuxStream(stream utils.AVStream) {
 	}
 }
 
+// 推流中途编码参数发生变化(例如分辨率改变、重新发送了不同的sps/pps), 替换AVStream, 通知输出流重新生成封装头
+func (s *PublishSource) updateStream(stream utils.AVStream) {
+	var old utils.AVStream
+	for _, stream_ := range s.originStreams.All() {
+		if stream_.Index() == stream.Index() {
+			old = stream_
+			break
+		}
+	}
+
+	if old.CodecId() != stream.CodecId() {
+		log.Sugar.Errorf("不支持推流中途更换编码器 %s->%s track: %d source: %s", old.CodecId(), stream.CodecId(), stream.Index(), s.ID)
+		return
+	} else if bytes.Equal(old.Extra(), stream.Extra()) {
+		return
+	}
+
+	log.Sugar.Infof("编码参数发生变化 track: %d codec: %s source: %s", stream.Index(), stream.CodecId(), s.ID)
+
+	// 替换前查找使用该路原始流的输出流, 替换后无法再根据AVStream区分
+	var transStreams []TransStream
+	for _, transStream := range s.TransStreams {
+		if s.isOriginTrack(transStream, stream.Index()) {
+			transStreams = append(transStreams, transStream)
+		}
+	}
+
+	s.originStreams.Replace(stream)
+	s.allStreams.Replace(stream)
+
+	// GOP缓存的是旧编码参数的帧, 不再发送给新的sink
+	if s.gopBuffer != nil {
+		s.gopBuffer.Clear()
+	}
+
+	for _, transStream := range transStreams {
+		data, timestamp, err := transStream.UpdateTrack(stream)
+		if err != nil {
+			log.Sugar.Errorf("更新输出流track失败 err: %s source: %s", err.Error(), s.ID)
+			continue
+		}
+
+		// 向已经在拉流的sink发送新的封装头
+		if len(data) > 0 {
+			index, _ := transStream.FindTrack(stream.Index())
+			s.DispatchBuffer(transStream, index, data, timestamp, false)
+		}
+	}
+}
+
+// 超过probe_timeout才到达的track(例如国标和1078设备的音频晚于视频数秒到达), 添加到已经创建的输出流
+func (s *PublishSource) addLateTrack(stream utils.AVStream) {
+	log.Sugar.Infof("添加超时到达的track: %d codec: %s source: %s", stream.Index(), stream.CodecId(), s.ID)
+
+	s.originStreams.Add(stream)
+	s.allStreams.Add(stream)
+
+	if utils.AVMediaTypeVideo == stream.Type() && !s.existVideo {
+		s.existVideo = true
+		if AppConfig.GOPCache && s.gopBuffer == nil {
+			s.gopBuffer = NewStreamBuffer()
+			s.gopBuffer.SetDiscardHandler(s.OnDiscardPacket)
+		}
+	}
+
+	// 遍历过程中会修改TransStreams, 先复制
+	transStreams := make([]TransStream, 0, len(s.TransStreams))
+	for _, transStream := range s.TransStreams {
+		transStreams = append(transStreams, transStream)
+	}
+
+	for _, transStream := range transStreams {
+		s.appendTrack(transStream, stream)
+	}
+}
+
+// 查找sink输出的新track, sink不拉取该track返回nil
+func (s *PublishSource) findLateTrack(sink Sink, stream utils.AVStream) utils.AVStream {
+	tracks, err := selectSinkTracks(sink, s.originStreams.All())
+	if err != nil {
+		return nil
+	}
+
+	codecIds, err := negotiateSinkCodecs(sink, tracks)
+	if err != nil {
+		return nil
+	}
+
+	for i, track := range tracks {
+		if track == stream {
+			return s.outputTrack(sink, track, codecIds[i])
+		}
+	}
+
+	return nil
+}
+
+// 向输出流添加新track. 所有sink都拉取该track并且协议支持时, 直接添加并刷新封装头;
+// 否则ts流的sink重新创建输出流, 其余协议(rtsp/rtc在信令中协商了track, flv/rtmp/fmp4不能重复发送文件头)断开拉取该track的sink
+func (s *PublishSource) appendTrack(transStream TransStream, stream utils.AVStream) {
+	id := transStream.GetID()
+	sinks := s.TransStreamSinks[id]
+
+	var track utils.AVStream
+	var accepted []Sink
+	sameTrack := true
+	if TransStreamHls == id.Protocol() {
+		// hls输出流由推流源创建, 所有hls sink共享, 按照创建规则添加. 纯音频rendition只添加音频
+		if !IsSupportCodec(TransStreamHls, stream.CodecId()) || (transStream != s.hlsStream && utils.AVMediaTypeAudio != stream.Type()) {
+			return
+		}
+
+		track = stream
+	} else {
+		for _, sink := range sinks {
+			output := s.findLateTrack(sink, stream)
+			if output == nil {
+				continue
+			} else if track != nil && track != output {
+				sameTrack = false
+			}
+
+			track = output
+			accepted = append(accepted, sink)
+		}
+
+		if len(accepted) == 0 {
+			return
+		}
+	}
+
+	if (TransStreamHls == id.Protocol() || len(accepted) == len(sinks)) && sameTrack {
+		data, timestamp, err := transStream.AppendTrack(track)
+		if err == nil {
+			s.updateTransStreamID(transStream)
+
+			if len(data) > 0 {
+				index, _ := transStream.FindTrack(track.Index())
+				s.DispatchBuffer(transStream, index, data, timestamp, false)
+			}
+
+			return
+		} else if err != ErrAppendTrackNotSupported {
+			log.Sugar.Errorf("输出流添加track失败 err: %s track: %d source: %s", err.Error(), track.Index(), s.ID)
+			return
+		}
+	}
+
+	if TransStreamTs == id.Protocol() {
+		for _, sink := range accepted {
+			s.reattachSink(sink, transStream)
+		}
+
+		return
+	}
+
+	// rtsp/rtc已经在信令中协商了track, flv/rtmp/fmp4不能重复发送文件头, 断开拉取该track的sink, 拉流端重连后拉取全部track
+	log.Sugar.Warnf("%s输出流不支持添加track, 断开拉取该track的sink track: %d source: %s", id.Protocol(), stream.Index(), s.ID)
+	for _, sink := range accepted {
+		sink.Close()
+	}
+}
+
+// 输出流添加track后, 按照新的track重新生成输出流ID, 新的sink可以复用该输出流
+func (s *PublishSource) updateTransStreamID(transStream TransStream) {
+	oldId := transStream.GetID()
+	id := GenerateTransStreamID(oldId.Protocol(), transStream.GetTracks()...)
+
+	s.TransStreams[id] = transStream
+	s.TransStreamSinks[id] = s.TransStreamSinks[oldId]
+	delete(s.TransStreams, oldId)
+	delete(s.TransStreamSinks, oldId)
+	transStream.SetID(id)
+
+	// 包括暂停推流的sink
+	for _, sink := range s.sinks {
+		if sink.GetTransStreamID() == oldId {
+			sink.SetTransStreamID(id)
+		}
+	}
+}
+
+// 将sink从原输出流移除, 重新查找或创建包含新track的输出流. 发包计数清零, 等到关键帧从新的封装头开始发送
+func (s *PublishSource) reattachSink(sink Sink, transStream TransStream) {
+	id := transStream.GetID()
+	delete(s.TransStreamSinks[id], sink.GetID())
+	delete(s.sinks, sink.GetID())
+	if s.recordSink != sink {
+		s.sinkCount--
+	}
+
+	sink.StopStreaming(transStream)
+
+	// 原输出流的track已经过时, 新的sink不会再复用, 最后一个sink离开后释放
+	if len(s.TransStreamSinks[id]) == 0 && transStream != s.hlsStream {
+		transStream.Close()
+		delete(s.TransStreams, id)
+		delete(s.TransStreamSinks, id)
+	}
+
+	sink.SetSentPacketCount(0)
+	if s.doAddSink(sink) {
+		return
+	}
+
+	// 恢复计数, 由doRemoveSink统一删除
+	s.sinks[sink.GetID()] = sink
+	if s.recordSink != sink {
+		s.sinkCount++
+	}
+
+	sink.Close()
+}
+
 // 解析完所有track后, 创建各种输出流
 func (s *PublishSource) writeHeader() {
 	if s.completed {
@@ -722,12 +1277,21 @@ func (s *PublishSource) writeHeader() {
 		return
 	}
 
-	// 创建录制流和HLS
-	s.CreateDefaultOutStreams()
+	// 断开重连, 接管上一次推流的输出流. 否则创建录制流和HLS
+	var resumed bool
+	if old := takeReconnectSource(s.ID); old != nil {
+		if resumed = s.resume(old); !resumed {
+			old.expire()
+		}
+	}
+
+	if !resumed {
+		s.CreateDefaultOutStreams()
+	}
 
 	// 将等待队列的sink添加到输出流队列
 	sinks := PopWaitingSinks(s.ID)
-	if s.recordSink != nil {
+	if s.recordSink != nil && !resumed {
 		sinks = append(sinks, s.recordSink)
 	}
 
@@ -736,6 +1300,10 @@ func (s *PublishSource) writeHeader() {
 			sink.Close()
 		}
 	}
+
+	for _, listener := range sourceListeners {
+		listener.OnSourceReady(s.ID)
+	}
 }
 
 func (s *PublishSource) IsCompleted() bool {
@@ -752,34 +1320,35 @@ func (s *PublishSource) NotTrackAdded(index int) bool {
 	return true
 }
 
-func (s *PublishSource) IsTimeoutTrack(index int) bool {
-	for _, i := range s.timeoutTracks {
-		if i == index {
-			return true
-		}
-	}
-
-	return false
-}
-
-func (s *PublishSource) SetTimeoutTrack(index int) {
-	s.timeoutTracks = append(s.timeoutTracks, index)
-}
-
 func (s *PublishSource) OnDeMuxStreamDone() {
 	s.writeHeader()
 }
 
 func (s *PublishSource) OnDeMuxPacket(packet utils.AVPacket) {
+	s.continueTimestamp(packet)
+
+	if len(s.packetListeners) > 0 {
+		s.notifyPacketListeners(packet)
+	}
+
+	// 拉流端订阅了元数据, 提取视频帧中的SEI
+	if utils.AVMediaTypeVideo == packet.MediaType() && HasMetadataSubscriber(s.ID) {
+		s.publishVideoMetadata(packet)
+	}
+
 	if AppConfig.GOPCache && s.existVideo {
 		s.gopBuffer.AddPacket(packet)
 	}
 
-	// 分发给各个传输流
+	// 分发给各个传输流, 使用转码流的输出流由转码器分发
 	for _, transStream := range s.TransStreams {
-		s.DispatchPacket(transStream, packet)
+		if s.isOriginTrack(transStream, packet.Index()) {
+			s.DispatchPacket(transStream, packet)
+		}
 	}
 
+	s.transcode(packet)
+
 	// 未开启GOP缓存或只存在音频流, 释放掉内存
 	if !AppConfig.GOPCache || !s.existVideo {
 		s.FindOrCreatePacketBuffer(packet.Index(), packet.MediaType()).FreeTail()
@@ -854,3 +1423,33 @@ func (s *PublishSource) Sinks() []Sink {
 func (s *PublishSource) GetBitrateStatistics() *BitrateStatistics {
 	return s.statistics
 }
+
+func (s *PublishSource) AddPacketListener(listener PacketListener) {
+	s.packetListeners = append(s.packetListeners, listener)
+}
+
+func (s *PublishSource) RemovePacketListener(listener PacketListener) {
+	// 可能在notifyPacketListeners遍历时调用, 创建新的切片, 不修改正在遍历的切片
+	listeners := make([]PacketListener, 0, len(s.packetListeners))
+	for _, l := range s.packetListeners {
+		if l != listener {
+			listeners = append(listeners, l)
+		}
+	}
+
+	s.packetListeners = listeners
+}
+
+func (s *PublishSource) notifyPacketListeners(packet utils.AVPacket) {
+	for _, avStream := range s.originStreams.All() {
+		if avStream.Index() != packet.Index() {
+			continue
+		}
+
+		for _, listener := range s.packetListeners {
+			listener.OnPacket(s, avStream, packet)
+		}
+
+		break
+	}
+}
@@ -0,0 +1,20 @@
+package stream
+
+// SourceListener 监听Source的生命周期, 例如启动外部转码进程.
+// 回调在Source的事件协程中执行, 不能阻塞, 也不能同步调用Source的AddSink/RemoveSink等需要等待事件协程处理的函数.
+type SourceListener interface {
+	// OnSourceReady Source解析完所有track, 已经可以拉流
+	OnSourceReady(sourceId string)
+
+	// OnSourceClosed Source已经关闭
+	OnSourceClosed(sourceId string)
+}
+
+var (
+	sourceListeners []SourceListener
+)
+
+// AddSourceListener 添加Source生命周期监听, 只允许在启动时调用
+func AddSourceListener(listener SourceListener) {
+	sourceListeners = append(sourceListeners, listener)
+}
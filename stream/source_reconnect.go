@@ -0,0 +1,259 @@
+package stream
+
+import (
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/log"
+	"sync"
+	"time"
+)
+
+var (
+	// 推流断开后等待重连的source, 保留输出流和sink
+	reconnectSources     = make(map[string]*reconnectSource, 64)
+	reconnectSourcesLock sync.Mutex
+)
+
+type reconnectSource struct {
+	source *PublishSource
+	timer  *time.Timer
+	done   chan struct{} // 关闭后, 等待重连期间的事件协程退出
+}
+
+// 等待重连期间, 继续在source的事件协程中处理sink断开等事件
+func (r *reconnectSource) loop() {
+	for {
+		select {
+		case event := <-r.source.mainContextEvents:
+			event()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// 在事件协程中执行cb后结束事件协程, 等待执行完毕. 此前投递的事件都已经处理
+func (r *reconnectSource) stop(cb func()) {
+	group := sync.WaitGroup{}
+	group.Add(1)
+
+	r.source.PostEvent(func() {
+		if cb != nil {
+			cb()
+		}
+
+		close(r.done)
+		group.Done()
+	})
+
+	group.Wait()
+}
+
+// 每路track的时间戳
+type trackTimestamp struct {
+	first    int64 // 本次推流的第一帧dts
+	dts      int64 // 最近一帧的dts
+	duration int64 // 最近两帧的dts间隔
+	offset   int64 // 重连后的时间戳偏移量
+}
+
+// 推流断开或被新推流替换, 保留输出流等待重连. 超时未重连, 关闭输出流, sink添加到等待队列
+func (s *PublishSource) waitReconnect() {
+	timeout := time.Duration(AppConfig.ReconnectTimeout)
+	if s.replaced.Load() {
+		timeout = time.Duration(AppConfig.PublishConflict.Timeout) * time.Millisecond
+	}
+
+	log.Sugar.Infof("推流断开, 等待重连 timeout: %s source: %s", timeout, s.ID)
+
+	reconnect := &reconnectSource{source: s, done: make(chan struct{})}
+	reconnectSourcesLock.Lock()
+	defer reconnectSourcesLock.Unlock()
+
+	reconnectSources[s.ID] = reconnect
+	go reconnect.loop()
+
+	reconnect.timer = time.AfterFunc(timeout, func() {
+		// 释放完成前持有锁, 同一路流重新推流时, 在writeHeader中等待sink全部添加到等待队列
+		reconnectSourcesLock.Lock()
+		defer reconnectSourcesLock.Unlock()
+
+		if reconnectSources[s.ID] != reconnect {
+			return
+		}
+
+		delete(reconnectSources, s.ID)
+		log.Sugar.Infof("等待重连超时 source: %s", s.ID)
+		reconnect.stop(s.expire)
+	})
+}
+
+// 查找等待重连的source, 等待期间断开的sink从该source删除
+func findReconnectSource(id string) *PublishSource {
+	reconnectSourcesLock.Lock()
+	defer reconnectSourcesLock.Unlock()
+
+	if reconnect, ok := reconnectSources[id]; ok {
+		return reconnect.source
+	}
+
+	return nil
+}
+
+// 取出等待重连的source
+func takeReconnectSource(id string) *PublishSource {
+	reconnectSourcesLock.Lock()
+	defer reconnectSourcesLock.Unlock()
+
+	reconnect, ok := reconnectSources[id]
+	if !ok {
+		return nil
+	}
+
+	reconnect.timer.Stop()
+	delete(reconnectSources, id)
+	// 结束等待期间的事件协程, 由新推流接管
+	reconnect.stop(nil)
+	return reconnect.source
+}
+
+// 重连等待结束, 关闭保留的输出流、录制流和转码器
+func (s *PublishSource) expire() {
+	s.closeRecordAndTranscoders()
+	s.closeOutputs()
+
+	go s.hookPublishDone()
+}
+
+// 重新推流的track是否与上一次推流一致. 索引、类型和编码器都相同才能继续使用原来的输出流
+func (s *PublishSource) isSameTracks(old *PublishSource) bool {
+	streams := s.originStreams.All()
+	if len(streams) != len(old.originStreams.All()) {
+		return false
+	}
+
+	for _, avStream := range streams {
+		if old.findOriginStream(avStream.Index(), avStream.Type(), avStream.CodecId()) == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *PublishSource) findOriginStream(index int, mediaType utils.AVMediaType, codecId utils.AVCodecID) utils.AVStream {
+	for _, avStream := range s.originStreams.All() {
+		if avStream.Index() == index && avStream.Type() == mediaType && avStream.CodecId() == codecId {
+			return avStream
+		}
+	}
+
+	return nil
+}
+
+// 接管上一次推流的输出流、sink、录制流和转码器, 已有的sink不中断拉流. track不一致返回false
+func (s *PublishSource) resume(old *PublishSource) bool {
+	if !s.isSameTracks(old) {
+		log.Sugar.Warnf("重新推流的track与上一次推流不一致, 重新创建输出流 source: %s", s.ID)
+		return false
+	}
+
+	log.Sugar.Infof("推流重连成功, 继续使用原输出流 sink count: %d source: %s", old.sinkCount, s.ID)
+
+	s.TransStreams = old.TransStreams
+	s.TransStreamSinks = old.TransStreamSinks
+	s.sinks = old.sinks
+	s.sinkCount = old.sinkCount
+	s.hlsStream = old.hlsStream
+	s.hlsAudioStream = old.hlsAudioStream
+	s.recordSink = old.recordSink
+	s.recordFilePath = old.recordFilePath
+	s.audioTranscoders = old.audioTranscoders
+	s.videoTranscoders = old.videoTranscoders
+	for _, transcoder := range s.audioTranscoders {
+		s.allStreams.Add(transcoder.GetStream())
+	}
+
+	for _, transcoder := range s.videoTranscoders {
+		s.allStreams.Add(transcoder.GetStream())
+	}
+
+	// 新推流的时间戳延续上一次推流, 已经缓存的包同样偏移
+	s.previousTimestamps = old.timestamps
+	for index, timestamp := range s.timestamps {
+		if previous, ok := s.previousTimestamps[index]; ok {
+			timestamp.offset = previous.dts + previous.duration - timestamp.first
+			timestamp.dts += timestamp.offset
+		}
+	}
+
+	if s.gopBuffer != nil {
+		s.gopBuffer.PeekAll(func(packet utils.AVPacket) {
+			if timestamp, ok := s.timestamps[packet.Index()]; ok && timestamp.offset != 0 {
+				packet.SetDts(packet.Dts() + timestamp.offset)
+				packet.SetPts(packet.Pts() + timestamp.offset)
+			}
+		})
+	}
+
+	// 输出流使用新的AVStream, 重新生成封装头. hls切片声明不连续
+	for _, avStream := range s.originStreams.All() {
+		previous := old.findOriginStream(avStream.Index(), avStream.Type(), avStream.CodecId())
+		for _, transStream := range s.TransStreams {
+			if _, track := transStream.FindTrack(avStream.Index()); track != previous {
+				continue
+			}
+
+			data, timestamp, err := transStream.UpdateTrack(avStream)
+			if err != nil {
+				log.Sugar.Errorf("更新输出流track失败 err: %s source: %s", err.Error(), s.ID)
+				continue
+			}
+
+			if len(data) > 0 {
+				index, _ := transStream.FindTrack(avStream.Index())
+				s.DispatchBuffer(transStream, index, data, timestamp, false)
+			}
+		}
+	}
+
+	// 删除等待期间断开的sink
+	for _, sink := range s.sinks {
+		if SessionStateClosed == sink.GetState() {
+			s.doRemoveSink(sink)
+		}
+	}
+
+	// 发送探测track期间缓存的包, 已有的sink不丢失这部分数据
+	if s.gopBuffer != nil {
+		for _, transStream := range s.TransStreams {
+			s.DispatchGOPBuffer(transStream)
+		}
+	}
+
+	return true
+}
+
+// 记录每路track的时间戳. 断开重连后, 新推流的时间戳从上一次推流的末尾延续, 保持单调递增
+func (s *PublishSource) continueTimestamp(packet utils.AVPacket) {
+	timestamp, ok := s.timestamps[packet.Index()]
+	if !ok {
+		timestamp = &trackTimestamp{first: packet.Dts(), dts: packet.Dts()}
+		if previous, ok := s.previousTimestamps[packet.Index()]; ok {
+			timestamp.offset = previous.dts + previous.duration - packet.Dts()
+			timestamp.dts += timestamp.offset
+		}
+
+		s.timestamps[packet.Index()] = timestamp
+	}
+
+	if timestamp.offset != 0 {
+		packet.SetDts(packet.Dts() + timestamp.offset)
+		packet.SetPts(packet.Pts() + timestamp.offset)
+	}
+
+	if packet.Dts() > timestamp.dts {
+		timestamp.duration = packet.Dts() - timestamp.dts
+	}
+
+	timestamp.dts = packet.Dts()
+}
@@ -0,0 +1,112 @@
+package stream
+
+import (
+	"github.com/lkmio/avformat/utils"
+	"testing"
+	"time"
+)
+
+func TestContinueTimestamp(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous map[int]*trackTimestamp
+		index    int
+		dts      []int64
+		expected []int64
+	}{
+		{"first publish", nil, 0, []int64{0, 40, 80}, []int64{0, 40, 80}},
+		{"continue from previous", map[int]*trackTimestamp{0: {dts: 1000, duration: 40}}, 0, []int64{0, 40}, []int64{1040, 1080}},
+		{"new publish starts late", map[int]*trackTimestamp{0: {dts: 1000, duration: 40}}, 0, []int64{5000, 5040}, []int64{1040, 1080}},
+		{"track not in previous", map[int]*trackTimestamp{1: {dts: 1000, duration: 40}}, 0, []int64{0, 40}, []int64{0, 40}},
+		{"repeated timestamp", nil, 0, []int64{0, 40, 40, 80}, []int64{0, 40, 40, 80}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := &PublishSource{timestamps: make(map[int]*trackTimestamp, 4), previousTimestamps: test.previous}
+			for i, dts := range test.dts {
+				packet := utils.NewAudioPacket(nil, dts, dts+10, utils.AVCodecIdAAC, test.index, 1000)
+				source.continueTimestamp(packet)
+				if packet.Dts() != test.expected[i] || packet.Pts() != test.expected[i]+10 {
+					t.Fatalf("packet %d: dts %d pts %d, expected dts %d", i, packet.Dts(), packet.Pts(), test.expected[i])
+				}
+			}
+		})
+	}
+
+	// 相同的时间戳不覆盖帧间隔, 重连时使用最近一次有效的间隔
+	source := &PublishSource{timestamps: make(map[int]*trackTimestamp, 4)}
+	for _, dts := range []int64{0, 40, 40} {
+		source.continueTimestamp(utils.NewAudioPacket(nil, dts, dts, utils.AVCodecIdAAC, 0, 1000))
+	}
+
+	if timestamp := source.timestamps[0]; timestamp.dts != 40 || timestamp.duration != 40 {
+		t.Fatalf("dts %d duration %d", timestamp.dts, timestamp.duration)
+	}
+}
+
+// 等待重连期间断开的sink立即从source删除, 超时后其余sink添加到等待队列
+func TestReconnectTimeout(t *testing.T) {
+	config := AppConfig
+	defer func() {
+		AppConfig = config
+	}()
+
+	AppConfig.ReconnectTimeout = int64(100 * time.Millisecond)
+
+	video := utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, nil, nil)
+	source := newTestSource(video)
+	if err := SourceManager.Add(source); err != nil {
+		t.Fatal(err)
+	}
+
+	closing := newTestSink(SinkID(uint64(1)), TransStreamTs, nil)
+	waiting := newTestSink(SinkID(uint64(2)), TransStreamTs, nil)
+	for _, sink := range []*testSink{closing, waiting} {
+		if !source.doAddSink(sink) {
+			t.Fatal("failed to add sink")
+		}
+	}
+
+	transStream := source.TransStreams[waiting.GetTransStreamID()].(*testTransStream)
+	source.reconnectable = true
+	source.DoClose()
+
+	if findReconnectSource(source.ID) != source {
+		t.Fatal("source not waiting for reconnection")
+	}
+
+	closing.Close()
+
+	// 等待删除事件执行完毕
+	done := make(chan struct{})
+	source.PostEvent(func() {
+		close(done)
+	})
+	<-done
+
+	if _, ok := source.sinks[closing.GetID()]; ok || closing.stopped != 1 {
+		t.Fatal("sink closed during the grace window not removed")
+	} else if source.sinkCount != 1 {
+		t.Fatalf("sink count %d", source.sinkCount)
+	}
+
+	// 超时后释放输出流, 释放完成前findReconnectSource阻塞
+	deadline := time.Now().Add(2 * time.Second)
+	for findReconnectSource(source.ID) != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if findReconnectSource(source.ID) != nil {
+		t.Fatal("grace window not expired")
+	} else if !transStream.closed || source.TransStreams != nil {
+		t.Fatal("outputs not closed")
+	} else if SessionStateWaiting != waiting.GetState() || waiting.stopped != 1 {
+		t.Fatal("sink not moved to the waiting queue")
+	}
+
+	sinks := PopWaitingSinks(source.ID)
+	if len(sinks) != 1 || sinks[0] != Sink(waiting) {
+		t.Fatalf("waiting sinks %v", sinks)
+	}
+}
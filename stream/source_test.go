@@ -0,0 +1,413 @@
+package stream
+
+import (
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/lkm/log"
+	"go.uber.org/zap/zapcore"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// 测试使用的输出流, 记录更新的track和关闭状态
+type testTransStream struct {
+	BaseTransStream
+	updated []utils.AVStream
+	closed  bool
+}
+
+// UpdateTrack 返回新的封装头, 由source发送给已有的sink
+func (t *testTransStream) UpdateTrack(stream utils.AVStream) ([][]byte, int64, error) {
+	if _, _, err := t.BaseTransStream.UpdateTrack(stream); err != nil {
+		return nil, -1, err
+	}
+
+	t.updated = append(t.updated, stream)
+	return [][]byte{stream.Extra()}, 0, nil
+}
+
+func (t *testTransStream) Close() ([][]byte, int64, error) {
+	t.closed = true
+	return nil, 0, nil
+}
+
+// 测试使用的sink, 记录收到的数据和停止推流的次数
+type testSink struct {
+	BaseSink
+	data    [][]byte
+	stopped int // StopStreaming调用次数
+}
+
+func (s *testSink) Write(index int, data [][]byte, ts int64) error {
+	s.data = append(s.data, data...)
+	return nil
+}
+
+func (s *testSink) StopStreaming(stream TransStream) {
+	s.stopped++
+}
+
+func newTestSink(id SinkID, protocol TransStreamProtocol, values url.Values) *testSink {
+	sink := &testSink{BaseSink: BaseSink{ID: id, SourceID: "live/test", Protocol: protocol}}
+	sink.SetUrlValues(values)
+	return sink
+}
+
+// 创建已经解析完track的推流源
+func newTestSource(streams ...utils.AVStream) *PublishSource {
+	source := &PublishSource{ID: "live/test", Type: SourceTypeRtmp}
+	source.Init(64)
+	source.gopBuffer = NewStreamBuffer()
+	source.completed = true
+
+	for _, avStream := range streams {
+		source.originStreams.Add(avStream)
+		source.allStreams.Add(avStream)
+		source.existVideo = source.existVideo || utils.AVMediaTypeVideo == avStream.Type()
+	}
+
+	return source
+}
+
+func init() {
+	for _, protocol := range []TransStreamProtocol{TransStreamRtmp, TransStreamFlv, TransStreamRtsp, TransStreamHls, TransStreamTs} {
+		RegisterTransStreamFactory(protocol, func(source Source, protocol TransStreamProtocol, streams []utils.AVStream) (TransStream, error) {
+			return &testTransStream{BaseTransStream: BaseTransStream{Protocol: protocol}}, nil
+		})
+	}
+}
+
+func TestMain(m *testing.M) {
+	log.InitLogger(false, zapcore.ErrorLevel, "", 0, 0, 0, false)
+	os.Exit(m.Run())
+}
+
+// hls拉流共享推流时创建的输出流, url参数不能创建新的hls输出流覆盖主播放列表
+func TestHlsSinkSharesDefaultStream(t *testing.T) {
+	config := AppConfig
+	defer func() {
+		AppConfig = config
+	}()
+
+	AppConfig.Hls.Enable = true
+	AppConfig.Hls.AudioRendition = true
+
+	video := utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, nil, nil)
+	audio := utils.NewAVStream(utils.AVMediaTypeAudio, 1, utils.AVCodecIdAAC, nil, nil)
+	source := newTestSource(video, audio)
+	source.CreateDefaultOutStreams()
+
+	if source.hlsStream == nil || source.hlsAudioStream == nil {
+		t.Fatal("default hls streams not created")
+	}
+
+	count := len(source.TransStreams)
+	tests := []struct {
+		name     string
+		query    string
+		expected TransStream
+	}{
+		{"default", "", source.hlsStream},
+		{"audio=1", "audio=1", source.hlsStream},
+		{"audio rendition", "video=0", source.hlsAudioStream},
+		// 无法对共享的切片生效的参数, 拒绝拉流
+		{"audio=0", "audio=0", nil},
+		{"acodec", "acodec=mp3", nil},
+		{"atrack", "atrack=0", nil},
+		{"vcodec", "vcodec=h265", nil},
+		{"vtrack", "video=0&vtrack=0", nil},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, _ := url.ParseQuery(test.query)
+			sink := newTestSink(SinkID(uint64(i)), TransStreamHls, values)
+			if err := SetSinkTrackParams(sink, values); test.expected == nil {
+				if err == nil {
+					t.Fatal("unsupported hls parameter accepted")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			} else if !source.doAddSink(sink) {
+				t.Fatal("failed to add sink")
+			}
+
+			if source.TransStreams[sink.GetTransStreamID()] != test.expected {
+				t.Fatalf("sink bound to unexpected hls stream")
+			} else if len(source.TransStreams) != count {
+				t.Fatalf("hls stream created by sink, count: %d", len(source.TransStreams))
+			} else if len(source.audioTranscoders) > 0 || len(source.videoTranscoders) > 0 {
+				t.Fatal("transcoder created for hls sink")
+			}
+		})
+	}
+
+	// 主播放列表的输出流没有被替换或关闭
+	if source.hlsStream.(*testTransStream).closed {
+		t.Fatal("main hls stream closed")
+	}
+}
+
+// 推流中途编码参数变化, 已经在拉流的sink收到新的封装头, 使用其他track的输出流不受影响
+func TestUpdateStreamReachesSinks(t *testing.T) {
+	video := utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, []byte("old"), nil)
+	audio := utils.NewAVStream(utils.AVMediaTypeAudio, 1, utils.AVCodecIdAAC, []byte("aac"), nil)
+	source := newTestSource(video, audio)
+
+	var sinks []*testSink
+	for i, protocol := range []TransStreamProtocol{TransStreamRtmp, TransStreamTs, TransStreamRtsp} {
+		sink := newTestSink(SinkID(uint64(i)), protocol, nil)
+		if !source.doAddSink(sink) {
+			t.Fatalf("failed to add %s sink", protocol.String())
+		}
+
+		// 已经发送过关键帧
+		sink.SetSentPacketCount(1)
+		sinks = append(sinks, sink)
+	}
+
+	// 纯音频拉流
+	audioSink := newTestSink(SinkID(uint64(len(sinks))), TransStreamFlv, nil)
+	audioSink.SetEnableVideo(false)
+	if !source.doAddSink(audioSink) {
+		t.Fatal("failed to add audio sink")
+	}
+
+	audioSink.SetSentPacketCount(1)
+
+	// 相同的编码参数不更新
+	source.OnDeMuxStream(utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, []byte("old"), nil))
+	for _, sink := range sinks {
+		if len(sink.data) > 0 {
+			t.Fatal("unchanged parameters dispatched")
+		}
+	}
+
+	updated := utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, []byte("new"), nil)
+	source.OnDeMuxStream(updated)
+
+	for _, sink := range sinks {
+		transStream := source.TransStreams[sink.GetTransStreamID()].(*testTransStream)
+		if len(transStream.updated) != 1 || transStream.updated[0] != updated {
+			t.Fatalf("%s stream not updated", sink.GetProtocol().String())
+		} else if _, track := transStream.FindTrack(0); track != updated {
+			t.Fatalf("%s stream still uses the old track", sink.GetProtocol().String())
+		} else if len(sink.data) != 1 || string(sink.data[0]) != "new" {
+			t.Fatalf("%s sink received %q", sink.GetProtocol().String(), sink.data)
+		}
+	}
+
+	if len(audioSink.data) > 0 || len(source.TransStreams[audioSink.GetTransStreamID()].(*testTransStream).updated) > 0 {
+		t.Fatal("audio-only stream updated")
+	}
+
+	// 新的sink使用新的编码参数
+	for _, avStream := range source.originStreams.All() {
+		if avStream.Index() == updated.Index() && avStream != updated {
+			t.Fatal("origin stream not replaced")
+		}
+	}
+
+	// 不支持推流中途更换编码器
+	source.OnDeMuxStream(utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH265, []byte("h265"), nil))
+	for _, sink := range sinks {
+		if len(sink.data) != 1 {
+			t.Fatal("codec change dispatched")
+		}
+	}
+}
+
+// 超时到达的track: ts拉流端重新创建输出流并释放原输出流, 不能添加track的协议断开拉流端
+func TestAppendLateTrack(t *testing.T) {
+	video := utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, nil, nil)
+	source := newTestSource(video)
+
+	tsSink := newTestSink(SinkID(uint64(1)), TransStreamTs, nil)
+	rtspSink := newTestSink(SinkID(uint64(2)), TransStreamRtsp, nil)
+	// 不拉取音频, 保持原有track
+	videoSink := newTestSink(SinkID(uint64(3)), TransStreamRtsp, nil)
+	videoSink.SetEnableAudio(false)
+	for _, sink := range []*testSink{tsSink, rtspSink, videoSink} {
+		if !source.doAddSink(sink) {
+			t.Fatalf("failed to add %s sink", sink.GetProtocol().String())
+		}
+	}
+
+	oldTsStream := source.TransStreams[tsSink.GetTransStreamID()].(*testTransStream)
+	audio := utils.NewAVStream(utils.AVMediaTypeAudio, 1, utils.AVCodecIdAAC, nil, nil)
+	source.OnDeMuxStream(audio)
+
+	// ts拉流端使用包含新track的输出流
+	transStream, ok := source.TransStreams[tsSink.GetTransStreamID()]
+	if !ok || transStream.TrackCount() != 2 {
+		t.Fatal("ts sink not reattached")
+	} else if source.TransStreamSinks[tsSink.GetTransStreamID()][tsSink.GetID()] == nil {
+		t.Fatal("ts sink missing from the new stream")
+	} else if !oldTsStream.closed {
+		t.Fatal("emptied ts stream not released")
+	}
+
+	for _, transStream := range source.TransStreams {
+		if transStream == oldTsStream {
+			t.Fatal("emptied ts stream still dispatched")
+		}
+	}
+
+	if SessionStateClosed != rtspSink.GetState() {
+		t.Fatal("rtsp sink kept the old track set")
+	} else if SessionStateClosed == videoSink.GetState() {
+		t.Fatal("video-only rtsp sink closed")
+	}
+}
+
+// 关闭输出流: 跳过录制流后继续将其余sink添加到等待队列, 已经断开的sink也停止推流
+func TestCloseOutputs(t *testing.T) {
+	video := utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, nil, nil)
+	source := newTestSource(video)
+	source.ID = "live/close"
+
+	var sinks []*testSink
+	for i := 0; i < 8; i++ {
+		sink := newTestSink(SinkID(uint64(i)), TransStreamTs, nil)
+		sink.SourceID = source.ID
+		if !source.doAddSink(sink) {
+			t.Fatal("failed to add sink")
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	record, closed := sinks[0], sinks[1]
+	source.recordSink = record
+	closed.Lock()
+	closed.SetState(SessionStateClosed)
+	closed.UnLock()
+
+	source.closeOutputs()
+
+	waiting := PopWaitingSinks(source.ID)
+	if len(waiting) != len(sinks)-2 {
+		t.Fatalf("waiting sinks: %d expected: %d", len(waiting), len(sinks)-2)
+	}
+
+	for _, sink := range waiting {
+		if sink == Sink(record) || sink == Sink(closed) {
+			t.Fatalf("unexpected waiting sink %s", sink.String())
+		} else if SessionStateWaiting != sink.GetState() || sink.(*testSink).stopped != 1 {
+			t.Fatalf("sink %s not stopped", sink.String())
+		}
+	}
+
+	if record.stopped != 0 {
+		t.Fatal("record sink stopped with the outputs")
+	} else if closed.stopped != 1 {
+		t.Fatal("closed sink not stopped")
+	}
+}
+
+// 暂停推流的sink仍然拉取转码流, 其他sink断开不能释放转码器和输出流, 恢复后继续推流
+func TestPausedSinkKeepsTranscoder(t *testing.T) {
+	audio := utils.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdPCMALAW, nil, nil)
+	source := newTestSource(audio)
+
+	values, _ := url.ParseQuery("acodec=pcmu")
+	var sinks []*testSink
+	for i := 0; i < 2; i++ {
+		sink := newTestSink(SinkID(uint64(i)), TransStreamRtsp, values)
+		if err := SetSinkTrackParams(sink, values); err != nil {
+			t.Fatal(err)
+		} else if !source.doAddSink(sink) {
+			t.Fatal("failed to add sink")
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	paused, other := sinks[0], sinks[1]
+	id := paused.GetTransStreamID()
+	if len(source.audioTranscoders) != 1 || other.GetTransStreamID() != id {
+		t.Fatalf("transcoders: %d", len(source.audioTranscoders))
+	}
+
+	// 执行投递到source的事件
+	runEvent := func() {
+		(<-source.mainContextEvents)()
+	}
+
+	source.PauseSink(paused)
+	runEvent()
+	source.doRemoveSink(other)
+
+	if len(source.audioTranscoders) != 1 {
+		t.Fatal("transcoder released with a paused sink")
+	} else if _, ok := source.TransStreams[id]; !ok {
+		t.Fatal("transcoded stream closed with a paused sink")
+	}
+
+	source.ResumeSink(paused)
+	runEvent()
+
+	if _, ok := source.TransStreamSinks[id][paused.GetID()]; !ok {
+		t.Fatal("sink not resumed")
+	}
+
+	// 最后一个sink断开后释放
+	source.doRemoveSink(paused)
+	if len(source.audioTranscoders) != 0 {
+		t.Fatal("transcoder not released")
+	} else if _, ok := source.TransStreams[id]; ok {
+		t.Fatal("transcoded stream not closed")
+	}
+}
+
+// 暂停期间不发送, 恢复后等到关键帧才继续发送
+func TestPauseResumeFromKeyFrame(t *testing.T) {
+	video := utils.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, nil, nil)
+	source := newTestSource(video)
+
+	sink := newTestSink(SinkID(uint64(1)), TransStreamRtsp, nil)
+	if !source.doAddSink(sink) {
+		t.Fatal("failed to add sink")
+	}
+
+	transStream := source.TransStreams[sink.GetTransStreamID()]
+	steps := []struct {
+		event string // pause/resume, 为空时分发data
+		data  string
+		key   bool
+	}{
+		{"", "k1", true},
+		{"", "d1", false},
+		{"pause", "", false},
+		{"", "d2", false},
+		{"", "k2", true},
+		{"resume", "", false},
+		{"", "d3", false},
+		{"", "k3", true},
+		{"", "d4", false},
+	}
+
+	for _, step := range steps {
+		switch step.event {
+		case "pause":
+			source.PauseSink(sink)
+			(<-source.mainContextEvents)()
+		case "resume":
+			source.ResumeSink(sink)
+			(<-source.mainContextEvents)()
+		default:
+			source.DispatchBuffer(transStream, 0, [][]byte{[]byte(step.data)}, 0, step.key)
+		}
+	}
+
+	var received []string
+	for _, data := range sink.data {
+		received = append(received, string(data))
+	}
+
+	if expected := "k1,d1,k3,d4"; strings.Join(received, ",") != expected {
+		t.Fatalf("received: %v, expected: %s", received, expected)
+	}
+}
@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"github.com/lkmio/avformat/libavc"
@@ -23,9 +24,10 @@ type TransStreamProtocol uint32
 type SessionState uint32
 
 const (
-	SourceTypeRtmp  = SourceType(1)
-	SourceType28181 = SourceType(2)
-	SourceType1078  = SourceType(3)
+	SourceTypeRtmp     = SourceType(1)
+	SourceType28181    = SourceType(2)
+	SourceType1078     = SourceType(3)
+	SourceTypeFailover = SourceType(4) // 跟随主备源的虚拟源
 
 	TransStreamRtmp            = TransStreamProtocol(1)
 	TransStreamFlv             = TransStreamProtocol(2)
@@ -33,6 +35,8 @@ const (
 	TransStreamHls             = TransStreamProtocol(4)
 	TransStreamRtc             = TransStreamProtocol(5)
 	TransStreamGBStreamForward = TransStreamProtocol(6) // 国标级联转发
+	TransStreamTs              = TransStreamProtocol(7) // http-ts/ws-ts直播流
+	TransStreamFmp4            = TransStreamProtocol(8) // http-fmp4/ws-fmp4直播流
 )
 
 const (
@@ -52,6 +56,8 @@ func (s SourceType) String() string {
 		return "28181"
 	} else if SourceType1078 == s {
 		return "jt1078"
+	} else if SourceTypeFailover == s {
+		return "failover"
 	}
 
 	panic(fmt.Sprintf("unknown source type %d", s))
@@ -70,6 +76,10 @@ func (p TransStreamProtocol) String() string {
 		return "rtc"
 	} else if TransStreamGBStreamForward == p {
 		return "gb_stream_forward"
+	} else if TransStreamTs == p {
+		return "ts"
+	} else if TransStreamFmp4 == p {
+		return "fmp4"
 	}
 
 	panic(fmt.Sprintf("unknown stream protocol %d", p))
@@ -130,44 +140,51 @@ func ParseUrl(name string) (string, url.Values) {
 	return name, nil
 }
 
-func ExtractVideoPacket(codec utils.AVCodecID, key, extractStream bool, data []byte, pts, dts int64, index, timebase int) (utils.AVStream, utils.AVPacket, error) {
-	var stream utils.AVStream
-
+// 从关键帧中解析出编码参数, 创建AVStream
+func extractVideoStream(codec utils.AVCodecID, data []byte, index int) (utils.AVStream, error) {
 	if utils.AVCodecIdH264 == codec {
 		//从关键帧中解析出sps和pps
-		if key && extractStream {
-			sps, pps, err := libavc.ParseExtraDataFromKeyNALU(data)
-			if err != nil {
-				log.Sugar.Errorf("从关键帧中解析sps pps失败 data:%s", hex.EncodeToString(data))
-				return nil, nil, err
-			}
-
-			codecData, err := utils.NewAVCCodecData(sps, pps)
-			if err != nil {
-				log.Sugar.Errorf("解析sps pps失败 data:%s sps:%s, pps:%s", hex.EncodeToString(data), hex.EncodeToString(sps), hex.EncodeToString(pps))
-				return nil, nil, err
-			}
+		sps, pps, err := libavc.ParseExtraDataFromKeyNALU(data)
+		if err != nil {
+			return nil, fmt.Errorf("从关键帧中解析sps pps失败 err: %s data: %s", err.Error(), hex.EncodeToString(data))
+		}
 
-			stream = utils.NewAVStream(utils.AVMediaTypeVideo, 0, codec, codecData.AnnexBExtraData(), codecData)
+		codecData, err := utils.NewAVCCodecData(sps, pps)
+		if err != nil {
+			return nil, fmt.Errorf("解析sps pps失败 err: %s sps: %s, pps: %s", err.Error(), hex.EncodeToString(sps), hex.EncodeToString(pps))
 		}
 
+		return utils.NewAVStream(utils.AVMediaTypeVideo, index, codec, codecData.AnnexBExtraData(), codecData), nil
 	} else if utils.AVCodecIdH265 == codec {
-		if key && extractStream {
-			vps, sps, pps, err := libhevc.ParseExtraDataFromKeyNALU(data)
-			if err != nil {
-				log.Sugar.Errorf("从关键帧中解析vps sps pps失败  data:%s", hex.EncodeToString(data))
-				return nil, nil, err
-			}
-
-			codecData, err := utils.NewHEVCCodecData(vps, sps, pps)
-			if err != nil {
-				log.Sugar.Errorf("解析sps pps失败 data:%s vps:%s sps:%s, pps:%s", hex.EncodeToString(data), hex.EncodeToString(vps), hex.EncodeToString(sps), hex.EncodeToString(pps))
-				return nil, nil, err
-			}
+		vps, sps, pps, err := libhevc.ParseExtraDataFromKeyNALU(data)
+		if err != nil {
+			return nil, fmt.Errorf("从关键帧中解析vps sps pps失败 err: %s data: %s", err.Error(), hex.EncodeToString(data))
+		}
 
-			stream = utils.NewAVStream(utils.AVMediaTypeVideo, 0, codec, codecData.AnnexBExtraData(), codecData)
+		codecData, err := utils.NewHEVCCodecData(vps, sps, pps)
+		if err != nil {
+			return nil, fmt.Errorf("解析vps sps pps失败 err: %s vps: %s sps: %s, pps: %s", err.Error(), hex.EncodeToString(vps), hex.EncodeToString(sps), hex.EncodeToString(pps))
 		}
 
+		return utils.NewAVStream(utils.AVMediaTypeVideo, index, codec, codecData.AnnexBExtraData(), codecData), nil
+	}
+
+	return nil, nil
+}
+
+// ExtractVideoPacket 创建视频AVPacket. current为nil时从关键帧中解析出AVStream;
+// 否则每个关键帧都重新解析编码参数, 与current不同(例如分辨率改变)时返回新的AVStream, 关键帧不携带编码参数时忽略.
+func ExtractVideoPacket(codec utils.AVCodecID, key bool, current utils.AVStream, data []byte, pts, dts int64, index, timebase int) (utils.AVStream, utils.AVPacket, error) {
+	var stream utils.AVStream
+
+	if key {
+		stream_, err := extractVideoStream(codec, data, index)
+		if err != nil && current == nil {
+			log.Sugar.Errorf("%s", err.Error())
+			return nil, nil, err
+		} else if err == nil && stream_ != nil && (current == nil || !bytes.Equal(current.Extra(), stream_.Extra())) {
+			stream = stream_
+		}
 	}
 
 	packet := utils.NewVideoPacket(data, dts, pts, key, utils.PacketTypeAnnexB, codec, index, timebase)
@@ -304,7 +321,7 @@ func LoopEvent(source Source) {
 		select {
 		// 读取推流数据
 		case data := <-source.StreamPipe():
-			if AppConfig.ReceiveTimeout > 0 {
+			if AppConfig.ReceiveTimeout > 0 || AppConfig.Failover.Enable {
 				source.SetLastPacketTime(time.Now())
 			}
 
@@ -8,19 +8,20 @@ type StreamManager struct {
 	streams []utils.AVStream
 }
 
+// Add 添加Stream, 同一索引的同一编码器只能存在一路. 音视频都可能存在多路, 编码器也可能相同(例如多语言音轨).
+// 转码流和原始流索引相同, 编码器不同
 func (s *StreamManager) Add(stream utils.AVStream) {
 	for _, stream_ := range s.streams {
-		utils.Assert(stream_.Type() != stream.Type())
-		utils.Assert(stream_.CodecId() != stream.CodecId())
+		utils.Assert(stream_.Index() != stream.Index() || stream_.CodecId() != stream.CodecId())
 	}
 
 	s.streams = append(s.streams, stream)
 
-	//按照AVCodecId升序排序
+	//按照AVCodecId升序排序, 编码器相同按照索引升序
 	for i := 0; i < len(s.streams); i++ {
 		for j := 1; j < len(s.streams)-i; j++ {
 			tmp := s.streams[j-1]
-			if s.streams[j].CodecId() < tmp.CodecId() {
+			if s.streams[j].CodecId() < tmp.CodecId() || (s.streams[j].CodecId() == tmp.CodecId() && s.streams[j].Index() < tmp.Index()) {
 				s.streams[j-1] = s.streams[j]
 				s.streams[j] = tmp
 			}
@@ -28,6 +29,28 @@ func (s *StreamManager) Add(stream utils.AVStream) {
 	}
 }
 
+// Replace 替换索引和编码器相同的Stream, 返回被替换的Stream
+func (s *StreamManager) Replace(stream utils.AVStream) utils.AVStream {
+	for i, stream_ := range s.streams {
+		if stream_.Index() == stream.Index() && stream_.CodecId() == stream.CodecId() {
+			s.streams[i] = stream
+			return stream_
+		}
+	}
+
+	return nil
+}
+
+// Remove 删除Stream, 例如释放转码器后删除转码流
+func (s *StreamManager) Remove(stream utils.AVStream) {
+	for i, stream_ := range s.streams {
+		if stream_ == stream {
+			s.streams = append(s.streams[:i], s.streams[i+1:]...)
+			return
+		}
+	}
+}
+
 func (s *StreamManager) FindStream(id utils.AVCodecID) utils.AVStream {
 	for _, stream_ := range s.streams {
 		if stream_.CodecId() == id {
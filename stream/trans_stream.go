@@ -1,9 +1,14 @@
 package stream
 
 import (
+	"errors"
+	"fmt"
 	"github.com/lkmio/avformat/utils"
 )
 
+// ErrAppendTrackNotSupported 输出流不支持在WriteHeader之后添加track
+var ErrAppendTrackNotSupported = errors.New("appending a track after the header is written is not supported")
+
 // TransStream 将AVPacket封装成传输流
 type TransStream interface {
 	GetID() TransStreamID
@@ -18,8 +23,19 @@ type TransStream interface {
 
 	GetTracks() []utils.AVStream
 
+	// FindTrack 根据AVStream的索引查找track, 返回track在输出流中的索引
+	FindTrack(index int) (int, utils.AVStream)
+
 	WriteHeader() error
 
+	// UpdateTrack 推流中途编码参数发生变化(例如分辨率改变), 使用新的AVStream替换索引相同的track, 重新生成封装头.
+	// 返回需要立即发送给已有sink的数据, 例如新的sequence header
+	UpdateTrack(stream utils.AVStream) ([][]byte, int64, error)
+
+	// AppendTrack WriteHeader之后添加track(超过probe_timeout才到达的track), 重新生成封装头.
+	// 返回需要立即发送给已有sink的数据, 不支持时返回ErrAppendTrackNotSupported
+	AppendTrack(stream utils.AVStream) ([][]byte, int64, error)
+
 	// GetProtocol 返回输出流协议
 	GetProtocol() TransStreamProtocol
 
@@ -73,6 +89,23 @@ func (t *BaseTransStream) AddTrack(stream utils.AVStream) error {
 	return nil
 }
 
+// UpdateTrack 只替换track. 关键帧前添加编码参数的输出流, 后续关键帧自动使用新的编码参数
+func (t *BaseTransStream) UpdateTrack(stream utils.AVStream) ([][]byte, int64, error) {
+	for i, track := range t.Tracks {
+		if track.Index() == stream.Index() && track.Type() == stream.Type() {
+			t.Tracks[i] = stream
+			return nil, -1, nil
+		}
+	}
+
+	return nil, -1, fmt.Errorf("track %d not found", stream.Index())
+}
+
+// AppendTrack 默认不支持, 由source为sink重新创建输出流
+func (t *BaseTransStream) AppendTrack(stream utils.AVStream) ([][]byte, int64, error) {
+	return nil, -1, ErrAppendTrackNotSupported
+}
+
 func (t *BaseTransStream) Close() ([][]byte, int64, error) {
 	return nil, 0, nil
 }
@@ -113,6 +146,17 @@ func (t *BaseTransStream) GetTracks() []utils.AVStream {
 	return t.Tracks
 }
 
+// FindTrack 输出流可能丢弃了部分track, track在输出流中的索引与AVStream的索引不一定相同. 未找到返回-1
+func (t *BaseTransStream) FindTrack(index int) (int, utils.AVStream) {
+	for i, track := range t.Tracks {
+		if track.Index() == index {
+			return i, track
+		}
+	}
+
+	return -1, nil
+}
+
 func (t *BaseTransStream) IsExistVideo() bool {
 	return t.ExistVideo
 }
@@ -1,67 +1,44 @@
 package stream
 
-import "github.com/lkmio/avformat/utils"
+import (
+	"encoding/binary"
+	"github.com/lkmio/avformat/utils"
+	"hash/fnv"
+	"sort"
+)
 
-// TransStreamID 每个传输流的唯一Id，根据输出流协议ID+流包含的音视频编码器ID生成
+// TransStreamID 每个传输流的唯一Id，根据输出流协议ID+流包含的track生成
 // 输出流协议ID占用高8位
-// 每个音视频编译器ID占用8位. 意味着每个输出流至多7路流.
+// 低56位是每路track的索引和编码器ID的哈希值. 同一编码器可能存在多路track, 仅凭编码器无法区分输出流.
 type TransStreamID uint64
 
-var (
-	// AVCodecID转为byte的对应关系
-	narrowCodecIds map[int]byte
-)
-
-func init() {
-	narrowCodecIds = map[int]byte{
-		int(utils.AVCodecIdH263): 0x1,
-		int(utils.AVCodecIdH264): 0x2,
-		int(utils.AVCodecIdH265): 0x3,
-		int(utils.AVCodecIdAV1):  0x4,
-		int(utils.AVCodecIdVP8):  0x5,
-		int(utils.AVCodecIdVP9):  0x6,
-
-		int(utils.AVCodecIdAAC):      101,
-		int(utils.AVCodecIdMP3):      102,
-		int(utils.AVCodecIdOPUS):     103,
-		int(utils.AVCodecIdPCMALAW):  104,
-		int(utils.AVCodecIdPCMMULAW): 105,
-	}
+// Protocol 返回输出流协议
+func (id TransStreamID) Protocol() TransStreamProtocol {
+	return TransStreamProtocol(id >> 56)
 }
 
-// GenerateTransStreamID 根据传入的推拉流协议和编码器ID生成StreamId
-// 请确保ids根据值升序排序传参
-/*func GenerateTransStreamID(protocol GetProtocol, ids ...utils.AVCodecID) GetTransStreamID {
-	len_ := len(ids)
-	utils.Assert(len_ > 0 && len_ < 8)
-
-	var streamId uint64
-	streamId = uint64(protocol) << 56
-
-	for i, GetID := range ids {
-		bId, ok := narrowCodecIds[int(GetID)]
-		utils.Assert(ok)
-
-		streamId |= uint64(bId) << (48 - i*8)
-	}
-
-	return GetTransStreamID(streamId)
-}*/
-
-// GenerateTransStreamID 根据输出流协议和输出流包含的音视频编码器ID生成流ID
-func GenerateTransStreamID(protocol TransStreamProtocol, ids ...utils.AVStream) TransStreamID {
-	len_ := len(ids)
-	utils.Assert(len_ > 0 && len_ < 8)
-
-	var streamId uint64
-	streamId = uint64(protocol) << 56
-
-	for i, id := range ids {
-		bId, ok := narrowCodecIds[int(id.CodecId())]
-		utils.Assert(ok)
-
-		streamId |= uint64(bId) << (48 - i*8)
+// GenerateTransStreamID 根据输出流协议和输出流包含的track生成流ID
+func GenerateTransStreamID(protocol TransStreamProtocol, tracks ...utils.AVStream) TransStreamID {
+	utils.Assert(len(tracks) > 0)
+
+	// 按照索引和编码器排序, 与track添加顺序无关. 推流中途添加track后, 输出流ID与新建的输出流一致
+	sorted := make([]utils.AVStream, len(tracks))
+	copy(sorted, tracks)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Index() != sorted[j].Index() {
+			return sorted[i].Index() < sorted[j].Index()
+		}
+
+		return sorted[i].CodecId() < sorted[j].CodecId()
+	})
+
+	hash := fnv.New64a()
+	var bytes [8]byte
+	for _, track := range sorted {
+		binary.BigEndian.PutUint32(bytes[:], uint32(track.Index()))
+		binary.BigEndian.PutUint32(bytes[4:], uint32(track.CodecId()))
+		_, _ = hash.Write(bytes[:])
 	}
 
-	return TransStreamID(streamId)
+	return TransStreamID(uint64(protocol)<<56 | hash.Sum64()&0xFFFFFFFFFFFFFF)
 }
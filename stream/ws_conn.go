@@ -0,0 +1,76 @@
+package stream
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/lkmio/avformat/transport"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// WSConn 将websocket连接适配为net.Conn, 每次Write作为一个二进制消息发送.
+// gorilla/websocket只支持一个并发写, 信令和转发流可能在不同的协程中发送, 写操作需要加锁.
+type WSConn struct {
+	*websocket.Conn
+
+	lock   sync.Mutex
+	reader io.Reader             // 正在读取的消息
+	format func(b []byte) []byte // 发送前处理数据, 为nil直接发送
+}
+
+func (w *WSConn) Read(b []byte) (int, error) {
+	for {
+		if w.reader == nil {
+			_, reader, err := w.Conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+
+			w.reader = reader
+		}
+
+		n, err := w.reader.Read(b)
+		if err == io.EOF {
+			// 读取下一个消息
+			w.reader = nil
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (w *WSConn) Write(b []byte) (int, error) {
+	data := b
+	if w.format != nil {
+		data = w.format(b)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.Conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (w *WSConn) SetDeadline(t time.Time) error {
+	if err := w.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return w.Conn.SetWriteDeadline(t)
+}
+
+// NewWSConn 创建websocket链路
+// @format 每次发送前对数据的处理, 例如ws-flv去掉http-flv的块长度和换行符
+func NewWSConn(conn *websocket.Conn, format func(b []byte) []byte) net.Conn {
+	return transport.NewConn(&WSConn{Conn: conn, format: format})
+}
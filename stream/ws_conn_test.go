@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 建立一对websocket连接, 返回客户端和服务端
+func newWSConnPair(t *testing.T) (*websocket.Conn, *websocket.Conn, func()) {
+	upgrader := websocket.Upgrader{}
+	accepted := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		accepted <- conn
+	}))
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	conn := <-accepted
+	return client, conn, func() {
+		_ = client.Close()
+		_ = conn.Close()
+		server.Close()
+	}
+}
+
+func TestWSConnRead(t *testing.T) {
+	client, conn, closeFunc := newWSConnPair(t)
+	defer closeFunc()
+
+	messages := [][]byte{[]byte("OPTIONS"), []byte(" rtsp://"), []byte("127.0.0.1")}
+	for _, message := range messages {
+		if err := client.WriteMessage(websocket.BinaryMessage, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 按照net.Conn读取, 跨越多个消息
+	ws := &WSConn{Conn: conn}
+	expected := bytes.Join(messages, nil)
+	var data []byte
+	buffer := make([]byte, 4)
+	for len(data) < len(expected) {
+		n, err := ws.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data = append(data, buffer[:n]...)
+	}
+
+	if !bytes.Equal(expected, data) {
+		t.Fatalf("read %q, expected %q", data, expected)
+	}
+}
+
+func TestWSConnWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   func(b []byte) []byte
+		data     []byte
+		expected []byte
+	}{
+		{"raw", nil, []byte{0x47, 0x40, 0x00}, []byte{0x47, 0x40, 0x00}},
+		{"format", func(b []byte) []byte { return b[1:] }, []byte{0x0D, 0x47}, []byte{0x47}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, conn, closeFunc := newWSConnPair(t)
+			defer closeFunc()
+
+			ws := &WSConn{Conn: conn, format: test.format}
+			if n, err := ws.Write(test.data); err != nil || n != len(test.data) {
+				t.Fatalf("write n: %d err: %v", n, err)
+			}
+
+			_, message, err := client.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(test.expected, message) {
+				t.Fatalf("received %v, expected %v", message, test.expected)
+			}
+		})
+	}
+}
+
+// 多个协程同时发送, 每个消息完整送达
+func TestWSConnConcurrentWrite(t *testing.T) {
+	client, conn, closeFunc := newWSConnPair(t)
+	defer closeFunc()
+
+	ws := &WSConn{Conn: conn}
+	count := 100
+	message := bytes.Repeat([]byte{0x47}, 188)
+
+	group := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for j := 0; j < count; j++ {
+				if _, err := ws.Write(message); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 4*count; i++ {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(message, data) {
+			t.Fatalf("broken message %d", i)
+		}
+	}
+
+	group.Wait()
+}
@@ -0,0 +1,277 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"github.com/lkmio/avformat/transport"
+	"github.com/lkmio/lkm/log"
+	"github.com/lkmio/lkm/stream"
+	"net"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// LadderManager 管理所有源流的转码进程
+	LadderManager = &ladderManager{pipelines: make(map[string][]*pipeline, 64), derived: make(map[string]string, 64)}
+)
+
+// 一路转码档位, 从源流拉取ts流写入转码进程的stdin, 转码进程将转码后的流以rtmp推流回本机, 生成派生流
+type pipeline struct {
+	sourceId string
+	ladder   string
+	args     string
+	closed   atomic.Bool
+
+	lock sync.Mutex
+	cmd  *exec.Cmd
+}
+
+// 派生流id
+func (p *pipeline) derivedId() string {
+	return DerivedSourceID(p.sourceId, p.ladder)
+}
+
+// 按照rtmp推流生成源流id的规则(app/stream)拆分派生流id, 最后一级路径为stream, 其余为app
+func splitSourceID(sourceId string) (string, string) {
+	i := strings.LastIndex(sourceId, "/")
+	if i < 0 {
+		return "", sourceId
+	}
+
+	return sourceId[:i], sourceId[i+1:]
+}
+
+// 派生流的rtmp推流地址, 分别拼接app和stream, url参数携带档位, 便于on_publish区分
+func (p *pipeline) outputUrl() string {
+	ip := stream.AppConfig.ListenIP
+	if addr := net.ParseIP(ip); addr == nil || addr.IsUnspecified() {
+		ip = "127.0.0.1"
+	}
+
+	host := stream.JoinHostPort(ip, stream.AppConfig.Rtmp.Port)
+	query := url.Values{"transcode": []string{p.ladder}}.Encode()
+	app, name := splitSourceID(p.derivedId())
+	if app == "" {
+		return fmt.Sprintf("rtmp://%s/%s?%s", host, url.PathEscape(name), query)
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(app, "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+
+	return fmt.Sprintf("rtmp://%s/%s/%s?%s", host, strings.Join(segments, "/"), url.PathEscape(name), query)
+}
+
+// 根据命令模板生成转码进程参数, 不经过shell, 编码参数按空格拆分
+func (p *pipeline) command() []string {
+	var args []string
+	for _, field := range strings.Fields(stream.AppConfig.Transcode.Command) {
+		if "{args}" == field {
+			args = append(args, strings.Fields(p.args)...)
+			continue
+		}
+
+		field = strings.ReplaceAll(field, "{output}", p.outputUrl())
+		field = strings.ReplaceAll(field, "{source}", p.sourceId)
+		args = append(args, field)
+	}
+
+	return args
+}
+
+// 守护转码进程, 异常退出后间隔重启, 直到源流关闭
+func (p *pipeline) run() {
+	for !p.closed.Load() {
+		err := p.start()
+		if p.closed.Load() {
+			break
+		}
+
+		log.Sugar.Errorf("转码进程退出, %d秒后重启 err: %v source: %s ladder: %s", stream.AppConfig.Transcode.RestartInterval, err, p.sourceId, p.ladder)
+		time.Sleep(time.Duration(stream.AppConfig.Transcode.RestartInterval) * time.Second)
+	}
+
+	log.Sugar.Infof("转码结束 source: %s ladder: %s", p.sourceId, p.ladder)
+}
+
+// 启动转码进程并添加推流sink, 阻塞到进程退出
+func (p *pipeline) start() error {
+	source := stream.SourceManager.Find(p.sourceId)
+	if source == nil {
+		p.closed.Store(true)
+		return fmt.Errorf("source %s not found", p.sourceId)
+	}
+
+	args := p.command()
+	if len(args) == 0 {
+		p.closed.Store(true)
+		return fmt.Errorf("transcode command is empty")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	cmd.Stderr = &stderrLogger{p}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	log.Sugar.Infof("启动转码进程 pid: %d source: %s ladder: %s command: %s", cmd.Process.Pid, p.sourceId, p.ladder, strings.Join(args, " "))
+
+	p.lock.Lock()
+	p.cmd = cmd
+	closed := p.closed.Load()
+	p.lock.Unlock()
+
+	// 启动期间源流已经关闭
+	if closed {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil
+	}
+
+	name := fmt.Sprintf("transcode-%s", p.ladder)
+	sink := &stream.BaseSink{ID: name, SourceID: p.sourceId, Protocol: stream.TransStreamTs, Conn: transport.NewConn(newPipeConn(stdin, name)), TCPStreaming: true}
+	sink.SetCreateTime(time.Now())
+	source.AddSink(sink)
+
+	err = cmd.Wait()
+	sink.Close()
+
+	p.lock.Lock()
+	p.cmd = nil
+	p.lock.Unlock()
+	return err
+}
+
+// 结束转码进程, 不再重启. 转码进程退出后, 派生流的rtmp连接断开, 派生流随之关闭
+func (p *pipeline) close() {
+	p.closed.Store(true)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.cmd != nil && p.cmd.Process != nil {
+		_ = p.cmd.Process.Kill()
+	}
+}
+
+// 转码进程的stderr输出到日志
+type stderrLogger struct {
+	p *pipeline
+}
+
+func (s *stderrLogger) Write(data []byte) (int, error) {
+	log.Sugar.Warnf("转码进程输出 source: %s ladder: %s %s", s.p.sourceId, s.p.ladder, strings.TrimSpace(string(data)))
+	return len(data), nil
+}
+
+type ladderManager struct {
+	lock      sync.Mutex
+	pipelines map[string][]*pipeline // key为源流id
+	derived   map[string]string      // 派生流id->源流id
+}
+
+// 查找源流匹配的转码档位, 使用第一条匹配的规则
+func (m *ladderManager) matchLadders(sourceId string) []string {
+	for _, rule := range stream.AppConfig.Transcode.Rules {
+		if ok, err := path.Match(rule.Source, sourceId); err == nil && ok {
+			return rule.Ladders
+		}
+	}
+
+	return nil
+}
+
+func (m *ladderManager) OnSourceReady(sourceId string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// 派生流不再转码
+	if _, ok := m.derived[sourceId]; ok {
+		return
+	} else if _, ok = m.pipelines[sourceId]; ok {
+		return
+	}
+
+	var pipelines []*pipeline
+	for _, ladder := range m.matchLadders(sourceId) {
+		args, ok := stream.AppConfig.Transcode.Ladders[ladder]
+		if !ok {
+			log.Sugar.Errorf("转码档位不存在 ladder: %s source: %s", ladder, sourceId)
+			continue
+		}
+
+		p := &pipeline{sourceId: sourceId, ladder: ladder, args: args}
+		pipelines = append(pipelines, p)
+		m.derived[p.derivedId()] = sourceId
+		go p.run()
+	}
+
+	if len(pipelines) > 0 {
+		m.pipelines[sourceId] = pipelines
+	}
+}
+
+func (m *ladderManager) OnSourceClosed(sourceId string) {
+	m.lock.Lock()
+	pipelines := m.pipelines[sourceId]
+	delete(m.pipelines, sourceId)
+	for _, p := range pipelines {
+		delete(m.derived, p.derivedId())
+	}
+	m.lock.Unlock()
+
+	if len(pipelines) == 0 {
+		return
+	}
+
+	// 在源流的事件协程中回调, 异步关闭转码进程和派生流
+	go func() {
+		for _, p := range pipelines {
+			p.close()
+
+			if source := stream.SourceManager.Find(p.derivedId()); source != nil {
+				source.Close()
+			}
+		}
+	}()
+}
+
+// DerivedSources 返回源流的派生流id
+func (m *ladderManager) DerivedSources(sourceId string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var ids []string
+	for _, p := range m.pipelines[sourceId] {
+		ids = append(ids, p.derivedId())
+	}
+
+	return ids
+}
+
+// DerivedSourceID 派生流id, 源流id加档位后缀
+func DerivedSourceID(sourceId, ladder string) string {
+	return sourceId + "_" + ladder
+}
+
+// Start 开启转码, 监听源流的创建和关闭
+func Start() error {
+	if !stream.AppConfig.Rtmp.Enable {
+		return fmt.Errorf("transcoding requires rtmp to be enabled")
+	} else if len(strings.Fields(stream.AppConfig.Transcode.Command)) == 0 {
+		return fmt.Errorf("transcode command is empty")
+	}
+
+	stream.AddSourceListener(LadderManager)
+	return nil
+}
@@ -0,0 +1,73 @@
+package ffmpeg
+
+import (
+	"github.com/lkmio/lkm/stream"
+	"strings"
+	"testing"
+)
+
+func TestSplitSourceID(t *testing.T) {
+	tests := []struct {
+		id         string
+		app        string
+		streamName string
+	}{
+		{"live/ch1_hd", "live", "ch1_hd"},
+		{"a/b/ch1_hd", "a/b", "ch1_hd"},
+		{"ch1_hd", "", "ch1_hd"},
+	}
+
+	for _, test := range tests {
+		if app, name := splitSourceID(test.id); app != test.app || name != test.streamName {
+			t.Fatalf("split %s: %s %s", test.id, app, name)
+		}
+	}
+}
+
+func TestPipelineCommand(t *testing.T) {
+	stream.AppConfig.Rtmp.Port = 1935
+	stream.AppConfig.Transcode.Command = "ffmpeg -i pipe:0 {args} -f flv {output}"
+
+	tests := []struct {
+		name     string
+		listenIP string
+		sourceId string
+		ladder   string
+		args     string
+		expected string
+	}{
+		{
+			name:     "app and stream",
+			listenIP: "0.0.0.0",
+			sourceId: "live/ch1",
+			ladder:   "hd",
+			args:     "-c:v libx264 -b:v 2000k",
+			expected: "ffmpeg -i pipe:0 -c:v libx264 -b:v 2000k -f flv rtmp://127.0.0.1:1935/live/ch1_hd?transcode=hd",
+		},
+		{
+			name:     "multi-level app",
+			listenIP: "192.168.1.2",
+			sourceId: "gb/34020000001320000001/34020000001310000001",
+			ladder:   "sd",
+			args:     "-c:v libx264",
+			expected: "ffmpeg -i pipe:0 -c:v libx264 -f flv rtmp://192.168.1.2:1935/gb/34020000001320000001/34020000001310000001_sd?transcode=sd",
+		},
+		{
+			name:     "escape",
+			listenIP: "",
+			sourceId: "live/a b",
+			ladder:   "hd",
+			expected: "ffmpeg -i pipe:0 -f flv rtmp://127.0.0.1:1935/live/a%20b_hd?transcode=hd",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream.AppConfig.ListenIP = test.listenIP
+			p := &pipeline{sourceId: test.sourceId, ladder: test.ladder, args: test.args}
+			if command := strings.Join(p.command(), " "); command != test.expected {
+				t.Fatalf("command %s, expected %s", command, test.expected)
+			}
+		})
+	}
+}
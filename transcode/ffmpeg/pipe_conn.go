@@ -0,0 +1,116 @@
+package ffmpeg
+
+import (
+	"github.com/lkmio/lkm/log"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// PipeQueueSize 写入转码进程stdin的队列长度, 转码进程处理不过来时丢弃新的数据, 不阻塞源流的推流协程
+	PipeQueueSize = 512
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+// pipeConn 将转码进程的stdin包装成net.Conn, 作为Sink的推流链路.
+// Write拷贝数据放入有界队列后立即返回, 由单独的协程写入stdin.
+type pipeConn struct {
+	writer  io.WriteCloser
+	name    string
+	queue   chan []byte
+	done    chan struct{}
+	once    sync.Once
+	dropped atomic.Int64 // 队列满丢弃的次数
+}
+
+func newPipeConn(writer io.WriteCloser, name string) *pipeConn {
+	p := &pipeConn{
+		writer: writer,
+		name:   name,
+		queue:  make(chan []byte, PipeQueueSize),
+		done:   make(chan struct{}),
+	}
+
+	go p.run()
+	return p
+}
+
+func (p *pipeConn) run() {
+	defer p.writer.Close()
+
+	for {
+		select {
+		case data := <-p.queue:
+			if _, err := p.writer.Write(data); err != nil {
+				log.Sugar.Errorf("写入转码进程失败 err: %s name: %s", err.Error(), p.name)
+				p.Close()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *pipeConn) Write(b []byte) (int, error) {
+	select {
+	case <-p.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	select {
+	case p.queue <- append([]byte(nil), b...):
+	default:
+		// 每丢弃100次打印一次日志
+		if p.dropped.Add(1)%100 == 1 {
+			log.Sugar.Warnf("转码进程处理不过来, 丢弃数据 dropped: %d name: %s", p.dropped.Load(), p.name)
+		}
+	}
+
+	return len(b), nil
+}
+
+func (p *pipeConn) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+	})
+
+	return nil
+}
+
+func (p *pipeConn) Read(b []byte) (n int, err error) {
+	return 0, io.EOF
+}
+
+func (p *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr(p.name)
+}
+
+func (p *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr(p.name)
+}
+
+func (p *pipeConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (p *pipeConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (p *pipeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,108 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录写入的数据, block关闭前阻塞写入
+type testWriter struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+	block  chan struct{}
+	closed chan struct{}
+}
+
+func newTestWriter(blocked bool) *testWriter {
+	w := &testWriter{block: make(chan struct{}), closed: make(chan struct{})}
+	if !blocked {
+		close(w.block)
+	}
+
+	return w
+}
+
+func (w *testWriter) Write(b []byte) (int, error) {
+	<-w.block
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buffer.Write(b)
+}
+
+func (w *testWriter) Close() error {
+	close(w.closed)
+	return nil
+}
+
+func (w *testWriter) String() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buffer.String()
+}
+
+func TestPipeConnWrite(t *testing.T) {
+	writer := newTestWriter(false)
+	conn := newPipeConn(writer, "test")
+
+	data := []byte("0123456789")
+	for i := 0; i < 10; i++ {
+		if n, err := conn.Write(data); err != nil || n != len(data) {
+			t.Fatalf("write %d %v", n, err)
+		}
+	}
+
+	// 写入后修改数据, 队列中保存的是副本
+	data[0] = 'x'
+
+	deadline := time.Now().Add(time.Second)
+	for writer.String() != strings.Repeat("0123456789", 10) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if writer.String() != strings.Repeat("0123456789", 10) {
+		t.Fatalf("written %q", writer.String())
+	}
+
+	_ = conn.Close()
+	select {
+	case <-writer.closed:
+	case <-time.After(time.Second):
+		t.Fatal("stdin not closed")
+	}
+
+	if _, err := conn.Write(data); err != io.ErrClosedPipe {
+		t.Fatalf("write after close: %v", err)
+	}
+}
+
+// 转码进程阻塞时, 写入不阻塞, 超过队列长度的数据丢弃
+func TestPipeConnOverflow(t *testing.T) {
+	writer := newTestWriter(true)
+	conn := newPipeConn(writer, "test")
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < PipeQueueSize*2; i++ {
+			_, _ = conn.Write([]byte{byte(i)})
+		}
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write blocked")
+	}
+
+	if dropped := conn.dropped.Load(); dropped < PipeQueueSize-1 {
+		t.Fatalf("dropped %d", dropped)
+	}
+
+	_ = conn.Close()
+	close(writer.block)
+}
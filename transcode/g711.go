@@ -0,0 +1,180 @@
+package transcode
+
+// G.711 A-law/μ-law与16位线性PCM互转, 算法参考ITU-T G.711和Sun Microsystems的g711.c
+
+const (
+	g711SignBit   = 0x80 // 符号位
+	g711QuantMask = 0x0F // 段内量化值
+	g711SegShift  = 4
+	g711SegMask   = 0x70 // 段号
+
+	ulawBias = 0x84 // μ-law编码前加的偏移
+	ulawClip = 8159
+)
+
+var (
+	alawSegEnd = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+	ulawSegEnd = [8]int{0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF, 0x1FFF}
+
+	// 解码和A-law/μ-law互转只有256种输入, 初始化时生成查找表
+	alawToLinearTable [256]int16
+	ulawToLinearTable [256]int16
+	alawToUlawTable   [256]byte
+	ulawToAlawTable   [256]byte
+)
+
+func init() {
+	for i := 0; i < 256; i++ {
+		alawToLinearTable[i] = alawToLinear(byte(i))
+		ulawToLinearTable[i] = ulawToLinear(byte(i))
+	}
+
+	for i := 0; i < 256; i++ {
+		alawToUlawTable[i] = linearToUlaw(alawToLinearTable[i])
+		ulawToAlawTable[i] = linearToAlaw(ulawToLinearTable[i])
+	}
+}
+
+func searchSegment(value int, table *[8]int) int {
+	for i, end := range table {
+		if value <= end {
+			return i
+		}
+	}
+
+	return len(table)
+}
+
+func linearToAlaw(pcm int16) byte {
+	value := int(pcm) >> 3
+	mask := 0xD5
+	if value < 0 {
+		mask = 0x55
+		value = -value - 1
+	}
+
+	seg := searchSegment(value, &alawSegEnd)
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+
+	alaw := seg << g711SegShift
+	if seg < 2 {
+		alaw |= (value >> 1) & g711QuantMask
+	} else {
+		alaw |= (value >> seg) & g711QuantMask
+	}
+
+	return byte(alaw ^ mask)
+}
+
+func alawToLinear(alaw byte) int16 {
+	value := int(alaw ^ 0x55)
+	t := (value & g711QuantMask) << 4
+	seg := (value & g711SegMask) >> g711SegShift
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+
+	if value&g711SignBit != 0 {
+		return int16(t)
+	}
+
+	return int16(-t)
+}
+
+func linearToUlaw(pcm int16) byte {
+	value := int(pcm) >> 2
+	mask := 0xFF
+	if value < 0 {
+		mask = 0x7F
+		value = -value
+	}
+
+	if value > ulawClip {
+		value = ulawClip
+	}
+
+	value += ulawBias >> 2
+	seg := searchSegment(value, &ulawSegEnd)
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+
+	ulaw := seg<<g711SegShift | (value>>(seg+1))&g711QuantMask
+	return byte(ulaw ^ mask)
+}
+
+func ulawToLinear(ulaw byte) int16 {
+	value := int(^ulaw)
+	t := ((value & g711QuantMask) << 3) + ulawBias
+	t <<= (value & g711SegMask) >> g711SegShift
+	if value&g711SignBit != 0 {
+		return int16(ulawBias - t)
+	}
+
+	return int16(t - ulawBias)
+}
+
+// 解码G.711, 追加16位小端PCM到dst
+func decodeG711(dst, src []byte, table *[256]int16) []byte {
+	for _, b := range src {
+		sample := table[b]
+		dst = append(dst, byte(sample), byte(sample>>8))
+	}
+
+	return dst
+}
+
+// 编码16位小端PCM, 追加G.711到dst. 末尾不足一个采样的字节丢弃
+func encodeG711(dst, src []byte, encode func(int16) byte) []byte {
+	for i := 0; i+1 < len(src); i += 2 {
+		dst = append(dst, encode(int16(uint16(src[i])|uint16(src[i+1])<<8)))
+	}
+
+	return dst
+}
+
+// ALawToPCM A-law解码为16位小端PCM, 追加到dst
+func ALawToPCM(dst, src []byte) []byte {
+	return decodeG711(dst, src, &alawToLinearTable)
+}
+
+// ULawToPCM μ-law解码为16位小端PCM, 追加到dst
+func ULawToPCM(dst, src []byte) []byte {
+	return decodeG711(dst, src, &ulawToLinearTable)
+}
+
+// PCMToALaw 16位小端PCM编码为A-law, 追加到dst
+func PCMToALaw(dst, src []byte) []byte {
+	return encodeG711(dst, src, linearToAlaw)
+}
+
+// PCMToULaw 16位小端PCM编码为μ-law, 追加到dst
+func PCMToULaw(dst, src []byte) []byte {
+	return encodeG711(dst, src, linearToUlaw)
+}
+
+// ALawToULaw A-law转μ-law, 追加到dst
+func ALawToULaw(dst, src []byte) []byte {
+	for _, b := range src {
+		dst = append(dst, alawToUlawTable[b])
+	}
+
+	return dst
+}
+
+// ULawToALaw μ-law转A-law, 追加到dst
+func ULawToALaw(dst, src []byte) []byte {
+	for _, b := range src {
+		dst = append(dst, ulawToAlawTable[b])
+	}
+
+	return dst
+}
@@ -0,0 +1,133 @@
+package transcode
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestG711Decode(t *testing.T) {
+	tests := []struct {
+		name     string
+		decode   func(dst, src []byte) []byte
+		code     byte
+		expected int16
+	}{
+		{"alaw zero", ALawToPCM, 0xD5, 8},
+		{"alaw negative zero", ALawToPCM, 0x55, -8},
+		{"alaw max", ALawToPCM, 0xAA, 32256},
+		{"alaw min", ALawToPCM, 0x2A, -32256},
+		{"ulaw zero", ULawToPCM, 0xFF, 0},
+		{"ulaw negative zero", ULawToPCM, 0x7F, 0},
+		{"ulaw max", ULawToPCM, 0x80, 32124},
+		{"ulaw min", ULawToPCM, 0x00, -32124},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pcm := test.decode(nil, []byte{test.code})
+			if len(pcm) != 2 {
+				t.Fatalf("decoded %d bytes", len(pcm))
+			} else if sample := int16(uint16(pcm[0]) | uint16(pcm[1])<<8); sample != test.expected {
+				t.Fatalf("decode %#x: %d, expected %d", test.code, sample, test.expected)
+			}
+		})
+	}
+}
+
+func TestG711RoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func(dst, src []byte) []byte
+		encode func(dst, src []byte) []byte
+		skip   byte // μ-law的0x7F(负零)与0xFF解码相同, 编码为0xFF
+	}{
+		{"alaw", ALawToPCM, PCMToALaw, 0},
+		{"ulaw", ULawToPCM, PCMToULaw, 0x7F},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var codes []byte
+			for i := 0; i < 256; i++ {
+				if test.skip == 0 || byte(i) != test.skip {
+					codes = append(codes, byte(i))
+				}
+			}
+
+			// 每个编码值解码后再编码, 得到原值
+			if encoded := test.encode(nil, test.decode(nil, codes)); !bytes.Equal(encoded, codes) {
+				t.Fatalf("round trip mismatch")
+			}
+		})
+	}
+}
+
+// PCM编码再解码, 量化误差不超过所在段的量化间隔
+func TestPCMRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		encode func(dst, src []byte) []byte
+		decode func(dst, src []byte) []byte
+	}{
+		{"alaw", PCMToALaw, ALawToPCM},
+		{"ulaw", PCMToULaw, ULawToPCM},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, sample := range []int16{0, 1, -1, 100, -100, 1000, -1000, 12345, -12345, 32000, -32000} {
+				pcm := []byte{byte(sample), byte(uint16(sample) >> 8)}
+				decoded := test.decode(nil, test.encode(nil, pcm))
+				value := int(int16(uint16(decoded[0]) | uint16(decoded[1])<<8))
+
+				diff := value - int(sample)
+				if diff < 0 {
+					diff = -diff
+				}
+
+				// 量化间隔随幅度增大, 误差不超过幅度的1/32加上最小段的量化间隔
+				abs := int(sample)
+				if abs < 0 {
+					abs = -abs
+				}
+
+				limit := abs/32 + 16
+				if diff > limit {
+					t.Fatalf("sample %d decoded %d", sample, value)
+				}
+			}
+		})
+	}
+}
+
+func TestG711Convert(t *testing.T) {
+	tests := []struct {
+		name    string
+		convert func(dst, src []byte) []byte
+		from    func(dst, src []byte) []byte
+		to      func(dst, src []byte) []byte
+	}{
+		{"alaw to ulaw", ALawToULaw, ALawToPCM, PCMToULaw},
+		{"ulaw to alaw", ULawToALaw, ULawToPCM, PCMToALaw},
+	}
+
+	codes := make([]byte, 256)
+	for i := range codes {
+		codes[i] = byte(i)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// 直接转换与先解码再编码的结果一致
+			if converted := test.convert(nil, codes); !bytes.Equal(converted, test.to(nil, test.from(nil, codes))) {
+				t.Fatal("convert mismatch")
+			}
+		})
+	}
+}
+
+func TestEncodeOddBytes(t *testing.T) {
+	if encoded := PCMToALaw(nil, []byte{0x00, 0x00, 0x01}); len(encoded) != 1 {
+		t.Fatalf("encoded %d bytes", len(encoded))
+	}
+}
@@ -0,0 +1,67 @@
+package transcode
+
+import (
+	"github.com/lkmio/avformat/utils"
+)
+
+const (
+	// G711SampleRate G.711和转换得到的PCM采样率
+	G711SampleRate = 8000
+)
+
+func init() {
+	registerG711Transcoder(utils.AVCodecIdPCMALAW, utils.AVCodecIdPCMMULAW, ALawToULaw)
+	registerG711Transcoder(utils.AVCodecIdPCMMULAW, utils.AVCodecIdPCMALAW, ULawToALaw)
+	registerG711Transcoder(utils.AVCodecIdPCMALAW, utils.AVCodecIdPCMS16LE, ALawToPCM)
+	registerG711Transcoder(utils.AVCodecIdPCMMULAW, utils.AVCodecIdPCMS16LE, ULawToPCM)
+	registerG711Transcoder(utils.AVCodecIdPCMS16LE, utils.AVCodecIdPCMALAW, PCMToALaw)
+	registerG711Transcoder(utils.AVCodecIdPCMS16LE, utils.AVCodecIdPCMMULAW, PCMToULaw)
+}
+
+func registerG711Transcoder(src, dst utils.AVCodecID, convert func(dst, src []byte) []byte) {
+	RegisterTranscoder(src, dst, func(stream utils.AVStream, codecId utils.AVCodecID) (Transcoder, error) {
+		return &g711Transcoder{
+			src:     src,
+			dst:     dst,
+			stream:  utils.NewAVStream(utils.AVMediaTypeAudio, stream.Index(), dst, nil, nil),
+			convert: convert,
+		}, nil
+	})
+}
+
+// g711Transcoder G.711A、G.711U和16位PCM之间逐采样转换, 无状态, 不引入延迟
+type g711Transcoder struct {
+	src     utils.AVCodecID
+	dst     utils.AVCodecID
+	stream  utils.AVStream
+	convert func(dst, src []byte) []byte
+	buffer  []byte // 输出包的data, 每次转码复用
+}
+
+func (t *g711Transcoder) SrcCodecId() utils.AVCodecID {
+	return t.src
+}
+
+func (t *g711Transcoder) DstCodecId() utils.AVCodecID {
+	return t.dst
+}
+
+func (t *g711Transcoder) GetStream() utils.AVStream {
+	return t.stream
+}
+
+func (t *g711Transcoder) Transcode(packet utils.AVPacket, handler func(packet utils.AVPacket)) error {
+	t.buffer = t.convert(t.buffer[:0], packet.Data())
+	if len(t.buffer) == 0 {
+		return nil
+	}
+
+	dts := packet.ConvertDts(G711SampleRate)
+	pts := packet.ConvertPts(G711SampleRate)
+	handler(utils.NewAudioPacket(t.buffer, dts, pts, t.dst, t.stream.Index(), G711SampleRate))
+	return nil
+}
+
+func (t *g711Transcoder) Close() {
+	t.buffer = nil
+}
@@ -1,4 +1,66 @@
 package transcode
 
+import (
+	"fmt"
+	"github.com/lkmio/avformat/utils"
+)
+
+// Transcoder 音视频转码器, 输入源编码的AVPacket, 输出目标编码的AVPacket
 type Transcoder interface {
+	// SrcCodecId 输入流的编码器
+	SrcCodecId() utils.AVCodecID
+
+	// DstCodecId 输出流的编码器
+	DstCodecId() utils.AVCodecID
+
+	// GetStream 返回描述输出流的AVStream, 输出流的索引与输入流相同
+	GetStream() utils.AVStream
+
+	// Transcode 转码AVPacket, 一个输入包可能输出0个或多个包, 通过handler回调.
+	// 输出包的data只在handler内有效, 需要保存请自行拷贝.
+	Transcode(packet utils.AVPacket, handler func(packet utils.AVPacket)) error
+
+	Close()
+}
+
+// Factory 根据输入流和目标编码器创建转码器
+type Factory func(src utils.AVStream, dst utils.AVCodecID) (Transcoder, error)
+
+type codecPair struct {
+	src utils.AVCodecID
+	dst utils.AVCodecID
+}
+
+var (
+	factories map[codecPair]Factory
+)
+
+func init() {
+	factories = make(map[codecPair]Factory, 8)
+}
+
+func RegisterTranscoder(src, dst utils.AVCodecID, factory Factory) {
+	pair := codecPair{src, dst}
+	_, ok := factories[pair]
+	if ok {
+		panic(fmt.Sprintf("transcoder %s->%s has been registered", src, dst))
+	}
+
+	factories[pair] = factory
+}
+
+// IsSupported 是否支持src到dst的转码
+func IsSupported(src, dst utils.AVCodecID) bool {
+	_, ok := factories[codecPair{src, dst}]
+	return ok
+}
+
+// NewTranscoder 创建src流转dst编码的转码器
+func NewTranscoder(src utils.AVStream, dst utils.AVCodecID) (Transcoder, error) {
+	factory, ok := factories[codecPair{src.CodecId(), dst}]
+	if !ok {
+		return nil, fmt.Errorf("unsupported transcoding %s->%s", src.CodecId(), dst)
+	}
+
+	return factory(src, dst)
 }